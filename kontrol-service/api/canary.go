@@ -0,0 +1,195 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	api "github.com/kurtosis-tech/kardinal/libs/cli-kontrol-api/api/golang/server"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+
+	"kardinal.kontrol-service/database"
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+)
+
+const flowCanaryPath = "/tenant/:uuid/flow/:flow-id/canary"
+
+func (sv *Server) registerFlowCanaryApi(router api.EchoRouter) {
+	router.GET(flowCanaryPath, sv.getFlowCanaryHandler)
+	router.PUT(flowCanaryPath, sv.putFlowCanaryHandler)
+	router.DELETE(flowCanaryPath, sv.deleteFlowCanaryHandler)
+}
+
+func (sv *Server) getFlowCanaryHandler(c echo.Context) error {
+	tenantUuid := c.Param("uuid")
+	flowId := c.Param("flow-id")
+
+	_, clusterTopology, err := getFlowRecord(sv, tenantUuid, flowId)
+	if err != nil {
+		return lookupErrorResponse(c, err, fmt.Sprintf("An error occurred getting flow '%v'", flowId))
+	}
+
+	canary, found := clusterTopology.FlowCanaries[flowId]
+	if !found {
+		missing := api.NotFoundJSONResponse{ResourceType: "canary", Id: flowId}
+		return c.JSON(http.StatusNotFound, missing)
+	}
+	return c.JSON(http.StatusOK, canary)
+}
+
+func (sv *Server) putFlowCanaryHandler(c echo.Context) error {
+	tenantUuid := c.Param("uuid")
+	flowId := c.Param("flow-id")
+
+	var canary resolved.FlowCanary
+	if err := json.NewDecoder(c.Request().Body).Decode(&canary); err != nil {
+		errMsg := "An error occurred reading the flow canary"
+		errResp := api.RequestErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusBadRequest, errResp)
+	}
+
+	flowRecord, clusterTopology, err := getFlowRecord(sv, tenantUuid, flowId)
+	if err != nil {
+		return lookupErrorResponse(c, err, fmt.Sprintf("An error occurred getting flow '%v'", flowId))
+	}
+
+	// the canaries of the other flows share the baseline traffic with this one
+	topologies, err := getTenantTopologies(sv, tenantUuid)
+	if err != nil {
+		return lookupErrorResponse(c, err, fmt.Sprintf("An error occurred getting the topologies of tenant '%v'", tenantUuid))
+	}
+	baseTopology, allFlows := topologies.baseClusterTopology, topologies.flows
+	if flowId == baseTopology.Namespace {
+		errMsg := "The baseline flow can't be a canary"
+		errResp := api.RequestErrorJSONResponse{
+			Error: fmt.Sprintf("Flow '%v' is the baseline flow", flowId),
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusBadRequest, errResp)
+	}
+	flowCanaries := map[string]resolved.FlowCanary{}
+	for _, flowTopology := range allFlows {
+		for canaryFlowId, flowCanary := range flowTopology.FlowCanaries {
+			flowCanaries[canaryFlowId] = flowCanary
+		}
+	}
+	flowCanaries[flowId] = canary
+	if err = resolved.ValidateFlowCanaries(flowCanaries); err != nil {
+		errMsg := "Invalid flow canary"
+		errResp := api.RequestErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusBadRequest, errResp)
+	}
+
+	clusterTopology.FlowCanaries = map[string]resolved.FlowCanary{flowId: canary}
+	if err = saveFlowRecord(sv, flowRecord, clusterTopology); err != nil {
+		errMsg := fmt.Sprintf("An error occurred saving the canary of flow '%v'", flowId)
+		errResp := api.ErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusInternalServerError, errResp)
+	}
+
+	logrus.Infof("Flow '%s' receives %d%% of the baseline traffic and %d canary matches", flowId, canary.Weight, len(canary.Matches))
+	return c.JSON(http.StatusOK, canary)
+}
+
+func (sv *Server) deleteFlowCanaryHandler(c echo.Context) error {
+	tenantUuid := c.Param("uuid")
+	flowId := c.Param("flow-id")
+
+	flowRecord, clusterTopology, err := getFlowRecord(sv, tenantUuid, flowId)
+	if err != nil {
+		return lookupErrorResponse(c, err, fmt.Sprintf("An error occurred getting flow '%v'", flowId))
+	}
+
+	clusterTopology.FlowCanaries = nil
+	if err = saveFlowRecord(sv, flowRecord, clusterTopology); err != nil {
+		errMsg := fmt.Sprintf("An error occurred removing the canary of flow '%v'", flowId)
+		errResp := api.ErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusInternalServerError, errResp)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// notFoundError is returned when the tenant or the flow of a request doesn't exist
+type notFoundError struct {
+	resourceType string
+	id           string
+}
+
+func (e notFoundError) Error() string {
+	return fmt.Sprintf("Cannot find %s %s", e.resourceType, e.id)
+}
+
+// lookupErrorResponse answers 404 when the tenant or the flow doesn't exist and 500 for the other errors, e.g. when
+// the database can't be reached
+func lookupErrorResponse(c echo.Context, err error, errMsg string) error {
+	var notFound notFoundError
+	if errors.As(err, &notFound) {
+		missing := api.NotFoundJSONResponse{ResourceType: notFound.resourceType, Id: notFound.id}
+		return c.JSON(http.StatusNotFound, missing)
+	}
+	errResp := api.ErrorJSONResponse{
+		Error: err.Error(),
+		Msg:   &errMsg,
+	}
+	return c.JSON(http.StatusInternalServerError, errResp)
+}
+
+// getFlowRecord returns the stored flow and its decoded cluster topology
+func getFlowRecord(sv *Server, tenantUuidStr string, flowId string) (*database.Flow, *resolved.ClusterTopology, error) {
+	tenant, err := sv.db.GetTenant(tenantUuidStr)
+	if err != nil {
+		logrus.Errorf("an error occured while getting the tenant %s\n: '%v'", tenantUuidStr, err.Error())
+		return nil, nil, err
+	}
+
+	if tenant == nil {
+		return nil, nil, notFoundError{resourceType: "tenant", id: tenantUuidStr}
+	}
+
+	for _, flowRecord := range tenant.Flows {
+		if flowRecord.FlowId != flowId {
+			continue
+		}
+		var clusterTopology resolved.ClusterTopology
+		err = json.Unmarshal(flowRecord.ClusterTopology, &clusterTopology)
+		if err != nil {
+			logrus.Errorf("An error occurred decoding the cluster topology for flow '%v'", flowId)
+			return nil, nil, err
+		}
+		return &flowRecord, &clusterTopology, nil
+	}
+
+	return nil, nil, notFoundError{resourceType: "flow", id: flowId}
+}
+
+func saveFlowRecord(sv *Server, flowRecord *database.Flow, clusterTopology *resolved.ClusterTopology) error {
+	clusterTopologyJson, err := json.Marshal(clusterTopology)
+	if err != nil {
+		logrus.Errorf("an error occured while encoding the cluster topology for flow %s, error was \n: '%v'", flowRecord.FlowId, err.Error())
+		return err
+	}
+	flowRecord.ClusterTopology = clusterTopologyJson
+
+	err = sv.db.SaveFlow(flowRecord)
+	if err != nil {
+		logrus.Errorf("an error occured while saving flow %s. error was \n: '%v'", flowRecord.FlowId, err.Error())
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	api "github.com/kurtosis-tech/kardinal/libs/cli-kontrol-api/api/golang/server"
+	"github.com/labstack/echo/v4"
+	"github.com/samber/lo"
+
+	"kardinal.kontrol-service/engine/flow"
+)
+
+const flowJoinPath = "/tenant/:uuid/flow/:flow-id/join"
+
+// flowJoinLinks are the links opening a flow in a browser, with the sticky flow cookie enabled the first response sets
+// the cookie and the rest of the browser session stays in the flow
+type flowJoinLinks struct {
+	FlowId string   `json:"flowId"`
+	Sticky bool     `json:"sticky"`
+	Links  []string `json:"links"`
+}
+
+func (sv *Server) registerFlowJoinApi(router api.EchoRouter) {
+	router.GET(flowJoinPath, sv.getFlowJoinLinksHandler)
+}
+
+func (sv *Server) getFlowJoinLinksHandler(c echo.Context) error {
+	tenantUuid := c.Param("uuid")
+	flowId := c.Param("flow-id")
+
+	topologies, err := getTenantTopologies(sv, tenantUuid)
+	if err != nil {
+		return lookupErrorResponse(c, err, fmt.Sprintf("An error occurred getting the topologies of tenant '%v'", tenantUuid))
+	}
+	clusterTopology, allFlows := topologies.baseClusterTopology, topologies.flows
+
+	tenantSettings, err := getTenantSettings(sv, tenantUuid)
+	if err != nil {
+		return lookupErrorResponse(c, err, fmt.Sprintf("An error occurred getting the settings of tenant '%v'", tenantUuid))
+	}
+
+	finalTopology := flow.MergeClusterTopologies(*clusterTopology, lo.Values(allFlows))
+	entries, found := finalTopology.GetFlowHostMapping(tenantSettings.FlowEntryStrategy)[flowId]
+	if !found {
+		missing := api.NotFoundJSONResponse{ResourceType: "flow", Id: flowId}
+		return c.JSON(http.StatusNotFound, missing)
+	}
+
+	return c.JSON(http.StatusOK, flowJoinLinks{
+		FlowId: flowId,
+		Sticky: tenantSettings.StickyFlowCookie.Enabled,
+		Links:  flow.GetFlowJoinLinks(entries, *tenantSettings),
+	})
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	api "github.com/kurtosis-tech/kardinal/libs/cli-kontrol-api/api/golang/server"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+)
+
+const flowMirrorPath = "/tenant/:uuid/flow/:flow-id/mirror"
+
+func (sv *Server) registerFlowMirrorApi(router api.EchoRouter) {
+	router.GET(flowMirrorPath, sv.getFlowMirrorHandler)
+	router.PUT(flowMirrorPath, sv.putFlowMirrorHandler)
+	router.DELETE(flowMirrorPath, sv.deleteFlowMirrorHandler)
+}
+
+func (sv *Server) getFlowMirrorHandler(c echo.Context) error {
+	tenantUuid := c.Param("uuid")
+	flowId := c.Param("flow-id")
+
+	_, clusterTopology, err := getFlowRecord(sv, tenantUuid, flowId)
+	if err != nil {
+		return lookupErrorResponse(c, err, fmt.Sprintf("An error occurred getting flow '%v'", flowId))
+	}
+
+	mirror, found := clusterTopology.FlowMirrors[flowId]
+	if !found {
+		missing := api.NotFoundJSONResponse{ResourceType: "mirror", Id: flowId}
+		return c.JSON(http.StatusNotFound, missing)
+	}
+	return c.JSON(http.StatusOK, mirror)
+}
+
+func (sv *Server) putFlowMirrorHandler(c echo.Context) error {
+	tenantUuid := c.Param("uuid")
+	flowId := c.Param("flow-id")
+
+	var mirror resolved.FlowMirror
+	if err := json.NewDecoder(c.Request().Body).Decode(&mirror); err != nil {
+		errMsg := "An error occurred reading the flow mirror"
+		errResp := api.RequestErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusBadRequest, errResp)
+	}
+
+	flowRecord, clusterTopology, err := getFlowRecord(sv, tenantUuid, flowId)
+	if err != nil {
+		return lookupErrorResponse(c, err, fmt.Sprintf("An error occurred getting flow '%v'", flowId))
+	}
+
+	err = mirror.Validate()
+	if err == nil && flowId == clusterTopology.Namespace {
+		err = fmt.Errorf("Flow '%v' is the baseline flow", flowId)
+	}
+	if err == nil {
+		// the mirrored requests must reach a version of the flow, which writes to the databases of the flow
+		for _, serviceID := range mirror.Services {
+			service, found := clusterTopology.GetFlowVersion(serviceID, flowId)
+			if !found {
+				err = fmt.Errorf("Service '%v' has no version in flow '%v'", serviceID, flowId)
+				break
+			}
+			if !service.IsHTTP() {
+				err = fmt.Errorf("Service '%v' is not an HTTP service", serviceID)
+				break
+			}
+		}
+	}
+	if err == nil {
+		// the services missing from the flow fall back to the baseline, which would get the writes twice
+		missing := clusterTopology.GetStatefulDependenciesWithoutFlowVersion(mirror.Services, flowId)
+		if len(missing) > 0 {
+			err = fmt.Errorf("The stateful services %v reached by the mirrored services have no version in flow '%v'", missing, flowId)
+		}
+	}
+	if err != nil {
+		errMsg := "Invalid flow mirror"
+		errResp := api.RequestErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusBadRequest, errResp)
+	}
+
+	clusterTopology.FlowMirrors = map[string]resolved.FlowMirror{flowId: mirror}
+	if err = saveFlowRecord(sv, flowRecord, clusterTopology); err != nil {
+		errMsg := fmt.Sprintf("An error occurred saving the mirror of flow '%v'", flowId)
+		errResp := api.ErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusInternalServerError, errResp)
+	}
+
+	logrus.Infof("Flow '%s' receives a copy of %v%% of the baseline requests of services %v", flowId, mirror.Percentage, mirror.Services)
+	return c.JSON(http.StatusOK, mirror)
+}
+
+func (sv *Server) deleteFlowMirrorHandler(c echo.Context) error {
+	tenantUuid := c.Param("uuid")
+	flowId := c.Param("flow-id")
+
+	flowRecord, clusterTopology, err := getFlowRecord(sv, tenantUuid, flowId)
+	if err != nil {
+		return lookupErrorResponse(c, err, fmt.Sprintf("An error occurred getting flow '%v'", flowId))
+	}
+
+	clusterTopology.FlowMirrors = nil
+	if err = saveFlowRecord(sv, flowRecord, clusterTopology); err != nil {
+		errMsg := fmt.Sprintf("An error occurred removing the mirror of flow '%v'", flowId)
+		errResp := api.ErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusInternalServerError, errResp)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
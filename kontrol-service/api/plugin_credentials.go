@@ -0,0 +1,137 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	api "github.com/kurtosis-tech/kardinal/libs/cli-kontrol-api/api/golang/server"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+
+	"kardinal.kontrol-service/plugins"
+)
+
+// The secrets of the plugin credentials endpoints are write only and never returned
+const pluginCredentialsPath = "/tenant/:uuid/plugin-credentials"
+
+type pluginCredentialsJSONResponse struct {
+	Credentials []plugins.PluginCredentials `json:"credentials"`
+}
+
+func (sv *Server) registerPluginCredentialsApi(router api.EchoRouter) {
+	router.GET(pluginCredentialsPath, sv.getPluginCredentialsHandler)
+	router.PUT(pluginCredentialsPath, sv.putPluginCredentialsHandler)
+	router.DELETE(pluginCredentialsPath, sv.deletePluginCredentialsHandler)
+}
+
+func (sv *Server) getPluginCredentialsHandler(c echo.Context) error {
+	tenantUuid := c.Param("uuid")
+	if found, err := sv.checkPluginCredentialsTenant(c, tenantUuid); !found {
+		return err
+	}
+
+	credentials, err := plugins.ListPluginCredentials(sv.db, tenantUuid)
+	if err != nil {
+		errMsg := fmt.Sprintf("An error occurred getting the plugin credentials of tenant '%v'", tenantUuid)
+		errResp := api.ErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusInternalServerError, errResp)
+	}
+
+	return c.JSON(http.StatusOK, pluginCredentialsJSONResponse{Credentials: credentials})
+}
+
+func (sv *Server) putPluginCredentialsHandler(c echo.Context) error {
+	tenantUuid := c.Param("uuid")
+	if found, err := sv.checkPluginCredentialsTenant(c, tenantUuid); !found {
+		return err
+	}
+
+	var credentials plugins.PluginCredentials
+	if err := json.NewDecoder(c.Request().Body).Decode(&credentials); err != nil {
+		// the decoding errors don't contain the values of the body
+		errMsg := "An error occurred reading the plugin credentials"
+		errResp := api.RequestErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusBadRequest, errResp)
+	}
+	if err := credentials.Validate(); err != nil {
+		errMsg := "Invalid plugin credentials"
+		errResp := api.RequestErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusBadRequest, errResp)
+	}
+
+	if err := plugins.SavePluginCredentials(sv.db, sv.pluginHost.GetCredentialsCipher(), tenantUuid, credentials); err != nil {
+		logrus.Errorf("An error occurred saving the plugin credentials of repository '%s' for tenant '%s': %v", credentials.Repository, tenantUuid, err)
+		errMsg := fmt.Sprintf("An error occurred saving the plugin credentials of tenant '%v'", tenantUuid)
+		errResp := api.ErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusInternalServerError, errResp)
+	}
+	logrus.Infof("Saved the %s plugin credentials of repository '%s' for tenant '%s'", credentials.Type, credentials.Repository, tenantUuid)
+
+	credentials.Secret = ""
+	return c.JSON(http.StatusOK, credentials)
+}
+
+func (sv *Server) deletePluginCredentialsHandler(c echo.Context) error {
+	tenantUuid := c.Param("uuid")
+	if found, err := sv.checkPluginCredentialsTenant(c, tenantUuid); !found {
+		return err
+	}
+
+	repository := c.QueryParam("repository")
+	if repository == "" {
+		errMsg := "The repository of the plugin credentials to delete is required"
+		errResp := api.RequestErrorJSONResponse{
+			Error: "missing repository query parameter",
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusBadRequest, errResp)
+	}
+
+	deleted, err := plugins.DeletePluginCredentials(sv.db, tenantUuid, repository)
+	if err != nil {
+		errMsg := fmt.Sprintf("An error occurred deleting the plugin credentials of tenant '%v'", tenantUuid)
+		errResp := api.ErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusInternalServerError, errResp)
+	}
+	if !deleted {
+		missing := api.NotFoundJSONResponse{ResourceType: "plugin-credentials", Id: repository}
+		return c.JSON(http.StatusNotFound, missing)
+	}
+	logrus.Infof("Deleted the plugin credentials of repository '%s' for tenant '%s'", repository, tenantUuid)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// checkPluginCredentialsTenant writes the error response and returns false if the tenant doesn't exist
+func (sv *Server) checkPluginCredentialsTenant(c echo.Context, tenantUuid string) (bool, error) {
+	tenant, err := sv.db.GetTenant(tenantUuid)
+	if err != nil {
+		errMsg := fmt.Sprintf("An error occurred getting tenant '%v'", tenantUuid)
+		errResp := api.ErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return false, c.JSON(http.StatusInternalServerError, errResp)
+	}
+	if tenant == nil {
+		missing := api.NotFoundJSONResponse{ResourceType: "tenant", Id: tenantUuid}
+		return false, c.JSON(http.StatusNotFound, missing)
+	}
+	return true, nil
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"kardinal.kontrol-service/plugins"
+)
+
+// pluginErrorJSONResponse is the error response of the requests failed by a plugin, it extends the generated error
+// response with the details of the plugin call
+type pluginErrorJSONResponse struct {
+	Error  string               `json:"error"`
+	Msg    *string              `json:"msg,omitempty"`
+	Plugin *plugins.PluginError `json:"plugin"`
+}
+
+// pluginErrorResponse implements the responses of the generated handlers calling plugins, the plugin timeouts are
+// reported as gateway timeouts
+type pluginErrorResponse struct {
+	statusCode int
+	body       pluginErrorJSONResponse
+}
+
+func newPluginErrorResponse(pluginErr *plugins.PluginError, err error, errMsg string) pluginErrorResponse {
+	statusCode := http.StatusInternalServerError
+	if pluginErr.Kind == plugins.PluginTimeoutError {
+		statusCode = http.StatusGatewayTimeout
+	}
+	return pluginErrorResponse{
+		statusCode: statusCode,
+		body: pluginErrorJSONResponse{
+			Error:  err.Error(),
+			Msg:    &errMsg,
+			Plugin: pluginErr,
+		},
+	}
+}
+
+func (response pluginErrorResponse) visit(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(response.statusCode)
+	return json.NewEncoder(w).Encode(response.body)
+}
+
+func (response pluginErrorResponse) VisitPostTenantUuidFlowCreateResponse(w http.ResponseWriter) error {
+	return response.visit(w)
+}
+
+func (response pluginErrorResponse) VisitDeleteTenantUuidFlowFlowIdResponse(w http.ResponseWriter) error {
+	return response.visit(w)
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	api "github.com/kurtosis-tech/kardinal/libs/cli-kontrol-api/api/golang/server"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+
+	"kardinal.kontrol-service/plugins"
+)
+
+const pluginWarmPath = "/tenant/:uuid/plugins/warm"
+
+type pluginWarmJSONResponse struct {
+	// Plugins are the names of the plugins ready to run
+	Plugins []string `json:"plugins"`
+}
+
+func (sv *Server) registerPluginWarmApi(router api.EchoRouter) {
+	router.POST(pluginWarmPath, sv.postPluginWarmHandler)
+}
+
+func (sv *Server) postPluginWarmHandler(c echo.Context) error {
+	tenantUuid := c.Param("uuid")
+
+	warmedPlugins, err := sv.warmTenantPlugins(c.Request().Context(), tenantUuid)
+	if err != nil {
+		errMsg := fmt.Sprintf("An error occurred warming the plugins of tenant '%v'", tenantUuid)
+		if pluginErr, found := plugins.GetPluginError(err); found {
+			response := newPluginErrorResponse(pluginErr, err, errMsg)
+			return c.JSON(response.statusCode, response.body)
+		}
+		errResp := api.ErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusInternalServerError, errResp)
+	}
+
+	return c.JSON(http.StatusOK, pluginWarmJSONResponse{Plugins: warmedPlugins})
+}
+
+// WarmAllTenantPlugins builds the environments of the plugins declared by the baselines of all the active tenants,
+// the failures are logged so one broken plugin doesn't prevent warming the others
+func (sv *Server) WarmAllTenantPlugins(ctx context.Context) {
+	tenantIds, err := sv.db.GetActiveTenantIds()
+	if err != nil {
+		logrus.Errorf("An error occurred getting the tenants to warm their plugins: %v", err)
+		return
+	}
+	for _, tenantId := range tenantIds {
+		warmedPlugins, err := sv.warmTenantPlugins(ctx, tenantId)
+		if err != nil {
+			logrus.Errorf("An error occurred warming the plugins of tenant '%s': %v", tenantId, err)
+		}
+		if len(warmedPlugins) > 0 {
+			logrus.Infof("Warmed the plugins %v of tenant '%s'", warmedPlugins, tenantId)
+		}
+	}
+}
+
+// warmTenantPlugins builds the environments of the plugins declared by the baseline of the tenant, it returns the
+// names of the plugins warmed, the failures are aggregated so one broken plugin doesn't prevent warming the others
+func (sv *Server) warmTenantPlugins(ctx context.Context, tenantUuid string) ([]string, error) {
+	topologies, err := getTenantTopologies(sv, tenantUuid)
+	if err != nil {
+		return nil, err
+	}
+	baseClusterTopology := topologies.baseClusterTopology
+
+	pluginRunner := plugins.NewPluginRunner(sv.gitPluginProvider, sv.pluginHost, tenantUuid, sv.db)
+	warmedPlugins := []string{}
+	var warmErrs []error
+	for _, plugin := range baseClusterTopology.GetPlugins() {
+		pluginTimeout, err := plugin.GetTimeout()
+		if err != nil {
+			warmErrs = append(warmErrs, fmt.Errorf("plugin '%s': %w", plugin.Name, err))
+			continue
+		}
+		if err = pluginRunner.WarmPlugin(ctx, plugin.Name, pluginTimeout); err != nil {
+			warmErrs = append(warmErrs, fmt.Errorf("plugin '%s': %w", plugin.Name, err))
+			continue
+		}
+		warmedPlugins = append(warmedPlugins, plugin.Name)
+	}
+	return warmedPlugins, errors.Join(warmErrs...)
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	api "github.com/kurtosis-tech/kardinal/libs/cli-kontrol-api/api/golang/server"
+	"github.com/labstack/echo/v4"
+
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+)
+
+// The generated flow-create handler ignores the options below, so they are read from the request body before it and
+// passed in the request context
+const (
+	flowCreatePath = "/tenant/:uuid/flow/create"
+
+	// maxFlowCreateBodyBytes limits the flow-create bodies read in memory by the middleware
+	maxFlowCreateBodyBytes = 10 << 20
+)
+
+type flowCreateResilienceKey struct{}
+
+type flowCreateOptions struct {
+	// Resilience are the resilience test settings of the services of the flow by service ID
+	Resilience json.RawMessage `json:"resilience,omitempty"`
+}
+
+// FlowCreateOptionsMiddleware reads the flow-create options that are not in the generated CLI API
+func FlowCreateOptionsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		request := c.Request()
+		if request.Method != http.MethodPost || c.Path() != flowCreatePath || request.Body == nil {
+			return next(c)
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Response(), request.Body, maxFlowCreateBodyBytes))
+		if err != nil {
+			errMsg := "An error occurred reading the flow create request"
+			errResp := api.RequestErrorJSONResponse{
+				Error: err.Error(),
+				Msg:   &errMsg,
+			}
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				return c.JSON(http.StatusRequestEntityTooLarge, errResp)
+			}
+			return c.JSON(http.StatusBadRequest, errResp)
+		}
+		request.Body = io.NopCloser(bytes.NewReader(body))
+
+		var options flowCreateOptions
+		if err = json.Unmarshal(body, &options); err != nil || len(options.Resilience) == 0 {
+			// the generated handler reports the invalid bodies
+			return next(c)
+		}
+
+		var resilience resolved.FlowResilience
+		if err = json.Unmarshal(options.Resilience, &resilience); err != nil {
+			errMsg := "An error occurred reading the flow resilience settings"
+			errResp := api.RequestErrorJSONResponse{
+				Error: err.Error(),
+				Msg:   &errMsg,
+			}
+			return c.JSON(http.StatusBadRequest, errResp)
+		}
+		c.SetRequest(request.WithContext(context.WithValue(request.Context(), flowCreateResilienceKey{}, resilience)))
+		return next(c)
+	}
+}
+
+// getFlowCreateResilience returns the resilience settings of the flow-create request, if any
+func getFlowCreateResilience(ctx context.Context) resolved.FlowResilience {
+	resilience, _ := ctx.Value(flowCreateResilienceKey{}).(resolved.FlowResilience)
+	return resilience
+}
+
+// validateFlowResilienceServices checks that the services with resilience settings have a version in the flow, the
+// settings only apply to the flow versions so the baseline and the other flows are not affected
+func validateFlowResilienceServices(clusterTopology *resolved.ClusterTopology, flowID string, resilience resolved.FlowResilience) error {
+	for serviceID := range resilience {
+		service, found := clusterTopology.GetFlowVersion(serviceID, flowID)
+		if !found {
+			return fmt.Errorf("Service '%v' has no version in flow '%v', add it to the flow spec to set its resilience settings", serviceID, flowID)
+		}
+		if !service.IsHTTP() {
+			return fmt.Errorf("Service '%v' is not an HTTP service, it can't have resilience settings", serviceID)
+		}
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	api "github.com/kurtosis-tech/kardinal/libs/cli-kontrol-api/api/golang/server"
 	apitypes "github.com/kurtosis-tech/kardinal/libs/cli-kontrol-api/api/golang/types"
@@ -13,6 +14,7 @@ import (
 	"github.com/kurtosis-tech/stacktrace"
 	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/cli-runtime/pkg/printers"
 	"kardinal.kontrol-service/database"
 	"kardinal.kontrol-service/engine"
@@ -22,6 +24,7 @@ import (
 	"kardinal.kontrol-service/types"
 	"kardinal.kontrol-service/types/cluster_topology/resolved"
 	"kardinal.kontrol-service/types/flow_spec"
+	"kardinal.kontrol-service/types/settings"
 	"kardinal.kontrol-service/types/templates"
 )
 
@@ -33,23 +36,47 @@ const (
 var _ api.StrictServerInterface = (*Server)(nil)
 
 type Server struct {
-	db               *database.Db
-	analyticsWrapper *AnalyticsWrapper
+	db                *database.Db
+	analyticsWrapper  *AnalyticsWrapper
+	gitPluginProvider plugins.GitPluginProvider
+	// pluginHost is shared by the plugin runners of all the tenants
+	pluginHost *plugins.PluginHost
+	// traceRouter is used by the tenants not setting their own trace router
+	traceRouter settings.TraceRouterSettings
 }
 
-func NewServer(db *database.Db, analyticsWrapper *AnalyticsWrapper) Server {
+func NewServer(
+	db *database.Db,
+	analyticsWrapper *AnalyticsWrapper,
+	gitPluginProvider plugins.GitPluginProvider,
+	pluginHost *plugins.PluginHost,
+	traceRouter settings.TraceRouterSettings,
+) Server {
 	return Server{
-		db:               db,
-		analyticsWrapper: analyticsWrapper,
+		db:                db,
+		analyticsWrapper:  analyticsWrapper,
+		gitPluginProvider: gitPluginProvider,
+		pluginHost:        pluginHost,
+		traceRouter:       traceRouter,
 	}
 }
 
+// RegisterExternalAndInternalApi registers the generated CLI and manager APIs, followed by the tenant settings, flow join,
+// canary and mirror, and plugin warm and credentials endpoints which are not part of the generated CLI API yet, so they
+// are registered directly on the router
 func (sv *Server) RegisterExternalAndInternalApi(router api.EchoRouter) {
 	externalHandlers := api.NewStrictHandler(sv, nil)
 	internalHandlers := managerapi.NewStrictHandler(sv, nil)
 
 	api.RegisterHandlers(router, externalHandlers)
 	managerapi.RegisterHandlers(router, internalHandlers)
+
+	sv.registerTenantSettingsApi(router)
+	sv.registerFlowJoinApi(router)
+	sv.registerFlowCanaryApi(router)
+	sv.registerFlowMirrorApi(router)
+	sv.registerPluginWarmApi(router)
+	sv.registerPluginCredentialsApi(router)
 }
 
 func (sv *Server) GetHealth(_ context.Context, _ api.GetHealthRequestObject) (api.GetHealthResponseObject, error) {
@@ -67,7 +94,15 @@ func (sv *Server) GetHealth(_ context.Context, _ api.GetHealthRequestObject) (ap
 }
 
 func (sv *Server) GetTenantUuidFlows(_ context.Context, request api.GetTenantUuidFlowsRequestObject) (api.GetTenantUuidFlowsResponseObject, error) {
-	clusterTopology, allFlows, _, _, _, _, _, _, _, err := getTenantTopologies(sv, request.Uuid)
+	topologies, err := getTenantTopologies(sv, request.Uuid)
+	if err != nil {
+		resourceType := "tenant"
+		missing := api.NotFoundJSONResponse{ResourceType: resourceType, Id: request.Uuid}
+		return api.GetTenantUuidFlows404JSONResponse{NotFoundJSONResponse: missing}, nil
+	}
+	clusterTopology, allFlows := topologies.baseClusterTopology, topologies.flows
+
+	tenantSettings, err := getTenantSettings(sv, request.Uuid)
 	if err != nil {
 		resourceType := "tenant"
 		missing := api.NotFoundJSONResponse{ResourceType: resourceType, Id: request.Uuid}
@@ -75,7 +110,7 @@ func (sv *Server) GetTenantUuidFlows(_ context.Context, request api.GetTenantUui
 	}
 
 	finalTopology := flow.MergeClusterTopologies(*clusterTopology, lo.Values(allFlows))
-	flowHostMapping := finalTopology.GetFlowHostMapping()
+	flowHostMapping := finalTopology.GetFlowHostMapping(tenantSettings.FlowEntryStrategy)
 	resp := lo.MapToSlice(flowHostMapping, func(flowId string, entries []resolved.IngressAccessEntry) apitypes.Flow {
 		isBaselineFlow := flowId == clusterTopology.Namespace
 		return apitypes.Flow{FlowId: flowId, AccessEntry: toApiIngressAccessEntries(entries), IsBaseline: &isBaselineFlow}
@@ -134,16 +169,17 @@ func (sv *Server) PostTenantUuidDeploy(_ context.Context, request api.PostTenant
 	return api.PostTenantUuidDeploy200JSONResponse(resp), nil
 }
 
-func (sv *Server) DeleteTenantUuidFlowFlowId(_ context.Context, request api.DeleteTenantUuidFlowFlowIdRequestObject) (api.DeleteTenantUuidFlowFlowIdResponseObject, error) {
+func (sv *Server) DeleteTenantUuidFlowFlowId(ctx context.Context, request api.DeleteTenantUuidFlowFlowIdRequestObject) (api.DeleteTenantUuidFlowFlowIdResponseObject, error) {
 	logrus.Infof("deleting dev flow for tenant '%s'", request.Uuid)
 	sv.analyticsWrapper.TrackEvent(EVENT_FLOW_DELETE, request.Uuid)
 
-	baseClusterTopology, allFlows, _, _, _, _, _, _, _, err := getTenantTopologies(sv, request.Uuid)
+	topologies, err := getTenantTopologies(sv, request.Uuid)
 	if err != nil {
 		resourceType := "tenant"
 		missing := api.NotFoundJSONResponse{ResourceType: resourceType, Id: request.Uuid}
 		return api.DeleteTenantUuidFlowFlowId404JSONResponse{NotFoundJSONResponse: missing}, nil
 	}
+	baseClusterTopology, allFlows := topologies.baseClusterTopology, topologies.flows
 
 	// the baseline flow ID uses the base cluster topology namespace name
 	if request.FlowId == baseClusterTopology.Namespace {
@@ -164,10 +200,13 @@ func (sv *Server) DeleteTenantUuidFlowFlowId(_ context.Context, request api.Dele
 
 	if flowTopology, found := allFlows[request.FlowId]; found {
 		logrus.Infof("deleting flow %s", request.FlowId)
-		pluginRunner := plugins.NewPluginRunner(plugins.NewGitPluginProviderImpl(), request.Uuid, sv.db)
-		err := flow.DeleteFlow(pluginRunner, flowTopology, request.FlowId)
+		pluginRunner := plugins.NewPluginRunner(sv.gitPluginProvider, sv.pluginHost, request.Uuid, sv.db)
+		err := flow.DeleteFlow(ctx, pluginRunner, flowTopology, request.FlowId)
 		if err != nil {
 			errMsg := fmt.Sprintf("An error occurred deleting flow '%v'", request.FlowId)
+			if pluginErr, found := plugins.GetPluginError(err); found {
+				return newPluginErrorResponse(pluginErr, err, errMsg), nil
+			}
 			errResp := api.ErrorJSONResponse{
 				Error: err.Error(),
 				Msg:   &errMsg,
@@ -192,11 +231,21 @@ func (sv *Server) DeleteTenantUuidFlowFlowId(_ context.Context, request api.Dele
 	return api.DeleteTenantUuidFlowFlowId2xxResponse{StatusCode: 204}, nil
 }
 
-func (sv *Server) PostTenantUuidFlowCreate(_ context.Context, request api.PostTenantUuidFlowCreateRequestObject) (api.PostTenantUuidFlowCreateResponseObject, error) {
+func (sv *Server) PostTenantUuidFlowCreate(ctx context.Context, request api.PostTenantUuidFlowCreateRequestObject) (api.PostTenantUuidFlowCreateResponseObject, error) {
 	sv.analyticsWrapper.TrackEvent(EVENT_FLOW_CREATE, request.Uuid)
 	serviceUpdates := request.Body.FlowSpec
 	templateSpec := request.Body.TemplateSpec
 
+	resilience := getFlowCreateResilience(ctx)
+	if err := resilience.Validate(); err != nil {
+		errMsg := "Invalid flow resilience settings"
+		errResp := api.RequestErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return api.PostTenantUuidFlowCreate400JSONResponse{RequestErrorJSONResponse: errResp}, nil
+	}
+
 	patches := []flow_spec.ServicePatchSpec{}
 	for _, serviceUpdate := range serviceUpdates {
 		envVarOverrides := map[string]string{}
@@ -220,11 +269,11 @@ func (sv *Server) PostTenantUuidFlowCreate(_ context.Context, request api.PostTe
 	requestTenantUuid := request.Uuid
 	requestFlowId := request.Body.FlowId
 
-	flowId, flowIdAlreadyExist, err := sv.checkOrCreateFlowID(requestTenantUuid, requestFlowId)
+	flowId, isInvalidFlowId, err := sv.checkOrCreateFlowID(requestTenantUuid, requestFlowId)
 	if err != nil {
 		var apiErrResponse api.PostTenantUuidFlowCreateResponseObject
-		errMsg := fmt.Sprintf("An error occurred checking or creating flow ID %s", *request.Body.FlowId)
-		if flowIdAlreadyExist {
+		errMsg := fmt.Sprintf("An error occurred checking or creating flow ID %s", lo.FromPtr(request.Body.FlowId))
+		if isInvalidFlowId {
 			errResp := api.RequestErrorJSONResponse{
 				Error: err.Error(),
 				Msg:   &errMsg,
@@ -241,9 +290,12 @@ func (sv *Server) PostTenantUuidFlowCreate(_ context.Context, request api.PostTe
 		return apiErrResponse, nil
 	}
 
-	entries, err := applyProdDevFlow(flowId, sv, request.Uuid, patches, templateSpec)
+	entries, err := applyProdDevFlow(ctx, flowId, sv, request.Uuid, patches, templateSpec, resilience)
 	if err != nil {
 		errMsg := "An error occurred creating flow"
+		if pluginErr, found := plugins.GetPluginError(err); found {
+			return newPluginErrorResponse(pluginErr, err, errMsg), nil
+		}
 		errResp := api.ErrorJSONResponse{
 			Error: err.Error(),
 			Msg:   &errMsg,
@@ -254,13 +306,16 @@ func (sv *Server) PostTenantUuidFlowCreate(_ context.Context, request api.PostTe
 	return api.PostTenantUuidFlowCreate200JSONResponse(resp), nil
 }
 
+// checkOrCreateFlowID returns the flow ID to use for a new flow, the returned bool is true if the requested flow ID
+// is invalid (already in use or not a valid DNS label) so the error can be reported as a bad request
 func (sv *Server) checkOrCreateFlowID(tenantUuid apitypes.Uuid, requestFlowId *string) (string, bool, error) {
-	var flowIdAlreadyExist bool
+	var isInvalidFlowId bool
 
-	clusterTopology, allFlows, _, _, _, _, _, _, _, err := getTenantTopologies(sv, tenantUuid)
+	topologies, err := getTenantTopologies(sv, tenantUuid)
 	if err != nil {
-		return "", flowIdAlreadyExist, err
+		return "", isInvalidFlowId, err
 	}
+	clusterTopology, allFlows := topologies.baseClusterTopology, topologies.flows
 
 	// Create the flow ID if it was not provided
 	if requestFlowId == nil || *requestFlowId == "" {
@@ -270,8 +325,14 @@ func (sv *Server) checkOrCreateFlowID(tenantUuid apitypes.Uuid, requestFlowId *s
 
 		randId := getRandID()
 
-		newFlowId := fmt.Sprintf("%s-%s", baselineFlowId, randId)
-		return newFlowId, flowIdAlreadyExist, nil
+		newFlowId := resolved.DNSLabel(baselineFlowId, randId)
+		return newFlowId, isInvalidFlowId, nil
+	}
+
+	// the flow ID is used as the version label, in resource names and as the flow hostname subdomain
+	if validationErrs := validation.IsDNS1123Label(*requestFlowId); len(validationErrs) > 0 {
+		isInvalidFlowId = true
+		return "", isInvalidFlowId, stacktrace.NewError("flow id '%s' is not valid: %s", *requestFlowId, strings.Join(validationErrs, "; "))
 	}
 
 	// check received flowID from the request
@@ -279,22 +340,23 @@ func (sv *Server) checkOrCreateFlowID(tenantUuid apitypes.Uuid, requestFlowId *s
 		return key == *requestFlowId
 	})
 	if found {
-		flowIdAlreadyExist = true
-		return "", flowIdAlreadyExist, stacktrace.NewError("flow id '%s' already exists", *requestFlowId)
+		isInvalidFlowId = true
+		return "", isInvalidFlowId, stacktrace.NewError("flow id '%s' already exists", *requestFlowId)
 	}
 
-	return *requestFlowId, flowIdAlreadyExist, nil
+	return *requestFlowId, isInvalidFlowId, nil
 }
 
 func (sv *Server) GetTenantUuidTopology(_ context.Context, request api.GetTenantUuidTopologyRequestObject) (api.GetTenantUuidTopologyResponseObject, error) {
 	logrus.Infof("getting topology for tenant '%s'", request.Uuid)
 
-	clusterTopology, allFlows, _, _, _, _, _, _, _, err := getTenantTopologies(sv, request.Uuid)
+	topologies, err := getTenantTopologies(sv, request.Uuid)
 	if err != nil {
 		resourceType := "tenant"
 		missing := api.NotFoundJSONResponse{ResourceType: resourceType, Id: request.Uuid}
 		return api.GetTenantUuidTopology404JSONResponse{NotFoundJSONResponse: missing}, nil
 	}
+	clusterTopology, allFlows := topologies.baseClusterTopology, topologies.flows
 
 	allFlowsTopology := lo.Values(allFlows)
 	topo := topology.ClusterTopology(clusterTopology, &allFlowsTopology)
@@ -302,37 +364,51 @@ func (sv *Server) GetTenantUuidTopology(_ context.Context, request api.GetTenant
 }
 
 func (sv *Server) GetTenantUuidClusterResources(_ context.Context, request managerapi.GetTenantUuidClusterResourcesRequestObject) (managerapi.GetTenantUuidClusterResourcesResponseObject, error) {
-	clusterTopology, allFlows, _, _, _, _, _, _, _, err := getTenantTopologies(sv, request.Uuid)
+	topologies, err := getTenantTopologies(sv, request.Uuid)
 	if err != nil {
 		return nil, nil
 	}
+	clusterTopology, allFlows := topologies.baseClusterTopology, topologies.flows
+
+	renderer, err := getTenantRenderer(sv, request.Uuid)
+	if err != nil {
+		logrus.WithError(err).Errorf("An error occurred while getting the renderer for tenant '%s'", request.Uuid)
+		return nil, err
+	}
 
 	namespace := clusterTopology.Namespace
 	finalTopology := flow.MergeClusterTopologies(*clusterTopology, lo.Values(allFlows))
-	clusterResources := flow.RenderClusterResources(finalTopology, namespace)
+	clusterResources := renderer.RenderClusterResources(finalTopology, namespace)
 	managerAPIClusterResources := newManagerAPIClusterResources(clusterResources)
 	return managerapi.GetTenantUuidClusterResources200JSONResponse(managerAPIClusterResources), nil
 }
 
 func (sv *Server) GetTenantUuidManifest(_ context.Context, request api.GetTenantUuidManifestRequestObject) (api.GetTenantUuidManifestResponseObject, error) {
 	logrus.Infof("generating manifest for tenant '%s'", request.Uuid)
-	clusterTopology, allFlows, _, _, _, _, _, _, _, err := getTenantTopologies(sv, request.Uuid)
+	topologies, err := getTenantTopologies(sv, request.Uuid)
 	if err != nil {
 		logrus.WithError(err).Errorf("An error occurred while getting topologys for tenant '%s'", request.Uuid)
 		return nil, err
 	}
+	clusterTopology, allFlows := topologies.baseClusterTopology, topologies.flows
+
+	renderer, err := getTenantRenderer(sv, request.Uuid)
+	if err != nil {
+		logrus.WithError(err).Errorf("An error occurred while getting the renderer for tenant '%s'", request.Uuid)
+		return nil, err
+	}
 
 	if clusterTopology != nil {
 		namespaceName := clusterTopology.Namespace
 		if allFlows != nil {
 			finalTopology := flow.MergeClusterTopologies(*clusterTopology, lo.Values(allFlows))
-			clusterResources := flow.RenderClusterResources(finalTopology, namespaceName)
+			clusterResources := renderer.RenderClusterResources(finalTopology, namespaceName)
 
 			var yamlBuffer bytes.Buffer
 			yamlPrinter := printers.YAMLPrinter{}
 
 			// Add namespace
-			newNamespace := types.NewNamespaceWithIstioEnabled(namespaceName)
+			newNamespace := renderer.RenderNamespace(namespaceName)
 
 			if err = yamlPrinter.PrintObj(newNamespace, &yamlBuffer); err != nil {
 				logrus.WithError(err).Errorf("An error occurred printing '%s' in the yaml buffer", newNamespace.Name)
@@ -402,6 +478,20 @@ func (sv *Server) GetTenantUuidManifest(_ context.Context, request api.GetTenant
 				}
 			}
 
+			for _, resource := range clusterResources.Certificates {
+				if err := yamlPrinter.PrintObj(&resource, &yamlBuffer); err != nil {
+					logrus.WithError(err).Errorf("An error occurred printing '%s' in the yaml buffer", resource.Name)
+					return nil, stacktrace.Propagate(err, "an error occurred printing certificate '%s' in the yaml buffer", resource.Name)
+				}
+			}
+
+			for _, resource := range clusterResources.NetworkPolicies {
+				if err := yamlPrinter.PrintObj(&resource, &yamlBuffer); err != nil {
+					logrus.WithError(err).Errorf("An error occurred printing '%s' in the yaml buffer", resource.Name)
+					return nil, stacktrace.Propagate(err, "an error occurred printing network policy '%s' in the yaml buffer", resource.Name)
+				}
+			}
+
 			response := api.GetTenantUuidManifest200ApplicationxYamlResponse{
 				Body:          &yamlBuffer,
 				ContentLength: int64(yamlBuffer.Len()),
@@ -414,12 +504,13 @@ func (sv *Server) GetTenantUuidManifest(_ context.Context, request api.GetTenant
 }
 
 func (sv *Server) GetTenantUuidTemplates(ctx context.Context, request api.GetTenantUuidTemplatesRequestObject) (api.GetTenantUuidTemplatesResponseObject, error) {
-	_, _, tenantTemplates, _, _, _, _, _, _, err := getTenantTopologies(sv, request.Uuid)
+	topologies, err := getTenantTopologies(sv, request.Uuid)
 	if err != nil {
 		resourceType := "tenant"
 		missing := api.NotFoundJSONResponse{ResourceType: resourceType, Id: request.Uuid}
 		return api.GetTenantUuidTemplates404JSONResponse{NotFoundJSONResponse: missing}, nil
 	}
+	tenantTemplates := topologies.templates
 
 	var allTemplatesForTenant []templates.Template
 
@@ -434,12 +525,13 @@ func (sv *Server) DeleteTenantUuidTemplatesTemplateName(_ context.Context, reque
 	tenantUuid := request.Uuid
 	templateName := request.TemplateName
 
-	_, _, tenantTemplates, _, _, _, _, _, _, err := getTenantTopologies(sv, tenantUuid)
+	topologies, err := getTenantTopologies(sv, tenantUuid)
 	if err != nil {
 		resourceType := "tenant"
 		missing := api.NotFoundJSONResponse{ResourceType: resourceType, Id: request.Uuid}
 		return api.DeleteTenantUuidTemplatesTemplateName404JSONResponse{NotFoundJSONResponse: missing}, nil
 	}
+	tenantTemplates := topologies.templates
 
 	if _, exists := tenantTemplates[templateName]; exists {
 		err = sv.db.DeleteTemplate(tenantUuid, templateName)
@@ -467,12 +559,13 @@ func (sv *Server) PostTenantUuidTemplatesCreate(_ context.Context, request api.P
 	templateOverrides := request.Body.Service
 	templateId := getRandTemplateID()
 
-	_, _, tenantTemplates, _, _, _, _, _, _, err := getTenantTopologies(sv, tenantUuid)
+	topologies, err := getTenantTopologies(sv, tenantUuid)
 	if err != nil {
 		resourceType := "tenant"
 		missing := api.NotFoundJSONResponse{ResourceType: resourceType, Id: request.Uuid}
 		return api.PostTenantUuidTemplatesCreate404JSONResponse{NotFoundJSONResponse: missing}, nil
 	}
+	tenantTemplates := topologies.templates
 
 	template := templates.NewTemplate(templateOverrides, templateDescriptionPtr, templateName, templateId)
 	templateJson, err := json.Marshal(template)
@@ -600,40 +693,50 @@ func applyProdOnlyFlow(
 		return nil, err
 	}
 
-	flowHostMapping := clusterTopology.GetFlowHostMapping()
+	tenantSettings, err := settings.ParseTenantSettings(tenant.Settings)
+	if err != nil {
+		logrus.Errorf("an error occured while decoding the settings for tenant %s. error was \n: '%v'", tenant.TenantId, err.Error())
+		return nil, err
+	}
+	tenantSettings = tenantSettings.WithServerTraceRouter(sv.traceRouter)
+
+	flowHostMapping := clusterTopology.GetFlowHostMapping(tenantSettings.FlowEntryStrategy)
 
 	return flowHostMapping[flowID], nil
 }
 
 // ============================================================================================================
 func applyProdDevFlow(
+	ctx context.Context,
 	flowID string,
 	sv *Server,
 	tenantUuidStr string,
 	patches []flow_spec.ServicePatchSpec,
 	templateSpec *apitypes.TemplateSpec,
+	resilience resolved.FlowResilience,
 ) ([]resolved.IngressAccessEntry, error) {
 	logrus.Debugf("generating base cluster topology for tenant %s on flowID %s", tenantUuidStr, flowID)
 
-	baseTopology, _, tenantTemplates, serviceConfigs, deploymentConfigs, statefulSetConfigs, ingressConfigs, gatewayConfigs, routeConfigs, err := getTenantTopologies(sv, tenantUuidStr)
+	topologies, err := getTenantTopologies(sv, tenantUuidStr)
 	if err != nil {
 		return nil, fmt.Errorf("no base cluster topology found for tenant %s, did you deploy the cluster?", tenantUuidStr)
 	}
+	baseTopology := topologies.baseClusterTopology
 
 	baseClusterTopologyMaybeWithTemplateOverrides := *baseTopology
 	if templateSpec != nil {
 		logrus.Debugf("Using template '%v'", templateSpec.TemplateName)
 
-		template, found := tenantTemplates[templateSpec.TemplateName]
+		template, found := topologies.templates[templateSpec.TemplateName]
 		if !found {
 			return nil, fmt.Errorf("template with name '%v' doesn't exist for tenant uuid '%v'", templateSpec.TemplateName, tenantUuidStr)
 		}
-		serviceConfigs = template.ApplyTemplateOverrides(serviceConfigs, templateSpec)
+		serviceConfigs := template.ApplyTemplateOverrides(topologies.serviceConfigs, templateSpec)
 
 		// the baseline flow ID uses the base cluster topology namespace name
 		baselineFlowID := baseClusterTopologyMaybeWithTemplateOverrides.Namespace
 
-		baseClusterTopologyWithTemplateOverridesPtr, err := engine.GenerateProdOnlyCluster(baselineFlowID, serviceConfigs, deploymentConfigs, statefulSetConfigs, ingressConfigs, gatewayConfigs, routeConfigs, baseTopology.Namespace)
+		baseClusterTopologyWithTemplateOverridesPtr, err := engine.GenerateProdOnlyCluster(baselineFlowID, serviceConfigs, topologies.deploymentConfigs, topologies.statefulSetConfigs, topologies.ingressConfigs, topologies.gatewayConfigs, topologies.routeConfigs, baseTopology.Namespace)
 		if err != nil {
 			return nil, fmt.Errorf("an error occurred while creating base cluster topology from templates:\n %s", err)
 		}
@@ -647,12 +750,31 @@ func applyProdDevFlow(
 		ServicePatches: patches,
 	}
 
-	pluginRunner := plugins.NewPluginRunner(plugins.NewGitPluginProviderImpl(), tenantUuidStr, sv.db)
-	devClusterTopology, err := engine.GenerateProdDevCluster(&baseClusterTopologyMaybeWithTemplateOverrides, baseTopology, pluginRunner, flowSpec)
+	pluginRunner := plugins.NewPluginRunner(sv.gitPluginProvider, sv.pluginHost, tenantUuidStr, sv.db)
+	// the plugin flows are deleted in the reverse order of their creation if the flow is not stored, so the failed flows
+	// don't leave their resources and plugin configs behind, even if the request was canceled
+	flowStored := false
+	defer func() {
+		if flowStored {
+			return
+		}
+		if rollbackErr := pluginRunner.RollbackFlows(context.WithoutCancel(ctx)); rollbackErr != nil {
+			logrus.Errorf("An error occurred rolling back the plugins of flow '%s': %v", flowID, rollbackErr)
+		}
+	}()
+
+	devClusterTopology, err := engine.GenerateProdDevCluster(ctx, &baseClusterTopologyMaybeWithTemplateOverrides, baseTopology, pluginRunner, flowSpec)
 	if err != nil {
 		return nil, err
 	}
 
+	if len(resilience) > 0 {
+		if err = validateFlowResilienceServices(devClusterTopology, flowID, resilience); err != nil {
+			return nil, err
+		}
+		devClusterTopology.FlowResilience = map[string]resolved.FlowResilience{flowID: resilience}
+	}
+
 	devClusterTopologyJson, err := json.Marshal(devClusterTopology)
 	if err != nil {
 		logrus.Errorf("an error occured while encoding the cluster topology for tenant %s and flow %s, error was \n: '%v'", tenantUuidStr, flowID, err.Error())
@@ -664,38 +786,41 @@ func applyProdDevFlow(
 		logrus.Errorf("an error occured while creating flow %s. error was \n: '%v'", flowID, err.Error())
 		return nil, err
 	}
+	flowStored = true
+	pluginRunner.CommitFlows()
 
-	flowHostMapping := devClusterTopology.GetFlowHostMapping()
+	tenantSettings, err := getTenantSettings(sv, tenantUuidStr)
+	if err != nil {
+		return nil, err
+	}
+
+	flowHostMapping := devClusterTopology.GetFlowHostMapping(tenantSettings.FlowEntryStrategy)
 
 	return flowHostMapping[flowID], nil
 }
 
-// Returns the following given a tenant ID:
-// - Base cluster topology
-// - Flows topology
-// - Templates
-// - Base service configs
-// - Base ingress configs
-// TOOD: Could return a struct if it becomes too heavy to manipulate the return values.
-func getTenantTopologies(sv *Server, tenantUuidStr string) (*resolved.ClusterTopology,
-	map[string]resolved.ClusterTopology,
-	map[string]templates.Template,
-	[]apitypes.ServiceConfig,
-	[]apitypes.DeploymentConfig,
-	[]apitypes.StatefulSetConfig,
-	[]apitypes.IngressConfig,
-	[]apitypes.GatewayConfig,
-	[]apitypes.RouteConfig,
-	error,
-) {
+// tenantTopologies are the decoded baseline topology, flow topologies, templates and configs stored for a tenant
+type tenantTopologies struct {
+	baseClusterTopology *resolved.ClusterTopology
+	flows               map[string]resolved.ClusterTopology
+	templates           map[string]templates.Template
+	serviceConfigs      []apitypes.ServiceConfig
+	deploymentConfigs   []apitypes.DeploymentConfig
+	statefulSetConfigs  []apitypes.StatefulSetConfig
+	ingressConfigs      []apitypes.IngressConfig
+	gatewayConfigs      []apitypes.GatewayConfig
+	routeConfigs        []apitypes.RouteConfig
+}
+
+func getTenantTopologies(sv *Server, tenantUuidStr string) (*tenantTopologies, error) {
 	tenant, err := sv.db.GetTenant(tenantUuidStr)
 	if err != nil {
 		logrus.Errorf("an error occured while getting the tenant %s\n: '%v'", tenantUuidStr, err.Error())
-		return nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+		return nil, err
 	}
 
 	if tenant == nil {
-		return nil, nil, nil, nil, nil, nil, nil, nil, nil, fmt.Errorf("Cannot find tenant %s", tenantUuidStr)
+		return nil, notFoundError{resourceType: "tenant", id: tenantUuidStr}
 	}
 
 	flows := map[string]resolved.ClusterTopology{}
@@ -704,7 +829,7 @@ func getTenantTopologies(sv *Server, tenantUuidStr string) (*resolved.ClusterTop
 		err := json.Unmarshal(flow.ClusterTopology, &clusterTopology)
 		if err != nil {
 			logrus.Errorf("An error occurred decoding the cluster topology for flow '%v'", flow.FlowId)
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, err
 		}
 		flows[flow.FlowId] = clusterTopology
 	}
@@ -715,7 +840,7 @@ func getTenantTopologies(sv *Server, tenantUuidStr string) (*resolved.ClusterTop
 		err := json.Unmarshal(tenantTemplate.Body, &template)
 		if err != nil {
 			logrus.Errorf("An error occurred decoding the template body for template '%v'", tenantTemplate.Name)
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, err
 		}
 		tenantTemplates[tenantTemplate.Name] = template
 	}
@@ -725,7 +850,7 @@ func getTenantTopologies(sv *Server, tenantUuidStr string) (*resolved.ClusterTop
 		err = json.Unmarshal(tenant.BaseClusterTopology, &baseClusterTopology)
 		if err != nil {
 			logrus.Errorf("An error occurred decoding the cluster topology for tenant '%v'", tenantUuidStr)
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, err
 		}
 	} else {
 		baseClusterTopology.FlowID = defaultBaselineFlowId
@@ -737,7 +862,7 @@ func getTenantTopologies(sv *Server, tenantUuidStr string) (*resolved.ClusterTop
 		err = json.Unmarshal(tenant.ServiceConfigs, &serviceConfigs)
 		if err != nil {
 			logrus.Errorf("An error occurred decoding the service configs for tenant '%v'", tenantUuidStr)
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, err
 		}
 	}
 
@@ -746,7 +871,7 @@ func getTenantTopologies(sv *Server, tenantUuidStr string) (*resolved.ClusterTop
 		err = json.Unmarshal(tenant.DeploymentConfigs, &deploymentConfigs)
 		if err != nil {
 			logrus.Errorf("An error occurred decoding the deployment configs for tenant '%v'", tenantUuidStr)
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, err
 		}
 	}
 
@@ -755,7 +880,7 @@ func getTenantTopologies(sv *Server, tenantUuidStr string) (*resolved.ClusterTop
 		err = json.Unmarshal(tenant.StatefulSetConfigs, &statefulSetConfigs)
 		if err != nil {
 			logrus.Errorf("An error occurred decoding the stateful set configs for tenant '%v'", tenantUuidStr)
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, err
 		}
 	}
 
@@ -764,7 +889,7 @@ func getTenantTopologies(sv *Server, tenantUuidStr string) (*resolved.ClusterTop
 		err = json.Unmarshal(tenant.IngressConfigs, &ingressConfigs)
 		if err != nil {
 			logrus.Errorf("An error occurred decoding the ingress configs for tenant '%v'", tenantUuidStr)
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, err
 		}
 	}
 
@@ -773,7 +898,7 @@ func getTenantTopologies(sv *Server, tenantUuidStr string) (*resolved.ClusterTop
 		err = json.Unmarshal(tenant.GatewayConfigs, &gatewayConfigs)
 		if err != nil {
 			logrus.Errorf("An error occurred decoding the gateway configs for tenant '%v'", tenantUuidStr)
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, err
 		}
 	}
 
@@ -782,11 +907,21 @@ func getTenantTopologies(sv *Server, tenantUuidStr string) (*resolved.ClusterTop
 		err = json.Unmarshal(tenant.RouteConfigs, &routeConfigs)
 		if err != nil {
 			logrus.Errorf("An error occurred decoding the route configs for tenant '%v'", tenantUuidStr)
-			return nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+			return nil, err
 		}
 	}
 
-	return &baseClusterTopology, flows, tenantTemplates, serviceConfigs, deploymentConfigs, statefulSetConfigs, ingressConfigs, gatewayConfigs, routeConfigs, nil
+	return &tenantTopologies{
+		baseClusterTopology: &baseClusterTopology,
+		flows:               flows,
+		templates:           tenantTemplates,
+		serviceConfigs:      serviceConfigs,
+		deploymentConfigs:   deploymentConfigs,
+		statefulSetConfigs:  statefulSetConfigs,
+		ingressConfigs:      ingressConfigs,
+		gatewayConfigs:      gatewayConfigs,
+		routeConfigs:        routeConfigs,
+	}, nil
 }
 
 func deleteTenantTopologies(sv *Server, tenantUuidStr string) error {
@@ -836,6 +971,8 @@ func newClIAPITemplates(templates []templates.Template) []apitypes.Template {
 	return apiTypeTemplates
 }
 
+// newManagerAPIClusterResources converts the rendered resources to the manager API type, the network policies and
+// certificates are not part of it yet so they are only available in the manifest
 func newManagerAPIClusterResources(clusterResources types.ClusterResources) managerapitypes.ClusterResources {
 	return managerapitypes.ClusterResources{
 		Services:              &clusterResources.Services,
@@ -851,12 +988,14 @@ func newManagerAPIClusterResources(clusterResources types.ClusterResources) mana
 	}
 }
 
+// toApiIngressAccessEntries converts the entries to the CLI API type, it has no path prefix or flow header fields so the
+// hostname is replaced by the entry address to keep the printed flow URLs usable
 func toApiIngressAccessEntries(entries []resolved.IngressAccessEntry) []apitypes.IngressAccessEntry {
 	return lo.Map(entries, func(item resolved.IngressAccessEntry, _ int) apitypes.IngressAccessEntry {
 		return apitypes.IngressAccessEntry{
 			FlowId:        item.FlowID,
 			FlowNamespace: item.FlowNamespace,
-			Hostname:      item.Hostname,
+			Hostname:      item.Address(),
 			Service:       item.Service,
 			Namespace:     item.Namespace,
 			Type:          item.Type,
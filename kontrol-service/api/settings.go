@@ -0,0 +1,133 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	api "github.com/kurtosis-tech/kardinal/libs/cli-kontrol-api/api/golang/server"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+
+	"kardinal.kontrol-service/database"
+	"kardinal.kontrol-service/engine/flow"
+	"kardinal.kontrol-service/types/settings"
+)
+
+const tenantSettingsPath = "/tenant/:uuid/settings"
+
+func (sv *Server) registerTenantSettingsApi(router api.EchoRouter) {
+	router.GET(tenantSettingsPath, sv.getTenantSettingsHandler)
+	router.PUT(tenantSettingsPath, sv.putTenantSettingsHandler)
+}
+
+func (sv *Server) getTenantSettingsHandler(c echo.Context) error {
+	tenantUuid := c.Param("uuid")
+
+	tenantSettings, err := getTenantSettings(sv, tenantUuid)
+	if err != nil {
+		return lookupErrorResponse(c, err, fmt.Sprintf("An error occurred getting the settings of tenant '%v'", tenantUuid))
+	}
+
+	return c.JSON(http.StatusOK, tenantSettings)
+}
+
+func (sv *Server) putTenantSettingsHandler(c echo.Context) error {
+	tenantUuid := c.Param("uuid")
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		errMsg := "An error occurred reading the tenant settings"
+		errResp := api.RequestErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusBadRequest, errResp)
+	}
+
+	tenantSettings, err := settings.ParseTenantSettings(body)
+	if err != nil {
+		errMsg := "Invalid tenant settings"
+		errResp := api.RequestErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusBadRequest, errResp)
+	}
+
+	tenant, err := sv.db.GetTenant(tenantUuid)
+	if err != nil {
+		errMsg := fmt.Sprintf("An error occurred getting tenant '%v'", tenantUuid)
+		errResp := api.ErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusInternalServerError, errResp)
+	}
+	if tenant == nil {
+		missing := api.NotFoundJSONResponse{ResourceType: "tenant", Id: tenantUuid}
+		return c.JSON(http.StatusNotFound, missing)
+	}
+
+	err = saveTenantSettings(sv, tenant, tenantSettings)
+	if err != nil {
+		errMsg := fmt.Sprintf("An error occurred saving the settings of tenant '%v'", tenantUuid)
+		errResp := api.ErrorJSONResponse{
+			Error: err.Error(),
+			Msg:   &errMsg,
+		}
+		return c.JSON(http.StatusInternalServerError, errResp)
+	}
+
+	return c.JSON(http.StatusOK, tenantSettings)
+}
+
+// getTenantSettings returns the stored settings of the tenant, or the default ones if they were never set
+func getTenantSettings(sv *Server, tenantUuidStr string) (*settings.TenantSettings, error) {
+	tenant, err := sv.db.GetTenant(tenantUuidStr)
+	if err != nil {
+		logrus.Errorf("an error occured while getting the tenant %s\n: '%v'", tenantUuidStr, err.Error())
+		return nil, err
+	}
+
+	if tenant == nil {
+		return nil, notFoundError{resourceType: "tenant", id: tenantUuidStr}
+	}
+
+	tenantSettings, err := settings.ParseTenantSettings(tenant.Settings)
+	if err != nil {
+		logrus.Errorf("An error occurred decoding the settings for tenant '%v'", tenantUuidStr)
+		return nil, err
+	}
+	tenantSettings = tenantSettings.WithServerTraceRouter(sv.traceRouter)
+
+	return &tenantSettings, nil
+}
+
+func saveTenantSettings(sv *Server, tenant *database.Tenant, tenantSettings settings.TenantSettings) error {
+	tenantSettingsJson, err := json.Marshal(tenantSettings)
+	if err != nil {
+		logrus.Errorf("an error occured while encoding the settings for tenant %s, error was \n: '%v'", tenant.TenantId, err.Error())
+		return err
+	}
+	tenant.Settings = tenantSettingsJson
+
+	err = sv.db.SaveTenant(tenant)
+	if err != nil {
+		logrus.Errorf("an error occured while saving tenant %s. erro was \n: '%v'", tenant.TenantId, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// getTenantRenderer returns the renderer selected in the tenant settings
+func getTenantRenderer(sv *Server, tenantUuidStr string) (flow.Renderer, error) {
+	tenantSettings, err := getTenantSettings(sv, tenantUuidStr)
+	if err != nil {
+		return nil, err
+	}
+
+	return flow.NewRenderer(*tenantSettings)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/kurtosis-tech/stacktrace"
+	"github.com/sirupsen/logrus"
+
+	"kardinal.kontrol-service/tracerouter"
+)
+
+const (
+	defaultPort            = "8080"
+	memoryCleanupInterval  = time.Minute
+	serverShutdownDuration = 10 * time.Second
+)
+
+// The trace router is configured with the environment variables:
+//   - PORT, the port to listen on, 8080 by default
+//   - TRACE_TTL, how long the routing table of a trace is kept after its last route was set, e.g. 30m
+//   - REDIS_ADDRESS, REDIS_PASSWORD and REDIS_DB, the Redis compatible server storing the routing tables, they are
+//     stored in memory without it, which only works with a single replica
+func main() {
+	if os.Getenv("DEBUG") == "true" {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	if err := run(ctx); err != nil {
+		logrus.Fatalf("The trace router failed: %v", err)
+	}
+}
+
+func run(ctx context.Context) error {
+	ttl := tracerouter.DefaultTraceTTL
+	if ttlStr := os.Getenv("TRACE_TTL"); ttlStr != "" {
+		var err error
+		ttl, err = time.ParseDuration(ttlStr)
+		if err != nil {
+			return stacktrace.Propagate(err, "An error occurred parsing the trace TTL '%s'", ttlStr)
+		}
+	}
+
+	store, err := newStore(ctx)
+	if err != nil {
+		return err
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = defaultPort
+	}
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           tracerouter.NewRouter(store, ttl).Handler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serverShutdownDuration)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logrus.Errorf("An error occurred shutting down the trace router: %v", err)
+		}
+	}()
+
+	logrus.Infof("Trace router listening on port %s, traces expire after %s", port, ttl)
+	if err = server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return stacktrace.Propagate(err, "An error occurred serving the trace router")
+	}
+	return nil
+}
+
+func newStore(ctx context.Context) (tracerouter.Store, error) {
+	redisAddress := os.Getenv("REDIS_ADDRESS")
+	if redisAddress == "" {
+		logrus.Warn("REDIS_ADDRESS is not set, the routing tables are stored in memory and are not shared between replicas")
+		store := tracerouter.NewMemoryStore()
+		go store.RunCleanup(ctx, memoryCleanupInterval)
+		return store, nil
+	}
+
+	redisDB := 0
+	if redisDBStr := os.Getenv("REDIS_DB"); redisDBStr != "" {
+		var err error
+		redisDB, err = strconv.Atoi(redisDBStr)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "An error occurred parsing the Redis DB '%s'", redisDBStr)
+		}
+	}
+
+	store, err := tracerouter.NewRedisStore(tracerouter.RedisOptions{
+		Address:  redisAddress,
+		Password: os.Getenv("REDIS_PASSWORD"),
+		DB:       redisDB,
+	})
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Storing the routing tables in Redis at '%s'", redisAddress)
+	return store, nil
+}
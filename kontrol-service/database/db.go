@@ -152,7 +152,7 @@ func (db *Db) Migrate() error {
 	}
 	defer unlockFunc()
 
-	err = db.AutoMigrate(&Tenant{}, &Flow{}, &PluginConfig{}, &Template{})
+	err = db.AutoMigrate(&Tenant{}, &Flow{}, &PluginConfig{}, &Template{}, &PluginCredential{})
 	if err != nil {
 		return stacktrace.Propagate(err, "An internal error has occurred migrating the tables")
 	}
@@ -161,7 +161,7 @@ func (db *Db) Migrate() error {
 }
 
 func (db *Db) Clear() error {
-	err := db.db.Migrator().DropTable(&Tenant{}, &Flow{}, &PluginConfig{}, &Template{})
+	err := db.db.Migrator().DropTable(&Tenant{}, &Flow{}, &PluginConfig{}, &Template{}, &PluginCredential{})
 	if err != nil {
 		return stacktrace.Propagate(err, "An internal error has occurred clearing the tables")
 	}
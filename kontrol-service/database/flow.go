@@ -32,6 +32,14 @@ func (db *Db) CreateFlow(
 	return flow, nil
 }
 
+func (db *Db) SaveFlow(flow *Flow) error {
+	result := db.db.Save(flow)
+	if result.Error != nil {
+		return stacktrace.Propagate(result.Error, "An internal error has occurred updating the flow '%v'", flow.FlowId)
+	}
+	return nil
+}
+
 func (db *Db) DeleteFlow(
 	tenantId string,
 	flowId string,
@@ -8,19 +8,23 @@ import (
 
 type PluginConfig struct {
 	gorm.Model
-	FlowId   string `gorm:"uniqueIndex:idx_tenant_plugin"`
-	Config   string
+	FlowId string `gorm:"uniqueIndex:idx_tenant_plugin"`
+	Config string
+	// Commit is the plugin revision which created the flow, the flow is deleted with the same revision
+	Commit   string
 	TenantId string `gorm:"uniqueIndex:idx_tenant_plugin"`
 }
 
 func (db *Db) CreatePluginConfig(
 	flowId string,
 	config string,
+	commit string,
 	tenantId string,
 ) (*PluginConfig, error) {
 	pluginConfig := &PluginConfig{
 		FlowId:   flowId,
 		Config:   config,
+		Commit:   commit,
 		TenantId: tenantId,
 	}
 	result := db.db.Create(pluginConfig)
@@ -0,0 +1,64 @@
+package database
+
+import (
+	"time"
+
+	"github.com/kurtosis-tech/stacktrace"
+	"gorm.io/gorm"
+)
+
+// PluginCredential is the credential used to pull the private plugin repositories of a tenant, the secret is
+// encrypted by the plugins package before being stored, the credentials have no soft delete so the deleted secrets are
+// removed from the database
+type PluginCredential struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	TenantId  string `gorm:"uniqueIndex:idx_tenant_plugin_repository"`
+	// Repository is the URL prefix of the repositories using the credential, e.g. github.com/my-org
+	Repository      string `gorm:"uniqueIndex:idx_tenant_plugin_repository"`
+	Type            string
+	Username        string
+	EncryptedSecret []byte
+}
+
+// SavePluginCredential creates the credential of the repository prefix or replaces the existing one
+func (db *Db) SavePluginCredential(credential *PluginCredential) error {
+	var existingCredential PluginCredential
+	result := db.db.Where("tenant_id = ? AND repository = ?", credential.TenantId, credential.Repository).First(&existingCredential)
+	if result.Error == nil {
+		credential.ID = existingCredential.ID
+		credential.CreatedAt = existingCredential.CreatedAt
+	} else if result.Error != gorm.ErrRecordNotFound {
+		return stacktrace.Propagate(result.Error, "An internal error has occurred fetching the plugin credential for repository '%v'", credential.Repository)
+	}
+
+	result = db.db.Save(credential)
+	if result.Error != nil {
+		return stacktrace.Propagate(result.Error, "An internal error has occurred saving the plugin credential for repository '%v'", credential.Repository)
+	}
+	return nil
+}
+
+func (db *Db) GetPluginCredentials(
+	tenantId string,
+) ([]PluginCredential, error) {
+	var credentials []PluginCredential
+	result := db.db.Where("tenant_id = ?", tenantId).Order("repository").Find(&credentials)
+	if result.Error != nil {
+		return nil, stacktrace.Propagate(result.Error, "An internal error has occurred fetching the plugin credentials of tenant '%v'", tenantId)
+	}
+	return credentials, nil
+}
+
+// DeletePluginCredential deletes the credential of the repository prefix, it returns false if there was none
+func (db *Db) DeletePluginCredential(
+	tenantId string,
+	repository string,
+) (bool, error) {
+	result := db.db.Where("tenant_id = ? AND repository = ?", tenantId, repository).Delete(&PluginCredential{})
+	if result.Error != nil {
+		return false, stacktrace.Propagate(result.Error, "An internal error has occurred deleting the plugin credential for repository '%v'", repository)
+	}
+	return result.RowsAffected > 0, nil
+}
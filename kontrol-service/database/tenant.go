@@ -16,10 +16,12 @@ type Tenant struct {
 	IngressConfigs      datatypes.JSON
 	GatewayConfigs      datatypes.JSON
 	RouteConfigs        datatypes.JSON
+	Settings            datatypes.JSON
 	Active              bool
-	Flows               []Flow         `gorm:"foreignKey:TenantId;references:TenantId;constraint:OnDelete:CASCADE"`
-	PluginConfigs       []PluginConfig `gorm:"foreignKey:TenantId;references:TenantId;constraint:OnDelete:CASCADE"`
-	Templates           []Template     `gorm:"foreignKey:TenantId;references:TenantId;constraint:OnDelete:CASCADE"`
+	Flows               []Flow             `gorm:"foreignKey:TenantId;references:TenantId;constraint:OnDelete:CASCADE"`
+	PluginConfigs       []PluginConfig     `gorm:"foreignKey:TenantId;references:TenantId;constraint:OnDelete:CASCADE"`
+	Templates           []Template         `gorm:"foreignKey:TenantId;references:TenantId;constraint:OnDelete:CASCADE"`
+	PluginCredentials   []PluginCredential `gorm:"foreignKey:TenantId;references:TenantId;constraint:OnDelete:CASCADE"`
 }
 
 func (db *Db) SaveTenant(tenant *Tenant) error {
@@ -59,3 +61,13 @@ func (db *Db) GetTenant(
 	}
 	return &tenant, nil
 }
+
+// GetActiveTenantIds returns the IDs of the active tenants
+func (db *Db) GetActiveTenantIds() ([]string, error) {
+	var tenantIds []string
+	result := db.db.Model(&Tenant{}).Where("active = ?", true).Pluck("tenant_id", &tenantIds)
+	if result.Error != nil {
+		return nil, stacktrace.Propagate(result.Error, "An internal error has occurred fetching the active tenants")
+	}
+	return tenantIds, nil
+}
@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -38,7 +39,7 @@ func GenerateProdOnlyCluster(
 	return clusterTopology, nil
 }
 
-func GenerateProdDevCluster(baseClusterTopologyMaybeWithTemplateOverrides *resolved.ClusterTopology, baseTopology *resolved.ClusterTopology, pluginRunner *plugins.PluginRunner, flowSpec flow_spec.FlowPatchSpec) (*resolved.ClusterTopology, error) {
+func GenerateProdDevCluster(ctx context.Context, baseClusterTopologyMaybeWithTemplateOverrides *resolved.ClusterTopology, baseTopology *resolved.ClusterTopology, pluginRunner *plugins.PluginRunner, flowSpec flow_spec.FlowPatchSpec) (*resolved.ClusterTopology, error) {
 	patches := []flow_spec.ServicePatch{}
 	for _, item := range flowSpec.ServicePatches {
 		devServiceName := item.Service
@@ -67,7 +68,7 @@ func GenerateProdDevCluster(baseClusterTopologyMaybeWithTemplateOverrides *resol
 		ServicePatches: patches,
 	}
 
-	clusterTopology, err := flow.CreateDevFlow(pluginRunner, *baseClusterTopologyMaybeWithTemplateOverrides, *baseTopology, flowPatch)
+	clusterTopology, err := flow.CreateDevFlow(ctx, pluginRunner, *baseClusterTopologyMaybeWithTemplateOverrides, *baseTopology, flowPatch)
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "An error occurred generating the cluster topology from the service configs")
 	}
@@ -174,7 +175,7 @@ func processGatewayAndRouteConfigs(gatewayConfigs []apitypes.GatewayConfig, rout
 			} else {
 				for _, listener := range gateway.Spec.Listeners {
 					if listener.Hostname != nil && !strings.HasPrefix(string(*listener.Hostname), "*.") {
-						logrus.Warnf("Gateway %v listener %v is missing a wildcard, creating flow entry points will not work properly.", gateway.Name, listener.Hostname)
+						logrus.Warnf("Gateway %v listener %v is missing a wildcard, creating flow entry points will not work properly unless the flow TLS gateway listeners are enabled.", gateway.Name, listener.Hostname)
 					}
 				}
 			}
@@ -352,6 +353,12 @@ func addAvailablePluginsFromServiceConfig(serviceConfig apitypes.ServiceConfig,
 			if found {
 				return nil, stacktrace.NewError("a plugin with service name '%s' already exists, the `plugin.servicename` value has to be unique", plugin.ServiceName)
 			}
+			if err = plugins.ValidatePluginName(plugin.Name); err != nil {
+				return nil, stacktrace.Propagate(err, "an error occurred parsing the plugin name for service %s", service.GetObjectMeta().GetName())
+			}
+			if _, err = plugin.GetTimeout(); err != nil {
+				return nil, stacktrace.Propagate(err, "an error occurred parsing the plugin timeout for service %s", service.GetObjectMeta().GetName())
+			}
 			availablePlugins[plugin.ServiceName] = &plugin
 		}
 	}
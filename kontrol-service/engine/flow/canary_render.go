@@ -0,0 +1,275 @@
+package flow
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"istio.io/api/networking/v1alpha3"
+	istioclient "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	net "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	gateway "sigs.k8s.io/gateway-api/apis/v1"
+
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+)
+
+// canaryBackendFunc returns the backend of a flow replacing a baseline backend of the gateway routes
+type canaryBackendFunc func(baselineRef gateway.HTTPBackendRef, flowID string) (gateway.ObjectName, bool)
+
+// getCanaryFlowIDs returns the IDs of the flows receiving canary traffic
+func getCanaryFlowIDs(canaries []resolved.FlowCanaryEntry) []string {
+	return lo.Map(canaries, func(entry resolved.FlowCanaryEntry, _ int) string { return entry.FlowID })
+}
+
+// addFlowCanaryRules sends part of the requests matched by the baseline rules to the flows, with weighted backends and
+// with copies of the rules matching the canary headers
+// The canary backends set the flow ID header so the inbound filters of the flow front services find the requests
+// entering the flow, the flow ID header set by the baseline rules is moved to the baseline backends for the same reason
+func addFlowCanaryRules(
+	rules []gateway.HTTPRouteRule,
+	canaries []resolved.FlowCanaryEntry,
+	baselineFlowID string,
+	canaryBackend canaryBackendFunc,
+) []gateway.HTTPRouteRule {
+	if len(canaries) == 0 {
+		return rules
+	}
+
+	canaryRules := []gateway.HTTPRouteRule{}
+	for _, ruleOriginal := range rules {
+		rule := ruleOriginal.DeepCopy()
+		if removeFlowHeader(rule) {
+			for refIx, ref := range rule.BackendRefs {
+				ref.Filters = setFilterFlowHeader(ref.Filters, baselineFlowID)
+				rule.BackendRefs[refIx] = ref
+			}
+		}
+
+		for _, canary := range canaries {
+			if len(canary.Canary.Matches) == 0 {
+				continue
+			}
+			canaryRule := rule.DeepCopy()
+			canaryRule.Matches = getCanaryMatches(rule.Matches, canary.Canary.Matches)
+			canaryRule.BackendRefs = lo.FilterMap(rule.BackendRefs, func(ref gateway.HTTPBackendRef, _ int) (gateway.HTTPBackendRef, bool) {
+				return getCanaryBackendRef(ref, canary.FlowID, ref.Weight, canaryBackend)
+			})
+			if len(canaryRule.BackendRefs) > 0 {
+				canaryRules = append(canaryRules, *canaryRule)
+			}
+		}
+
+		weightedRefs := []gateway.HTTPBackendRef{}
+		for _, ref := range rule.BackendRefs {
+			weight := lo.FromPtrOr(ref.Weight, 1)
+			baselinePercentage := int32(100)
+			for _, canary := range canaries {
+				if canary.Canary.Weight == 0 {
+					continue
+				}
+				canaryRef, found := getCanaryBackendRef(ref, canary.FlowID, lo.ToPtr(weight*canary.Canary.Weight), canaryBackend)
+				if found {
+					weightedRefs = append(weightedRefs, canaryRef)
+					baselinePercentage -= canary.Canary.Weight
+				}
+			}
+			if baselinePercentage != 100 {
+				ref.Weight = lo.ToPtr(weight * baselinePercentage)
+			}
+			weightedRefs = append(weightedRefs, ref)
+		}
+		rule.BackendRefs = weightedRefs
+		canaryRules = append(canaryRules, *rule)
+	}
+	return canaryRules
+}
+
+// getCanaryBackendRef returns a copy of the baseline backend sending the requests to the flow
+func getCanaryBackendRef(baselineRef gateway.HTTPBackendRef, flowID string, weight *int32, canaryBackend canaryBackendFunc) (gateway.HTTPBackendRef, bool) {
+	name, found := canaryBackend(baselineRef, flowID)
+	if !found {
+		logrus.Warnf("Backend %v has no version for flow '%s', it doesn't receive canary traffic", baselineRef.Name, flowID)
+		return gateway.HTTPBackendRef{}, false
+	}
+	ref := baselineRef.DeepCopy()
+	ref.Name = name
+	ref.Weight = weight
+	ref.Filters = setFilterFlowHeader(ref.Filters, flowID)
+	return *ref, true
+}
+
+// getCanaryMatches returns each match of the rule with the headers of each canary match added to it
+func getCanaryMatches(ruleMatches []gateway.HTTPRouteMatch, canaryMatches []resolved.FlowCanaryMatch) []gateway.HTTPRouteMatch {
+	if len(ruleMatches) == 0 {
+		ruleMatches = []gateway.HTTPRouteMatch{{}}
+	}
+
+	matches := []gateway.HTTPRouteMatch{}
+	for _, ruleMatch := range ruleMatches {
+		for _, canaryMatch := range canaryMatches {
+			match := ruleMatch.DeepCopy()
+			for _, header := range canaryMatch.Headers {
+				matchType := gateway.HeaderMatchExact
+				if header.Regex {
+					matchType = gateway.HeaderMatchRegularExpression
+				}
+				match.Headers = append(match.Headers, gateway.HTTPHeaderMatch{
+					Type:  lo.ToPtr(matchType),
+					Name:  gateway.HTTPHeaderName(header.Name),
+					Value: header.Value,
+				})
+			}
+			matches = append(matches, *match)
+		}
+	}
+	if len(matches) > maxHTTPRouteRuleMatches {
+		logrus.Warnf("Canary route rule has %d matches, more than the %d allowed by the Gateway API", len(matches), maxHTTPRouteRuleMatches)
+	}
+	return matches
+}
+
+// removeFlowHeader removes the flow ID header set by the rule, it returns true if the rule was setting it
+func removeFlowHeader(rule *gateway.HTTPRouteRule) bool {
+	found := false
+	filters := []gateway.HTTPRouteFilter{}
+	for _, filter := range rule.Filters {
+		if filter.Type == gateway.HTTPRouteFilterRequestHeaderModifier && filter.RequestHeaderModifier != nil {
+			modifier := filter.RequestHeaderModifier
+			set := lo.Filter(modifier.Set, func(header gateway.HTTPHeader, _ int) bool {
+				return string(header.Name) != resolved.FlowHeaderName
+			})
+			if len(set) != len(modifier.Set) {
+				found = true
+				modifier.Set = set
+			}
+			if len(modifier.Set) == 0 && len(modifier.Add) == 0 && len(modifier.Remove) == 0 {
+				continue
+			}
+		}
+		filters = append(filters, filter)
+	}
+	rule.Filters = filters
+	return found
+}
+
+// getIngressCanaryVirtualServices returns the virtual services splitting the traffic sent by the ingresses to the
+// baseline front services, the ingresses can't do it so it only works with ingress controllers in the mesh
+func getIngressCanaryVirtualServices(
+	ingress *resolved.Ingress,
+	allServices []*resolved.Service,
+	canaries []resolved.FlowCanaryEntry,
+	namespace string,
+) []istioclient.VirtualService {
+	if len(canaries) == 0 {
+		return []istioclient.VirtualService{}
+	}
+
+	// the baseline topology (or prod topology) flow ID and flow version are equal to the namespace these three should use same value
+	baselineFlowVersion := namespace
+	frontServiceIDs := lo.Uniq(lo.FlatMap(ingress.Ingresses, func(ingressDefinition net.Ingress, _ int) []string {
+		return lo.FlatMap(ingressDefinition.Spec.Rules, func(rule net.IngressRule, _ int) []string {
+			if rule.HTTP == nil {
+				return []string{}
+			}
+			return lo.FilterMap(rule.HTTP.Paths, func(path net.HTTPIngressPath, _ int) (string, bool) {
+				if path.Backend.Service == nil {
+					return "", false
+				}
+				return path.Backend.Service.Name, true
+			})
+		})
+	}))
+	sort.Strings(frontServiceIDs)
+
+	virtualServices := []istioclient.VirtualService{}
+	for _, frontServiceID := range frontServiceIDs {
+		target, found := findBackendRefService(frontServiceID, baselineFlowVersion, allServices)
+		if !found || target.ServiceSpec == nil || len(target.ServiceSpec.Ports) == 0 {
+			continue
+		}
+		virtualServices = append(virtualServices, getCanaryVirtualService(target, canaries, namespace))
+	}
+	return virtualServices
+}
+
+// getCanaryVirtualService returns the virtual service of the baseline front service of a service, sending the requests
+// matching the canary headers and the canary weights to the flow front services
+func getCanaryVirtualService(baselineService *resolved.Service, canaries []resolved.FlowCanaryEntry, namespace string) istioclient.VirtualService {
+	baselineHost := resolved.VersionedName(baselineService.ServiceID, namespace)
+	port := &v1alpha3.PortSelector{Number: uint32(baselineService.ServiceSpec.Ports[0].Port)}
+
+	getDestination := func(host string, flowID string, weight int32) *v1alpha3.HTTPRouteDestination {
+		destination := &v1alpha3.HTTPRouteDestination{
+			Destination: &v1alpha3.Destination{
+				Host: host,
+				Port: port,
+			},
+			Weight: weight,
+		}
+		if flowID != namespace {
+			destination.Headers = &v1alpha3.Headers{
+				Request: &v1alpha3.Headers_HeaderOperations{
+					Set: map[string]string{flowIDHeader: flowID},
+				},
+			}
+		}
+		return destination
+	}
+
+	httpRoutes := []*v1alpha3.HTTPRoute{}
+	weightedDestinations := []*v1alpha3.HTTPRouteDestination{}
+	baselineWeight := int32(100)
+	for _, canary := range canaries {
+		flowHost := resolved.VersionedName(baselineService.ServiceID, canary.FlowID)
+		if len(canary.Canary.Matches) > 0 {
+			httpRoutes = append(httpRoutes, &v1alpha3.HTTPRoute{
+				Match: lo.Map(canary.Canary.Matches, func(match resolved.FlowCanaryMatch, _ int) *v1alpha3.HTTPMatchRequest {
+					return getCanaryHTTPMatchRequest(match)
+				}),
+				Route: []*v1alpha3.HTTPRouteDestination{getDestination(flowHost, canary.FlowID, 0)},
+			})
+		}
+		if canary.Canary.Weight > 0 {
+			weightedDestinations = append(weightedDestinations, getDestination(flowHost, canary.FlowID, canary.Canary.Weight))
+			baselineWeight -= canary.Canary.Weight
+		}
+	}
+	if baselineWeight > 0 {
+		weightedDestinations = append(weightedDestinations, getDestination(baselineHost, namespace, baselineWeight))
+	}
+	if len(weightedDestinations) == 1 {
+		weightedDestinations[0].Weight = 0
+	}
+	httpRoutes = append(httpRoutes, &v1alpha3.HTTPRoute{Route: weightedDestinations})
+
+	return istioclient.VirtualService{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "networking.istio.io/v1alpha3",
+			Kind:       "VirtualService",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      resolved.DNSLabel(baselineHost, "canary"),
+			Namespace: namespace,
+		},
+		Spec: v1alpha3.VirtualService{
+			Hosts: []string{baselineHost},
+			Http:  httpRoutes,
+		},
+	}
+}
+
+func getCanaryHTTPMatchRequest(match resolved.FlowCanaryMatch) *v1alpha3.HTTPMatchRequest {
+	headers := map[string]*v1alpha3.StringMatch{}
+	for _, header := range match.Headers {
+		// the virtual services only match lowercase header names
+		name := strings.ToLower(header.Name)
+		if header.Regex {
+			headers[name] = &v1alpha3.StringMatch{MatchType: &v1alpha3.StringMatch_Regex{Regex: header.Value}}
+		} else {
+			headers[name] = &v1alpha3.StringMatch{MatchType: &v1alpha3.StringMatch_Exact{Exact: header.Value}}
+		}
+	}
+	return &v1alpha3.HTTPMatchRequest{Headers: headers}
+}
@@ -0,0 +1,155 @@
+package flow
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	gateway "sigs.k8s.io/gateway-api/apis/v1"
+
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	"kardinal.kontrol-service/types/settings"
+)
+
+func getCanaryTestTopology() *resolved.ClusterTopology {
+	serviceSpec := &corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 8080, AppProtocol: lo.ToPtr("HTTP")}}}
+	return &resolved.ClusterTopology{
+		Namespace: "prod",
+		Services: []*resolved.Service{
+			{ServiceID: "frontend", Version: "prod", ServiceSpec: serviceSpec},
+			{ServiceID: "frontend", Version: "dev-flow-1", ServiceSpec: serviceSpec},
+		},
+		GatewayAndRoutes: &resolved.GatewayAndRoutes{
+			ActiveFlowIDs: []string{"prod", "dev-flow-1"},
+			GatewayRoutes: []*gateway.HTTPRouteSpec{
+				{
+					Hostnames: []gateway.Hostname{"app.example.com"},
+					Rules: []gateway.HTTPRouteRule{
+						{BackendRefs: []gateway.HTTPBackendRef{getHTTPBackendRef("frontend", 8080)}},
+					},
+				},
+			},
+		},
+		FlowCanaries: map[string]resolved.FlowCanary{
+			"dev-flow-1": {
+				Weight: 10,
+				Matches: []resolved.FlowCanaryMatch{
+					{Headers: []resolved.FlowCanaryHeaderMatch{{Name: "x-user", Value: "alice"}}},
+				},
+			},
+		},
+	}
+}
+
+func getBackendFlowHeader(ref gateway.HTTPBackendRef) string {
+	for _, filter := range ref.Filters {
+		if filter.RequestHeaderModifier == nil {
+			continue
+		}
+		for _, header := range filter.RequestHeaderModifier.Set {
+			if string(header.Name) == resolved.FlowHeaderName {
+				return header.Value
+			}
+		}
+	}
+	return ""
+}
+
+func TestFlowCanaryGatewayRoutes(t *testing.T) {
+	topology := getCanaryTestTopology()
+	tenantSettings := settings.NewDefaultTenantSettings()
+	canaries := topology.GetFlowCanaries(topology.GatewayAndRoutes.ActiveFlowIDs)
+
+	routes, _, filters := getHTTPRoutes(topology.GatewayAndRoutes, topology.Services, canaries, topology.Namespace, tenantSettings)
+	baselineRoute, found := lo.Find(routes, func(route gateway.HTTPRoute) bool {
+		return lo.Contains(route.Spec.Hostnames, gateway.Hostname(resolved.ReplaceOrAddSubdomain("app.example.com", "prod")))
+	})
+	require.True(t, found)
+	require.Len(t, baselineRoute.Spec.Rules, 2)
+
+	// the requests matching the canary headers all go to the flow
+	matchRule := baselineRoute.Spec.Rules[0]
+	require.Len(t, matchRule.Matches, 1)
+	require.Equal(t, "x-user", string(matchRule.Matches[0].Headers[0].Name))
+	require.Len(t, matchRule.BackendRefs, 1)
+	require.Equal(t, "frontend-dev-flow-1", string(matchRule.BackendRefs[0].Name))
+	require.Equal(t, "dev-flow-1", getBackendFlowHeader(matchRule.BackendRefs[0]))
+
+	// the rest is split with the canary weight
+	weightedRule := baselineRoute.Spec.Rules[1]
+	require.Len(t, weightedRule.BackendRefs, 2)
+	require.Equal(t, "frontend-dev-flow-1", string(weightedRule.BackendRefs[0].Name))
+	require.Equal(t, int32(10), *weightedRule.BackendRefs[0].Weight)
+	require.Equal(t, "frontend-prod", string(weightedRule.BackendRefs[1].Name))
+	require.Equal(t, int32(90), *weightedRule.BackendRefs[1].Weight)
+	require.Empty(t, getBackendFlowHeader(weightedRule.BackendRefs[1]))
+
+	// the flow entry filter finds the canary requests with the flow ID header, the baseline one ignores them
+	require.Len(t, filters, 2)
+	for _, filter := range filters {
+		luaCode := filter.Spec.ConfigPatches[0].Patch.Value.Fields["typed_config"].GetStructValue().Fields["inlineCode"].GetStringValue()
+		if strings.Contains(filter.Name, "dev-flow-1") {
+			require.Contains(t, luaCode, `if hostname == "dev-flow-1.example.com" or flow_id == "dev-flow-1" then`)
+		} else {
+			require.Contains(t, luaCode, `if (hostname == "prod.example.com" or flow_id == "prod") and not (flow_id == "dev-flow-1") then`)
+		}
+	}
+}
+
+func TestFlowCanaryMovesBaselineFlowHeaderToBackends(t *testing.T) {
+	rules := []gateway.HTTPRouteRule{
+		{BackendRefs: []gateway.HTTPBackendRef{getHTTPBackendRef("frontend-prod", 8080)}},
+	}
+	setFlowHeader(rules, "prod")
+
+	canaries := []resolved.FlowCanaryEntry{{FlowID: "dev-flow-1", Canary: resolved.FlowCanary{Weight: 100}}}
+	canaryRules := addFlowCanaryRules(rules, canaries, "prod", func(_ gateway.HTTPBackendRef, flowID string) (gateway.ObjectName, bool) {
+		return gateway.ObjectName(resolved.VersionedName("frontend", flowID)), true
+	})
+
+	require.Len(t, canaryRules, 1)
+	require.Empty(t, canaryRules[0].Filters)
+	require.Len(t, canaryRules[0].BackendRefs, 2)
+	require.Equal(t, "dev-flow-1", getBackendFlowHeader(canaryRules[0].BackendRefs[0]))
+	require.Equal(t, "prod", getBackendFlowHeader(canaryRules[0].BackendRefs[1]))
+	require.Equal(t, int32(0), *canaryRules[0].BackendRefs[1].Weight)
+}
+
+func TestFlowCanaryGatewayAPIRoutes(t *testing.T) {
+	topology := getCanaryTestTopology()
+	canaries := topology.GetFlowCanaries(topology.GatewayAndRoutes.ActiveFlowIDs)
+
+	routes, _ := getFlowHeaderHTTPRoutes(topology.GatewayAndRoutes, topology.Services, canaries, topology.Namespace, settings.NewDefaultTenantSettings())
+	baselineRoute, found := lo.Find(routes, func(route gateway.HTTPRoute) bool {
+		return lo.Contains(route.Spec.Hostnames, gateway.Hostname(resolved.ReplaceOrAddSubdomain("app.example.com", "prod")))
+	})
+	require.True(t, found)
+	require.Len(t, baselineRoute.Spec.Rules, 2)
+	weightedRule := baselineRoute.Spec.Rules[1]
+	require.Equal(t, "frontend-dev-flow-1", string(weightedRule.BackendRefs[0].Name))
+	require.Equal(t, "dev-flow-1", getBackendFlowHeader(weightedRule.BackendRefs[0]))
+	require.Equal(t, "prod", getBackendFlowHeader(weightedRule.BackendRefs[1]))
+}
+
+func TestFlowCanaryIngressVirtualService(t *testing.T) {
+	topology := getCanaryTestTopology()
+	canaries := topology.GetFlowCanaries([]string{"prod", "dev-flow-1"})
+
+	virtualService := getCanaryVirtualService(topology.Services[0], canaries, topology.Namespace)
+	require.Equal(t, []string{"frontend-prod"}, virtualService.Spec.Hosts)
+	require.Len(t, virtualService.Spec.Http, 2)
+
+	matchRoute := virtualService.Spec.Http[0]
+	require.Equal(t, "alice", matchRoute.Match[0].Headers["x-user"].GetExact())
+	require.Equal(t, "frontend-dev-flow-1", matchRoute.Route[0].Destination.Host)
+	require.Equal(t, "dev-flow-1", matchRoute.Route[0].Headers.Request.Set[flowIDHeader])
+
+	weightedRoute := virtualService.Spec.Http[1]
+	require.Len(t, weightedRoute.Route, 2)
+	require.Equal(t, int32(10), weightedRoute.Route[0].Weight)
+	require.Equal(t, "frontend-prod", weightedRoute.Route[1].Destination.Host)
+	require.Equal(t, int32(90), weightedRoute.Route[1].Weight)
+	require.Nil(t, weightedRoute.Route[1].Headers)
+}
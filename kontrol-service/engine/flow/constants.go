@@ -2,30 +2,28 @@ package flow
 
 import (
 	"fmt"
+	"hash/fnv"
+	"sort"
 	"strings"
-)
 
-var TraceHeaderPriorities = []string{
-	"x-kardinal-trace-id",   // Our custom header (checked first)
-	"x-b3-traceid",          // Zipkin B3
-	"x-request-id",          // General request ID, often used for tracing
-	"x-cloud-trace-context", // Google Cloud Trace
-	"x-amzn-trace-id",       // AWS X-Ray
-	"traceparent",           // W3C Trace Context
-	"uber-trace-id",         // Jaeger
-	"x-datadog-trace-id",    // Datadog
-}
+	"github.com/samber/lo"
+
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	"kardinal.kontrol-service/types/settings"
+)
 
 const (
-	inboundRequestTraceIDFilter = `
+	inboundRequestTraceIDFilterTemplate = `
+%s
+
 function envoy_on_request(request_handle)
   local headers = request_handle:headers()
-  local trace_id = headers:get("x-kardinal-trace-id")
+  local trace_id = headers:get(trace_id_header)
   
   if not trace_id then
     request_handle:respond(
       {[":status"] = "400"},
-      "Missing required x-kardinal-trace-id header"
+      "Missing required " .. trace_id_header .. " header"
     )
   end
 end
@@ -33,6 +31,10 @@ end
 
 	outgoingRequestTraceIDFilterTemplate = `
 %s
+%s
+
+%s
+%s
 
 function get_trace_id(headers)
   for _, header_name in ipairs(trace_header_priorities) do
@@ -49,54 +51,182 @@ function envoy_on_request(request_handle)
   local headers = request_handle:headers()
   local trace_id, source_header = get_trace_id(headers)
   local hostname = headers:get(":authority")
-  
-  if not trace_id then
-    request_handle:logWarn("No valid trace ID found in request headers")
+%s
+
+  local destination = determine_destination(request_handle, trace_id, hostname)
+  if not destination then
     request_handle:respond(
-      {[":status"] = "400"},
-      "Missing required trace ID header"
+      {[":status"] = "503"},
+      "Failed to determine the destination from the trace router"
     )
     return
   end
+  request_handle:headers():add("x-kardinal-destination", destination)
+end
 
-  if source_header ~= "x-kardinal-trace-id" then
-    request_handle:headers():add("x-kardinal-trace-id", trace_id)
-    request_handle:logInfo("Set x-kardinal-trace-id from " .. source_header .. ": " .. trace_id)
+%s
+function baseline_destination(hostname)
+  local service = hostname:match("^([^.]+)")
+  local destination = baseline_destinations[service]
+  if destination then
+    return destination
   end
-
-  local destination = determine_destination(request_handle, trace_id, hostname)
-  request_handle:headers():add("x-kardinal-destination", destination)
+  return service .. "-%s"  -- Fallback to baseline
 end
+`
 
-function determine_destination(request_handle, trace_id, hostname)
+	// luaTraceRouterDestinationTemplate asks the trace router for the destination of the request
+	luaTraceRouterDestinationTemplate = `function determine_destination(request_handle, trace_id, hostname)
   hostname = hostname:match("^([^:]+)")
   local headers, body = request_handle:httpCall(
-    "outbound|8080||trace-router.default.svc.cluster.local",
+    trace_router_cluster,
     {
       [":method"] = "GET",
-      [":path"] = "/route?trace_id=" .. trace_id .. "&hostname=" .. hostname .. "&baseline_prefix=%s",
-      [":authority"] = "trace-router.default.svc.cluster.local"
+      [":path"] = "/route?trace_id=" .. url_encode(trace_id) .. "&hostname=" .. url_encode(hostname) .. "&namespace=%[1]s" .. "&baseline_prefix=%[1]s" .. "&baseline_destination=" .. url_encode(baseline_destination(hostname)),
+      [":authority"] = trace_router_authority
     },
     "",
-    5000
+    trace_router_timeout
   )
   
   if not headers or headers[":status"] ~= "200" then
+    if reject_without_trace_router then
+      request_handle:logErr("Failed to determine destination, rejecting the request")
+      return nil
+    end
     request_handle:logWarn("Failed to determine destination, falling back to baseline")
-    return hostname .. "-%s"  -- Fallback to baseline
+    return baseline_destination(hostname)
   end
   
   return body
 end
 `
 
+	// luaRequiredTraceIDTemplate copies the trace ID of the request to the canonical header, the trace router needs it
+	// so the requests without one are rejected or get a generated one
+	luaRequiredTraceIDTemplate = `  if not trace_id then
+%s
+  end
+
+  if source_header ~= trace_id_header then
+    request_handle:headers():add(trace_id_header, trace_id)
+    request_handle:logInfo("Set " .. trace_id_header .. " from " .. source_header .. ": " .. trace_id)
+  end`
+
+	// luaOptionalTraceID copies the trace ID of the request to the canonical header when there is one, the flow header
+	// routing modes don't need it
+	luaOptionalTraceID = `  if trace_id and source_header ~= trace_id_header then
+    request_handle:headers():add(trace_id_header, trace_id)
+  end`
+
+	// luaMissingTraceIDRejection is the body of the `if not trace_id` block of the strict filters
+	luaMissingTraceIDRejection = `    request_handle:logWarn("No valid trace ID found in request headers")
+    request_handle:respond(
+      {[":status"] = "400"},
+      "Missing required trace ID header"
+    )
+    return`
+
+	// luaMissingTraceIDGeneration is the body of the `if not trace_id` block of the filters generating the missing
+	// trace IDs, it expects the functions of luaTraceIDFunctions
+	luaMissingTraceIDGeneration = `    trace_id = generate_trace_id(request_handle)
+    source_header = "generated"
+    request_handle:logInfo("No trace ID found in request headers, using generated: " .. trace_id)
+    add_traceparent(request_handle, trace_id)`
+
+	// luaTraceIDFunctions generates trace IDs of 32 lowercase hex digits, which are also valid W3C trace IDs, and adds
+	// a traceparent header when add_traceparent_header is set and the request doesn't have one
+	// Envoy runs a Lua state per worker and math.random is never seeded, so each state seeds it before its first trace
+	// ID with the time, the address of a new table, the salt of the filter and the random x-request-id of the request,
+	// otherwise all the workers and pods would generate the same trace IDs
+	luaTraceIDFunctions = `
+local add_traceparent_header = %t
+local random_seed_salt = %d
+local random_seeded = false
+
+function seed_random(request_handle)
+  if random_seeded then
+    return
+  end
+  random_seeded = true
+  local seed = (os.time() + math.floor(os.clock() * 1000000) + random_seed_salt) %% 2147483647
+  local entropy = tostring({}) .. (request_handle:headers():get("x-request-id") or "")
+  for i = 1, #entropy do
+    seed = (seed * 31 + entropy:byte(i)) %% 2147483647
+  end
+  math.randomseed(seed)
+end
+
+function random_hex(words)
+  local hex = ""
+  for _ = 1, words do
+    hex = hex .. string.format("%%08x", math.random(0, 0xffffffff))
+  end
+  return hex
+end
+
+function generate_trace_id(request_handle)
+  seed_random(request_handle)
+  return random_hex(4)
+end
+
+function add_traceparent(request_handle, trace_id)
+  if not add_traceparent_header or request_handle:headers():get("traceparent") then
+    return
+  end
+  if #trace_id ~= 32 or not trace_id:match("^%%x+$") or trace_id:match("^0+$") then
+    request_handle:logWarn("Trace ID " .. trace_id .. " is not a valid W3C trace ID, not adding a traceparent header")
+    return
+  end
+  seed_random(request_handle)
+  request_handle:headers():add("traceparent", "00-" .. trace_id:lower() .. "-" .. random_hex(2) .. "-01")
+end
+`
+
+	// luaTraceRouterTraceIDGeneration asks the trace-router for a new trace ID and falls back to a local one
+	luaTraceRouterTraceIDGeneration = `      local generate_headers, generate_body = request_handle:httpCall(
+        trace_router_cluster,
+        {
+         [":method"] = "GET",
+         [":path"] = "/generate-trace-id",
+         [":authority"] = trace_router_authority
+        },
+        "",
+        trace_router_timeout
+      )
+
+      if generate_headers and generate_headers[":status"] == "200" then
+        trace_id = generate_body
+        request_handle:logInfo("Received trace ID from trace-router: " .. trace_id)
+      else
+        trace_id = generate_trace_id(request_handle)
+        request_handle:logWarn("Failed to get trace ID from trace-router, using locally generated: " .. trace_id)
+      end`
+
+	// luaURLEncodeFunction escapes the values of the trace router query parameters, the trace IDs come from the
+	// request headers and the hostnames from the :authority header
+	luaURLEncodeFunction = `
+function url_encode(value)
+  return (value:gsub("[^%w%-%._~]", function(c)
+    return string.format("%%%02X", string.byte(c))
+  end))
+end`
+
+	// luaRandomSeedModulus keeps the seeds of the Lua generators in the range of a positive 32 bits integer
+	luaRandomSeedModulus = 2147483647
+
 	luaFilterType = "type.googleapis.com/envoy.extensions.filters.http.lua.v3.Lua"
+
+	// flowIDHeader carries the flow ID of a request when the routing is done with header matches only
+	flowIDHeader = resolved.FlowHeaderName
 )
 
-func generateLuaTraceHeaderPriorities() string {
+// generateLuaTraceHeaders renders the canonical trace ID header of the tenant and the headers a trace ID is read from
+func generateLuaTraceHeaders(tenantSettings settings.TenantSettings) string {
 	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("local trace_id_header = %q\n", tenantSettings.TraceID.Header))
 	sb.WriteString("local trace_header_priorities = {")
-	for i, header := range TraceHeaderPriorities {
+	for i, header := range tenantSettings.TraceID.TraceHeaders() {
 		if i > 0 {
 			sb.WriteString(", ")
 		}
@@ -105,6 +235,95 @@ func generateLuaTraceHeaderPriorities() string {
 	sb.WriteString("}")
 	return sb.String()
 }
-func getOutgoingRequestTraceIDFilter(baselineHostName string) string {
-	return fmt.Sprintf(outgoingRequestTraceIDFilterTemplate, generateLuaTraceHeaderPriorities(), baselineHostName, baselineHostName)
+
+// generateLuaTraceRouter renders the location of the trace router of the tenant and its fallback, the trace router
+// is reached through the cluster created by Istio for its service
+func generateLuaTraceRouter(tenantSettings settings.TenantSettings) string {
+	traceRouter := tenantSettings.GetTraceRouter()
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("local trace_router_cluster = %q\n", fmt.Sprintf("outbound|%d||%s", traceRouter.Port, traceRouter.Host())))
+	sb.WriteString(fmt.Sprintf("local trace_router_authority = %q\n", traceRouter.Host()))
+	sb.WriteString(fmt.Sprintf("local trace_router_timeout = %d\n", traceRouter.TimeoutMs))
+	sb.WriteString(fmt.Sprintf("local reject_without_trace_router = %t\n", traceRouter.Fallback == settings.RejectTraceRouterFallback))
+	sb.WriteString(luaURLEncodeFunction)
+	return sb.String()
+}
+
+func getInboundRequestTraceIDFilter(tenantSettings settings.TenantSettings) string {
+	return fmt.Sprintf(inboundRequestTraceIDFilterTemplate, generateLuaTraceHeaders(tenantSettings))
+}
+
+// generateLuaBaselineDestinations renders the baseline x-kardinal-destination value of each service, so the Lua
+// fallback uses the same (possibly truncated and hashed) names as the rendered routes
+func generateLuaBaselineDestinations(baselineDestinations map[string]string) string {
+	var sb strings.Builder
+	sb.WriteString("local baseline_destinations = {")
+	hostnames := lo.Keys(baselineDestinations)
+	sort.Strings(hostnames)
+	for i, hostname := range hostnames {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(fmt.Sprintf("[%q] = %q", hostname, baselineDestinations[hostname]))
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
+
+// indentLua prefixes every line of the Lua code, so a block can be reused at a deeper nesting level
+func indentLua(code string, prefix string) string {
+	lines := strings.Split(code, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// generateLuaTraceIDFunctions renders the trace ID functions of a filter, the salt derived from the filter name keeps
+// the filters of different workloads from seeding their generators the same way
+func generateLuaTraceIDFunctions(tenantSettings settings.TenantSettings, filterName string) string {
+	saltHash := fnv.New32a()
+	saltHash.Write([]byte(filterName))
+	return fmt.Sprintf(luaTraceIDFunctions, tenantSettings.TraceID.Traceparent, saltHash.Sum32()%luaRandomSeedModulus)
+}
+
+// getOutgoingRequestTraceIDFilter returns the Lua filter setting the destination of the requests sent by a service (or
+// the waypoint), the requests without a trace ID get a generated one when generateMissingTraceID is set and are
+// rejected otherwise
+func getOutgoingRequestTraceIDFilter(
+	serviceID string,
+	baselineHostName string,
+	baselineDestinations map[string]string,
+	flowDestinations map[string]map[string]string,
+	tenantSettings settings.TenantSettings,
+	generateMissingTraceID bool,
+) string {
+	traceIDFunctions := ""
+	missingTraceID := luaMissingTraceIDRejection
+	if generateMissingTraceID {
+		traceIDFunctions = generateLuaTraceIDFunctions(tenantSettings, serviceID)
+		missingTraceID = luaMissingTraceIDGeneration
+	}
+	traceID := fmt.Sprintf(luaRequiredTraceIDTemplate, missingTraceID)
+	destinationFunction := fmt.Sprintf(luaTraceRouterDestinationTemplate, baselineHostName)
+
+	// the flows are routed with the propagated flow ID, the requests without a trace ID go through unchanged
+	if isFlowHeaderRouting(tenantSettings) {
+		traceIDFunctions = ""
+		traceID = luaOptionalTraceID
+		destinationFunction = generateLuaFlowHeaderDestination(flowDestinations, tenantSettings.FlowRoutingMode)
+	}
+
+	return fmt.Sprintf(
+		outgoingRequestTraceIDFilterTemplate,
+		generateLuaTraceHeaders(tenantSettings),
+		generateLuaTraceRouter(tenantSettings),
+		generateLuaBaselineDestinations(baselineDestinations),
+		traceIDFunctions,
+		traceID,
+		destinationFunction,
+		baselineHostName,
+	)
 }
@@ -1,9 +1,8 @@
 package flow
 
 import (
+	"context"
 	"fmt"
-	corev1 "k8s.io/api/core/v1"
-	kardinal "kardinal.kontrol-service/types/kardinal"
 
 	"kardinal.kontrol-service/constants"
 
@@ -22,6 +21,7 @@ import (
 // baseClusterTopologyMaybeWithTemplateOverrides - if a template is used then this is a modified version of the baseTopology
 // we pass in the base topology anyway as we use services which remain in `prod` version from it
 func CreateDevFlow(
+	ctx context.Context,
 	pluginRunner *plugins.PluginRunner,
 	baseClusterTopologyMaybeWithTemplateOverrides resolved.ClusterTopology,
 	baseTopology resolved.ClusterTopology,
@@ -48,7 +48,7 @@ func CreateDevFlow(
 
 	topologyRef := &topology
 
-	if err := applyPatch(pluginRunner, topologyRef, flowID, flowPatch.ServicePatches); err != nil {
+	if err := applyPatch(ctx, pluginRunner, topologyRef, flowID, flowPatch.ServicePatches); err != nil {
 		return nil, err
 	}
 
@@ -131,6 +131,7 @@ func markParentsAsShared(topology *resolved.ClusterTopology, service *resolved.S
 }
 
 func applyPatch(
+	ctx context.Context,
 	pluginRunner *plugins.PluginRunner,
 	topologyRef *resolved.ClusterTopology,
 	flowID string,
@@ -336,58 +337,11 @@ func applyPatch(
 	}
 
 	// SECTION 5 - Execute plugins and update the services deployment specs with the plugin's modifications
-	for pluginServiceName, serviceIds := range pluginServices {
-		var servicesServiceSpecs []corev1.ServiceSpec
-		var servicesWorkloadSpecs []*kardinal.WorkloadSpec
-		var servicesToUpdate []*resolved.Service
-
-		plugin, ok := pluginServicesMap[pluginServiceName]
-		if !ok {
-			return stacktrace.NewError("expected to find plugin with service name '%s' in the plugins service map, this is a bug in Kardinal", pluginServiceName)
-		}
-
-		if len(serviceIds) == 0 {
-			return stacktrace.NewError("expected to find at least one service depending on plugin '%s' but none was found, please review your manifest file", plugin.ServiceName)
-		}
-
-		for _, serviceId := range serviceIds {
-			service, err := topologyRef.GetService(serviceId)
-			if err != nil {
-				return stacktrace.Propagate(err, "an error occurred getting service '%s' from topology", serviceId)
-			}
-			servicesServiceSpecs = append(servicesServiceSpecs, *service.ServiceSpec)
-			servicesWorkloadSpecs = append(servicesWorkloadSpecs, service.WorkloadSpec)
-			servicesToUpdate = append(servicesToUpdate, service)
-		}
-
-		pluginId := plugins.GetPluginId(plugin.ServiceName, flowID)
-		logrus.Infof("Calling plugin '%v'...", pluginId)
-
-		servicesModifiedWorkloadSpecs, _, err := pluginRunner.CreateFlow(plugin.Name, servicesServiceSpecs, servicesWorkloadSpecs, pluginId, plugin.Args)
-		if err != nil {
-			return stacktrace.Propagate(err, "error when creating plugin flow for plugin '%s'", pluginId)
-		}
-
-		if len(servicesToUpdate) != len(servicesModifiedWorkloadSpecs) {
-			return fmt.Errorf("an error occurred executing plugin '%s', the number of workload specs returned by the plugin.CreateFlow function are not equal to the number of service depending on it, please check the plugin code or report a bug in the Kardinal repository", plugin.ServiceName)
-		}
-
-		// updating the service.workload_spec after the plugin execution
-		for serviceIndex := range serviceIds {
-			service := servicesToUpdate[serviceIndex]
-			modifiedWorkloadSpec := servicesModifiedWorkloadSpecs[serviceIndex]
-			service.WorkloadSpec = modifiedWorkloadSpec
-			if err = topologyRef.MoveServiceToVersion(service, flowID); err != nil {
-				return fmt.Errorf("an error occurred updating service '%s'", service.ServiceID)
-			}
-		}
-	}
-
-	return nil
+	return executePlugins(ctx, pluginRunner, topologyRef, flowID, pluginServices, pluginServicesMap)
 }
 
-func DeleteFlow(pluginRunner *plugins.PluginRunner, topology resolved.ClusterTopology, flowId string) error {
-	pluginsToDeleteFromThisFlow := map[string]string{}
+func DeleteFlow(ctx context.Context, pluginRunner *plugins.PluginRunner, topology resolved.ClusterTopology, flowId string) error {
+	pluginsToDeleteFromThisFlow := map[string]*resolved.StatefulPlugin{}
 
 	for _, service := range topology.Services {
 		// don't need to delete flow for services in the topology that aren't a part of this flow
@@ -396,15 +350,19 @@ func DeleteFlow(pluginRunner *plugins.PluginRunner, topology resolved.ClusterTop
 		}
 		for _, plugin := range service.StatefulPlugins {
 			pluginId := plugins.GetPluginId(plugin.ServiceName, flowId)
-			pluginsToDeleteFromThisFlow[pluginId] = plugin.Name
+			pluginsToDeleteFromThisFlow[pluginId] = plugin
 		}
 	}
 
-	for pluginId, pluginName := range pluginsToDeleteFromThisFlow {
-		err := pluginRunner.DeleteFlow(pluginName, pluginId)
+	for pluginId, plugin := range pluginsToDeleteFromThisFlow {
+		pluginTimeout, err := plugin.GetTimeout()
+		if err != nil {
+			return err
+		}
+		err = pluginRunner.DeleteFlow(ctx, plugin.Name, pluginId, pluginTimeout)
 		if err != nil {
 			logrus.Errorf("Error deleting flow: %v.", err)
-			return stacktrace.Propagate(err, "An error occurred while trying to call delete flow of plugin '%v' for flow '%v'", pluginName, flowId)
+			return stacktrace.Propagate(err, "An error occurred while trying to call delete flow of plugin '%v' for flow '%v'", plugin.Name, flowId)
 		}
 	}
 
@@ -1,6 +1,7 @@
 package flow
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -619,16 +620,23 @@ func assertStatefulServices(t *testing.T, originalCluster *resolved.ClusterTopol
 }
 
 func getPluginRunner(t *testing.T) (*plugins.PluginRunner, func() error) {
+	return getPluginRunnerWithLimits(t, plugins.PluginLimits{})
+}
+
+func getPluginRunnerWithLimits(t *testing.T, limits plugins.PluginLimits) (*plugins.PluginRunner, func() error) {
+	pluginHost, err := plugins.NewPluginHost(plugins.PluginHostConfig{Limits: limits, WorkDir: t.TempDir()})
+	require.NoError(t, err)
 	db, cleanUpDbFunc, err := database.NewSQLiteDB()
 	require.NoError(t, err)
 	err = db.Clear()
 	require.NoError(t, err)
-	err = db.AutoMigrate(&database.Tenant{}, &database.Flow{}, &database.PluginConfig{})
+	err = db.AutoMigrate(&database.Tenant{}, &database.Flow{}, &database.PluginConfig{}, &database.PluginCredential{})
 	require.NoError(t, err)
 	_, err = db.GetOrCreateTenant("tenant-test")
 	require.NoError(t, err)
 	pluginRunner := plugins.NewPluginRunner(
 		plugins.NewMockGitPluginProvider(plugins.MockGitHub),
+		pluginHost,
 		"tenant-test",
 		db,
 	)
@@ -729,7 +737,7 @@ func TestDevFlowImmutability(t *testing.T) {
 		},
 	}
 
-	devCluster, err := CreateDevFlow(pluginRunner, cluster, cluster, flowSpec)
+	devCluster, err := CreateDevFlow(context.Background(), pluginRunner, cluster, cluster, flowSpec)
 	require.NoError(t, err)
 
 	devCheckoutservice := getServiceRef(devCluster, "checkoutservice")
@@ -780,7 +788,7 @@ func TestFlowMerging(t *testing.T) {
 		},
 	}
 
-	devCluster, err := CreateDevFlow(pluginRunner, cluster, cluster, flowSpec)
+	devCluster, err := CreateDevFlow(context.Background(), pluginRunner, cluster, cluster, flowSpec)
 	require.NoError(t, err)
 	require.Equal(t, len(cluster.Services), len(devCluster.Services))
 	require.Equal(t, len(cluster.ServiceDependencies), len(devCluster.ServiceDependencies))
@@ -819,7 +827,7 @@ func TestExternalServicesFlowOnDependentService(t *testing.T) {
 		},
 	}
 
-	newClusterTopology, err := CreateDevFlow(pluginRunner, cluster, cluster, flowSpec)
+	newClusterTopology, err := CreateDevFlow(context.Background(), pluginRunner, cluster, cluster, flowSpec)
 	require.NoError(t, err)
 
 	// the topology should have the same amount of services
@@ -852,7 +860,7 @@ func TestExternalServicesCreateDevFlowOnNotDependentService(t *testing.T) {
 		},
 	}
 
-	newClusterTopology, err := CreateDevFlow(pluginRunner, cluster, cluster, flowSpec)
+	newClusterTopology, err := CreateDevFlow(context.Background(), pluginRunner, cluster, cluster, flowSpec)
 	require.NoError(t, err)
 
 	// topology should have same amount of services
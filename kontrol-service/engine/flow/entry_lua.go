@@ -0,0 +1,212 @@
+package flow
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/samber/lo"
+
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	"kardinal.kontrol-service/types/settings"
+)
+
+// luaFlowLookup generates the Lua code used by the inbound filter of a flow to find if a request entered the flow
+// With the subdomain entry strategy the requests are matched by hostname, with the other strategies and with the
+// sticky flow cookie they are matched by the flow ID found in the header set by the gateway, the join link query
+// parameter, the path prefix or the cookie
+// The canary requests sent to a flow from the baseline entry points are matched by the flow ID header set by the gateway,
+// the baseline flow doesn't match them
+type luaFlowLookup struct {
+	flowID         string
+	hostnames      []string
+	entryStrategy  resolved.FlowEntryStrategy
+	stickyCookie   settings.StickyFlowCookieSettings
+	useFlowIDCheck bool
+	canary         bool
+	canaryFlowIDs  []string
+}
+
+func newLuaFlowLookup(flowID string, hostnames []string, tenantSettings settings.TenantSettings) *luaFlowLookup {
+	return &luaFlowLookup{
+		flowID:         flowID,
+		hostnames:      hostnames,
+		entryStrategy:  tenantSettings.FlowEntryStrategy,
+		stickyCookie:   tenantSettings.StickyFlowCookie,
+		useFlowIDCheck: tenantSettings.FlowEntryStrategy != resolved.SubdomainEntryStrategy || tenantSettings.StickyFlowCookie.Enabled,
+	}
+}
+
+// setCanaries sets the flows receiving canary traffic from the baseline flow entry points
+func (l *luaFlowLookup) setCanaries(canaryFlowIDs []string, baselineFlowID string) {
+	if len(canaryFlowIDs) == 0 {
+		return
+	}
+	if l.flowID == baselineFlowID {
+		l.canaryFlowIDs = canaryFlowIDs
+		l.useFlowIDCheck = true
+	}
+	if lo.Contains(canaryFlowIDs, l.flowID) {
+		l.canary = true
+		l.useFlowIDCheck = true
+	}
+}
+
+// condition returns the Lua condition matching the requests of the flow
+func (l *luaFlowLookup) condition() string {
+	condition := l.entryCondition()
+	if len(l.canaryFlowIDs) == 0 || condition == "false" {
+		return condition
+	}
+	canaryConditions := lo.Map(l.canaryFlowIDs, func(flowID string, _ int) string { return fmt.Sprintf(`flow_id == "%s"`, flowID) })
+	return fmt.Sprintf("(%s) and not (%s)", condition, strings.Join(canaryConditions, " or "))
+}
+
+func (l *luaFlowLookup) entryCondition() string {
+	conditions := []string{}
+	if l.entryStrategy == resolved.SubdomainEntryStrategy {
+		for _, hostname := range l.hostnames {
+			conditions = append(conditions, fmt.Sprintf(`hostname == "%s"`, hostname))
+		}
+	}
+	if l.useFlowIDCheck {
+		conditions = append(conditions, fmt.Sprintf(`flow_id == "%s"`, l.flowID))
+	}
+	if len(conditions) == 0 {
+		return "false"
+	}
+	return strings.Join(conditions, " or ")
+}
+
+// sharedCondition returns the Lua condition matching the requests of the flow a shared service was created for
+func (l *luaFlowLookup) sharedCondition(originalFlowID string) string {
+	if l.entryStrategy == resolved.SubdomainEntryStrategy {
+		if l.canary && originalFlowID == l.flowID {
+			return fmt.Sprintf(`hostname == "%s" or flow_id == "%s"`, originalFlowID, originalFlowID)
+		}
+		return fmt.Sprintf(`hostname == "%s"`, originalFlowID)
+	}
+	return fmt.Sprintf(`flow_id == "%s"`, originalFlowID)
+}
+
+// functions returns the Lua functions used to find the flow ID of a request, the flow path prefix is removed from the
+// request path when it's found there
+func (l *luaFlowLookup) functions() string {
+	if !l.useFlowIDCheck {
+		return ""
+	}
+
+	var pathPrefixLookup string
+	if l.entryStrategy != resolved.SubdomainEntryStrategy {
+		pathPrefixLookup = fmt.Sprintf(`
+  local flow_path_prefix = "%s"
+  if path:sub(1, #flow_path_prefix) == flow_path_prefix then
+    local rest = path:sub(#flow_path_prefix + 1)
+    local next_char = rest:sub(1, 1)
+    if next_char == "" or next_char == "/" or next_char == "?" then
+      if next_char ~= "/" then
+        rest = "/" .. rest
+      end
+      headers:replace(":path", rest)
+      headers:replace(flow_id_header, "%s")
+      return "%s"
+    end
+  end
+`, resolved.FlowPathPrefix(l.flowID), l.flowID, l.flowID)
+	}
+
+	var cookieLookup string
+	if l.stickyCookie.Enabled {
+		cookieLookup = `
+  local cookie_flow_id = get_cookie_flow_id(headers)
+  if cookie_flow_id then
+    return cookie_flow_id
+  end
+`
+	}
+
+	return fmt.Sprintf(`
+local flow_id_header = "%s"
+%s
+function get_flow_id(headers)
+  local flow_id = headers:get(flow_id_header)
+  if flow_id then
+    return flow_id
+  end
+
+  local path = headers:get(":path") or ""
+  local query_flow_id = path:match("[?&]%s=([^&]+)")
+  if query_flow_id then
+    return query_flow_id
+  end
+%s%s
+  return nil
+end
+`, flowIDHeader, generateLuaCookieFlowIDFunction(), escapeLuaPattern(resolved.FlowQueryParamName), pathPrefixLookup, cookieLookup)
+}
+
+// lookup returns the Lua code setting the flow_id variable, and the sticky cookie of the response when the request
+// entered the flow without it
+func (l *luaFlowLookup) lookup() string {
+	if !l.useFlowIDCheck {
+		return ""
+	}
+
+	var lookup strings.Builder
+	lookup.WriteString(`  local flow_id = get_flow_id(headers)
+`)
+	if l.stickyCookie.Enabled {
+		lookup.WriteString(fmt.Sprintf(`  if (%s) and get_cookie_flow_id(headers) ~= "%s" then
+    request_handle:streamInfo():dynamicMetadata():set("%s", "set_cookie", "%s")
+  end
+`, l.condition(), l.flowID, l.metadataNamespace(), l.cookie()))
+	}
+	return lookup.String()
+}
+
+// responseFunction returns the Lua function adding the sticky cookie to the responses of the requests that entered
+// the flow without it
+func (l *luaFlowLookup) responseFunction() string {
+	if !l.stickyCookie.Enabled {
+		return ""
+	}
+	return fmt.Sprintf(`
+function envoy_on_response(response_handle)
+  local metadata = response_handle:streamInfo():dynamicMetadata():get("%s")
+  if metadata and metadata["set_cookie"] then
+    response_handle:headers():add("set-cookie", metadata["set_cookie"])
+  end
+end
+`, l.metadataNamespace())
+}
+
+// metadataNamespace is specific to the flow, the filters of all the flows served by a workload share the metadata
+func (l *luaFlowLookup) metadataNamespace() string {
+	return "kardinal.flow." + l.flowID
+}
+
+func (l *luaFlowLookup) cookie() string {
+	// the cookie is only read by the gateways and the inbound filters, the scripts of the pages never need it
+	cookie := fmt.Sprintf("%s=%s; Path=/; SameSite=Lax; Secure; HttpOnly", resolved.FlowCookieName, l.flowID)
+	if l.stickyCookie.Domain != "" {
+		cookie += "; Domain=" + l.stickyCookie.Domain
+	}
+	return cookie
+}
+
+// generateLuaCookieFlowIDFunction returns the Lua function reading the flow ID from the sticky flow cookie
+func generateLuaCookieFlowIDFunction() string {
+	return fmt.Sprintf(`
+function get_cookie_flow_id(headers)
+  local cookie = headers:get("cookie")
+  if not cookie then
+    return nil
+  end
+  return ("; " .. cookie):match(";%%s*%s=([^;]+)")
+end
+`, escapeLuaPattern(resolved.FlowCookieName))
+}
+
+// escapeLuaPattern escapes the magic characters used in the names put in Lua patterns
+func escapeLuaPattern(value string) string {
+	return strings.NewReplacer("-", "%-", ".", "%.").Replace(value)
+}
@@ -0,0 +1,304 @@
+package flow
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	net "k8s.io/api/networking/v1"
+	gateway "sigs.k8s.io/gateway-api/apis/v1"
+
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	"kardinal.kontrol-service/types/settings"
+)
+
+const maxHTTPRouteRuleMatches = 8
+
+// flowRouteSpec is a copy of a gateway route used to enter a flow
+type flowRouteSpec struct {
+	nameSuffix string
+	spec       *gateway.HTTPRouteSpec
+}
+
+func (r flowRouteSpec) getName(routeId int, flowID string) string {
+	name := fmt.Sprintf("http-route-%d", routeId)
+	if r.nameSuffix == "" {
+		return resolved.DNSLabel(name, flowID)
+	}
+	return resolved.DNSLabel(name, flowID, r.nameSuffix)
+}
+
+// getFlowRouteSpecs returns the copies of the gateway route used to enter a flow, with the sticky flow cookie there is
+// an extra copy matching the cookie on the original hostnames (the header strategy matches the cookie already)
+func getFlowRouteSpecs(
+	routeSpecOriginal *gateway.HTTPRouteSpec,
+	flowID string,
+	baselineFlowID string,
+	tenantSettings settings.TenantSettings,
+	alwaysSetFlowHeader bool,
+) []flowRouteSpec {
+	strategy := tenantSettings.FlowEntryStrategy
+
+	routeSpec := routeSpecOriginal.DeepCopy()
+	setFlowEntry(routeSpec, flowID, baselineFlowID, strategy)
+	// the inbound filters of the front services find the flow in this header when the hostnames are shared by all flows
+	if alwaysSetFlowHeader || strategy != resolved.SubdomainEntryStrategy || tenantSettings.StickyFlowCookie.Enabled {
+		setFlowHeader(routeSpec.Rules, flowID)
+	}
+	routeSpecs := []flowRouteSpec{{spec: routeSpec}}
+
+	if tenantSettings.StickyFlowCookie.Enabled && flowID != baselineFlowID && strategy != resolved.HeaderEntryStrategy {
+		stickyRouteSpec := routeSpecOriginal.DeepCopy()
+		stickyRouteSpec.Rules = getFlowCookieRules(stickyRouteSpec.Rules, flowID)
+		setFlowHeader(stickyRouteSpec.Rules, flowID)
+		routeSpecs = append(routeSpecs, flowRouteSpec{nameSuffix: "sticky", spec: stickyRouteSpec})
+	}
+
+	return routeSpecs
+}
+
+// setFlowEntry changes a gateway route copied for a flow so it only matches the requests entering the flow with the
+// entry strategy, the baseline flow keeps the original matches with the path prefix and header strategies
+func setFlowEntry(routeSpec *gateway.HTTPRouteSpec, flowID string, baselineFlowID string, strategy resolved.FlowEntryStrategy) {
+	switch strategy {
+	case resolved.PathPrefixEntryStrategy:
+		if flowID != baselineFlowID {
+			routeSpec.Rules = getFlowPathPrefixRules(routeSpec.Rules, flowID)
+		}
+	case resolved.HeaderEntryStrategy:
+		if flowID != baselineFlowID {
+			routeSpec.Rules = getFlowHeaderRules(routeSpec.Rules, flowID)
+		}
+	default:
+		routeSpec.Hostnames = lo.Map(routeSpec.Hostnames, func(hostname gateway.Hostname, _ int) gateway.Hostname {
+			return gateway.Hostname(resolved.ReplaceOrAddSubdomain(string(hostname), flowID))
+		})
+	}
+}
+
+// getFlowPathPrefixRules returns a rule for each match of the rules, the matches get the flow path prefix and the rules
+// remove it before sending the requests to the backends
+func getFlowPathPrefixRules(rules []gateway.HTTPRouteRule, flowID string) []gateway.HTTPRouteRule {
+	flowRules := []gateway.HTTPRouteRule{}
+	for _, rule := range rules {
+		matches := rule.Matches
+		if len(matches) == 0 {
+			matches = []gateway.HTTPRouteMatch{{}}
+		}
+
+		for _, match := range matches {
+			flowRule := rule.DeepCopy()
+			flowMatch := match.DeepCopy()
+
+			pathMatch := lo.FromPtr(flowMatch.Path)
+			matchType := lo.FromPtr(pathMatch.Type)
+			if matchType == "" {
+				matchType = gateway.PathMatchPathPrefix
+			}
+			path := lo.FromPtr(pathMatch.Value)
+			if path == "" {
+				path = "/"
+			}
+
+			var pathModifier *gateway.HTTPPathModifier
+			switch matchType {
+			case gateway.PathMatchPathPrefix:
+				pathModifier = &gateway.HTTPPathModifier{
+					Type:               gateway.PrefixMatchHTTPPathModifier,
+					ReplacePrefixMatch: lo.ToPtr(path),
+				}
+			case gateway.PathMatchExact:
+				pathModifier = &gateway.HTTPPathModifier{
+					Type:            gateway.FullPathHTTPPathModifier,
+					ReplaceFullPath: lo.ToPtr(path),
+				}
+			default:
+				logrus.Warnf("Path '%s' of type '%s' can't be rewritten, the requests of flow '%s' will keep the '%s' prefix", path, matchType, flowID, resolved.FlowPathPrefix(flowID))
+			}
+
+			flowMatch.Path = &gateway.HTTPPathMatch{
+				Type:  lo.ToPtr(matchType),
+				Value: lo.ToPtr(resolved.AddFlowPathPrefix(path, flowID)),
+			}
+			flowRule.Matches = []gateway.HTTPRouteMatch{*flowMatch}
+			if pathModifier != nil {
+				setURLRewritePath(flowRule, pathModifier, flowID)
+			}
+			flowRules = append(flowRules, *flowRule)
+		}
+	}
+	return flowRules
+}
+
+// setURLRewritePath sets the path rewrite of the rule, a rule can only have one URL rewrite filter so an existing one
+// is reused if it doesn't rewrite the path already
+func setURLRewritePath(rule *gateway.HTTPRouteRule, pathModifier *gateway.HTTPPathModifier, flowID string) {
+	for filterIx, filter := range rule.Filters {
+		if filter.Type != gateway.HTTPRouteFilterURLRewrite || filter.URLRewrite == nil {
+			continue
+		}
+		if filter.URLRewrite.Path != nil {
+			logrus.Warnf("Route rule already rewrites the path, the requests of flow '%s' will keep the '%s' prefix", flowID, resolved.FlowPathPrefix(flowID))
+			return
+		}
+		filter.URLRewrite.Path = pathModifier
+		rule.Filters[filterIx] = filter
+		return
+	}
+
+	rule.Filters = append(rule.Filters, gateway.HTTPRouteFilter{
+		Type: gateway.HTTPRouteFilterURLRewrite,
+		URLRewrite: &gateway.HTTPURLRewriteFilter{
+			Path: pathModifier,
+		},
+	})
+}
+
+// getFlowHeaderRules returns the rules with each match duplicated, the copies require the flow ID header, the flow
+// cookie or the flow query parameter
+func getFlowHeaderRules(rules []gateway.HTTPRouteRule, flowID string) []gateway.HTTPRouteRule {
+	return getFlowMatchRules(rules, flowID, []gateway.HTTPHeaderMatch{getFlowHeaderMatch(flowID), getFlowCookieMatch(flowID)})
+}
+
+// getFlowCookieRules returns the rules with each match duplicated, the copies require the flow cookie or the flow
+// query parameter
+func getFlowCookieRules(rules []gateway.HTTPRouteRule, flowID string) []gateway.HTTPRouteRule {
+	return getFlowMatchRules(rules, flowID, []gateway.HTTPHeaderMatch{getFlowCookieMatch(flowID)})
+}
+
+func getFlowMatchRules(rules []gateway.HTTPRouteRule, flowID string, headerMatches []gateway.HTTPHeaderMatch) []gateway.HTTPRouteRule {
+	return lo.Map(rules, func(rule gateway.HTTPRouteRule, _ int) gateway.HTTPRouteRule {
+		flowRule := rule.DeepCopy()
+		matches := flowRule.Matches
+		if len(matches) == 0 {
+			matches = []gateway.HTTPRouteMatch{{}}
+		}
+
+		flowMatches := []gateway.HTTPRouteMatch{}
+		for _, match := range matches {
+			for _, headerMatch := range headerMatches {
+				flowMatch := match.DeepCopy()
+				flowMatch.Headers = append(flowMatch.Headers, headerMatch)
+				flowMatches = append(flowMatches, *flowMatch)
+			}
+			queryMatch := match.DeepCopy()
+			queryMatch.QueryParams = append(queryMatch.QueryParams, gateway.HTTPQueryParamMatch{
+				Type:  lo.ToPtr(gateway.QueryParamMatchExact),
+				Name:  gateway.HTTPHeaderName(resolved.FlowQueryParamName),
+				Value: flowID,
+			})
+			flowMatches = append(flowMatches, *queryMatch)
+		}
+		if len(flowMatches) > maxHTTPRouteRuleMatches {
+			logrus.Warnf("Route rule of flow '%s' has %d matches, more than the %d allowed by the Gateway API", flowID, len(flowMatches), maxHTTPRouteRuleMatches)
+		}
+		flowRule.Matches = flowMatches
+		return *flowRule
+	})
+}
+
+func getFlowHeaderMatch(flowID string) gateway.HTTPHeaderMatch {
+	return gateway.HTTPHeaderMatch{
+		Type:  lo.ToPtr(gateway.HeaderMatchExact),
+		Name:  gateway.HTTPHeaderName(resolved.FlowHeaderName),
+		Value: flowID,
+	}
+}
+
+func getFlowCookieMatch(flowID string) gateway.HTTPHeaderMatch {
+	return gateway.HTTPHeaderMatch{
+		Type:  lo.ToPtr(gateway.HeaderMatchRegularExpression),
+		Name:  "cookie",
+		Value: fmt.Sprintf(`(^|;\s*)%s=%s(;|$)`, regexp.QuoteMeta(resolved.FlowCookieName), regexp.QuoteMeta(flowID)),
+	}
+}
+
+// setFlowHeader makes the rules set the flow ID header on the requests, replacing the one sent by the client
+func setFlowHeader(rules []gateway.HTTPRouteRule, flowID string) {
+	for ruleIx, rule := range rules {
+		rule.Filters = setFilterFlowHeader(rule.Filters, flowID)
+		rules[ruleIx] = rule
+	}
+}
+
+// setFilterFlowHeader returns the filters of a rule or a backend setting the flow ID header too, they can only have
+// one request header modifier filter
+func setFilterFlowHeader(filters []gateway.HTTPRouteFilter, flowID string) []gateway.HTTPRouteFilter {
+	flowHeader := gateway.HTTPHeader{
+		Name:  gateway.HTTPHeaderName(resolved.FlowHeaderName),
+		Value: flowID,
+	}
+
+	_, filterIx, found := lo.FindIndexOf(filters, func(filter gateway.HTTPRouteFilter) bool {
+		return filter.Type == gateway.HTTPRouteFilterRequestHeaderModifier && filter.RequestHeaderModifier != nil
+	})
+	if found {
+		modifier := filters[filterIx].RequestHeaderModifier
+		modifier.Set = append(lo.Filter(modifier.Set, func(header gateway.HTTPHeader, _ int) bool {
+			return string(header.Name) != resolved.FlowHeaderName
+		}), flowHeader)
+		return filters
+	}
+	return append(filters, gateway.HTTPRouteFilter{
+		Type: gateway.HTTPRouteFilterRequestHeaderModifier,
+		RequestHeaderModifier: &gateway.HTTPHeaderFilter{
+			Set: []gateway.HTTPHeader{flowHeader},
+		},
+	})
+}
+
+// setIngressRuleFlowEntry changes an ingress rule copied for a flow so it only matches the requests entering the flow,
+// the ingresses can't rewrite the paths, the flow path prefix is removed by the inbound filter of the front service
+func setIngressRuleFlowEntry(rule *net.IngressRule, flowID string, baselineFlowID string, strategy resolved.FlowEntryStrategy) {
+	switch resolved.IngressEntryStrategy(strategy) {
+	case resolved.PathPrefixEntryStrategy:
+		if flowID == baselineFlowID || rule.HTTP == nil {
+			return
+		}
+		for pathIx, path := range rule.HTTP.Paths {
+			path.Path = resolved.AddFlowPathPrefix(path.Path, flowID)
+			rule.HTTP.Paths[pathIx] = path
+		}
+	default:
+		rule.Host = resolved.ReplaceOrAddSubdomain(rule.Host, flowID)
+	}
+}
+
+// getExternalFilterName returns the name of the filter setting the routing table of a flow, the hostnames are the
+// same for all the flows with the path prefix and header strategies so the flow ID is added
+func getExternalFilterName(hostnames []string, flowID string, strategy resolved.FlowEntryStrategy) string {
+	name := strings.Join(hostnames, "-")
+	if strategy == resolved.SubdomainEntryStrategy {
+		return name
+	}
+	return flowID + "-" + name
+}
+
+// GetFlowJoinLinks returns a link for each entry point of the flow, the flows entered with a header are joined with the
+// flow query parameter which is matched by the gateway routes too
+func GetFlowJoinLinks(entries []resolved.IngressAccessEntry, tenantSettings settings.TenantSettings) []string {
+	scheme := "http"
+	if tenantSettings.FlowTLS.CertManagerIssuer != "" || tenantSettings.FlowTLS.GatewayListeners {
+		scheme = "https"
+	}
+
+	links := lo.Map(entries, func(entry resolved.IngressAccessEntry, _ int) string {
+		link := url.URL{
+			Scheme: scheme,
+			Host:   entry.Hostname,
+			Path:   entry.PathPrefix + "/",
+		}
+		if entry.FlowHeader != "" {
+			link.RawQuery = url.Values{resolved.FlowQueryParamName: []string{entry.FlowID}}.Encode()
+		}
+		return link.String()
+	})
+
+	links = lo.Uniq(links)
+	sort.Strings(links)
+	return links
+}
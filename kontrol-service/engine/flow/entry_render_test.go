@@ -0,0 +1,181 @@
+package flow
+
+import (
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+	gateway "sigs.k8s.io/gateway-api/apis/v1"
+
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	"kardinal.kontrol-service/types/settings"
+)
+
+func getEntryTestRouteSpec() *gateway.HTTPRouteSpec {
+	return &gateway.HTTPRouteSpec{
+		Hostnames: []gateway.Hostname{"app.example.com"},
+		Rules: []gateway.HTTPRouteRule{
+			{
+				Matches: []gateway.HTTPRouteMatch{
+					{Path: &gateway.HTTPPathMatch{Type: lo.ToPtr(gateway.PathMatchPathPrefix), Value: lo.ToPtr("/api")}},
+					{Path: &gateway.HTTPPathMatch{Type: lo.ToPtr(gateway.PathMatchExact), Value: lo.ToPtr("/health")}},
+				},
+				BackendRefs: []gateway.HTTPBackendRef{getHTTPBackendRef("frontend", 8080)},
+			},
+		},
+	}
+}
+
+func getEntryTestSettings(strategy resolved.FlowEntryStrategy) settings.TenantSettings {
+	tenantSettings := settings.NewDefaultTenantSettings()
+	tenantSettings.FlowEntryStrategy = strategy
+	return tenantSettings
+}
+
+func TestFlowPathPrefixRouteRewrite(t *testing.T) {
+	routeSpec := getEntryTestRouteSpec()
+
+	flowRoutes := getFlowRouteSpecs(routeSpec, "dev-flow-1", "prod", getEntryTestSettings(resolved.PathPrefixEntryStrategy), false)
+	require.Len(t, flowRoutes, 1)
+	flowRouteSpec := flowRoutes[0].spec
+	// the hostnames are shared by the flows
+	require.Equal(t, []gateway.Hostname{"app.example.com"}, flowRouteSpec.Hostnames)
+
+	// each match gets its own rule so its path can be rewritten
+	require.Len(t, flowRouteSpec.Rules, 2)
+	prefixRule := flowRouteSpec.Rules[0]
+	require.Equal(t, "/flows/dev-flow-1/api", lo.FromPtr(prefixRule.Matches[0].Path.Value))
+	require.Equal(t, &gateway.HTTPPathModifier{Type: gateway.PrefixMatchHTTPPathModifier, ReplacePrefixMatch: lo.ToPtr("/api")}, getRuleURLRewrite(t, prefixRule).Path)
+	exactRule := flowRouteSpec.Rules[1]
+	require.Equal(t, "/flows/dev-flow-1/health", lo.FromPtr(exactRule.Matches[0].Path.Value))
+	require.Equal(t, &gateway.HTTPPathModifier{Type: gateway.FullPathHTTPPathModifier, ReplaceFullPath: lo.ToPtr("/health")}, getRuleURLRewrite(t, exactRule).Path)
+	// the requests entering the flow get the flow header
+	require.Equal(t, "dev-flow-1", getRuleFlowHeader(prefixRule))
+
+	// the baseline keeps the original matches
+	baselineRoutes := getFlowRouteSpecs(routeSpec, "prod", "prod", getEntryTestSettings(resolved.PathPrefixEntryStrategy), false)
+	require.Equal(t, routeSpec.Rules[0].Matches, baselineRoutes[0].spec.Rules[0].Matches)
+
+	// the original route is not modified
+	require.Equal(t, getEntryTestRouteSpec(), routeSpec)
+}
+
+func TestFlowPathPrefixRouteRewriteReusesTheURLRewriteFilter(t *testing.T) {
+	routeSpec := getEntryTestRouteSpec()
+	routeSpec.Rules[0].Matches = routeSpec.Rules[0].Matches[:1]
+	routeSpec.Rules[0].Filters = []gateway.HTTPRouteFilter{{
+		Type:       gateway.HTTPRouteFilterURLRewrite,
+		URLRewrite: &gateway.HTTPURLRewriteFilter{Hostname: lo.ToPtr(gateway.PreciseHostname("backend.example.com"))},
+	}}
+
+	flowRules := getFlowPathPrefixRules(routeSpec.Rules, "dev-flow-1")
+	require.Len(t, flowRules, 1)
+	require.Len(t, flowRules[0].Filters, 1)
+	urlRewrite := getRuleURLRewrite(t, flowRules[0])
+	require.Equal(t, gateway.PreciseHostname("backend.example.com"), lo.FromPtr(urlRewrite.Hostname))
+	require.Equal(t, "/api", lo.FromPtr(urlRewrite.Path.ReplacePrefixMatch))
+}
+
+func TestFlowHeaderRouteMatches(t *testing.T) {
+	routeSpec := getEntryTestRouteSpec()
+
+	flowRoutes := getFlowRouteSpecs(routeSpec, "dev-flow-1", "prod", getEntryTestSettings(resolved.HeaderEntryStrategy), false)
+	require.Len(t, flowRoutes, 1)
+	rule := flowRoutes[0].spec.Rules[0]
+	// the header, the cookie and the query parameter for each original match
+	require.Len(t, rule.Matches, 6)
+	require.Equal(t, []gateway.HTTPHeaderMatch{getFlowHeaderMatch("dev-flow-1")}, rule.Matches[0].Headers)
+	require.Equal(t, []gateway.HTTPHeaderMatch{getFlowCookieMatch("dev-flow-1")}, rule.Matches[1].Headers)
+	require.Equal(t, gateway.HTTPHeaderName(resolved.FlowQueryParamName), rule.Matches[2].QueryParams[0].Name)
+	require.Equal(t, "dev-flow-1", rule.Matches[2].QueryParams[0].Value)
+	for _, match := range rule.Matches[:3] {
+		require.Equal(t, "/api", lo.FromPtr(match.Path.Value))
+	}
+	require.Equal(t, "dev-flow-1", getRuleFlowHeader(rule))
+}
+
+func getRuleURLRewrite(t *testing.T, rule gateway.HTTPRouteRule) *gateway.HTTPURLRewriteFilter {
+	filter, found := lo.Find(rule.Filters, func(filter gateway.HTTPRouteFilter) bool {
+		return filter.Type == gateway.HTTPRouteFilterURLRewrite
+	})
+	require.True(t, found)
+	return filter.URLRewrite
+}
+
+func TestFlowEntryLuaLookup(t *testing.T) {
+	// the subdomain strategy matches the hostnames only
+	lookup := newLuaFlowLookup("dev-flow-1", []string{"dev-flow-1.app.example.com"}, getEntryTestSettings(resolved.SubdomainEntryStrategy))
+	require.Equal(t, `hostname == "dev-flow-1.app.example.com"`, lookup.condition())
+	require.Empty(t, lookup.functions())
+	require.Empty(t, lookup.lookup())
+
+	// the path prefix strategy finds the flow in the header, the query parameter or the path prefix, which is removed
+	lookup = newLuaFlowLookup("dev-flow-1", []string{"app.example.com"}, getEntryTestSettings(resolved.PathPrefixEntryStrategy))
+	require.Equal(t, `flow_id == "dev-flow-1"`, lookup.condition())
+	functions := lookup.functions()
+	require.Contains(t, functions, `local flow_id_header = "x-kardinal-flow"`)
+	require.Contains(t, functions, `path:match("[?&]kardinal%-flow=([^&]+)")`)
+	require.Contains(t, functions, `local flow_path_prefix = "/flows/dev-flow-1"`)
+	require.Contains(t, functions, `headers:replace(":path", rest)`)
+	require.Contains(t, lookup.lookup(), "local flow_id = get_flow_id(headers)")
+
+	// the header strategy uses the path prefix for the ingresses, which can't match headers
+	lookup = newLuaFlowLookup("dev-flow-1", []string{"app.example.com"}, getEntryTestSettings(resolved.HeaderEntryStrategy))
+	require.Equal(t, `flow_id == "dev-flow-1"`, lookup.condition())
+	require.Contains(t, lookup.functions(), `local flow_path_prefix = "/flows/dev-flow-1"`)
+}
+
+func TestFlowEntryLuaLookupWithCanaries(t *testing.T) {
+	tenantSettings := getEntryTestSettings(resolved.SubdomainEntryStrategy)
+
+	// the baseline flow doesn't match the canary requests of the flows
+	baselineLookup := newLuaFlowLookup("prod", []string{"app.example.com"}, tenantSettings)
+	baselineLookup.setCanaries([]string{"dev-flow-1"}, "prod")
+	require.Equal(t, `(hostname == "app.example.com" or flow_id == "prod") and not (flow_id == "dev-flow-1")`, baselineLookup.condition())
+
+	flowLookup := newLuaFlowLookup("dev-flow-1", []string{"dev-flow-1.app.example.com"}, tenantSettings)
+	flowLookup.setCanaries([]string{"dev-flow-1"}, "prod")
+	require.Equal(t, `hostname == "dev-flow-1.app.example.com" or flow_id == "dev-flow-1"`, flowLookup.condition())
+}
+
+func TestFlowEntryLuaStickyCookie(t *testing.T) {
+	tenantSettings := getEntryTestSettings(resolved.SubdomainEntryStrategy)
+	tenantSettings.StickyFlowCookie = settings.StickyFlowCookieSettings{Enabled: true, Domain: ".example.com"}
+
+	lookup := newLuaFlowLookup("dev-flow-1", []string{"dev-flow-1.app.example.com"}, tenantSettings)
+	require.Equal(t, `hostname == "dev-flow-1.app.example.com" or flow_id == "dev-flow-1"`, lookup.condition())
+	require.Equal(t, "kardinal-flow=dev-flow-1; Path=/; SameSite=Lax; Secure; HttpOnly; Domain=.example.com", lookup.cookie())
+	require.Contains(t, lookup.functions(), "local cookie_flow_id = get_cookie_flow_id(headers)")
+
+	// the cookie is only set on the responses of the requests entering the flow without it
+	require.Contains(t, lookup.lookup(), `if (hostname == "dev-flow-1.app.example.com" or flow_id == "dev-flow-1") and get_cookie_flow_id(headers) ~= "dev-flow-1" then`)
+	require.Contains(t, lookup.lookup(), `dynamicMetadata():set("kardinal.flow.dev-flow-1", "set_cookie", "kardinal-flow=dev-flow-1; Path=/; SameSite=Lax; Secure; HttpOnly; Domain=.example.com")`)
+	require.Contains(t, lookup.responseFunction(), `dynamicMetadata():get("kardinal.flow.dev-flow-1")`)
+
+	// the sticky routes match the cookie on the original hostnames
+	flowRoutes := getFlowRouteSpecs(getEntryTestRouteSpec(), "dev-flow-1", "prod", tenantSettings, false)
+	require.Len(t, flowRoutes, 2)
+	require.Equal(t, "http-route-0-dev-flow-1-sticky", flowRoutes[1].getName(0, "dev-flow-1"))
+	require.Equal(t, []gateway.Hostname{"app.example.com"}, flowRoutes[1].spec.Hostnames)
+	require.Equal(t, []gateway.HTTPHeaderMatch{getFlowCookieMatch("dev-flow-1")}, flowRoutes[1].spec.Rules[0].Matches[0].Headers)
+}
+
+func TestGetFlowJoinLinks(t *testing.T) {
+	entries := []resolved.IngressAccessEntry{
+		{FlowID: "dev-flow-1", Hostname: "dev-flow-1.app.example.com"},
+		{FlowID: "dev-flow-1", Hostname: "app.example.com", PathPrefix: "/flows/dev-flow-1"},
+		{FlowID: "dev-flow-1", Hostname: "app.example.com", FlowHeader: resolved.FlowHeaderName},
+		{FlowID: "dev-flow-1", Hostname: "dev-flow-1.app.example.com"},
+	}
+	tenantSettings := settings.NewDefaultTenantSettings()
+
+	require.Equal(t, []string{
+		"http://app.example.com/?kardinal-flow=dev-flow-1",
+		"http://app.example.com/flows/dev-flow-1/",
+		"http://dev-flow-1.app.example.com/",
+	}, GetFlowJoinLinks(entries, tenantSettings))
+
+	// https when the flow hostnames are covered by TLS
+	tenantSettings.FlowTLS.GatewayListeners = true
+	require.Equal(t, "https://dev-flow-1.app.example.com/", GetFlowJoinLinks(entries[:1], tenantSettings)[0])
+}
@@ -0,0 +1,220 @@
+package flow
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/samber/lo"
+
+	"kardinal.kontrol-service/constants"
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	"kardinal.kontrol-service/types/settings"
+)
+
+const (
+	// luaFlowHeaderFunctions read and write the flow ID in the x-kardinal-flow header
+	luaFlowHeaderFunctions = `
+function get_propagated_flow_id(headers)
+  return headers:get(propagated_flow_id_header)
+end
+
+function set_propagated_flow_id(headers, flow_id)
+  headers:replace(propagated_flow_id_header, flow_id)
+end
+
+function remove_propagated_flow_id(headers)
+  headers:remove(propagated_flow_id_header)
+end
+`
+
+	// luaBaggageFunctions read and write the flow ID as a member of the W3C baggage header, keeping the other members
+	luaBaggageFunctions = `
+function get_propagated_flow_id(headers)
+  local baggage = headers:get("baggage")
+  if not baggage then
+    return nil
+  end
+  for member in baggage:gmatch("[^,]+") do
+    local key, value = member:match("^%s*([^=%s]+)%s*=%s*([^;%s]*)")
+    if key == flow_baggage_key and value ~= "" then
+      return value
+    end
+  end
+  return nil
+end
+
+function get_other_baggage_members(headers)
+  local members = {}
+  local baggage = headers:get("baggage")
+  if baggage then
+    for member in baggage:gmatch("[^,]+") do
+      local key = member:match("^%s*([^=%s]+)")
+      if key and key ~= flow_baggage_key then
+        table.insert(members, (member:gsub("^%s+", "")))
+      end
+    end
+  end
+  return members
+end
+
+function set_propagated_flow_id(headers, flow_id)
+  local members = get_other_baggage_members(headers)
+  table.insert(members, flow_baggage_key .. "=" .. flow_id)
+  headers:replace("baggage", table.concat(members, ","))
+end
+
+function remove_propagated_flow_id(headers)
+  local members = get_other_baggage_members(headers)
+  if #members == 0 then
+    headers:remove("baggage")
+  else
+    headers:replace("baggage", table.concat(members, ","))
+  end
+end
+`
+
+	luaFlowHeaderDestinationFunction = `
+function determine_destination(request_handle, trace_id, hostname)
+  hostname = hostname:match("^([^:]+)")
+  local flow_id = get_propagated_flow_id(request_handle:headers())
+  if flow_id then
+    local destinations = flow_destinations[hostname:match("^([^.]+)")]
+    if destinations and destinations[flow_id] then
+      return destinations[flow_id]
+    end
+  end
+  return baseline_destination(hostname)
+end
+`
+)
+
+// isFlowHeaderRouting returns true when the flows are routed with the propagated flow ID instead of the trace router
+func isFlowHeaderRouting(tenantSettings settings.TenantSettings) bool {
+	return tenantSettings.FlowRoutingMode == settings.FlowHeaderRoutingMode || tenantSettings.FlowRoutingMode == settings.BaggageRoutingMode
+}
+
+// isTraceIDRequired returns true when the inner services reject the requests without a trace ID, the trace router
+// needs one to find the routing table of the request while the flow header routing modes only need it in the strict
+// trace ID mode
+func isTraceIDRequired(tenantSettings settings.TenantSettings) bool {
+	return !isFlowHeaderRouting(tenantSettings) || tenantSettings.TraceID.Mode == settings.StrictTraceIDMode
+}
+
+// getFlowDestinations returns the x-kardinal-destination of the flow versions of each service, by service ID and
+// flow ID, the shared versions are used by the flow they were created for
+func getFlowDestinations(services []*resolved.Service, baselineVersion string) map[string]map[string]string {
+	flowDestinations := map[string]map[string]string{}
+	for serviceID, serviceVersions := range lo.GroupBy(services, func(service *resolved.Service) string { return service.ServiceID }) {
+		destinations := getServiceFlowDestinations(serviceVersions, baselineVersion)
+		if len(destinations) > 0 {
+			flowDestinations[serviceID] = destinations
+		}
+	}
+	return flowDestinations
+}
+
+// getServiceFlowDestinations returns the versioned name of the flow versions of a service by flow ID
+func getServiceFlowDestinations(serviceVersions []*resolved.Service, baselineVersion string) map[string]string {
+	destinations := map[string]string{}
+	for _, service := range serviceVersions {
+		if service.Version == baselineVersion {
+			continue
+		}
+		flowID := service.Version
+		if service.Version == constants.SharedVersionVersionString {
+			flowID = service.OriginalVersionIfShared
+		}
+		destinations[flowID] = resolved.VersionedName(service.ServiceID, service.Version)
+	}
+	return destinations
+}
+
+// generateLuaFlowPropagation returns the get_propagated_flow_id and set_propagated_flow_id Lua functions of the
+// routing mode
+func generateLuaFlowPropagation(mode settings.FlowRoutingMode) string {
+	if mode == settings.BaggageRoutingMode {
+		return fmt.Sprintf("local flow_baggage_key = %q\n%s", resolved.FlowBaggageKey, luaBaggageFunctions)
+	}
+	return fmt.Sprintf("local propagated_flow_id_header = %q\n%s", flowIDHeader, luaFlowHeaderFunctions)
+}
+
+// generateLuaFlowDestinations renders the flow destinations table, sorted so the filters don't change between renders
+func generateLuaFlowDestinations(flowDestinations map[string]map[string]string) string {
+	var sb strings.Builder
+	sb.WriteString("local flow_destinations = {")
+	serviceIDs := lo.Keys(flowDestinations)
+	sort.Strings(serviceIDs)
+	for i, serviceID := range serviceIDs {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(fmt.Sprintf("\n  [%q] = {", serviceID))
+		flowIDs := lo.Keys(flowDestinations[serviceID])
+		sort.Strings(flowIDs)
+		for j, flowID := range flowIDs {
+			if j > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(fmt.Sprintf("[%q] = %q", flowID, flowDestinations[serviceID][flowID]))
+		}
+		sb.WriteString("}")
+	}
+	sb.WriteString("\n}")
+	return sb.String()
+}
+
+// generateLuaFlowHeaderDestination returns the determine_destination Lua function of the outbound filters in the
+// flow header routing modes, the destination is read from the flow destinations table with the propagated flow ID
+// so there is no call to the trace router
+func generateLuaFlowHeaderDestination(flowDestinations map[string]map[string]string, mode settings.FlowRoutingMode) string {
+	return fmt.Sprintf("%s\n%s%s", generateLuaFlowDestinations(flowDestinations), generateLuaFlowPropagation(mode), luaFlowHeaderDestinationFunction)
+}
+
+// getTopologyFlowIDs returns the baseline and the flows having a version of one of the services
+func getTopologyFlowIDs(services []*resolved.Service, baselineVersion string) []string {
+	flowIDs := []string{baselineVersion}
+	for _, destinations := range getFlowDestinations(services, baselineVersion) {
+		flowIDs = append(flowIDs, lo.Keys(destinations)...)
+	}
+	return flowIDs
+}
+
+// generateLuaKnownFlowIDs renders the set of the flow IDs a request can carry, sorted so the filters don't change
+// between renders
+func generateLuaKnownFlowIDs(flowIDs []string) string {
+	flowIDs = lo.Uniq(flowIDs)
+	sort.Strings(flowIDs)
+	return fmt.Sprintf("local known_flow_ids = {%s}", strings.Join(lo.Map(flowIDs, func(flowID string, _ int) string {
+		return fmt.Sprintf("[%q] = true", flowID)
+	}), ", "))
+}
+
+// generateFlowHeaderEntryLuaScript returns the inbound filter of the flow entry points in the flow header routing
+// modes, it writes the flow ID in the propagated header of the requests entering the flow. The requests not entering
+// it lose a propagated flow ID set by the client that isn't one of the known flows, the requests carrying a known
+// flow ID are the ones entering it through another filter of the workload or the calls made inside the flow.
+func generateFlowHeaderEntryLuaScript(flowLookup *luaFlowLookup, knownFlowIDs []string, tenantSettings settings.TenantSettings) string {
+	flowID := flowLookup.flowID
+
+	return fmt.Sprintf(`
+%s
+%s
+%s
+function envoy_on_request(request_handle)
+  local headers = request_handle:headers()
+  local hostname = headers:get(":authority")
+%s
+  if %s then
+    request_handle:logInfo("Request entered flow %s, Hostname: " .. (hostname or "none"))
+    set_propagated_flow_id(headers, "%s")
+  else
+    local propagated_flow_id = get_propagated_flow_id(headers)
+    if propagated_flow_id and not known_flow_ids[propagated_flow_id] then
+      request_handle:logWarn("Removing the unknown flow ID " .. propagated_flow_id .. " of the request")
+      remove_propagated_flow_id(headers)
+    end
+  end
+end
+%s`, flowLookup.functions(), generateLuaFlowPropagation(tenantSettings.FlowRoutingMode), generateLuaKnownFlowIDs(knownFlowIDs), flowLookup.lookup(), flowLookup.condition(), flowID, flowID, flowLookup.responseFunction())
+}
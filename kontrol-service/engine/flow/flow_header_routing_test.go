@@ -0,0 +1,87 @@
+package flow
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"kardinal.kontrol-service/constants"
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	"kardinal.kontrol-service/types/settings"
+)
+
+func TestGetFlowDestinations(t *testing.T) {
+	services := []*resolved.Service{
+		{ServiceID: "frontend", Version: "prod"},
+		{ServiceID: "frontend", Version: "dev-flow-1"},
+		{ServiceID: "backend", Version: "prod"},
+		{ServiceID: "backend", Version: constants.SharedVersionVersionString, IsShared: true, OriginalVersionIfShared: "dev-flow-2"},
+		{ServiceID: "postgres", Version: "prod"},
+	}
+
+	flowDestinations := getFlowDestinations(services, "prod")
+	require.Equal(t, map[string]map[string]string{
+		"frontend": {"dev-flow-1": "frontend-dev-flow-1"},
+		"backend":  {"dev-flow-2": resolved.VersionedName("backend", constants.SharedVersionVersionString)},
+	}, flowDestinations)
+
+	require.Equal(t, `local flow_destinations = {
+  ["backend"] = {["dev-flow-2"] = "backend-shared"},
+  ["frontend"] = {["dev-flow-1"] = "frontend-dev-flow-1"}
+}`, generateLuaFlowDestinations(flowDestinations))
+}
+
+func TestFlowHeaderRoutingLuaFilters(t *testing.T) {
+	services := []*resolved.Service{
+		{ServiceID: "frontend", Version: "prod"},
+		{ServiceID: "frontend", Version: "dev-flow-1"},
+	}
+
+	for _, mode := range []settings.FlowRoutingMode{settings.FlowHeaderRoutingMode, settings.BaggageRoutingMode} {
+		tenantSettings := settings.NewDefaultTenantSettings()
+		tenantSettings.FlowRoutingMode = mode
+
+		entryFilter := generateDynamicLuaScript(services, "dev-flow-1", "prod", []string{"dev-flow-1.app.example.com"}, nil, tenantSettings)
+		require.NotContains(t, entryFilter, "httpCall")
+		require.Contains(t, entryFilter, `set_propagated_flow_id(headers, "dev-flow-1")`)
+
+		// the client can't pick a flow that doesn't exist
+		require.Contains(t, entryFilter, `local known_flow_ids = {["dev-flow-1"] = true, ["prod"] = true}`)
+		require.Contains(t, entryFilter, "if propagated_flow_id and not known_flow_ids[propagated_flow_id] then")
+		require.Contains(t, entryFilter, "remove_propagated_flow_id(headers)")
+
+		// the requests without a trace ID are routed too, with or without the trace ID generation
+		for _, generateMissingTraceID := range []bool{false, true} {
+			outboundFilter := getOutgoingRequestTraceIDFilter("frontend", "prod", map[string]string{"frontend": "frontend-prod"}, getFlowDestinations(services, "prod"), tenantSettings, generateMissingTraceID)
+			require.NotContains(t, outboundFilter, "if not trace_id then")
+			require.NotContains(t, outboundFilter, "generate_trace_id")
+			require.Contains(t, outboundFilter, "if trace_id and source_header ~= trace_id_header then")
+		}
+		require.False(t, isTraceIDRequired(tenantSettings))
+
+		outboundFilter := getOutgoingRequestTraceIDFilter("frontend", "prod", map[string]string{"frontend": "frontend-prod"}, getFlowDestinations(services, "prod"), tenantSettings, false)
+		require.NotContains(t, outboundFilter, "httpCall")
+		require.Contains(t, outboundFilter, `["frontend"] = {["dev-flow-1"] = "frontend-dev-flow-1"}`)
+		if mode == settings.BaggageRoutingMode {
+			require.Contains(t, outboundFilter, `local flow_baggage_key = "kardinal-flow"`)
+			require.Contains(t, entryFilter, `headers:remove("baggage")`)
+		} else {
+			require.Contains(t, outboundFilter, `local propagated_flow_id_header = "x-kardinal-flow"`)
+			require.Contains(t, entryFilter, "headers:remove(propagated_flow_id_header)")
+		}
+	}
+}
+
+func TestTraceRouterRoutingRequiresTraceIDs(t *testing.T) {
+	tenantSettings := settings.NewDefaultTenantSettings()
+	require.True(t, isTraceIDRequired(tenantSettings))
+
+	outboundFilter := getOutgoingRequestTraceIDFilter("frontend", "prod", map[string]string{"frontend": "frontend-prod"}, nil, tenantSettings, false)
+	require.Contains(t, outboundFilter, "if not trace_id then")
+	require.Contains(t, outboundFilter, "Missing required trace ID header")
+
+	// the strict mode keeps rejecting the requests without a trace ID in the flow header routing modes
+	tenantSettings.FlowRoutingMode = settings.FlowHeaderRoutingMode
+	tenantSettings.TraceID.Mode = settings.StrictTraceIDMode
+	require.True(t, isTraceIDRequired(tenantSettings))
+}
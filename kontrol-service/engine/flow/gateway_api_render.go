@@ -0,0 +1,302 @@
+package flow
+
+import (
+	"sort"
+
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	gateway "sigs.k8s.io/gateway-api/apis/v1"
+
+	istioclient "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	securityv1beta1 "istio.io/client-go/pkg/apis/security/v1beta1"
+
+	"kardinal.kontrol-service/constants"
+	"kardinal.kontrol-service/types"
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	"kardinal.kontrol-service/types/settings"
+)
+
+// GatewayAPIRenderer routes the flows with Gateway API HTTPRoutes only, so flows can be used in clusters without Istio
+// The gateway routes set the flow ID header on the requests entering a flow, and the routes attached to each Service
+// (GAMMA) send the requests carrying that header to the flow version of the service. The services have to propagate
+// the flow ID header on their outgoing requests, there isn't a sidecar doing it for them.
+type GatewayAPIRenderer struct {
+	settings settings.TenantSettings
+}
+
+func NewGatewayAPIRenderer(tenantSettings settings.TenantSettings) *GatewayAPIRenderer {
+	return &GatewayAPIRenderer{
+		settings: tenantSettings,
+	}
+}
+
+func (r *GatewayAPIRenderer) RenderNamespace(namespace string) *v1.Namespace {
+	return types.NewNamespace(namespace)
+}
+
+func (r *GatewayAPIRenderer) RenderClusterResources(clusterTopology *resolved.ClusterTopology, namespace string) types.ClusterResources {
+	// the baseline topology (or prod topology) flow ID and flow version are equal to the namespace these three should use same value
+	baselineFlowVersion := namespace
+
+	serviceList := []v1.Service{}
+	routes := []gateway.HTTPRoute{}
+
+	groupedServices := lo.GroupBy(clusterTopology.Services, func(item *resolved.Service) string { return item.ServiceID })
+	for serviceID, services := range groupedServices {
+		logrus.Infof("Rendering service with id: '%v'.", serviceID)
+		if len(services) == 0 {
+			continue
+		}
+		// ServiceSpec is nil for external services - don't process anything bc theres nothing to add to the cluster
+		if services[0].ServiceSpec == nil {
+			continue
+		}
+
+		baselineService, found := lo.Find(services, func(service *resolved.Service) bool {
+			return service.Version == baselineFlowVersion
+		})
+		if !found {
+			logrus.Errorf("No baseline version found for service '%s', skipping it", serviceID)
+			continue
+		}
+
+		// without a mesh the requests not matched by any route reach the Service directly, so it only selects the baseline pods
+		service := getService(baselineService, namespace)
+		service.Spec.Selector = map[string]string{
+			"app":     serviceID,
+			"version": baselineFlowVersion,
+		}
+		serviceList = append(serviceList, *service)
+
+		versionedServices := lo.UniqBy(services, func(service *resolved.Service) string { return service.Version })
+		for _, versionedService := range versionedServices {
+			serviceList = append(serviceList, getVersionedService(versionedService, versionedService.Version, namespace))
+		}
+
+		if !baselineService.IsHTTP() {
+			logrus.Infof("Service '%s' is not an HTTP service, its flow versions are only reachable through the versioned services", serviceID)
+			continue
+		}
+		routes = append(routes, getServiceFlowsHTTPRoute(baselineService, services, namespace))
+	}
+
+	if len(clusterTopology.GetFlowMirrors()) > 0 {
+		// without the Lua filters the mirrored requests would keep the baseline flow and write to the baseline databases
+		logrus.Warnf("The flow mirrors are only rendered by the Istio renderer with sidecars")
+	}
+	if len(clusterTopology.FlowResilience) > 0 {
+		logrus.Warnf("The flow resilience test settings are only rendered by the Istio renderer")
+	}
+
+	routeCanaries := clusterTopology.GetFlowCanaries(clusterTopology.GatewayAndRoutes.ActiveFlowIDs)
+	frontRoutes, frontServices := getFlowHeaderHTTPRoutes(clusterTopology.GatewayAndRoutes, clusterTopology.Services, routeCanaries, namespace, r.settings)
+	routes = append(routes, frontRoutes...)
+	serviceList = append(serviceList, frontServices...)
+
+	// Ingresses can't set request headers, the Lua filters that do it in the Istio renderer are not available here
+	ingresses, frontServices, _ := getIngresses(clusterTopology.Ingress, clusterTopology.Services, nil, namespace, r.settings)
+	if len(ingresses) > 0 {
+		logrus.Warnf("Ingresses can't set the '%s' header or remove the flow path prefix, flows entered through an ingress only route their front service", flowIDHeader)
+		if len(clusterTopology.GetFlowCanaries(clusterTopology.Ingress.ActiveFlowIDs)) > 0 {
+			logrus.Warnf("Ingresses can't split the traffic, the flow canaries are only rendered for the gateway routes")
+		}
+	}
+	serviceList = append(serviceList, frontServices...)
+
+	serviceList = lo.UniqBy(serviceList, func(service v1.Service) string { return service.Name })
+
+	flowEntryPoints := getFlowEntryPoints(clusterTopology, r.settings.FlowEntryStrategy)
+	gateways := addFlowTLSListeners(r.settings.FlowTLS, getGateways(clusterTopology.GatewayAndRoutes), flowEntryPoints)
+	ingresses = addFlowIngressTLS(r.settings.FlowTLS, ingresses, flowEntryPoints)
+
+	return types.ClusterResources{
+		Services: serviceList,
+
+		Deployments: lo.FilterMap(clusterTopology.Services, func(service *resolved.Service, _ int) (appsv1.Deployment, bool) {
+			deployment := getDeployment(service, namespace, map[string]string{})
+			if deployment == nil {
+				return appsv1.Deployment{}, false
+			}
+			return *deployment, true
+		}),
+
+		StatefulSets: lo.FilterMap(clusterTopology.Services, func(service *resolved.Service, _ int) (appsv1.StatefulSet, bool) {
+			statefulSet := getStatefulSet(service, namespace, map[string]string{})
+			if statefulSet == nil {
+				return appsv1.StatefulSet{}, false
+			}
+			return *statefulSet, true
+		}),
+
+		Gateways: gateways,
+
+		HTTPRoutes: routes,
+
+		Ingresses: ingresses,
+
+		VirtualServices: []istioclient.VirtualService{},
+
+		DestinationRules: []istioclient.DestinationRule{},
+
+		EnvoyFilters: []istioclient.EnvoyFilter{},
+
+		AuthorizationPolicies: []securityv1beta1.AuthorizationPolicy{},
+
+		NetworkPolicies: getNetworkPolicies(r.settings, clusterTopology.Services, namespace),
+
+		Certificates: getFlowCertificates(r.settings.FlowTLS, flowEntryPoints),
+	}
+}
+
+// getServiceFlowsHTTPRoute returns the route attached to the service that sends the requests of each flow to the
+// flow version of the service and everything else to the baseline version
+func getServiceFlowsHTTPRoute(baselineService *resolved.Service, services []*resolved.Service, namespace string) gateway.HTTPRoute {
+	serviceID := baselineService.ServiceID
+	port := gateway.PortNumber(baselineService.ServiceSpec.Ports[0].Port)
+
+	flowBackends := getServiceFlowDestinations(services, baselineService.Version)
+
+	// sorted so the rendered routes don't change between calls
+	flowIDs := lo.Keys(flowBackends)
+	sort.Strings(flowIDs)
+
+	rules := lo.Map(flowIDs, func(flowID string, _ int) gateway.HTTPRouteRule {
+		return gateway.HTTPRouteRule{
+			Matches: []gateway.HTTPRouteMatch{
+				{
+					Headers: []gateway.HTTPHeaderMatch{
+						{
+							Type:  lo.ToPtr(gateway.HeaderMatchExact),
+							Name:  gateway.HTTPHeaderName(flowIDHeader),
+							Value: flowID,
+						},
+					},
+				},
+			},
+			BackendRefs: []gateway.HTTPBackendRef{getHTTPBackendRef(flowBackends[flowID], port)},
+		}
+	})
+	rules = append(rules, gateway.HTTPRouteRule{
+		BackendRefs: []gateway.HTTPBackendRef{getHTTPBackendRef(resolved.VersionedName(serviceID, baselineService.Version), port)},
+	})
+
+	return gateway.HTTPRoute{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "gateway.networking.k8s.io/v1",
+			Kind:       "HTTPRoute",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      resolved.DNSLabel(serviceID, "flows"),
+			Namespace: namespace,
+		},
+		Spec: gateway.HTTPRouteSpec{
+			CommonRouteSpec: gateway.CommonRouteSpec{
+				ParentRefs: []gateway.ParentReference{
+					{
+						Group: lo.ToPtr(gateway.Group("")),
+						Kind:  lo.ToPtr(gateway.Kind("Service")),
+						Name:  gateway.ObjectName(serviceID),
+						Port:  &port,
+					},
+				},
+			},
+			Rules: rules,
+		},
+	}
+}
+
+// getFlowHeaderHTTPRoutes returns a copy of the gateway routes for each active flow, the copies only match the requests
+// entering the flow, send them to the flow version of the backends and set the flow ID header used by the service routes
+func getFlowHeaderHTTPRoutes(
+	gatewayAndRoutes *resolved.GatewayAndRoutes,
+	allServices []*resolved.Service,
+	canaries []resolved.FlowCanaryEntry,
+	namespace string,
+	tenantSettings settings.TenantSettings,
+) ([]gateway.HTTPRoute, []v1.Service) {
+	routes := []gateway.HTTPRoute{}
+	frontServices := map[string]v1.Service{}
+
+	// the baseline topology (or prod topology) flow ID and flow version are equal to the namespace these three should use same value
+	baselineFlowVersion := namespace
+
+	for _, activeFlowID := range gatewayAndRoutes.ActiveFlowIDs {
+		logrus.Infof("Setting gateway route for active flow ID: %v", activeFlowID)
+		for routeId, routeSpecOriginal := range gatewayAndRoutes.GatewayRoutes {
+			for _, flowRoute := range getFlowRouteSpecs(routeSpecOriginal, activeFlowID, baselineFlowVersion, tenantSettings, true) {
+				routeSpec := flowRoute.spec
+				backendServices := map[gateway.ObjectName]*resolved.Service{}
+
+				for ruleIx, rule := range routeSpec.Rules {
+					for refIx, ref := range rule.BackendRefs {
+						// fallback to baseline if backend not found at the active flow
+						target, found := findBackendRefService(string(ref.Name), activeFlowID, allServices)
+						if !found {
+							target, found = findBackendRefService(string(ref.Name), baselineFlowVersion, allServices)
+						}
+						if !found {
+							logrus.Errorf("Backend service %v for route %v not found", ref.Name, routeId)
+							continue
+						}
+						idVersion := resolved.VersionedName(target.ServiceID, target.Version)
+						frontServices[idVersion] = getVersionedService(target, target.Version, namespace)
+						ref.Name = gateway.ObjectName(idVersion)
+						rule.BackendRefs[refIx] = ref
+						backendServices[ref.Name] = target
+					}
+					routeSpec.Rules[ruleIx] = rule
+				}
+
+				if activeFlowID == baselineFlowVersion {
+					routeSpec.Rules = addFlowCanaryRules(routeSpec.Rules, canaries, baselineFlowVersion, func(ref gateway.HTTPBackendRef, flowID string) (gateway.ObjectName, bool) {
+						baselineTarget, found := backendServices[ref.Name]
+						if !found {
+							return "", false
+						}
+						target, found := findBackendRefService(baselineTarget.ServiceID, flowID, allServices)
+						if !found {
+							target = baselineTarget
+						}
+						return gateway.ObjectName(resolved.VersionedName(target.ServiceID, target.Version)), true
+					})
+				}
+
+				for parentRefIx, parentRef := range routeSpec.ParentRefs {
+					if parentRef.Namespace == nil || string(*parentRef.Namespace) == "" {
+						defaultNS := gateway.Namespace(constants.DefaultNS)
+						parentRef.Namespace = &defaultNS
+					}
+					routeSpec.ParentRefs[parentRefIx] = parentRef
+				}
+
+				routes = append(routes, gateway.HTTPRoute{
+					TypeMeta: metav1.TypeMeta{
+						APIVersion: "gateway.networking.k8s.io/v1",
+						Kind:       "HTTPRoute",
+					},
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      flowRoute.getName(routeId, activeFlowID),
+						Namespace: namespace,
+					},
+					Spec: *routeSpec,
+				})
+			}
+		}
+	}
+
+	return routes, lo.Values(frontServices)
+}
+
+func getHTTPBackendRef(serviceName string, port gateway.PortNumber) gateway.HTTPBackendRef {
+	return gateway.HTTPBackendRef{
+		BackendRef: gateway.BackendRef{
+			BackendObjectReference: gateway.BackendObjectReference{
+				Name: gateway.ObjectName(serviceName),
+				Port: &port,
+			},
+		},
+	}
+}
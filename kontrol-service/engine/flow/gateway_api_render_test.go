@@ -0,0 +1,119 @@
+package flow
+
+import (
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	gateway "sigs.k8s.io/gateway-api/apis/v1"
+
+	"kardinal.kontrol-service/constants"
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	"kardinal.kontrol-service/types/settings"
+)
+
+func getGatewayAPITestTopology() *resolved.ClusterTopology {
+	topology := getCanaryTestTopology()
+	topology.FlowCanaries = nil
+	topology.Ingress = &resolved.Ingress{}
+	return topology
+}
+
+func getRuleFlowHeader(rule gateway.HTTPRouteRule) string {
+	return getBackendFlowHeader(gateway.HTTPBackendRef{Filters: rule.Filters})
+}
+
+func TestGetServiceFlowsHTTPRoute(t *testing.T) {
+	topology := getGatewayAPITestTopology()
+
+	route := getServiceFlowsHTTPRoute(topology.Services[0], topology.Services, topology.Namespace)
+	require.Equal(t, "frontend-flows", route.Name)
+	require.Equal(t, "prod", route.Namespace)
+
+	// the route is attached to the baseline service port
+	require.Len(t, route.Spec.ParentRefs, 1)
+	parentRef := route.Spec.ParentRefs[0]
+	require.Equal(t, gateway.Kind("Service"), lo.FromPtr(parentRef.Kind))
+	require.Equal(t, gateway.ObjectName("frontend"), parentRef.Name)
+	require.Equal(t, gateway.PortNumber(8080), lo.FromPtr(parentRef.Port))
+
+	// the flow requests go to the flow version, the rest to the baseline version
+	require.Len(t, route.Spec.Rules, 2)
+	flowRule := route.Spec.Rules[0]
+	require.Len(t, flowRule.Matches, 1)
+	require.Equal(t, []gateway.HTTPHeaderMatch{{Type: lo.ToPtr(gateway.HeaderMatchExact), Name: flowIDHeader, Value: "dev-flow-1"}}, flowRule.Matches[0].Headers)
+	require.Equal(t, gateway.ObjectName("frontend-dev-flow-1"), flowRule.BackendRefs[0].Name)
+	baselineRule := route.Spec.Rules[1]
+	require.Empty(t, baselineRule.Matches)
+	require.Equal(t, gateway.ObjectName("frontend-prod"), baselineRule.BackendRefs[0].Name)
+	require.Equal(t, gateway.PortNumber(8080), lo.FromPtr(baselineRule.BackendRefs[0].Port))
+}
+
+func TestGetFlowHeaderHTTPRoutes(t *testing.T) {
+	topology := getGatewayAPITestTopology()
+
+	routes, frontServices := getFlowHeaderHTTPRoutes(topology.GatewayAndRoutes, topology.Services, nil, topology.Namespace, settings.NewDefaultTenantSettings())
+	require.Len(t, routes, 2)
+
+	for _, flowID := range []string{"prod", "dev-flow-1"} {
+		route, found := lo.Find(routes, func(route gateway.HTTPRoute) bool {
+			return lo.Contains(route.Spec.Hostnames, gateway.Hostname(resolved.ReplaceOrAddSubdomain("app.example.com", flowID)))
+		})
+		require.True(t, found, flowID)
+		require.Equal(t, "prod", route.Namespace)
+		require.Len(t, route.Spec.Rules, 1)
+
+		// the gateway sets the flow header used by the service routes
+		rule := route.Spec.Rules[0]
+		require.Equal(t, flowID, getRuleFlowHeader(rule))
+		require.Equal(t, gateway.ObjectName(resolved.VersionedName("frontend", flowID)), rule.BackendRefs[0].Name)
+	}
+
+	// the original routes are not modified
+	require.Empty(t, topology.GatewayAndRoutes.GatewayRoutes[0].Rules[0].Filters)
+	require.Equal(t, gateway.ObjectName("frontend"), topology.GatewayAndRoutes.GatewayRoutes[0].Rules[0].BackendRefs[0].Name)
+
+	frontServiceNames := lo.Map(frontServices, func(service corev1.Service, _ int) string { return service.Name })
+	require.ElementsMatch(t, []string{"frontend-prod", "frontend-dev-flow-1"}, frontServiceNames)
+}
+
+func TestGetFlowHeaderHTTPRoutesFallsBackToBaselineBackends(t *testing.T) {
+	topology := getGatewayAPITestTopology()
+	topology.Services = topology.Services[:1]
+	topology.GatewayAndRoutes.GatewayRoutes[0].ParentRefs = []gateway.ParentReference{{Name: "gateway"}}
+
+	routes, _ := getFlowHeaderHTTPRoutes(topology.GatewayAndRoutes, topology.Services, nil, topology.Namespace, settings.NewDefaultTenantSettings())
+	require.Len(t, routes, 2)
+	for _, route := range routes {
+		require.Equal(t, gateway.ObjectName("frontend-prod"), route.Spec.Rules[0].BackendRefs[0].Name)
+		require.Equal(t, gateway.Namespace(constants.DefaultNS), lo.FromPtr(route.Spec.ParentRefs[0].Namespace))
+	}
+}
+
+func TestGatewayAPIRendererClusterResources(t *testing.T) {
+	topology := getGatewayAPITestTopology()
+	tenantSettings := settings.NewDefaultTenantSettings()
+	tenantSettings.Renderer = settings.GatewayAPIRenderer
+	renderer, err := NewRenderer(tenantSettings)
+	require.NoError(t, err)
+
+	resources := renderer.RenderClusterResources(topology, topology.Namespace)
+
+	// no Istio resources
+	require.Empty(t, resources.VirtualServices)
+	require.Empty(t, resources.DestinationRules)
+	require.Empty(t, resources.EnvoyFilters)
+	require.Empty(t, resources.AuthorizationPolicies)
+
+	// the service only selects the baseline pods, each version gets its own service
+	service, found := lo.Find(resources.Services, func(service corev1.Service) bool { return service.Name == "frontend" })
+	require.True(t, found)
+	require.Equal(t, map[string]string{"app": "frontend", "version": "prod"}, service.Spec.Selector)
+	serviceNames := lo.Map(resources.Services, func(service corev1.Service, _ int) string { return service.Name })
+	require.ElementsMatch(t, []string{"frontend", "frontend-prod", "frontend-dev-flow-1"}, serviceNames)
+
+	routeNames := lo.Map(resources.HTTPRoutes, func(route gateway.HTTPRoute, _ int) string { return route.Name })
+	require.Contains(t, routeNames, "frontend-flows")
+	require.Len(t, resources.HTTPRoutes, 3)
+}
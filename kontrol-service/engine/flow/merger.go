@@ -15,8 +15,20 @@ func MergeClusterTopologies(baseTopology resolved.ClusterTopology, clusterTopolo
 		Ingress:             DeepCopyIngress(baseTopology.Ingress),
 		GatewayAndRoutes:    DeepCopyGatewayAndRoutes(baseTopology.GatewayAndRoutes),
 		Namespace:           baseTopology.Namespace,
+		FlowCanaries:        map[string]resolved.FlowCanary{},
+		FlowMirrors:         map[string]resolved.FlowMirror{},
+		FlowResilience:      map[string]resolved.FlowResilience{},
 	}
 	for _, topology := range clusterTopologies {
+		for flowID, canary := range topology.FlowCanaries {
+			mergedTopology.FlowCanaries[flowID] = canary
+		}
+		for flowID, mirror := range topology.FlowMirrors {
+			mergedTopology.FlowMirrors[flowID] = mirror
+		}
+		for flowID, resilience := range topology.FlowResilience {
+			mergedTopology.FlowResilience[flowID] = resilience
+		}
 		mergedTopology.Services = append(mergedTopology.Services, topology.Services...)
 		mergedTopology.ServiceDependencies = append(mergedTopology.ServiceDependencies, topology.ServiceDependencies...)
 		mergedTopology.Ingress.ActiveFlowIDs = append(mergedTopology.Ingress.ActiveFlowIDs, topology.Ingress.ActiveFlowIDs...)
@@ -0,0 +1,179 @@
+package flow
+
+import (
+	"fmt"
+
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"istio.io/api/networking/v1alpha3"
+	istioclient "istio.io/client-go/pkg/apis/networking/v1alpha3"
+
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	"kardinal.kontrol-service/types/settings"
+)
+
+const (
+	// mirrorTraceIDPrefix keeps the trace IDs of the mirrored requests apart from the baseline ones, the generated IDs
+	// are hex digits only so a mirrored request never sets the routes of a baseline trace
+	mirrorTraceIDPrefix = "mirror-"
+
+	// luaMirroredRequestFunction finds the requests mirrored by Envoy, which adds the -shadow suffix to their host
+	luaMirroredRequestFunction = `
+function is_mirrored(hostname)
+  return hostname:match("%-shadow$") ~= nil or hostname:match("%-shadow:%d+$") ~= nil
+end
+`
+
+	// luaReplaceTraceIDFunction gives a new trace to the mirrored requests, so the routes of the flow don't change the
+	// routes of the baseline request, the traceparent header gets the hex part of the trace ID
+	luaReplaceTraceIDFunction = `
+function replace_trace_id(headers, trace_id, traceparent_id)
+  for _, header_name in ipairs(trace_header_priorities) do
+    if header_name == "traceparent" then
+      if headers:get(header_name) then
+        headers:replace(header_name, "00-" .. traceparent_id .. "-" .. random_hex(2) .. "-01")
+      end
+    elseif headers:get(header_name) then
+      headers:replace(header_name, trace_id)
+    end
+  end
+  headers:replace(trace_id_header, trace_id)
+end
+`
+)
+
+// serviceMirror is a flow version receiving a copy of the baseline requests of a service
+type serviceMirror struct {
+	flowID     string
+	version    string
+	percentage float64
+}
+
+type mirrorInboundFilter struct {
+	allServices []*resolved.Service
+	flowID      string
+	namespace   string
+	settings    settings.TenantSettings
+}
+
+func (f *mirrorInboundFilter) getName() string {
+	return "inbound-mirror"
+}
+
+func (f *mirrorInboundFilter) getFilter() string {
+	return generateMirrorLuaScript(f.allServices, f.flowID, f.namespace, f.settings)
+}
+
+// getServiceMirrors returns the flow versions mirroring the baseline requests of the service, the mirrors of the
+// services which are not HTTP or don't have a version in the flow are ignored
+func getServiceMirrors(serviceID string, services []*resolved.Service, mirrors []resolved.FlowMirrorEntry) []serviceMirror {
+	serviceMirrors := []serviceMirror{}
+	for _, mirror := range mirrors {
+		if !lo.Contains(mirror.Mirror.Services, serviceID) {
+			continue
+		}
+		flowService, found := lo.Find(services, func(service *resolved.Service) bool {
+			return service.Version == mirror.FlowID
+		})
+		if !found {
+			logrus.Warnf("Service '%s' has no version in flow '%s', its requests are not mirrored", serviceID, mirror.FlowID)
+			continue
+		}
+		if !flowService.IsHTTP() {
+			logrus.Warnf("Service '%s' is not an HTTP service, its requests are not mirrored to flow '%s'", serviceID, mirror.FlowID)
+			continue
+		}
+		serviceMirrors = append(serviceMirrors, serviceMirror{
+			flowID:     mirror.FlowID,
+			version:    flowService.Version,
+			percentage: mirror.Mirror.Percentage,
+		})
+	}
+	return serviceMirrors
+}
+
+// setHTTPRouteMirrors copies the requests of the route to the flow versions, Envoy discards the responses of the
+// mirrored requests
+func setHTTPRouteMirrors(route *v1alpha3.HTTPRoute, serviceID string, mirrors []serviceMirror) {
+	if len(mirrors) == 1 {
+		route.Mirror = &v1alpha3.Destination{Host: serviceID, Subset: mirrors[0].version}
+		route.MirrorPercentage = &v1alpha3.Percent{Value: mirrors[0].percentage}
+		return
+	}
+	route.Mirrors = lo.Map(mirrors, func(mirror serviceMirror, _ int) *v1alpha3.HTTPMirrorPolicy {
+		return &v1alpha3.HTTPMirrorPolicy{
+			Destination: &v1alpha3.Destination{Host: serviceID, Subset: mirror.version},
+			Percentage:  &v1alpha3.Percent{Value: mirror.percentage},
+		}
+	})
+}
+
+// getMirrorEnvoyFilters returns the inbound filters of the mirroring flow versions, which move the mirrored requests
+// to the flow
+func getMirrorEnvoyFilters(
+	allServices []*resolved.Service,
+	mirrors []resolved.FlowMirrorEntry,
+	namespace string,
+	tenantSettings settings.TenantSettings,
+) []istioclient.EnvoyFilter {
+	filters := []istioclient.EnvoyFilter{}
+	groupedServices := lo.GroupBy(allServices, func(item *resolved.Service) string { return item.ServiceID })
+	for _, serviceID := range lo.Uniq(lo.FlatMap(mirrors, func(mirror resolved.FlowMirrorEntry, _ int) []string { return mirror.Mirror.Services })) {
+		for _, mirror := range getServiceMirrors(serviceID, groupedServices[serviceID], mirrors) {
+			version := mirror.version
+			filter := &mirrorInboundFilter{allServices: allServices, flowID: mirror.flowID, namespace: namespace, settings: tenantSettings}
+			filters = append(filters, getInboundFilter(serviceID, namespace, 1, &version, filter, tenantSettings))
+		}
+	}
+	return filters
+}
+
+// generateMirrorLuaScript returns the inbound filter of a flow version receiving mirrored requests. The mirrored
+// requests keep the trace of the baseline request, so they get a new trace routed to the flow, or the flow ID in the
+// flow header routing modes, and their calls to the stateful services reach the flow versions instead of the
+// baseline ones
+func generateMirrorLuaScript(allServices []*resolved.Service, flowId string, namespace string, tenantSettings settings.TenantSettings) string {
+	if isFlowHeaderRouting(tenantSettings) {
+		return fmt.Sprintf(`
+%s
+%s
+function envoy_on_request(request_handle)
+  local headers = request_handle:headers()
+  local hostname = headers:get(":authority") or ""
+  if not is_mirrored(hostname) then
+    return
+  end
+
+  request_handle:logInfo("Mirrored request entered flow %s, Hostname: " .. hostname)
+  set_propagated_flow_id(headers, "%s")
+end
+`, luaMirroredRequestFunction, generateLuaFlowPropagation(tenantSettings.FlowRoutingMode), flowId, flowId)
+	}
+
+	// the baseline topology (or prod topology) flow ID and flow version are equal to the namespace these three should use same value
+	baselineFlowVersion := namespace
+	setRouteCalls := generateLuaSetRouteCalls(allServices, flowId, baselineFlowVersion, func(_ *resolved.Service) string {
+		return "true"
+	})
+
+	return fmt.Sprintf(`
+%s
+%s
+%s
+%s%s
+local mirror_trace_id_prefix = %q
+function envoy_on_request(request_handle)
+  local headers = request_handle:headers()
+  local hostname = headers:get(":authority") or ""
+  if not is_mirrored(hostname) then
+    return
+  end
+
+  local traceparent_id = generate_trace_id(request_handle)
+  local trace_id = mirror_trace_id_prefix .. traceparent_id
+  replace_trace_id(headers, trace_id, traceparent_id)
+  request_handle:logInfo("Mirrored request entered flow %s, trace ID: " .. trace_id .. ", Hostname: " .. hostname)
+%s
+end
+`, generateLuaTraceHeaders(tenantSettings), generateLuaTraceRouter(tenantSettings), generateLuaTraceIDFunctions(tenantSettings, resolved.DNSLabel(flowId, "mirror")), luaMirroredRequestFunction, luaReplaceTraceIDFunction, mirrorTraceIDPrefix, flowId, setRouteCalls)
+}
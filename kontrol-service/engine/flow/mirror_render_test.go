@@ -0,0 +1,83 @@
+package flow
+
+import (
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	"kardinal.kontrol-service/types/settings"
+)
+
+func getMirrorTestServices() []*resolved.Service {
+	httpSpec := &corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 8080, AppProtocol: lo.ToPtr("HTTP")}}}
+	tcpSpec := &corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "tcp", Port: 5432}}}
+	return []*resolved.Service{
+		{ServiceID: "cartservice", Version: "prod", ServiceSpec: httpSpec},
+		{ServiceID: "cartservice", Version: "dev-flow-1", ServiceSpec: httpSpec},
+		{ServiceID: "cartservice", Version: "dev-flow-2", ServiceSpec: httpSpec},
+		{ServiceID: "postgres", Version: "prod", ServiceSpec: tcpSpec},
+		{ServiceID: "postgres", Version: "dev-flow-1", ServiceSpec: tcpSpec},
+	}
+}
+
+func TestFlowMirrorVirtualService(t *testing.T) {
+	services := getMirrorTestServices()
+	cartServices := services[:3]
+	mirrors := []resolved.FlowMirrorEntry{
+		{FlowID: "dev-flow-1", Mirror: resolved.FlowMirror{Percentage: 10, Services: []string{"cartservice", "postgres"}}},
+	}
+
+	virtualService, _ := getVirtualService("cartservice", cartServices, getServiceMirrors("cartservice", cartServices, mirrors), nil, "prod")
+	require.Len(t, virtualService.Spec.Http, 3)
+	baselineRoute := virtualService.Spec.Http[0]
+	require.Equal(t, "cartservice", baselineRoute.Mirror.Host)
+	require.Equal(t, "dev-flow-1", baselineRoute.Mirror.Subset)
+	require.Equal(t, 10.0, baselineRoute.MirrorPercentage.Value)
+	// only the baseline requests are mirrored
+	require.Nil(t, virtualService.Spec.Http[1].Mirror)
+	require.Nil(t, virtualService.Spec.Http[2].Mirror)
+
+	// the TCP services can't be mirrored
+	require.Empty(t, getServiceMirrors("postgres", services[3:], mirrors))
+
+	mirrors = append(mirrors, resolved.FlowMirrorEntry{FlowID: "dev-flow-2", Mirror: resolved.FlowMirror{Percentage: 5, Services: []string{"cartservice"}}})
+	virtualService, _ = getVirtualService("cartservice", cartServices, getServiceMirrors("cartservice", cartServices, mirrors), nil, "prod")
+	baselineRoute = virtualService.Spec.Http[0]
+	require.Nil(t, baselineRoute.Mirror)
+	require.Len(t, baselineRoute.Mirrors, 2)
+	require.Equal(t, "dev-flow-2", baselineRoute.Mirrors[1].Destination.Subset)
+	require.Equal(t, 5.0, baselineRoute.Mirrors[1].Percentage.Value)
+}
+
+func TestFlowMirrorEnvoyFilters(t *testing.T) {
+	services := getMirrorTestServices()
+	mirrors := []resolved.FlowMirrorEntry{
+		{FlowID: "dev-flow-1", Mirror: resolved.FlowMirror{Percentage: 10, Services: []string{"cartservice"}}},
+	}
+
+	filters := getMirrorEnvoyFilters(services, mirrors, "prod", settings.NewDefaultTenantSettings())
+	require.Len(t, filters, 1)
+	require.Equal(t, map[string]string{"app": "cartservice", "version": "dev-flow-1"}, filters[0].Spec.WorkloadSelector.Labels)
+
+	// the mirrored requests get a new trace routed to the versions of the flow
+	luaCode := filters[0].Spec.ConfigPatches[0].Patch.Value.Fields["typed_config"].GetStructValue().Fields["inlineCode"].GetStringValue()
+	require.Contains(t, luaCode, "replace_trace_id(headers, trace_id, traceparent_id)")
+
+	// the mirrored traces have their own namespace, so they never set the routes of a baseline trace
+	require.Contains(t, luaCode, `local mirror_trace_id_prefix = "mirror-"`)
+	require.Contains(t, luaCode, "local trace_id = mirror_trace_id_prefix .. traceparent_id")
+	calls := getLuaTraceRouterCalls(t, luaCode, map[string]string{"trace_id": "mirror-4bf92f3577b34da6a3ce929d0e0e4736"})
+	require.ElementsMatch(t, []luaTraceRouterCall{
+		{method: "POST", path: "/set-route?trace_id=mirror-4bf92f3577b34da6a3ce929d0e0e4736&hostname=cartservice&destination=cartservice-dev-flow-1"},
+		{method: "POST", path: "/set-route?trace_id=mirror-4bf92f3577b34da6a3ce929d0e0e4736&hostname=postgres&destination=postgres-dev-flow-1"},
+	}, calls)
+
+	tenantSettings := settings.NewDefaultTenantSettings()
+	tenantSettings.FlowRoutingMode = settings.FlowHeaderRoutingMode
+	luaCode = generateMirrorLuaScript(services, "dev-flow-1", "prod", tenantSettings)
+	require.NotContains(t, luaCode, "httpCall")
+	require.Contains(t, luaCode, `set_propagated_flow_id(headers, "dev-flow-1")`)
+}
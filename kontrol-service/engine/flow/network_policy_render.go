@@ -0,0 +1,100 @@
+package flow
+
+import (
+	"sort"
+
+	"github.com/samber/lo"
+	net "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"kardinal.kontrol-service/constants"
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	"kardinal.kontrol-service/types/settings"
+)
+
+// getNetworkPolicies returns the policies isolating the flow versions of the stateful services, each of them only
+// accepts traffic from the pods of its flow so a misrouted baseline pod can't write into a flow database
+func getNetworkPolicies(tenantSettings settings.TenantSettings, allServices []*resolved.Service, namespace string) []net.NetworkPolicy {
+	networkPolicies := []net.NetworkPolicy{}
+	if !tenantSettings.StatefulFlowIsolation {
+		return networkPolicies
+	}
+
+	// the baseline topology (or prod topology) flow ID and flow version are equal to the namespace these three should use same value
+	baselineFlowVersion := namespace
+
+	// in ambient mode the requests handled by the waypoint reach the pods from the waypoint pod
+	peers := []net.NetworkPolicyPeer{}
+	if tenantSettings.Renderer == settings.IstioRenderer && tenantSettings.IstioDataplaneMode == settings.AmbientDataplaneMode {
+		peers = append(peers, net.NetworkPolicyPeer{
+			PodSelector: &metav1.LabelSelector{
+				MatchLabels: waypointSelector(tenantSettings.WaypointName),
+			},
+		})
+	}
+
+	services := lo.UniqBy(allServices, func(service *resolved.Service) string {
+		return resolved.VersionedName(service.ServiceID, service.Version)
+	})
+	for _, service := range services {
+		if !service.IsStateful || service.IsExternal || service.WorkloadSpec == nil || service.Version == baselineFlowVersion {
+			continue
+		}
+		networkPolicies = append(networkPolicies, getFlowIsolationNetworkPolicy(service, namespace, peers))
+	}
+
+	// sorted so the rendered policies don't change between calls
+	sort.Slice(networkPolicies, func(i, j int) bool {
+		return networkPolicies[i].Name < networkPolicies[j].Name
+	})
+
+	return networkPolicies
+}
+
+func getFlowIsolationNetworkPolicy(service *resolved.Service, namespace string, extraPeers []net.NetworkPolicyPeer) net.NetworkPolicy {
+	// a shared version is used by the flow it was created for
+	flowVersions := []string{service.Version}
+	if service.Version == constants.SharedVersionVersionString && service.OriginalVersionIfShared != "" {
+		flowVersions = append(flowVersions, service.OriginalVersionIfShared)
+	}
+
+	peers := []net.NetworkPolicyPeer{
+		{
+			PodSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{
+					{
+						Key:      "version",
+						Operator: metav1.LabelSelectorOpIn,
+						Values:   flowVersions,
+					},
+				},
+			},
+		},
+	}
+	peers = append(peers, extraPeers...)
+
+	return net.NetworkPolicy{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "networking.k8s.io/v1",
+			Kind:       "NetworkPolicy",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      resolved.DNSLabel(resolved.VersionedName(service.ServiceID, service.Version), "isolation"),
+			Namespace: namespace,
+		},
+		Spec: net.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app":     service.ServiceID,
+					"version": service.Version,
+				},
+			},
+			PolicyTypes: []net.PolicyType{net.PolicyTypeIngress},
+			Ingress: []net.NetworkPolicyIngressRule{
+				{
+					From: peers,
+				},
+			},
+		},
+	}
+}
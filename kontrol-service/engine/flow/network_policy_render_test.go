@@ -0,0 +1,68 @@
+package flow
+
+import (
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+	net "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"kardinal.kontrol-service/constants"
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	"kardinal.kontrol-service/types/settings"
+)
+
+func getNetworkPolicyTestServices() []*resolved.Service {
+	workloadSpec := pluginExecutionTopology("postgres").Services[0].WorkloadSpec
+	return []*resolved.Service{
+		{ServiceID: "postgres", Version: "prod", IsStateful: true, WorkloadSpec: workloadSpec},
+		{ServiceID: "redis", Version: "prod", IsStateful: true, WorkloadSpec: workloadSpec},
+		{ServiceID: "frontend", Version: "prod", WorkloadSpec: workloadSpec},
+		{ServiceID: "postgres", Version: "dev-flow-1", IsStateful: true, WorkloadSpec: workloadSpec},
+		{ServiceID: "redis", Version: constants.SharedVersionVersionString, IsStateful: true, IsShared: true, OriginalVersionIfShared: "dev-flow-2", WorkloadSpec: workloadSpec},
+		{ServiceID: "frontend", Version: "dev-flow-1", WorkloadSpec: workloadSpec},
+	}
+}
+
+func TestGetNetworkPolicies(t *testing.T) {
+	tenantSettings := settings.NewDefaultTenantSettings()
+	services := getNetworkPolicyTestServices()
+
+	// disabled by default
+	require.Empty(t, getNetworkPolicies(tenantSettings, services, "prod"))
+
+	tenantSettings.StatefulFlowIsolation = true
+	policies := getNetworkPolicies(tenantSettings, services, "prod")
+	policyNames := lo.Map(policies, func(policy net.NetworkPolicy, _ int) string { return policy.Name })
+	// only the flow versions of the stateful services are isolated
+	require.Equal(t, []string{"postgres-dev-flow-1-isolation", "redis-shared-isolation"}, policyNames)
+
+	postgresPolicy := policies[0]
+	require.Equal(t, "prod", postgresPolicy.Namespace)
+	require.Equal(t, map[string]string{"app": "postgres", "version": "dev-flow-1"}, postgresPolicy.Spec.PodSelector.MatchLabels)
+	require.Equal(t, []net.PolicyType{net.PolicyTypeIngress}, postgresPolicy.Spec.PolicyTypes)
+	require.Len(t, postgresPolicy.Spec.Ingress, 1)
+	require.Equal(t, []net.NetworkPolicyPeer{{
+		PodSelector: &metav1.LabelSelector{
+			MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "version", Operator: metav1.LabelSelectorOpIn, Values: []string{"dev-flow-1"}}},
+		},
+	}}, postgresPolicy.Spec.Ingress[0].From)
+
+	// a shared version accepts the traffic of the flow it was created for
+	redisPolicy := policies[1]
+	require.Equal(t, []string{constants.SharedVersionVersionString, "dev-flow-2"}, redisPolicy.Spec.Ingress[0].From[0].PodSelector.MatchExpressions[0].Values)
+}
+
+func TestGetNetworkPoliciesAcceptTheWaypointInAmbientMode(t *testing.T) {
+	tenantSettings := getAmbientTestSettings()
+	tenantSettings.StatefulFlowIsolation = true
+
+	policies := getNetworkPolicies(tenantSettings, getNetworkPolicyTestServices(), "prod")
+	require.Len(t, policies, 2)
+	for _, policy := range policies {
+		peers := policy.Spec.Ingress[0].From
+		require.Len(t, peers, 2)
+		require.Equal(t, waypointSelector("kardinal-waypoint"), peers[1].PodSelector.MatchLabels)
+	}
+}
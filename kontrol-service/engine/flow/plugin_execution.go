@@ -0,0 +1,244 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kurtosis-tech/stacktrace"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+
+	"kardinal.kontrol-service/plugins"
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	kardinal "kardinal.kontrol-service/types/kardinal"
+)
+
+// pluginExecution is the create_flow call of a plugin for the services depending on it
+type pluginExecution struct {
+	plugin     *resolved.StatefulPlugin
+	pluginId   string
+	serviceIds []string
+	timeout    time.Duration
+
+	// modifiedWorkloadSpecs are returned by the plugin, in the order of the service IDs
+	modifiedWorkloadSpecs []*kardinal.WorkloadSpec
+	err                   error
+}
+
+// executePlugins runs the plugins of the flow and updates the services with their modifications, the plugins are run
+// in the order of their service names, the ones modifying the same services one after another so each gets the specs
+// modified by the previous ones, and the independent ones concurrently up to the plugin concurrency limit, the plugins
+// get copies of the specs of the topology services, which are only updated once all of them succeeded, in the same
+// order
+func executePlugins(
+	ctx context.Context,
+	pluginRunner *plugins.PluginRunner,
+	topologyRef *resolved.ClusterTopology,
+	flowID string,
+	pluginServices map[string][]string,
+	pluginServicesMap map[string]*resolved.StatefulPlugin,
+) error {
+	pluginServiceNames := make([]string, 0, len(pluginServices))
+	for pluginServiceName := range pluginServices {
+		pluginServiceNames = append(pluginServiceNames, pluginServiceName)
+	}
+	sort.Strings(pluginServiceNames)
+
+	services := map[string]*resolved.Service{}
+	executions := make([]*pluginExecution, 0, len(pluginServiceNames))
+	for _, pluginServiceName := range pluginServiceNames {
+		serviceIds := pluginServices[pluginServiceName]
+		plugin, ok := pluginServicesMap[pluginServiceName]
+		if !ok {
+			return stacktrace.NewError("expected to find plugin with service name '%s' in the plugins service map, this is a bug in Kardinal", pluginServiceName)
+		}
+
+		if len(serviceIds) == 0 {
+			return stacktrace.NewError("expected to find at least one service depending on plugin '%s' but none was found, please review your manifest file", plugin.ServiceName)
+		}
+
+		for _, serviceId := range serviceIds {
+			service, err := topologyRef.GetService(serviceId)
+			if err != nil {
+				return stacktrace.Propagate(err, "an error occurred getting service '%s' from topology", serviceId)
+			}
+			services[serviceId] = service
+		}
+
+		pluginTimeout, err := plugin.GetTimeout()
+		if err != nil {
+			return err
+		}
+		executions = append(executions, &pluginExecution{
+			plugin:     plugin,
+			pluginId:   plugins.GetPluginId(plugin.ServiceName, flowID),
+			serviceIds: serviceIds,
+			timeout:    pluginTimeout,
+		})
+	}
+
+	runPluginExecutions(ctx, pluginRunner, services, groupPluginExecutions(executions), pluginRunner.GetLimits().Concurrency)
+
+	var pluginErrs []error
+	for _, execution := range executions {
+		if execution.err != nil {
+			pluginErrs = append(pluginErrs, execution.err)
+		}
+	}
+	if len(pluginErrs) > 0 {
+		return stacktrace.Propagate(errors.Join(pluginErrs...), "%d of the %d plugins of flow '%s' failed", len(pluginErrs), len(executions), flowID)
+	}
+
+	// updating the service.workload_spec after the plugin execution
+	for _, execution := range executions {
+		for serviceIndex, serviceId := range execution.serviceIds {
+			service, err := topologyRef.GetService(serviceId)
+			if err != nil {
+				return stacktrace.Propagate(err, "an error occurred getting service '%s' from topology", serviceId)
+			}
+			service.WorkloadSpec = execution.modifiedWorkloadSpecs[serviceIndex]
+			if err = topologyRef.MoveServiceToVersion(service, flowID); err != nil {
+				return fmt.Errorf("an error occurred updating service '%s'", service.ServiceID)
+			}
+		}
+	}
+
+	return nil
+}
+
+// groupPluginExecutions groups the executions modifying the same services, directly or through other executions, the
+// groups and the executions of each group keep the order of the executions
+func groupPluginExecutions(executions []*pluginExecution) [][]*pluginExecution {
+	groupIdxByService := map[string]int{}
+	// parents is the union-find forest of the executions
+	parents := make([]int, len(executions))
+	var find func(int) int
+	find = func(idx int) int {
+		if parents[idx] != idx {
+			parents[idx] = find(parents[idx])
+		}
+		return parents[idx]
+	}
+	for idx, execution := range executions {
+		parents[idx] = idx
+		for _, serviceId := range execution.serviceIds {
+			if otherIdx, found := groupIdxByService[serviceId]; found {
+				root, otherRoot := find(idx), find(otherIdx)
+				// the earliest execution is the root so the groups are ordered by their first execution
+				if otherRoot < root {
+					parents[root] = otherRoot
+				} else {
+					parents[otherRoot] = root
+				}
+			} else {
+				groupIdxByService[serviceId] = idx
+			}
+		}
+	}
+
+	groupsByRoot := map[int]int{}
+	var groups [][]*pluginExecution
+	for idx, execution := range executions {
+		root := find(idx)
+		groupIdx, found := groupsByRoot[root]
+		if !found {
+			groupIdx = len(groups)
+			groupsByRoot[root] = groupIdx
+			groups = append(groups, nil)
+		}
+		groups[groupIdx] = append(groups[groupIdx], execution)
+	}
+	return groups
+}
+
+// runPluginExecutions runs the groups concurrently with at most concurrency plugins at the same time, the executions of
+// a group run one after another and get the workload specs modified by the previous ones, no new plugin is started once
+// one failed since the flow won't be created, the plugins already running are left to finish so their flows can be
+// rolled back
+func runPluginExecutions(
+	ctx context.Context,
+	pluginRunner *plugins.PluginRunner,
+	services map[string]*resolved.Service,
+	groups [][]*pluginExecution,
+	concurrency int,
+) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	workers := make(chan struct{}, concurrency)
+	var failed sync.Once
+	failedCh := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for _, group := range groups {
+		wg.Add(1)
+		go func(group []*pluginExecution) {
+			defer wg.Done()
+			workloadSpecs := map[string]*kardinal.WorkloadSpec{}
+			for _, execution := range group {
+				select {
+				case workers <- struct{}{}:
+				case <-failedCh:
+					return
+				}
+				select {
+				case <-failedCh:
+					<-workers
+					return
+				default:
+				}
+
+				runPluginExecution(ctx, pluginRunner, services, workloadSpecs, execution)
+				<-workers
+				if execution.err != nil {
+					failed.Do(func() { close(failedCh) })
+					return
+				}
+			}
+		}(group)
+	}
+	wg.Wait()
+}
+
+// runPluginExecution calls the plugin with the latest workload specs of its services, the specs of the topology are
+// copied so a plugin can't modify the services of a flow which fails
+func runPluginExecution(
+	ctx context.Context,
+	pluginRunner *plugins.PluginRunner,
+	services map[string]*resolved.Service,
+	workloadSpecs map[string]*kardinal.WorkloadSpec,
+	execution *pluginExecution,
+) {
+	var servicesServiceSpecs []corev1.ServiceSpec
+	var servicesWorkloadSpecs []*kardinal.WorkloadSpec
+	for _, serviceId := range execution.serviceIds {
+		service := services[serviceId]
+		servicesServiceSpecs = append(servicesServiceSpecs, *service.ServiceSpec.DeepCopy())
+		workloadSpec, found := workloadSpecs[serviceId]
+		if !found {
+			workloadSpec = service.WorkloadSpec.DeepCopy()
+		}
+		servicesWorkloadSpecs = append(servicesWorkloadSpecs, workloadSpec)
+	}
+
+	logrus.Infof("Calling plugin '%v'...", execution.pluginId)
+	servicesModifiedWorkloadSpecs, _, err := pluginRunner.CreateFlow(ctx, execution.plugin.Name, servicesServiceSpecs, servicesWorkloadSpecs, execution.pluginId, execution.plugin.Args, execution.timeout)
+	if err != nil {
+		// the plugin errors are wrapped without a stack trace so they can be found in the aggregated error
+		execution.err = fmt.Errorf("error when creating plugin flow for plugin '%s': %w", execution.pluginId, err)
+		return
+	}
+
+	if len(execution.serviceIds) != len(servicesModifiedWorkloadSpecs) {
+		execution.err = fmt.Errorf("an error occurred executing plugin '%s', the number of workload specs returned by the plugin.CreateFlow function are not equal to the number of service depending on it, please check the plugin code or report a bug in the Kardinal repository", execution.plugin.ServiceName)
+		return
+	}
+	for serviceIndex, serviceId := range execution.serviceIds {
+		workloadSpecs[serviceId] = servicesModifiedWorkloadSpecs[serviceIndex]
+	}
+	execution.modifiedWorkloadSpecs = servicesModifiedWorkloadSpecs
+}
@@ -0,0 +1,195 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	apps "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+
+	"kardinal.kontrol-service/plugins"
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	kardinal "kardinal.kontrol-service/types/kardinal"
+)
+
+const testPluginDelay = 200 * time.Millisecond
+
+// concurrencyRecordingPlugin records the maximum number of concurrent calls and the deleted flows, it fails for the
+// flows with a 'fail' argument
+type concurrencyRecordingPlugin struct {
+	running    atomic.Int32
+	maxRunning atomic.Int32
+
+	deletedFlowsMutex sync.Mutex
+	deletedFlows      []string
+}
+
+func (p *concurrencyRecordingPlugin) CreateFlow(_ context.Context, _ []v1.ServiceSpec, podSpecs []v1.PodSpec, flowUuid string, arguments map[string]string) ([]v1.PodSpec, map[string]interface{}, error) {
+	running := p.running.Add(1)
+	defer p.running.Add(-1)
+	for {
+		maxRunning := p.maxRunning.Load()
+		if running <= maxRunning || p.maxRunning.CompareAndSwap(maxRunning, running) {
+			break
+		}
+	}
+	time.Sleep(testPluginDelay)
+	if arguments["fail"] == "true" {
+		return nil, nil, errors.New("the database can't be created")
+	}
+	return podSpecs, map[string]interface{}{}, nil
+}
+
+func (p *concurrencyRecordingPlugin) DeleteFlow(_ context.Context, _ map[string]interface{}, flowUuid string) error {
+	p.deletedFlowsMutex.Lock()
+	defer p.deletedFlowsMutex.Unlock()
+	p.deletedFlows = append(p.deletedFlows, flowUuid)
+	return nil
+}
+
+func (p *concurrencyRecordingPlugin) getDeletedFlows() []string {
+	p.deletedFlowsMutex.Lock()
+	defer p.deletedFlowsMutex.Unlock()
+	return append([]string{}, p.deletedFlows...)
+}
+
+var testConcurrencyRecordingPlugin = &concurrencyRecordingPlugin{}
+
+func init() {
+	plugins.RegisterNativePlugin("test-concurrency-recording", testConcurrencyRecordingPlugin)
+}
+
+func pluginExecutionTopology(serviceIds ...string) *resolved.ClusterTopology {
+	topology := &resolved.ClusterTopology{Namespace: "prod"}
+	for _, serviceId := range serviceIds {
+		topology.Services = append(topology.Services, &resolved.Service{
+			ServiceID:   serviceId,
+			Version:     "prod",
+			ServiceSpec: &v1.ServiceSpec{},
+			WorkloadSpec: &kardinal.WorkloadSpec{
+				DeploymentSpec: &apps.DeploymentSpec{
+					Template: v1.PodTemplateSpec{
+						Spec: v1.PodSpec{Containers: []v1.Container{{Name: serviceId}}},
+					},
+				},
+			},
+		})
+	}
+	return topology
+}
+
+func TestExecutePluginsRunsIndependentPluginsConcurrently(t *testing.T) {
+	testConcurrencyRecordingPlugin.maxRunning.Store(0)
+	pluginRunner, cleanUpDbFunc := getPluginRunnerWithLimits(t, plugins.PluginLimits{Concurrency: 2})
+	defer cleanUpDbFunc()
+
+	topology := pluginExecutionTopology("cartservice", "checkoutservice", "paymentservice")
+	pluginServices := map[string][]string{}
+	pluginServicesMap := map[string]*resolved.StatefulPlugin{}
+	for idx, serviceId := range []string{"cartservice", "checkoutservice", "paymentservice"} {
+		pluginServiceName := fmt.Sprintf("database-%d", idx)
+		pluginServices[pluginServiceName] = []string{serviceId}
+		pluginServicesMap[pluginServiceName] = &resolved.StatefulPlugin{Name: "builtin://test-concurrency-recording", ServiceName: pluginServiceName}
+	}
+
+	start := time.Now()
+	err := executePlugins(context.Background(), pluginRunner, topology, "dev-flow", pluginServices, pluginServicesMap)
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 3*testPluginDelay)
+	require.Equal(t, int32(2), testConcurrencyRecordingPlugin.maxRunning.Load())
+	for _, service := range topology.Services {
+		require.Equal(t, "dev-flow", service.Version)
+	}
+}
+
+func TestExecutePluginsChainsThePluginsOfTheSameService(t *testing.T) {
+	pluginRunner, cleanUpDbFunc := getPluginRunnerWithLimits(t, plugins.PluginLimits{Concurrency: 4})
+	defer cleanUpDbFunc()
+
+	topology := pluginExecutionTopology("cartservice", "checkoutservice")
+	pluginServices := map[string][]string{
+		"redis":    {"cartservice"},
+		"postgres": {"cartservice", "checkoutservice"},
+	}
+	pluginServicesMap := map[string]*resolved.StatefulPlugin{
+		"redis":    {Name: "builtin://env", ServiceName: "redis", Args: map[string]string{"REDIS": "redis-dev-flow"}},
+		"postgres": {Name: "builtin://env", ServiceName: "postgres", Args: map[string]string{"DB": "postgres-dev-flow", "REDIS": "overridden"}},
+	}
+
+	err := executePlugins(context.Background(), pluginRunner, topology, "dev-flow", pluginServices, pluginServicesMap)
+	require.NoError(t, err)
+
+	// the plugins run in the order of their service names, redis gets the spec modified by postgres
+	cartService, err := topology.GetService("cartservice")
+	require.NoError(t, err)
+	require.Equal(t, []v1.EnvVar{{Name: "DB", Value: "postgres-dev-flow"}, {Name: "REDIS", Value: "redis-dev-flow"}}, cartService.WorkloadSpec.GetTemplateSpec().Containers[0].Env)
+	checkoutService, err := topology.GetService("checkoutservice")
+	require.NoError(t, err)
+	require.Equal(t, []v1.EnvVar{{Name: "DB", Value: "postgres-dev-flow"}, {Name: "REDIS", Value: "overridden"}}, checkoutService.WorkloadSpec.GetTemplateSpec().Containers[0].Env)
+	require.Equal(t, "dev-flow", cartService.Version)
+}
+
+func TestExecutePluginsAggregatesErrors(t *testing.T) {
+	testConcurrencyRecordingPlugin.deletedFlowsMutex.Lock()
+	testConcurrencyRecordingPlugin.deletedFlows = nil
+	testConcurrencyRecordingPlugin.deletedFlowsMutex.Unlock()
+	pluginRunner, cleanUpDbFunc := getPluginRunnerWithLimits(t, plugins.PluginLimits{Concurrency: 4})
+	defer cleanUpDbFunc()
+
+	topology := pluginExecutionTopology("cartservice", "checkoutservice", "paymentservice")
+	pluginServices := map[string][]string{
+		"database-0": {"cartservice"},
+		"database-1": {"checkoutservice"},
+		"database-2": {"paymentservice"},
+	}
+	pluginServicesMap := map[string]*resolved.StatefulPlugin{
+		"database-0": {Name: "builtin://test-concurrency-recording", ServiceName: "database-0", Args: map[string]string{"fail": "true"}},
+		"database-1": {Name: "builtin://test-concurrency-recording", ServiceName: "database-1"},
+		"database-2": {Name: "builtin://test-concurrency-recording", ServiceName: "database-2", Args: map[string]string{"fail": "true"}},
+	}
+
+	err := executePlugins(context.Background(), pluginRunner, topology, "dev-flow", pluginServices, pluginServicesMap)
+	require.ErrorContains(t, err, "2 of the 3 plugins of flow 'dev-flow' failed")
+	require.ErrorContains(t, err, "error when creating plugin flow for plugin 'database-0-dev-flow'")
+	require.ErrorContains(t, err, "error when creating plugin flow for plugin 'database-2-dev-flow'")
+	pluginErr, found := plugins.GetPluginError(err)
+	require.True(t, found)
+	require.Equal(t, "builtin://test-concurrency-recording", pluginErr.Plugin)
+
+	// the topology is not modified and the flow of the plugin which succeeded is rolled back
+	for _, service := range topology.Services {
+		require.Equal(t, "prod", service.Version)
+		require.Equal(t, pluginExecutionTopology(service.ServiceID).Services[0].WorkloadSpec, service.WorkloadSpec)
+	}
+	require.Empty(t, testConcurrencyRecordingPlugin.getDeletedFlows())
+	require.NoError(t, pluginRunner.RollbackFlows(context.Background()))
+	require.Equal(t, []string{"database-1-dev-flow"}, testConcurrencyRecordingPlugin.getDeletedFlows())
+	err = pluginRunner.DeleteFlow(context.Background(), "builtin://test-concurrency-recording", "database-1-dev-flow", 0)
+	require.ErrorContains(t, err, "no config map found for flow UUID: database-1-dev-flow")
+}
+
+func TestGroupPluginExecutions(t *testing.T) {
+	executions := []*pluginExecution{
+		{pluginId: "a", serviceIds: []string{"cartservice"}},
+		{pluginId: "b", serviceIds: []string{"checkoutservice"}},
+		{pluginId: "c", serviceIds: []string{"paymentservice", "cartservice"}},
+		{pluginId: "d", serviceIds: []string{"checkoutservice", "paymentservice"}},
+		{pluginId: "e", serviceIds: []string{"frontend"}},
+	}
+
+	var groupIds [][]string
+	for _, group := range groupPluginExecutions(executions) {
+		var ids []string
+		for _, execution := range group {
+			ids = append(ids, execution.pluginId)
+		}
+		groupIds = append(groupIds, ids)
+	}
+	require.Equal(t, [][]string{{"a", "b", "c", "d"}, {"e"}}, groupIds)
+}
@@ -2,6 +2,7 @@ package flow
 
 import (
 	"fmt"
+	"net/url"
 	"regexp"
 	"slices"
 	"strings"
@@ -9,6 +10,7 @@ import (
 	"kardinal.kontrol-service/constants"
 	"kardinal.kontrol-service/types"
 	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	"kardinal.kontrol-service/types/settings"
 
 	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
@@ -27,15 +29,61 @@ import (
 	gateway "sigs.k8s.io/gateway-api/apis/v1"
 )
 
+// IstioRenderer routes the flows with Istio VirtualServices, DestinationRules and Lua EnvoyFilters running on the
+// sidecars, or on the namespace waypoint proxy in ambient mode, the Lua filters get the flow destinations from the trace router
+type IstioRenderer struct {
+	settings settings.TenantSettings
+}
+
+func NewIstioRenderer(tenantSettings settings.TenantSettings) *IstioRenderer {
+	return &IstioRenderer{
+		settings: tenantSettings,
+	}
+}
+
+func (r *IstioRenderer) isAmbient() bool {
+	return r.settings.IstioDataplaneMode == settings.AmbientDataplaneMode
+}
+
+func (r *IstioRenderer) RenderNamespace(namespace string) *v1.Namespace {
+	if r.isAmbient() {
+		return types.NewNamespaceWithIstioAmbientEnabled(namespace, r.settings.WaypointName)
+	}
+	return types.NewNamespaceWithIstioEnabled(namespace)
+}
+
+// renderAuthorizationPolicies tells if the policies requiring the trace ID header are rendered, they are only
+// supported with sidecars because ztunnel can't check request headers
+func (r *IstioRenderer) renderAuthorizationPolicies() bool {
+	if !r.settings.AuthorizationPolicies {
+		return false
+	}
+	if r.isAmbient() {
+		logrus.Warnf("Authorization policies are not rendered in ambient mode, the trace ID header can't be checked by ztunnel")
+		return false
+	}
+	return true
+}
+
+// podAnnotations are the annotations added to the pods of every service, ambient pods are captured by ztunnel
+// based on the namespace labels so they don't need any
+func (r *IstioRenderer) podAnnotations() map[string]string {
+	if r.isAmbient() {
+		return map[string]string{}
+	}
+	return istioSidecarAnnotations()
+}
+
 // RenderClusterResources returns a cluster resource for a given topology
 // Perhaps we can make this throw an error if the # of extHosts != # of versions
 // This assumes that there is a dev version of the ext host as well
-func RenderClusterResources(clusterTopology *resolved.ClusterTopology, namespace string) types.ClusterResources {
+func (r *IstioRenderer) RenderClusterResources(clusterTopology *resolved.ClusterTopology, namespace string) types.ClusterResources {
 	virtualServices := []istioclient.VirtualService{}
 	destinationRules := []istioclient.DestinationRule{}
 	envoyFilters := []istioclient.EnvoyFilter{}
 
 	authorizationPolicies := []securityv1beta1.AuthorizationPolicy{}
+	renderAuthorizationPolicies := r.renderAuthorizationPolicies()
 
 	serviceList := []v1.Service{}
 
@@ -73,6 +121,13 @@ func RenderClusterResources(clusterTopology *resolved.ClusterTopology, namespace
 
 	targetServices := lo.Uniq(append(targetHttpRouteServices, targeIngressServices...))
 
+	flowMirrors := clusterTopology.GetFlowMirrors()
+	if r.isAmbient() && len(flowMirrors) > 0 {
+		// the waypoint would mirror the requests before the Lua filters moving them to the flows
+		logrus.Warnf("The flow mirrors are not rendered in ambient mode")
+		flowMirrors = nil
+	}
+
 	groupedServices := lo.GroupBy(clusterTopology.Services, func(item *resolved.Service) string { return item.ServiceID })
 	for serviceID, services := range groupedServices {
 		logrus.Infof("Rendering service with id: '%v'.", serviceID)
@@ -85,30 +140,58 @@ func RenderClusterResources(clusterTopology *resolved.ClusterTopology, namespace
 			}
 			serviceList = append(serviceList, *getService(services[0], namespace))
 
-			virtualService, destinationRule := getVirtualService(serviceID, services, namespace)
+			virtualService, destinationRule := getVirtualService(
+				serviceID,
+				services,
+				getServiceMirrors(serviceID, services, flowMirrors),
+				clusterTopology.GetServiceResilience(serviceID),
+				namespace,
+			)
 			virtualServices = append(virtualServices, *virtualService)
 			if destinationRule != nil {
 				destinationRules = append(destinationRules, *destinationRule)
 			}
 			logrus.Infof("adding filters and authorization policies for service '%s'", serviceID)
 
-			authorizationPolicy := getAuthorizationPolicy(services[0], namespace)
-			if authorizationPolicy != nil {
-				authorizationPolicies = append(authorizationPolicies, *authorizationPolicy)
+			if renderAuthorizationPolicies {
+				authorizationPolicy := getAuthorizationPolicy(services[0], namespace, r.settings.TraceID.Header)
+				if authorizationPolicy != nil {
+					authorizationPolicies = append(authorizationPolicies, *authorizationPolicy)
+				}
 			}
 		}
 	}
 
-	envoyFiltersForService := getEnvoyFilters(clusterTopology.Services, namespace, targetServices)
-	envoyFilters = append(envoyFilters, envoyFiltersForService...)
+	entryStrategy := r.settings.FlowEntryStrategy
 
-	routes, frontServices, inboundFrontFilters := getHTTPRoutes(clusterTopology.GatewayAndRoutes, clusterTopology.Services, namespace)
+	routeCanaries := clusterTopology.GetFlowCanaries(clusterTopology.GatewayAndRoutes.ActiveFlowIDs)
+	routes, frontServices, routeFrontFilters := getHTTPRoutes(clusterTopology.GatewayAndRoutes, clusterTopology.Services, routeCanaries, namespace, r.settings)
 	serviceList = append(serviceList, frontServices...)
-	envoyFilters = append(envoyFilters, inboundFrontFilters...)
 
-	ingresses, frontServices, inboundFrontFilters := getIngresses(clusterTopology.Ingress, clusterTopology.Services, namespace)
+	ingressCanaries := clusterTopology.GetFlowCanaries(clusterTopology.Ingress.ActiveFlowIDs)
+	ingresses, frontServices, ingressFrontFilters := getIngresses(clusterTopology.Ingress, clusterTopology.Services, ingressCanaries, namespace, r.settings)
 	serviceList = append(serviceList, frontServices...)
-	envoyFilters = append(envoyFilters, inboundFrontFilters...)
+	virtualServices = append(virtualServices, getIngressCanaryVirtualServices(clusterTopology.Ingress, clusterTopology.Services, ingressCanaries, namespace)...)
+
+	// copied so appending the ingress filters can't write into the backing array of the route filters
+	inboundFrontFilters := make([]istioclient.EnvoyFilter, 0, len(routeFrontFilters)+len(ingressFrontFilters))
+	inboundFrontFilters = append(inboundFrontFilters, routeFrontFilters...)
+	inboundFrontFilters = append(inboundFrontFilters, ingressFrontFilters...)
+	gateways := getGateways(clusterTopology.GatewayAndRoutes)
+
+	flowEntryPoints := getFlowEntryPoints(clusterTopology, entryStrategy)
+	gateways = addFlowTLSListeners(r.settings.FlowTLS, gateways, flowEntryPoints)
+	ingresses = addFlowIngressTLS(r.settings.FlowTLS, ingresses, flowEntryPoints)
+
+	if r.isAmbient() {
+		envoyFilters = append(envoyFilters, getWaypointEnvoyFilters(clusterTopology.Services, namespace, r.settings, inboundFrontFilters)...)
+		gateways = append(gateways, getWaypointGateway(namespace, r.settings.WaypointName))
+	} else {
+		envoyFiltersForService := getEnvoyFilters(clusterTopology.Services, namespace, targetServices, r.settings)
+		envoyFilters = append(envoyFilters, envoyFiltersForService...)
+		envoyFilters = append(envoyFilters, inboundFrontFilters...)
+		envoyFilters = append(envoyFilters, getMirrorEnvoyFilters(clusterTopology.Services, flowMirrors, namespace, r.settings)...)
+	}
 
 	logrus.Infof("have total of %d envoy filters", len(envoyFilters))
 
@@ -117,7 +200,7 @@ func RenderClusterResources(clusterTopology *resolved.ClusterTopology, namespace
 
 		Deployments: lo.FilterMap(clusterTopology.Services, func(service *resolved.Service, _ int) (appsv1.Deployment, bool) {
 			// Deployment spec is nil for external services, don't need to add anything to cluster
-			deployment := getDeployment(service, namespace)
+			deployment := getDeployment(service, namespace, r.podAnnotations())
 			if deployment == nil {
 				return appsv1.Deployment{}, false
 			}
@@ -126,14 +209,14 @@ func RenderClusterResources(clusterTopology *resolved.ClusterTopology, namespace
 
 		StatefulSets: lo.FilterMap(clusterTopology.Services, func(service *resolved.Service, _ int) (appsv1.StatefulSet, bool) {
 			// StatefulSet spec is nil for external services, don't need to add anything to cluster
-			statefulSet := getStatefulSet(service, namespace)
+			statefulSet := getStatefulSet(service, namespace, r.podAnnotations())
 			if statefulSet == nil {
 				return appsv1.StatefulSet{}, false
 			}
 			return *statefulSet, true
 		}),
 
-		Gateways: getGateways(clusterTopology.GatewayAndRoutes),
+		Gateways: gateways,
 
 		HTTPRoutes: routes,
 
@@ -145,7 +228,11 @@ func RenderClusterResources(clusterTopology *resolved.ClusterTopology, namespace
 
 		EnvoyFilters: envoyFilters,
 
-		AuthorizationPolicies: []securityv1beta1.AuthorizationPolicy{},
+		AuthorizationPolicies: authorizationPolicies,
+
+		NetworkPolicies: getNetworkPolicies(r.settings, clusterTopology.Services, namespace),
+
+		Certificates: getFlowCertificates(r.settings.FlowTLS, flowEntryPoints),
 	}
 }
 
@@ -172,13 +259,14 @@ func getTCPRoute(service *resolved.Service, servicePort *v1.ServicePort) *v1alph
 	}
 }
 
-func getHTTPRoute(service *resolved.Service, host *string) *v1alpha3.HTTPRoute {
+// getHTTPRoute returns the route to a version of the service, with the resilience test settings of its flow if any
+func getHTTPRoute(service *resolved.Service, host *string, resilience *resolved.ServiceResilience) *v1alpha3.HTTPRoute {
 	matches := []*v1alpha3.HTTPMatchRequest{
 		{
 			Headers: map[string]*v1alpha3.StringMatch{
 				"x-kardinal-destination": {
 					MatchType: &v1alpha3.StringMatch_Exact{
-						Exact: service.ServiceID + "-" + service.Version,
+						Exact: resolved.VersionedName(service.ServiceID, service.Version),
 					},
 				},
 			},
@@ -190,14 +278,14 @@ func getHTTPRoute(service *resolved.Service, host *string) *v1alpha3.HTTPRoute {
 			Headers: map[string]*v1alpha3.StringMatch{
 				"x-kardinal-destination": {
 					MatchType: &v1alpha3.StringMatch_Exact{
-						Exact: *host + "-" + service.Version,
+						Exact: resolved.VersionedName(*host, service.Version),
 					},
 				},
 			},
 		})
 	}
 
-	return &v1alpha3.HTTPRoute{
+	route := &v1alpha3.HTTPRoute{
 		Match: matches,
 		Route: []*v1alpha3.HTTPRouteDestination{
 			{
@@ -208,9 +296,23 @@ func getHTTPRoute(service *resolved.Service, host *string) *v1alpha3.HTTPRoute {
 			},
 		},
 	}
+	if resilience != nil {
+		setHTTPRouteResilience(route, service.ServiceID, *resilience)
+	}
+	return route
 }
 
-func getVirtualService(serviceID string, services []*resolved.Service, namespace string) (*istioclient.VirtualService, *istioclient.DestinationRule) {
+// getVirtualService returns the routes to the versions of the service, the baseline route copies its requests to the
+// mirroring flow versions and the flow routes use the resilience test settings of their flow, by flow ID
+func getVirtualService(
+	serviceID string,
+	services []*resolved.Service,
+	mirrors []serviceMirror,
+	resilience map[string]resolved.ServiceResilience,
+	namespace string,
+) (*istioclient.VirtualService, *istioclient.DestinationRule) {
+	// the baseline topology (or prod topology) flow ID and flow version are equal to the namespace these three should use same value
+	baselineFlowVersion := namespace
 	httpRoutes := []*v1alpha3.HTTPRoute{}
 	tcpRoutes := []*v1alpha3.TCPRoute{}
 	destinationRule := getDestinationRule(serviceID, services, namespace)
@@ -221,7 +323,15 @@ func getVirtualService(serviceID string, services []*resolved.Service, namespace
 		var flowHost *string
 
 		if servicePort.AppProtocol != nil && *servicePort.AppProtocol == "HTTP" {
-			httpRoutes = append(httpRoutes, getHTTPRoute(service, flowHost))
+			var flowResilience *resolved.ServiceResilience
+			if serviceResilience, found := resilience[service.Version]; found {
+				flowResilience = &serviceResilience
+			}
+			httpRoute := getHTTPRoute(service, flowHost, flowResilience)
+			if service.Version == baselineFlowVersion && len(mirrors) > 0 {
+				setHTTPRouteMirrors(httpRoute, serviceID, mirrors)
+			}
+			httpRoutes = append(httpRoutes, httpRoute)
 		} else {
 			tcpRoutes = append(tcpRoutes, getTCPRoute(service, servicePort))
 		}
@@ -310,7 +420,17 @@ func getService(service *resolved.Service, namespace string) *v1.Service {
 	}
 }
 
-func getStatefulSet(service *resolved.Service, namespace string) *appsv1.StatefulSet {
+// istioSidecarAnnotations are the pod annotations used to inject the Istio sidecar running the Lua filters
+func istioSidecarAnnotations() map[string]string {
+	return map[string]string{
+		"sidecar.istio.io/inject": "true",
+		// TODO: make this a flag to help debugging
+		// One can view the logs with: kubeclt logs -f -l app=<serviceID> -n <namespace> -c istio-proxy
+		"sidecar.istio.io/componentLogLevel": "lua:info",
+	}
+}
+
+func getStatefulSet(service *resolved.Service, namespace string, podAnnotations map[string]string) *appsv1.StatefulSet {
 	if !service.WorkloadSpec.IsStatefulSet() {
 		return nil
 	}
@@ -321,7 +441,7 @@ func getStatefulSet(service *resolved.Service, namespace string) *appsv1.Statefu
 			Kind:       "StatefulSet",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      fmt.Sprintf("%s-%s", service.ServiceID, service.Version),
+			Name:      resolved.VersionedName(service.ServiceID, service.Version),
 			Namespace: namespace,
 			Labels: map[string]string{
 				"app":     service.ServiceID,
@@ -340,12 +460,7 @@ func getStatefulSet(service *resolved.Service, namespace string) *appsv1.Statefu
 		},
 	}
 	statefulSet.Spec.Template.ObjectMeta = metav1.ObjectMeta{
-		Annotations: map[string]string{
-			"sidecar.istio.io/inject": "true",
-			// TODO: make this a flag to help debugging
-			// One can view the logs with: kubeclt logs -f -l app=<serviceID> -n <namespace> -c istio-proxy
-			"sidecar.istio.io/componentLogLevel": "lua:info",
-		},
+		Annotations: podAnnotations,
 		Labels: map[string]string{
 			"app":     service.ServiceID,
 			"version": service.Version,
@@ -355,7 +470,7 @@ func getStatefulSet(service *resolved.Service, namespace string) *appsv1.Statefu
 	return &statefulSet
 }
 
-func getDeployment(service *resolved.Service, namespace string) *appsv1.Deployment {
+func getDeployment(service *resolved.Service, namespace string, podAnnotations map[string]string) *appsv1.Deployment {
 	if !service.WorkloadSpec.IsDeployment() {
 		return nil
 	}
@@ -366,7 +481,7 @@ func getDeployment(service *resolved.Service, namespace string) *appsv1.Deployme
 			Kind:       "Deployment",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      fmt.Sprintf("%s-%s", service.ServiceID, service.Version),
+			Name:      resolved.VersionedName(service.ServiceID, service.Version),
 			Namespace: namespace,
 			Labels: map[string]string{
 				"app":     service.ServiceID,
@@ -393,12 +508,7 @@ func getDeployment(service *resolved.Service, namespace string) *appsv1.Deployme
 		},
 	}
 	deployment.Spec.Template.ObjectMeta = metav1.ObjectMeta{
-		Annotations: map[string]string{
-			"sidecar.istio.io/inject": "true",
-			// TODO: make this a flag to help debugging
-			// One can view the logs with: kubeclt logs -f -l app=<serviceID> -n <namespace> -c istio-proxy
-			"sidecar.istio.io/componentLogLevel": "lua:info",
-		},
+		Annotations: podAnnotations,
 		Labels: map[string]string{
 			"app":     service.ServiceID,
 			"version": service.Version,
@@ -437,7 +547,7 @@ func getVersionedService(service *resolved.Service, flowVersion string, namespac
 			Kind:       "Service",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      fmt.Sprintf("%s-%s", service.ServiceID, flowVersion),
+			Name:      resolved.VersionedName(service.ServiceID, flowVersion),
 			Namespace: namespace,
 			Labels: map[string]string{
 				"app":     service.ServiceID,
@@ -451,9 +561,15 @@ func getVersionedService(service *resolved.Service, flowVersion string, namespac
 func getIngresses(
 	ingress *resolved.Ingress,
 	allServices []*resolved.Service,
+	canaries []resolved.FlowCanaryEntry,
 	namespace string,
+	tenantSettings settings.TenantSettings,
 ) ([]net.Ingress, []v1.Service, []istioclient.EnvoyFilter) {
 	ingressList := []net.Ingress{}
+	entryStrategy := tenantSettings.FlowEntryStrategy
+	// the ingresses can't match headers, they use the path prefix with the header strategy
+	ingressSettings := tenantSettings
+	ingressSettings.FlowEntryStrategy = resolved.IngressEntryStrategy(entryStrategy)
 	frontServices := map[string]v1.Service{}
 	filters := []istioclient.EnvoyFilter{}
 
@@ -469,13 +585,13 @@ func getIngresses(
 
 				rule := ruleOriginal.DeepCopy()
 
-				flowHostname := resolved.ReplaceOrAddSubdomain(rule.Host, activeFlowID)
-				rule.Host = flowHostname
+				// the baseline topology (or prod topology) flow ID and namespace are equal
+				setIngressRuleFlowEntry(rule, activeFlowID, namespace, entryStrategy)
 				hostnames := []string{
-					flowHostname,
+					rule.Host,
 				}
 
-				for _, pathOriginal := range ruleOriginal.HTTP.Paths {
+				for _, pathOriginal := range rule.HTTP.Paths {
 					target, found := findBackendRefService(pathOriginal.Backend.Service.Name, activeFlowID, allServices)
 					// fallback to baseline if backend not found at the active flow
 					// the baseline topology (or prod topology) flow ID and flow version are equal to the namespace these three should use same value
@@ -485,7 +601,7 @@ func getIngresses(
 					}
 					if found {
 						path := *pathOriginal.DeepCopy()
-						idVersion := fmt.Sprintf("%s-%s", target.ServiceID, activeFlowID)
+						idVersion := resolved.VersionedName(target.ServiceID, activeFlowID)
 						_, serviceAlreadyAdded := frontServices[idVersion]
 						if !serviceAlreadyAdded {
 							frontServices[idVersion] = getVersionedService(target, activeFlowID, namespace)
@@ -494,10 +610,10 @@ func getIngresses(
 
 							// Set Envoy FIlter for the service
 							filter := &externalInboudFilter{
-								filter: generateDynamicLuaScript(allServices, activeFlowID, namespace, hostnames),
-								name:   strings.Join(hostnames, "-"),
+								filter: generateDynamicLuaScript(allServices, activeFlowID, namespace, hostnames, getCanaryFlowIDs(canaries), ingressSettings),
+								name:   getExternalFilterName(hostnames, activeFlowID, entryStrategy),
 							}
-							inboundFilter := getInboundFilter(target.ServiceID, namespace, -1, &target.Version, filter)
+							inboundFilter := getInboundFilter(target.ServiceID, namespace, -1, &target.Version, filter, tenantSettings)
 							logrus.Debugf("Adding inbound filter to setup routing table for flow '%s' on service '%s', version '%s'", activeFlowID, target.ServiceID, target.Version)
 							filters = append(filters, inboundFilter)
 						}
@@ -525,7 +641,9 @@ func getIngresses(
 func getHTTPRoutes(
 	gatewayAndRoutes *resolved.GatewayAndRoutes,
 	allServices []*resolved.Service,
+	canaries []resolved.FlowCanaryEntry,
 	namespace string,
+	tenantSettings settings.TenantSettings,
 ) ([]gateway.HTTPRoute, []v1.Service, []istioclient.EnvoyFilter) {
 	routes := []gateway.HTTPRoute{}
 	frontServices := map[string]v1.Service{}
@@ -534,65 +652,78 @@ func getHTTPRoutes(
 	for _, activeFlowID := range gatewayAndRoutes.ActiveFlowIDs {
 		logrus.Infof("Setting gateway route for active flow ID: %v", activeFlowID)
 		for routeId, routeSpecOriginal := range gatewayAndRoutes.GatewayRoutes {
-			routeSpec := routeSpecOriginal.DeepCopy()
-
-			routeSpec.Hostnames = lo.Map(routeSpec.Hostnames, func(hostname gateway.Hostname, _ int) gateway.Hostname {
-				return gateway.Hostname(resolved.ReplaceOrAddSubdomain(string(hostname), activeFlowID))
-			})
-
-			for _, rule := range routeSpec.Rules {
-				for refIx, ref := range rule.BackendRefs {
-					target, found := findBackendRefService(string(ref.Name), activeFlowID, allServices)
-					// fallback to baseline if backend not found at the active flow
-					// the baseline topology (or prod topology) flow ID and flow version are equal to the namespace these three should use same value
-					baselineFlowVersion := namespace
-					if !found {
-						target, found = findBackendRefService(string(ref.Name), baselineFlowVersion, allServices)
-					}
-					if found {
-						idVersion := fmt.Sprintf("%s-%s", target.ServiceID, activeFlowID)
-						_, serviceAlreadyAdded := frontServices[idVersion]
-						if !serviceAlreadyAdded {
-							frontServices[idVersion] = getVersionedService(target, activeFlowID, namespace)
+			// the baseline topology (or prod topology) flow ID and namespace are equal
+			for _, flowRoute := range getFlowRouteSpecs(routeSpecOriginal, activeFlowID, namespace, tenantSettings, false) {
+				routeSpec := flowRoute.spec
+				backendServices := map[gateway.ObjectName]*resolved.Service{}
+
+				for _, rule := range routeSpec.Rules {
+					for refIx, ref := range rule.BackendRefs {
+						target, found := findBackendRefService(string(ref.Name), activeFlowID, allServices)
+						// fallback to baseline if backend not found at the active flow
+						// the baseline topology (or prod topology) flow ID and flow version are equal to the namespace these three should use same value
+						baselineFlowVersion := namespace
+						if !found {
+							target, found = findBackendRefService(string(ref.Name), baselineFlowVersion, allServices)
+						}
+						if found {
+							idVersion := resolved.VersionedName(target.ServiceID, activeFlowID)
+							// several rules can use the same backend, all of them are sent to the flow version
 							ref.Name = gateway.ObjectName(idVersion)
 							rule.BackendRefs[refIx] = ref
-
-							hostnames := lo.Map(routeSpec.Hostnames, func(item gateway.Hostname, _ int) string { return string(item) })
-							// Set Envoy FIlter for the service
-							filter := &externalInboudFilter{
-								filter: generateDynamicLuaScript(allServices, activeFlowID, namespace, hostnames),
-								name:   strings.Join(hostnames, "-"),
+							backendServices[ref.Name] = target
+							_, serviceAlreadyAdded := frontServices[idVersion]
+							if !serviceAlreadyAdded {
+								frontServices[idVersion] = getVersionedService(target, activeFlowID, namespace)
+
+								hostnames := lo.Map(routeSpec.Hostnames, func(item gateway.Hostname, _ int) string { return string(item) })
+								// Set Envoy FIlter for the service
+								filter := &externalInboudFilter{
+									filter: generateDynamicLuaScript(allServices, activeFlowID, namespace, hostnames, getCanaryFlowIDs(canaries), tenantSettings),
+									name:   getExternalFilterName(hostnames, activeFlowID, tenantSettings.FlowEntryStrategy),
+								}
+								inboundFilter := getInboundFilter(target.ServiceID, namespace, -1, &target.Version, filter, tenantSettings)
+								logrus.Debugf("Adding inbound filter to setup routing table for flow '%s' on service '%s', version '%s'", activeFlowID, target.ServiceID, target.Version)
+								filters = append(filters, inboundFilter)
 							}
-							inboundFilter := getInboundFilter(target.ServiceID, namespace, -1, &target.Version, filter)
-							logrus.Debugf("Adding inbound filter to setup routing table for flow '%s' on service '%s', version '%s'", activeFlowID, target.ServiceID, target.Version)
-							filters = append(filters, inboundFilter)
+						} else {
+							logrus.Errorf(">> service not found %v", ref.Name)
 						}
-					} else {
-						logrus.Errorf(">> service not found %v", ref.Name)
 					}
 				}
-			}
 
-			for parentRefIx, parentRef := range routeSpec.ParentRefs {
-				if parentRef.Namespace == nil || string(*parentRef.Namespace) == "" {
-					defaultNS := gateway.Namespace("default")
-					parentRef.Namespace = &defaultNS
+				if activeFlowID == namespace {
+					// the flow front services are added by the flows, the canaries are only rendered for the active flows
+					routeSpec.Rules = addFlowCanaryRules(routeSpec.Rules, canaries, namespace, func(ref gateway.HTTPBackendRef, flowID string) (gateway.ObjectName, bool) {
+						target, found := backendServices[ref.Name]
+						if !found {
+							return "", false
+						}
+						return gateway.ObjectName(resolved.VersionedName(target.ServiceID, flowID)), true
+					})
 				}
-				routeSpec.ParentRefs[parentRefIx] = parentRef
-			}
 
-			route := gateway.HTTPRoute{
-				TypeMeta: metav1.TypeMeta{
-					APIVersion: "gateway.networking.k8s.io/v1",
-					Kind:       "HTTPRoute",
-				},
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      fmt.Sprintf("http-route-%d-%s", routeId, activeFlowID),
-					Namespace: namespace,
-				},
-				Spec: *routeSpec,
+				for parentRefIx, parentRef := range routeSpec.ParentRefs {
+					if parentRef.Namespace == nil || string(*parentRef.Namespace) == "" {
+						defaultNS := gateway.Namespace("default")
+						parentRef.Namespace = &defaultNS
+					}
+					routeSpec.ParentRefs[parentRefIx] = parentRef
+				}
+
+				route := gateway.HTTPRoute{
+					TypeMeta: metav1.TypeMeta{
+						APIVersion: "gateway.networking.k8s.io/v1",
+						Kind:       "HTTPRoute",
+					},
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      flowRoute.getName(routeId, activeFlowID),
+						Namespace: namespace,
+					},
+					Spec: *routeSpec,
+				}
+				routes = append(routes, route)
 			}
-			routes = append(routes, route)
 		}
 	}
 
@@ -603,11 +734,22 @@ func getEnvoyFilters(
 	allServices []*resolved.Service,
 	namespace string,
 	targetServices []string,
+	tenantSettings settings.TenantSettings,
 ) []istioclient.EnvoyFilter {
 	filters := []istioclient.EnvoyFilter{}
 
 	// HttpRoute (workload) are applied at the serviceID level, not the serviceID-version level
 	groupedServices := lo.GroupBy(allServices, func(item *resolved.Service) string { return item.ServiceID })
+
+	// the baseline topology (or prod topology) flow ID and flow version are equal to the namespace these three should use same value
+	baselineFlowVersion := namespace
+	// the outbound filters fall back to these destinations when the trace router can't be reached
+	baselineDestinations := lo.MapValues(groupedServices, func(_ []*resolved.Service, serviceID string) string {
+		return resolved.VersionedName(serviceID, baselineFlowVersion)
+	})
+	// the outbound filters of the flow header routing modes find the flow destinations without the trace router
+	flowDestinations := getFlowDestinations(allServices, baselineFlowVersion)
+
 	for serviceID, services := range groupedServices {
 		if len(services) == 0 {
 			continue
@@ -626,41 +768,137 @@ func getEnvoyFilters(
 		// more inbound EnvoyFilters for routing routing traffic on frontend services are added by the getHTTPRoutes function
 		if isTargertService {
 			logrus.Debugf("Adding inbound filter to enforce trace IDs for service '%s'", serviceID)
-			inboundFilter := getInboundFilter(serviceID, namespace, 0, nil, &traceIdEnforcer{})
+			inboundFilter := getInboundFilter(serviceID, namespace, 0, nil, &traceIdEnforcer{settings: tenantSettings}, tenantSettings)
 			filters = append(filters, inboundFilter)
-		} else {
+		} else if isTraceIDRequired(tenantSettings) {
 			logrus.Debugf("Adding inbound filter for inner service '%s'", serviceID)
-			inboundFilter := getInboundFilter(serviceID, namespace, 0, nil, &innerInboundFilter{})
+			inboundFilter := getInboundFilter(serviceID, namespace, 0, nil, &innerInboundFilter{settings: tenantSettings}, tenantSettings)
 			filters = append(filters, inboundFilter)
 		}
 
-		outboundFilter := getOutboundFilter(serviceID, namespace)
+		// in the edge mode the services targeted by a gateway or an ingress also start traces, e.g. for webhooks
+		generateMissingTraceID := isTargertService && tenantSettings.TraceID.Mode == settings.EdgeTraceIDMode
+		outboundFilter := getOutboundFilter(serviceID, namespace, baselineDestinations, flowDestinations, tenantSettings, generateMissingTraceID)
 		filters = append(filters, outboundFilter)
 	}
 
 	return filters
 }
 
+// getWaypointEnvoyFilters returns the Lua filters of the ambient mode, all of them run in the namespace waypoint
+// proxy, which sees every request sent to the services of the namespace. The chain is: the trace ID enforcer, the
+// filters setting the routing table of the flows entered from a gateway or an ingress and finally the filter setting
+// the destination header used by the VirtualServices. There is no per service inbound filter requiring the trace ID
+// header because the waypoint can't tell the requests coming from a gateway from the ones between services.
+func getWaypointEnvoyFilters(
+	allServices []*resolved.Service,
+	namespace string,
+	tenantSettings settings.TenantSettings,
+	inboundFrontFilters []istioclient.EnvoyFilter,
+) []istioclient.EnvoyFilter {
+	waypointName := tenantSettings.WaypointName
+	// the baseline topology (or prod topology) flow ID and flow version and host are equal to the namespace these four should use same value
+	baselineFlowVersion := namespace
+	baselineHostName := namespace
+
+	groupedServices := lo.GroupBy(allServices, func(item *resolved.Service) string { return item.ServiceID })
+	baselineDestinations := lo.MapValues(groupedServices, func(_ []*resolved.Service, serviceID string) string {
+		return resolved.VersionedName(serviceID, baselineFlowVersion)
+	})
+	flowDestinations := getFlowDestinations(allServices, baselineFlowVersion)
+
+	// filters with higher priority are applied later and, being inserted before the others, run first
+	enforcer := &traceIdEnforcer{settings: tenantSettings}
+	filters := []istioclient.EnvoyFilter{
+		getLuaEnvoyFilter(
+			resolved.DNSLabel(waypointName, enforcer.getName()),
+			namespace,
+			0,
+			waypointSelector(waypointName),
+			v1alpha3.EnvoyFilter_ANY,
+			enforcer.getFilter(),
+		),
+	}
+
+	for _, frontFilter := range inboundFrontFilters {
+		filter := frontFilter.DeepCopy()
+		filter.Spec.WorkloadSelector.Labels = waypointSelector(waypointName)
+		for _, patch := range filter.Spec.ConfigPatches {
+			patch.Match.Context = v1alpha3.EnvoyFilter_ANY
+		}
+		filters = append(filters, *filter)
+	}
+
+	filters = append(filters, getLuaEnvoyFilter(
+		resolved.DNSLabel(waypointName, "router"),
+		namespace,
+		-2,
+		waypointSelector(waypointName),
+		v1alpha3.EnvoyFilter_ANY,
+		// the waypoint can't tell the requests of the edge services from the other ones, so it never generates trace IDs
+		getOutgoingRequestTraceIDFilter(waypointName, baselineHostName, baselineDestinations, flowDestinations, tenantSettings, false),
+	))
+
+	return filters
+}
+
+func waypointSelector(waypointName string) map[string]string {
+	return map[string]string{
+		"gateway.networking.k8s.io/gateway-name": waypointName,
+	}
+}
+
+// getWaypointGateway returns the waypoint proxy used by the services of the namespace in ambient mode
+func getWaypointGateway(namespace string, waypointName string) gateway.Gateway {
+	return gateway.Gateway{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "gateway.networking.k8s.io/v1",
+			Kind:       "Gateway",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      waypointName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"istio.io/waypoint-for": "service",
+			},
+		},
+		Spec: gateway.GatewaySpec{
+			GatewayClassName: "istio-waypoint",
+			Listeners: []gateway.Listener{
+				{
+					Name:     "mesh",
+					Port:     15008,
+					Protocol: "HBONE",
+				},
+			},
+		},
+	}
+}
+
 type luaFilter interface {
 	getName() string
 	getFilter() string
 }
 
-type innerInboundFilter struct{}
+type innerInboundFilter struct {
+	settings settings.TenantSettings
+}
 
 type externalInboudFilter struct {
 	filter string
 	name   string
 }
 
-type traceIdEnforcer struct{}
+type traceIdEnforcer struct {
+	settings settings.TenantSettings
+}
 
 func (f *innerInboundFilter) getName() string {
 	return "inbound-router"
 }
 
 func (f *innerInboundFilter) getFilter() string {
-	return inboundRequestTraceIDFilter
+	return getInboundRequestTraceIDFilter(f.settings)
 }
 
 func (f *externalInboudFilter) getName() string {
@@ -677,10 +915,18 @@ func (f *traceIdEnforcer) getName() string {
 }
 
 func (f *traceIdEnforcer) getFilter() string {
-	return generateTraceIDEnforcerLuaScript()
+	return generateTraceIDEnforcerLuaScript(f.settings, f.getName())
 }
 
-func getInboundFilter(serviceID, namespace string, priority int32, versionSelector *string, luaFilter luaFilter) istioclient.EnvoyFilter {
+// getInboundFilter returns the inbound EnvoyFilter of the service, the trace ID filter of the tenant is used when no Lua
+// filter is given
+func getInboundFilter(
+	serviceID, namespace string,
+	priority int32,
+	versionSelector *string,
+	luaFilter luaFilter,
+	tenantSettings settings.TenantSettings,
+) istioclient.EnvoyFilter {
 	labelSelector := map[string]string{
 		"app": serviceID,
 	}
@@ -689,94 +935,65 @@ func getInboundFilter(serviceID, namespace string, priority int32, versionSelect
 	}
 
 	if luaFilter == nil {
-		luaFilter = &innerInboundFilter{}
+		luaFilter = &innerInboundFilter{settings: tenantSettings}
 	}
 	filterName := luaFilter.getName()
 	ids := []*string{&serviceID, versionSelector, &filterName}
-	name := strings.Join(lo.FilterMap(ids, func(id *string, _ int) (string, bool) {
+	name := resolved.DNSLabel(lo.FilterMap(ids, func(id *string, _ int) (string, bool) {
 		if id != nil {
 			return *id, true
 		} else {
 			return "", false
 		}
-	}), "-")
+	})...)
 
-	return istioclient.EnvoyFilter{
-		TypeMeta: metav1.TypeMeta{
-			APIVersion: "networking.istio.io/v1alpha3",
-			Kind:       "EnvoyFilter",
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      name,
-			Namespace: namespace,
-		},
-		Spec: v1alpha3.EnvoyFilter{
-			Priority: priority,
-			WorkloadSelector: &v1alpha3.WorkloadSelector{
-				Labels: labelSelector,
-			},
-			ConfigPatches: []*v1alpha3.EnvoyFilter_EnvoyConfigObjectPatch{
-				{
-					ApplyTo: v1alpha3.EnvoyFilter_HTTP_FILTER,
-					Match: &v1alpha3.EnvoyFilter_EnvoyConfigObjectMatch{
-						Context: v1alpha3.EnvoyFilter_SIDECAR_INBOUND,
-						ObjectTypes: &v1alpha3.EnvoyFilter_EnvoyConfigObjectMatch_Listener{
-							Listener: &v1alpha3.EnvoyFilter_ListenerMatch{
-								FilterChain: &v1alpha3.EnvoyFilter_ListenerMatch_FilterChainMatch{
-									Filter: &v1alpha3.EnvoyFilter_ListenerMatch_FilterMatch{
-										Name: "envoy.filters.network.http_connection_manager",
-									},
-								},
-							},
-						},
-					},
-					Patch: &v1alpha3.EnvoyFilter_Patch{
-						Operation: v1alpha3.EnvoyFilter_Patch_INSERT_BEFORE,
-						Value: &structpb.Struct{
-							Fields: map[string]*structpb.Value{
-								"name": {Kind: &structpb.Value_StringValue{StringValue: "envoy.lua"}},
-								"typed_config": {
-									Kind: &structpb.Value_StructValue{
-										StructValue: &structpb.Struct{
-											Fields: map[string]*structpb.Value{
-												"@type":      {Kind: &structpb.Value_StringValue{StringValue: luaFilterType}},
-												"inlineCode": {Kind: &structpb.Value_StringValue{StringValue: luaFilter.getFilter()}},
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-		},
-	}
+	return getLuaEnvoyFilter(name, namespace, priority, labelSelector, v1alpha3.EnvoyFilter_SIDECAR_INBOUND, luaFilter.getFilter())
 }
 
-func getOutboundFilter(serviceID, namespace string) istioclient.EnvoyFilter {
+func getOutboundFilter(
+	serviceID string,
+	namespace string,
+	baselineDestinations map[string]string,
+	flowDestinations map[string]map[string]string,
+	tenantSettings settings.TenantSettings,
+	generateMissingTraceID bool,
+) istioclient.EnvoyFilter {
 	// the baseline topology (or prod topology) flow ID and flow version and host are equal to the namespace these four should use same value
 	baselineHostName := namespace
+	labelSelector := map[string]string{
+		"app": serviceID,
+	}
+	return getLuaEnvoyFilter(
+		resolved.DNSLabel(serviceID, "outbound-router"),
+		namespace,
+		0,
+		labelSelector,
+		v1alpha3.EnvoyFilter_SIDECAR_OUTBOUND,
+		getOutgoingRequestTraceIDFilter(serviceID, baselineHostName, baselineDestinations, flowDestinations, tenantSettings, generateMissingTraceID),
+	)
+}
+
+// getLuaEnvoyFilter returns an EnvoyFilter inserting the Lua code in the HTTP filter chain of the selected workloads
+func getLuaEnvoyFilter(name, namespace string, priority int32, labelSelector map[string]string, context v1alpha3.EnvoyFilter_PatchContext, luaCode string) istioclient.EnvoyFilter {
 	return istioclient.EnvoyFilter{
 		TypeMeta: metav1.TypeMeta{
 			APIVersion: "networking.istio.io/v1alpha3",
 			Kind:       "EnvoyFilter",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      fmt.Sprintf("%s-outbound-router", serviceID),
+			Name:      name,
 			Namespace: namespace,
 		},
 		Spec: v1alpha3.EnvoyFilter{
+			Priority: priority,
 			WorkloadSelector: &v1alpha3.WorkloadSelector{
-				Labels: map[string]string{
-					"app": serviceID,
-				},
+				Labels: labelSelector,
 			},
 			ConfigPatches: []*v1alpha3.EnvoyFilter_EnvoyConfigObjectPatch{
 				{
 					ApplyTo: v1alpha3.EnvoyFilter_HTTP_FILTER,
 					Match: &v1alpha3.EnvoyFilter_EnvoyConfigObjectMatch{
-						Context: v1alpha3.EnvoyFilter_SIDECAR_OUTBOUND,
+						Context: context,
 						ObjectTypes: &v1alpha3.EnvoyFilter_EnvoyConfigObjectMatch_Listener{
 							Listener: &v1alpha3.EnvoyFilter_ListenerMatch{
 								FilterChain: &v1alpha3.EnvoyFilter_ListenerMatch_FilterChainMatch{
@@ -797,7 +1014,7 @@ func getOutboundFilter(serviceID, namespace string) istioclient.EnvoyFilter {
 										StructValue: &structpb.Struct{
 											Fields: map[string]*structpb.Value{
 												"@type":      {Kind: &structpb.Value_StringValue{StringValue: luaFilterType}},
-												"inlineCode": {Kind: &structpb.Value_StringValue{StringValue: getOutgoingRequestTraceIDFilter(baselineHostName)}},
+												"inlineCode": {Kind: &structpb.Value_StringValue{StringValue: luaCode}},
 											},
 										},
 									},
@@ -812,14 +1029,14 @@ func getOutboundFilter(serviceID, namespace string) istioclient.EnvoyFilter {
 }
 
 // getAuthorizationPolicy returns an authorization policy that denies requests with the missing header
-// this is not really needed as we have an inbound rule
-func getAuthorizationPolicy(service *resolved.Service, namespace string) *securityv1beta1.AuthorizationPolicy {
+// this is not really needed as we have an inbound rule, it's only rendered if enabled in the tenant settings
+func getAuthorizationPolicy(service *resolved.Service, namespace string, traceIDHeader string) *securityv1beta1.AuthorizationPolicy {
 	if !service.IsHTTP() {
 		return nil
 	}
 	return &securityv1beta1.AuthorizationPolicy{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      fmt.Sprintf("%s-require-trace-id", service.ServiceID),
+			Name:      resolved.DNSLabel(service.ServiceID, "require-trace-id"),
 			Namespace: namespace,
 		},
 		Spec: securityapi.AuthorizationPolicy{
@@ -833,7 +1050,7 @@ func getAuthorizationPolicy(service *resolved.Service, namespace string) *securi
 				{
 					When: []*securityapi.Condition{
 						{
-							Key:       "request.headers[x-kardinal-trace-id]",
+							Key:       fmt.Sprintf("request.headers[%s]", traceIDHeader),
 							NotValues: []string{"*"},
 						},
 					},
@@ -843,9 +1060,40 @@ func getAuthorizationPolicy(service *resolved.Service, namespace string) *securi
 	}
 }
 
-func generateTraceIDEnforcerLuaScript() string {
+// generateTraceIDEnforcerLuaScript returns the Lua filter making sure the requests entering the cluster have a trace
+// ID, with the sticky flow cookie it also sets the flow ID header from the cookie for the inbound filters of the flows
+func generateTraceIDEnforcerLuaScript(tenantSettings settings.TenantSettings, filterName string) string {
+	var cookieFlowIDFunction, stickyFlowLookup string
+	if tenantSettings.StickyFlowCookie.Enabled {
+		cookieFlowIDFunction = generateLuaCookieFlowIDFunction()
+		stickyFlowLookup = fmt.Sprintf(`
+  if not headers:get("%s") then
+    local cookie_flow_id = get_cookie_flow_id(headers)
+    if cookie_flow_id then
+      request_handle:headers():add("%s", cookie_flow_id)
+    end
+  end
+`, flowIDHeader, flowIDHeader)
+	}
+
+	traceIDFunctions := generateLuaTraceIDFunctions(tenantSettings, filterName)
+	var missingTraceID string
+	switch {
+	case tenantSettings.TraceID.Mode == settings.StrictTraceIDMode:
+		missingTraceID = indentLua(luaMissingTraceIDRejection, "  ")
+	case tenantSettings.TraceID.Traceparent || isFlowHeaderRouting(tenantSettings):
+		// the trace ID is generated locally, the ones returned by the trace-router may not be valid W3C trace IDs and
+		// the flow header routing modes don't call the trace-router
+		missingTraceID = indentLua(luaMissingTraceIDGeneration, "  ")
+	default:
+		missingTraceID = luaTraceRouterTraceIDGeneration
+	}
+
 	return fmt.Sprintf(`
 %s
+%s
+%s
+%s
 
 function get_trace_id(headers)
   for _, header_name in ipairs(trace_header_priorities) do
@@ -860,7 +1108,7 @@ end
 
 function envoy_on_request(request_handle)
   local headers = request_handle:headers()
-  local trace_id = headers:get("x-kardinal-trace-id")
+  local trace_id = headers:get(trace_id_header)
   local hostname = headers:get(":authority")
 
   request_handle:logInfo("Enforcing trace ID header - Initial trace ID: " .. (trace_id or "none") .. ", Hostname: " .. (hostname or "none"))
@@ -871,54 +1119,93 @@ function envoy_on_request(request_handle)
       trace_id = found_trace_id
       request_handle:logInfo("Using existing trace ID from " .. source_header .. ": " .. trace_id)
     else
-      local generate_headers, generate_body = request_handle:httpCall(
-        "outbound|8080||trace-router.default.svc.cluster.local",
-        {
-         [":method"] = "GET",
-         [":path"] = "/generate-trace-id",
-         [":authority"] = "trace-router.default.svc.cluster.local"
-        },
-        "",
-        5000
-      )
-
-      if generate_headers and generate_headers[":status"] == "200" then
-        trace_id = generate_body
-        request_handle:logInfo("Received trace ID from trace-router: " .. trace_id)
-      else
-        trace_id = string.format("%%032x", math.random(2^128 - 1))
-        request_handle:logWarn("Failed to get trace ID from trace-router, using locally generated: " .. trace_id)
-      end
+%s
     end
 
-    request_handle:headers():add("x-kardinal-trace-id", trace_id)
+    request_handle:headers():add(trace_id_header, trace_id)
   end
-
+%s
 end
-`, generateLuaTraceHeaderPriorities())
+`, generateLuaTraceHeaders(tenantSettings), generateLuaTraceRouter(tenantSettings), traceIDFunctions, cookieFlowIDFunction, missingTraceID, stickyFlowLookup)
 }
 
-func generateDynamicLuaScript(allServices []*resolved.Service, flowId string, namespace string, hostnames []string) string {
-	// fallback to baseline if backend not found at the active flow
+// generateDynamicLuaScript returns the Lua filter setting the routing table of the requests entering the flow, the
+// flow is selected by the hostname with the subdomain entry strategy and by the flow ID header, path prefix, join link
+// or sticky cookie otherwise, the canary flow IDs are the flows receiving part of the baseline traffic
+func generateDynamicLuaScript(
+	allServices []*resolved.Service,
+	flowId string,
+	namespace string,
+	hostnames []string,
+	canaryFlowIDs []string,
+	tenantSettings settings.TenantSettings,
+) string {
+	flowLookup := newLuaFlowLookup(flowId, hostnames, tenantSettings)
+	flowLookup.setCanaries(canaryFlowIDs, namespace)
+
+	if isFlowHeaderRouting(tenantSettings) {
+		knownFlowIDs := append(append(getTopologyFlowIDs(allServices, namespace), flowId), canaryFlowIDs...)
+		return generateFlowHeaderEntryLuaScript(flowLookup, knownFlowIDs, tenantSettings)
+	}
+
 	// the baseline topology (or prod topology) flow ID and flow version are equal to the namespace these three should use same value
 	baselineFlowVersion := namespace
+	setRouteCalls := generateLuaSetRouteCalls(allServices, flowId, baselineFlowVersion, func(service *resolved.Service) string {
+		if service.IsShared {
+			return flowLookup.sharedCondition(service.OriginalVersionIfShared)
+		}
+		return flowLookup.condition()
+	})
+
+	return fmt.Sprintf(`
+%s
+%s
+%s
+function envoy_on_request(request_handle)
+  local headers = request_handle:headers()
+  local trace_id = headers:get(trace_id_header)
+  local hostname = headers:get(":authority")
+%s
+  request_handle:logInfo("Setting routing table for flowId %s, trace ID: " .. (trace_id or "none") .. ", Hostname: " .. (hostname or "none"))
+
+  if not trace_id then
+    request_handle:logWarn("Missing trace ID from " .. source_header .. ", make sure traceId enforcer filter was apply before.")
+  else
+    %s
+  end
+
+end
+%s`, generateLuaTraceHeaders(tenantSettings), generateLuaTraceRouter(tenantSettings), flowLookup.functions(), flowLookup.lookup(), flowId, setRouteCalls, flowLookup.responseFunction())
+}
+
+// generateLuaSetRouteCalls returns the Lua code setting the destinations of the flow in the trace router, the flow
+// version of each service is used, or the baseline one when the flow doesn't have it
+// Each call is done when the Lua condition of the service is met
+func generateLuaSetRouteCalls(allServices []*resolved.Service, flowId string, baselineFlowVersion string, condition func(service *resolved.Service) string) string {
 	var setRouteCalls strings.Builder
 
 	// Helper function to add a setRoute call
 	addSetRouteCall := func(service, destination string) {
 		setRouteCalls.WriteString(fmt.Sprintf(`
-    request_handle:httpCall(
-      "outbound|8080||trace-router.default.svc.cluster.local",
+    local set_route_headers = request_handle:httpCall(
+      trace_router_cluster,
       {
         [":method"] = "POST",
-        [":path"] = "/set-route?trace_id=" .. trace_id .. "&hostname=%s&destination=%s",
-        [":authority"] = "trace-router.default.svc.cluster.local",
+        [":path"] = "/set-route?trace_id=" .. url_encode(trace_id) .. "&hostname=%s&destination=%s",
+        [":authority"] = trace_router_authority,
         ["Content-Type"] = "application/json"
       },
       "{}",
-      5000
+      trace_router_timeout
     )
-`, service, destination))
+    if not set_route_headers or set_route_headers[":status"] ~= "200" then
+      if reject_without_trace_router then
+        request_handle:respond({[":status"] = "503"}, "Failed to set the route of %s in the trace router")
+        return
+      end
+      request_handle:logWarn("Failed to set the route of %s in the trace router, it will use the baseline")
+    end
+`, url.QueryEscape(service), url.QueryEscape(destination), service, service))
 	}
 
 	groupedServices := lo.GroupBy(allServices, func(item *resolved.Service) string { return item.ServiceID })
@@ -945,41 +1232,16 @@ func generateDynamicLuaScript(allServices []*resolved.Service, flowId string, na
 			continue
 		}
 
+		destination := resolved.VersionedName(service.ServiceID, service.Version)
 		if service.IsShared {
-			setRouteCalls.WriteString(fmt.Sprintf(`
-    if hostname == "%s" then`, service.OriginalVersionIfShared))
-			destination := fmt.Sprintf("%s-%s", service.ServiceID, constants.SharedVersionVersionString)
-			addSetRouteCall(service.ServiceID, destination)
-			setRouteCalls.WriteString(`
-    end`)
-		} else {
-			for _, hostname := range hostnames {
-				setRouteCalls.WriteString(fmt.Sprintf(`
-    if hostname == "%s" then`, string(hostname)))
-				destination := fmt.Sprintf("%s-%s", service.ServiceID, service.Version)
-				addSetRouteCall(service.ServiceID, destination)
-				setRouteCalls.WriteString(`
-    end`)
-			}
+			destination = resolved.VersionedName(service.ServiceID, constants.SharedVersionVersionString)
 		}
+		setRouteCalls.WriteString(fmt.Sprintf(`
+    if %s then`, condition(service)))
+		addSetRouteCall(service.ServiceID, destination)
+		setRouteCalls.WriteString(`
+    end`)
 	}
 
-	return fmt.Sprintf(`
-%s
-
-function envoy_on_request(request_handle)
-  local headers = request_handle:headers()
-  local trace_id = headers:get("x-kardinal-trace-id")
-  local hostname = headers:get(":authority")
-
-  request_handle:logInfo("Setting routing table for flowId %s, trace ID: " .. (trace_id or "none") .. ", Hostname: " .. (hostname or "none"))
-
-  if not trace_id then
-    request_handle:logWarn("Missing trace ID from " .. source_header .. ", make sure traceId enforcer filter was apply before.")
-  else
-    %s
-  end
-
-end
-`, generateLuaTraceHeaderPriorities(), flowId, setRouteCalls.String())
+	return setRouteCalls.String()
 }
@@ -0,0 +1,29 @@
+package flow
+
+import (
+	"github.com/kurtosis-tech/stacktrace"
+	corev1 "k8s.io/api/core/v1"
+
+	"kardinal.kontrol-service/types"
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	"kardinal.kontrol-service/types/settings"
+)
+
+// Renderer turns a resolved cluster topology (usually the baseline merged with all the flows) into the cluster
+// resources applied by the Kardinal manager
+type Renderer interface {
+	RenderClusterResources(clusterTopology *resolved.ClusterTopology, namespace string) types.ClusterResources
+	RenderNamespace(namespace string) *corev1.Namespace
+}
+
+// NewRenderer returns the renderer selected in the tenant settings
+func NewRenderer(tenantSettings settings.TenantSettings) (Renderer, error) {
+	switch tenantSettings.Renderer {
+	case settings.IstioRenderer:
+		return NewIstioRenderer(tenantSettings), nil
+	case settings.GatewayAPIRenderer:
+		return NewGatewayAPIRenderer(tenantSettings), nil
+	default:
+		return nil, stacktrace.NewError("unknown renderer '%s'", tenantSettings.Renderer)
+	}
+}
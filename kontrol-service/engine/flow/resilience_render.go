@@ -0,0 +1,55 @@
+package flow
+
+import (
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"istio.io/api/networking/v1alpha3"
+
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+)
+
+// setHTTPRouteResilience sets the faults, timeout and retries of a flow route, the invalid durations are ignored
+func setHTTPRouteResilience(route *v1alpha3.HTTPRoute, serviceID string, resilience resolved.ServiceResilience) {
+	if resilience.Delay != nil || resilience.Abort != nil {
+		route.Fault = &v1alpha3.HTTPFaultInjection{}
+	}
+	if resilience.Delay != nil {
+		if fixedDelay, found := getResilienceDuration(serviceID, "fixed delay", resilience.Delay.FixedDelay); found {
+			route.Fault.Delay = &v1alpha3.HTTPFaultInjection_Delay{
+				HttpDelayType: &v1alpha3.HTTPFaultInjection_Delay_FixedDelay{FixedDelay: fixedDelay},
+				Percentage:    &v1alpha3.Percent{Value: resilience.Delay.Percentage},
+			}
+		}
+	}
+	if resilience.Abort != nil {
+		route.Fault.Abort = &v1alpha3.HTTPFaultInjection_Abort{
+			ErrorType:  &v1alpha3.HTTPFaultInjection_Abort_HttpStatus{HttpStatus: resilience.Abort.HTTPStatus},
+			Percentage: &v1alpha3.Percent{Value: resilience.Abort.Percentage},
+		}
+	}
+	if resilience.Timeout != "" {
+		if timeout, found := getResilienceDuration(serviceID, "timeout", resilience.Timeout); found {
+			route.Timeout = timeout
+		}
+	}
+	if resilience.Retries != nil {
+		route.Retries = &v1alpha3.HTTPRetry{
+			Attempts: resilience.Retries.Attempts,
+			RetryOn:  resilience.Retries.RetryOn,
+		}
+		if resilience.Retries.PerTryTimeout != "" {
+			if perTryTimeout, found := getResilienceDuration(serviceID, "per try timeout", resilience.Retries.PerTryTimeout); found {
+				route.Retries.PerTryTimeout = perTryTimeout
+			}
+		}
+	}
+}
+
+func getResilienceDuration(serviceID string, name string, duration string) (*durationpb.Duration, bool) {
+	parsed, err := resolved.ParseResilienceDuration(duration)
+	if err != nil {
+		logrus.Errorf("Ignoring the %s of service '%s': %v", name, serviceID, err)
+		return nil, false
+	}
+	return durationpb.New(parsed), true
+}
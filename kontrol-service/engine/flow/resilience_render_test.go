@@ -0,0 +1,51 @@
+package flow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+	"istio.io/api/networking/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+)
+
+func TestFlowResilienceVirtualService(t *testing.T) {
+	serviceSpec := &corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 8080, AppProtocol: lo.ToPtr("HTTP")}}}
+	services := []*resolved.Service{
+		{ServiceID: "payments", Version: "prod", ServiceSpec: serviceSpec},
+		{ServiceID: "payments", Version: "dev-flow-1", ServiceSpec: serviceSpec},
+		{ServiceID: "payments", Version: "dev-flow-2", ServiceSpec: serviceSpec},
+	}
+	resilience := map[string]resolved.ServiceResilience{
+		"dev-flow-1": {
+			Delay:   &resolved.FaultDelay{FixedDelay: "2s", Percentage: 50},
+			Abort:   &resolved.FaultAbort{HTTPStatus: 503, Percentage: 10},
+			Timeout: "5s",
+			Retries: &resolved.RetryPolicy{Attempts: 3, PerTryTimeout: "1500ms", RetryOn: "5xx"},
+		},
+	}
+
+	virtualService, _ := getVirtualService("payments", services, nil, resilience, "prod")
+	require.Len(t, virtualService.Spec.Http, 3)
+
+	flowRoute := virtualService.Spec.Http[1]
+	require.Equal(t, "dev-flow-1", flowRoute.Route[0].Destination.Subset)
+	delay := flowRoute.Fault.Delay.HttpDelayType.(*v1alpha3.HTTPFaultInjection_Delay_FixedDelay)
+	require.Equal(t, 2*time.Second, delay.FixedDelay.AsDuration())
+	require.Equal(t, 50.0, flowRoute.Fault.Delay.Percentage.Value)
+	require.Equal(t, 10.0, flowRoute.Fault.Abort.Percentage.Value)
+	require.Equal(t, 5*time.Second, flowRoute.Timeout.AsDuration())
+	require.Equal(t, int32(3), flowRoute.Retries.Attempts)
+	require.Equal(t, 1500*time.Millisecond, flowRoute.Retries.PerTryTimeout.AsDuration())
+	require.Equal(t, "5xx", flowRoute.Retries.RetryOn)
+
+	// the baseline and the other flows are not affected
+	for _, route := range []int{0, 2} {
+		require.Nil(t, virtualService.Spec.Http[route].Fault)
+		require.Nil(t, virtualService.Spec.Http[route].Timeout)
+		require.Nil(t, virtualService.Spec.Http[route].Retries)
+	}
+}
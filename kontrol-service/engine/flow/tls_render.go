@@ -0,0 +1,165 @@
+package flow
+
+import (
+	"sort"
+
+	"github.com/samber/lo"
+	net "k8s.io/api/networking/v1"
+	gateway "sigs.k8s.io/gateway-api/apis/v1"
+
+	"kardinal.kontrol-service/types"
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	"kardinal.kontrol-service/types/settings"
+)
+
+const (
+	gatewayEntryType = "gateway"
+	ingressEntryType = "ingress"
+
+	flowHTTPSPort = 443
+)
+
+// flowTLSSecretName returns the secret holding the certificate of the flow hostnames served by an entry point (a
+// gateway or an ingress), it's deterministic so the secrets can also be created without cert-manager
+func flowTLSSecretName(flowID string, entryPointName string) string {
+	return resolved.DNSLabel(flowID, entryPointName, "tls")
+}
+
+// flowEntryPoint groups the hostnames of a flow served by the same gateway or ingress
+type flowEntryPoint struct {
+	flowID     string
+	entryType  string
+	name       string
+	namespace  string
+	hostnames  []string
+	secretName string
+}
+
+// getFlowEntryPoints returns the flow entry points of the topology sorted so the rendered resources don't change
+// between calls
+func getFlowEntryPoints(clusterTopology *resolved.ClusterTopology, entryStrategy resolved.FlowEntryStrategy) []flowEntryPoint {
+	entryPoints := map[string]*flowEntryPoint{}
+	for flowID, entries := range clusterTopology.GetFlowHostMapping(entryStrategy) {
+		for _, entry := range entries {
+			key := flowID + "/" + entry.Type + "/" + entry.Namespace + "/" + entry.Service
+			entryPoint, found := entryPoints[key]
+			if !found {
+				entryPoint = &flowEntryPoint{
+					flowID:     flowID,
+					entryType:  entry.Type,
+					name:       entry.Service,
+					namespace:  entry.Namespace,
+					hostnames:  []string{},
+					secretName: flowTLSSecretName(flowID, entry.Service),
+				}
+				entryPoints[key] = entryPoint
+			}
+			entryPoint.hostnames = append(entryPoint.hostnames, entry.Hostname)
+		}
+	}
+
+	keys := lo.Keys(entryPoints)
+	sort.Strings(keys)
+	return lo.Map(keys, func(key string, _ int) flowEntryPoint {
+		entryPoint := entryPoints[key]
+		entryPoint.hostnames = lo.Uniq(entryPoint.hostnames)
+		sort.Strings(entryPoint.hostnames)
+		return *entryPoint
+	})
+}
+
+// getFlowCertificates returns a cert-manager Certificate for the hostnames of each flow entry point, the certificates
+// are created in the namespace of the gateway or ingress using them
+func getFlowCertificates(tlsSettings settings.FlowTLSSettings, entryPoints []flowEntryPoint) []types.Certificate {
+	certificates := []types.Certificate{}
+	if tlsSettings.CertManagerIssuer == "" {
+		return certificates
+	}
+
+	for _, entryPoint := range entryPoints {
+		certificate := types.NewCertificate(
+			entryPoint.secretName,
+			entryPoint.namespace,
+			entryPoint.secretName,
+			entryPoint.hostnames,
+			tlsSettings.CertManagerIssuer,
+			tlsSettings.CertManagerIssuerKind,
+		)
+		certificates = append(certificates, *certificate)
+	}
+
+	return certificates
+}
+
+// addFlowTLSListeners adds an HTTPS listener for each flow hostname served by the gateways, the listeners accept the
+// same routes as the first listener of the gateway
+func addFlowTLSListeners(tlsSettings settings.FlowTLSSettings, gateways []gateway.Gateway, entryPoints []flowEntryPoint) []gateway.Gateway {
+	if !tlsSettings.GatewayListeners {
+		return gateways
+	}
+
+	for gatewayIx := range gateways {
+		gw := gateways[gatewayIx].DeepCopy()
+		var allowedRoutes *gateway.AllowedRoutes
+		if len(gw.Spec.Listeners) > 0 {
+			allowedRoutes = gw.Spec.Listeners[0].AllowedRoutes
+		}
+		listenerNames := lo.SliceToMap(gw.Spec.Listeners, func(listener gateway.Listener) (gateway.SectionName, bool) {
+			return listener.Name, true
+		})
+
+		for _, entryPoint := range entryPoints {
+			if entryPoint.entryType != gatewayEntryType || entryPoint.name != gw.Name || entryPoint.namespace != gw.Namespace {
+				continue
+			}
+			for _, hostname := range entryPoint.hostnames {
+				name := gateway.SectionName(resolved.DNSLabel("https", hostname))
+				if listenerNames[name] {
+					continue
+				}
+				listenerNames[name] = true
+				gw.Spec.Listeners = append(gw.Spec.Listeners, gateway.Listener{
+					Name:          name,
+					Hostname:      lo.ToPtr(gateway.Hostname(hostname)),
+					Port:          flowHTTPSPort,
+					Protocol:      gateway.HTTPSProtocolType,
+					AllowedRoutes: allowedRoutes,
+					TLS: &gateway.GatewayTLSConfig{
+						Mode: lo.ToPtr(gateway.TLSModeTerminate),
+						CertificateRefs: []gateway.SecretObjectReference{
+							{
+								Name: gateway.ObjectName(entryPoint.secretName),
+							},
+						},
+					},
+				})
+			}
+		}
+		gateways[gatewayIx] = *gw
+	}
+
+	return gateways
+}
+
+// addFlowIngressTLS adds the TLS section covering the flow hostnames to the ingresses, only the certificates rendered
+// with cert-manager are referenced because the ingress rules of all the flows live in the same resource
+func addFlowIngressTLS(tlsSettings settings.FlowTLSSettings, ingresses []net.Ingress, entryPoints []flowEntryPoint) []net.Ingress {
+	if tlsSettings.CertManagerIssuer == "" {
+		return ingresses
+	}
+
+	for ingressIx, ingress := range ingresses {
+		for _, entryPoint := range entryPoints {
+			if entryPoint.entryType != ingressEntryType || entryPoint.name != ingress.Name || entryPoint.namespace != ingress.Namespace {
+				continue
+			}
+			ingress.Spec.TLS = append(ingress.Spec.TLS, net.IngressTLS{
+				Hosts:      entryPoint.hostnames,
+				SecretName: entryPoint.secretName,
+			})
+		}
+		ingresses[ingressIx] = ingress
+	}
+
+	return ingresses
+}
@@ -0,0 +1,110 @@
+package flow
+
+import (
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+	net "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	gateway "sigs.k8s.io/gateway-api/apis/v1"
+
+	"kardinal.kontrol-service/types"
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	"kardinal.kontrol-service/types/settings"
+)
+
+func getTLSTestEntryPoints(t *testing.T) []flowEntryPoint {
+	topology := getGatewayAPITestTopology()
+	topology.GatewayAndRoutes.GatewayRoutes[0].ParentRefs = []gateway.ParentReference{{Name: "gateway", Namespace: lo.ToPtr(gateway.Namespace("default"))}}
+
+	entryPoints := getFlowEntryPoints(topology, resolved.SubdomainEntryStrategy)
+	require.Len(t, entryPoints, 2)
+	return entryPoints
+}
+
+func getTLSTestGateway() gateway.Gateway {
+	return gateway.Gateway{
+		ObjectMeta: metav1.ObjectMeta{Name: "gateway", Namespace: "default"},
+		Spec: gateway.GatewaySpec{
+			Listeners: []gateway.Listener{{Name: "http", Port: 80, Protocol: gateway.HTTPProtocolType}},
+		},
+	}
+}
+
+func TestGetFlowCertificates(t *testing.T) {
+	entryPoints := getTLSTestEntryPoints(t)
+	tlsSettings := settings.NewDefaultTenantSettings().FlowTLS
+
+	// only rendered with a cert-manager issuer
+	require.Empty(t, getFlowCertificates(tlsSettings, entryPoints))
+
+	tlsSettings.CertManagerIssuer = "letsencrypt"
+	certificates := getFlowCertificates(tlsSettings, entryPoints)
+	require.Len(t, certificates, 2)
+	certificate, found := lo.Find(certificates, func(certificate types.Certificate) bool {
+		return certificate.Name == flowTLSSecretName("dev-flow-1", "gateway")
+	})
+	require.True(t, found)
+	require.Equal(t, "cert-manager.io/v1", certificate.APIVersion)
+	require.Equal(t, "default", certificate.Namespace)
+	require.Equal(t, certificate.Name, certificate.Spec.SecretName)
+	require.Equal(t, []string{resolved.ReplaceOrAddSubdomain("app.example.com", "dev-flow-1")}, certificate.Spec.DNSNames)
+	require.Equal(t, types.CertificateIssuerRef{Name: "letsencrypt", Kind: settings.ClusterIssuerKind, Group: "cert-manager.io"}, certificate.Spec.IssuerRef)
+}
+
+func TestAddFlowTLSListeners(t *testing.T) {
+	entryPoints := getTLSTestEntryPoints(t)
+	tlsSettings := settings.NewDefaultTenantSettings().FlowTLS
+
+	gateways := addFlowTLSListeners(tlsSettings, []gateway.Gateway{getTLSTestGateway()}, entryPoints)
+	require.Len(t, gateways[0].Spec.Listeners, 1)
+
+	tlsSettings.GatewayListeners = true
+	gateways = addFlowTLSListeners(tlsSettings, []gateway.Gateway{getTLSTestGateway()}, entryPoints)
+	listeners := gateways[0].Spec.Listeners
+	require.Len(t, listeners, 3)
+
+	flowHostname := resolved.ReplaceOrAddSubdomain("app.example.com", "dev-flow-1")
+	listener, found := lo.Find(listeners, func(listener gateway.Listener) bool {
+		return string(lo.FromPtr(listener.Hostname)) == flowHostname
+	})
+	require.True(t, found)
+	require.Equal(t, gateway.PortNumber(flowHTTPSPort), listener.Port)
+	require.Equal(t, gateway.HTTPSProtocolType, listener.Protocol)
+	require.Equal(t, gateway.TLSModeTerminate, lo.FromPtr(listener.TLS.Mode))
+	require.Equal(t, []gateway.SecretObjectReference{{Name: gateway.ObjectName(flowTLSSecretName("dev-flow-1", "gateway"))}}, listener.TLS.CertificateRefs)
+
+	// the listeners are not added twice
+	gateways = addFlowTLSListeners(tlsSettings, gateways, entryPoints)
+	require.Len(t, gateways[0].Spec.Listeners, 3)
+
+	// the other gateways are left unchanged
+	otherGateway := getTLSTestGateway()
+	otherGateway.Name = "other-gateway"
+	gateways = addFlowTLSListeners(tlsSettings, []gateway.Gateway{otherGateway}, entryPoints)
+	require.Len(t, gateways[0].Spec.Listeners, 1)
+}
+
+func TestAddFlowIngressTLS(t *testing.T) {
+	entryPoints := []flowEntryPoint{
+		{
+			flowID:     "dev-flow-1",
+			entryType:  ingressEntryType,
+			name:       "ingress",
+			namespace:  "prod",
+			hostnames:  []string{"dev-flow-1.app.example.com"},
+			secretName: flowTLSSecretName("dev-flow-1", "ingress"),
+		},
+	}
+	ingress := net.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress", Namespace: "prod"}}
+	tlsSettings := settings.NewDefaultTenantSettings().FlowTLS
+
+	// the secrets are only referenced when cert-manager creates them
+	ingresses := addFlowIngressTLS(tlsSettings, []net.Ingress{ingress}, entryPoints)
+	require.Empty(t, ingresses[0].Spec.TLS)
+
+	tlsSettings.CertManagerIssuer = "letsencrypt"
+	ingresses = addFlowIngressTLS(tlsSettings, []net.Ingress{ingress}, entryPoints)
+	require.Equal(t, []net.IngressTLS{{Hosts: []string{"dev-flow-1.app.example.com"}, SecretName: flowTLSSecretName("dev-flow-1", "ingress")}}, ingresses[0].Spec.TLS)
+}
@@ -0,0 +1,189 @@
+package flow
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"kardinal.kontrol-service/tracerouter"
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	"kardinal.kontrol-service/types/settings"
+)
+
+// luaTraceRouterCallRegex matches the method and the path expression of the trace router calls in the Lua filters
+var luaTraceRouterCallRegex = regexp.MustCompile(`\[":method"\] = "(\w+)",\s*\[":path"\] = (.+?),?\n`)
+
+type luaTraceRouterCall struct {
+	method string
+	path   string
+}
+
+// getLuaTraceRouterCalls returns the trace router calls of the Lua code, the path concatenations are evaluated with
+// the values of the Lua variables and function calls
+func getLuaTraceRouterCalls(t *testing.T, luaCode string, luaValues map[string]string) []luaTraceRouterCall {
+	var calls []luaTraceRouterCall
+	for _, match := range luaTraceRouterCallRegex.FindAllStringSubmatch(luaCode, -1) {
+		var path strings.Builder
+		for _, part := range strings.Split(match[2], " .. ") {
+			if strings.HasPrefix(part, `"`) {
+				value, err := strconv.Unquote(part)
+				require.NoError(t, err)
+				path.WriteString(value)
+				continue
+			}
+			expression, encoded := strings.CutPrefix(part, "url_encode(")
+			if encoded {
+				expression = strings.TrimSuffix(expression, ")")
+			}
+			value, found := luaValues[expression]
+			require.True(t, found, "no value for the Lua expression '%s'", part)
+			if encoded {
+				value = luaURLEncode(value)
+			}
+			path.WriteString(value)
+		}
+		calls = append(calls, luaTraceRouterCall{method: match[1], path: path.String()})
+	}
+	return calls
+}
+
+// luaURLEncode escapes the value like the url_encode Lua function
+func luaURLEncode(value string) string {
+	var encoded strings.Builder
+	for _, c := range []byte(value) {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			encoded.WriteByte(c)
+			continue
+		}
+		encoded.WriteString(fmt.Sprintf("%%%02X", c))
+	}
+	return encoded.String()
+}
+
+func callTraceRouter(t *testing.T, handler http.Handler, call luaTraceRouterCall) string {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(call.method, call.path, nil))
+	body, err := io.ReadAll(recorder.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, recorder.Code, "%s %s: %s", call.method, call.path, body)
+	return string(body)
+}
+
+func TestTraceRouterWithRenderedLuaFilters(t *testing.T) {
+	namespace := "prod"
+	flowID := "dev-flow-1"
+	tenantSettings := settings.NewDefaultTenantSettings()
+	services := []*resolved.Service{
+		{ServiceID: "frontend", Version: namespace},
+		{ServiceID: "frontend", Version: flowID},
+		{ServiceID: "backend", Version: namespace},
+		{ServiceID: "backend", Version: flowID},
+		{ServiceID: "postgres", Version: namespace},
+	}
+	baselineDestinations := map[string]string{}
+	for _, service := range services {
+		if service.Version == namespace {
+			baselineDestinations[service.ServiceID] = resolved.VersionedName(service.ServiceID, namespace)
+		}
+	}
+
+	router := tracerouter.NewRouter(tracerouter.NewMemoryStore(), time.Minute).Handler()
+
+	// the flow entry point filter sets the routing table of the trace
+	entryFilter := generateDynamicLuaScript(services, flowID, namespace, []string{"dev-flow-1.app.example.com"}, nil, tenantSettings)
+	setRouteCalls := getLuaTraceRouterCalls(t, entryFilter, map[string]string{"trace_id": "flow-trace"})
+	require.Len(t, setRouteCalls, 3)
+	for _, call := range setRouteCalls {
+		require.Equal(t, http.MethodPost, call.method)
+		callTraceRouter(t, router, call)
+	}
+
+	// the outbound filters read it for every request sent by the services
+	outboundFilter := getOutgoingRequestTraceIDFilter("frontend", namespace, baselineDestinations, getFlowDestinations(services, namespace), tenantSettings, false)
+	expectedDestinations := map[string]map[string]string{
+		"flow-trace": {
+			"backend":                        "backend-dev-flow-1",
+			"backend.prod.svc.cluster.local": "backend-dev-flow-1",
+			"frontend":                       "frontend-dev-flow-1",
+			"postgres":                       "postgres-prod",
+		},
+		"baseline-trace": {
+			"backend":                        "backend-prod",
+			"backend.prod.svc.cluster.local": "backend-prod",
+			"postgres":                       "postgres-prod",
+		},
+	}
+	for traceID, destinations := range expectedDestinations {
+		for hostname, expectedDestination := range destinations {
+			// same as the baseline_destination Lua function
+			service := strings.Split(hostname, ".")[0]
+			routeCalls := getLuaTraceRouterCalls(t, outboundFilter, map[string]string{
+				"trace_id":                       traceID,
+				"hostname":                       hostname,
+				"baseline_destination(hostname)": baselineDestinations[service],
+			})
+			require.Len(t, routeCalls, 1)
+			require.Equal(t, http.MethodGet, routeCalls[0].method)
+			destination := callTraceRouter(t, router, routeCalls[0])
+			require.Equal(t, expectedDestination, destination, fmt.Sprintf("destination of '%s' in trace '%s'", hostname, traceID))
+		}
+	}
+}
+
+func TestLuaTraceIDGeneratorsAreSeeded(t *testing.T) {
+	tenantSettings := settings.NewDefaultTenantSettings()
+	baselineDestinations := map[string]string{"frontend": "frontend-prod", "backend": "backend-prod"}
+	saltRegex := regexp.MustCompile(`local random_seed_salt = (\d+)`)
+
+	salts := map[string]bool{}
+	for _, serviceID := range []string{"frontend", "backend"} {
+		filter := getOutgoingRequestTraceIDFilter(serviceID, "prod", baselineDestinations, nil, tenantSettings, true)
+		// the generator is seeded once per Lua state before the first ID is generated
+		require.Contains(t, filter, "math.randomseed(seed)")
+		require.Contains(t, filter, "local random_seeded = false")
+		require.Contains(t, filter, "seed_random(request_handle)")
+		require.Contains(t, filter, "generate_trace_id(request_handle)")
+		require.NotContains(t, filter, "math.random(2^128 - 1)")
+
+		salt := saltRegex.FindStringSubmatch(filter)
+		require.Len(t, salt, 2)
+		salts[salt[1]] = true
+	}
+	// the filters loaded at the same time don't start from the same seed
+	require.Len(t, salts, 2)
+}
+
+func TestInboundFilterFallbackUsesTheTenantSettings(t *testing.T) {
+	tenantSettings := settings.NewDefaultTenantSettings()
+	tenantSettings.TraceID.Header = "x-correlation-id"
+
+	filter := getInboundFilter("frontend", "prod", 0, nil, nil, tenantSettings)
+	luaCode := filter.Spec.ConfigPatches[0].Patch.Value.Fields["typed_config"].GetStructValue().Fields["inlineCode"].GetStringValue()
+	require.Contains(t, luaCode, `local trace_id_header = "x-correlation-id"`)
+}
+
+func TestTraceRouterQueryParametersAreEncoded(t *testing.T) {
+	tenantSettings := settings.NewDefaultTenantSettings()
+	outboundFilter := getOutgoingRequestTraceIDFilter("frontend", "prod", map[string]string{"backend": "backend-prod"}, nil, tenantSettings, false)
+	require.Contains(t, outboundFilter, "function url_encode(value)")
+	require.Contains(t, outboundFilter, `"/route?trace_id=" .. url_encode(trace_id) .. "&hostname=" .. url_encode(hostname) .. "&namespace=prod"`)
+
+	router := tracerouter.NewRouter(tracerouter.NewMemoryStore(), time.Minute).Handler()
+	// a trace ID sent by a client can't add query parameters to the trace router calls
+	routeCalls := getLuaTraceRouterCalls(t, outboundFilter, map[string]string{
+		"trace_id":                       "abc&hostname=backend",
+		"hostname":                       "backend",
+		"baseline_destination(hostname)": "backend-prod",
+	})
+	require.Len(t, routeCalls, 1)
+	require.Contains(t, routeCalls[0].path, "trace_id=abc%26hostname%3Dbackend&")
+	require.Equal(t, "backend-prod", callTraceRouter(t, router, routeCalls[0]))
+}
@@ -0,0 +1,64 @@
+package flow
+
+import (
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+	"istio.io/api/networking/v1alpha3"
+	istioclient "istio.io/client-go/pkg/apis/networking/v1alpha3"
+
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+	"kardinal.kontrol-service/types/settings"
+)
+
+func getAmbientTestSettings() settings.TenantSettings {
+	tenantSettings := settings.NewDefaultTenantSettings()
+	tenantSettings.IstioDataplaneMode = settings.AmbientDataplaneMode
+	tenantSettings.WaypointName = "kardinal-waypoint"
+	return tenantSettings
+}
+
+func TestGetWaypointEnvoyFilters(t *testing.T) {
+	tenantSettings := getAmbientTestSettings()
+	services := []*resolved.Service{
+		{ServiceID: "frontend", Version: "prod"},
+		{ServiceID: "frontend", Version: "dev-flow-1"},
+	}
+	frontFilter := getLuaEnvoyFilter("frontend-inbound", "prod", 1, map[string]string{"app": "frontend"}, v1alpha3.EnvoyFilter_SIDECAR_INBOUND, "-- front filter")
+
+	filters := getWaypointEnvoyFilters(services, "prod", tenantSettings, []istioclient.EnvoyFilter{frontFilter})
+	filterNames := lo.Map(filters, func(filter istioclient.EnvoyFilter, _ int) string { return filter.Name })
+	require.Equal(t, []string{"kardinal-waypoint-trace-id-enforcer", "frontend-inbound", "kardinal-waypoint-router"}, filterNames)
+
+	// all the filters run in the waypoint for every traffic direction
+	for _, filter := range filters {
+		require.Equal(t, "prod", filter.Namespace)
+		require.Equal(t, waypointSelector("kardinal-waypoint"), filter.Spec.WorkloadSelector.Labels)
+		for _, patch := range filter.Spec.ConfigPatches {
+			require.Equal(t, v1alpha3.EnvoyFilter_ANY, patch.Match.Context)
+		}
+	}
+
+	// the front filters of the sidecars are copied
+	require.Equal(t, map[string]string{"app": "frontend"}, frontFilter.Spec.WorkloadSelector.Labels)
+	require.Equal(t, v1alpha3.EnvoyFilter_SIDECAR_INBOUND, frontFilter.Spec.ConfigPatches[0].Match.Context)
+
+	// the router falls back to the baseline versions and never generates trace IDs
+	router := filters[2]
+	require.Equal(t, int32(-2), router.Spec.Priority)
+	routerCode := router.Spec.ConfigPatches[0].Patch.Value.Fields["typed_config"].GetStructValue().Fields["inlineCode"].GetStringValue()
+	require.Contains(t, routerCode, `local baseline_destinations = {["frontend"] = "frontend-prod"}`)
+	require.NotContains(t, routerCode, "generate_trace_id()")
+}
+
+func TestGetWaypointGateway(t *testing.T) {
+	waypoint := getWaypointGateway("prod", "kardinal-waypoint")
+	require.Equal(t, "kardinal-waypoint", waypoint.Name)
+	require.Equal(t, "prod", waypoint.Namespace)
+	require.Equal(t, map[string]string{"istio.io/waypoint-for": "service"}, waypoint.Labels)
+	require.Equal(t, "istio-waypoint", string(waypoint.Spec.GatewayClassName))
+	require.Len(t, waypoint.Spec.Listeners, 1)
+	require.Equal(t, "HBONE", string(waypoint.Spec.Listeners[0].Protocol))
+	require.Equal(t, 15008, int(waypoint.Spec.Listeners[0].Port))
+}
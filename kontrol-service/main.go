@@ -1,17 +1,23 @@
 package main
 
 import (
+	"context"
 	"flag"
 	cli_api "github.com/kurtosis-tech/kardinal/libs/cli-kontrol-api/api/golang/server"
+	"github.com/kurtosis-tech/stacktrace"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/sirupsen/logrus"
 	"kardinal.kontrol-service/api"
 	"kardinal.kontrol-service/database"
+	"kardinal.kontrol-service/plugins"
+	"kardinal.kontrol-service/types/settings"
 	"net/http"
 	"os"
 	"runtime/debug"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -47,6 +53,45 @@ func startServer(isDevMode bool) {
 		logrus.Fatal("An error occurred parsing the DB port number", err)
 	}
 
+	traceRouter, err := getServerTraceRouter()
+	if err != nil {
+		logrus.Fatal("An error occurred configuring the trace router", err)
+	}
+
+	pluginLimits, err := getServerPluginLimits()
+	if err != nil {
+		logrus.Fatal("An error occurred configuring the plugin limits", err)
+	}
+
+	// the remote plugins can't reach the loopback, link-local, private and denied addresses outside of these networks
+	var pluginRemoteAllowedNetworks []string
+	if allowedNetworksStr := os.Getenv("PLUGIN_REMOTE_ALLOWED_NETWORKS"); allowedNetworksStr != "" {
+		pluginRemoteAllowedNetworks = strings.Split(allowedNetworksStr, ",")
+	}
+
+	var pluginEnvCacheSize int
+	if cacheSizeStr := os.Getenv("PLUGIN_ENV_CACHE_SIZE"); cacheSizeStr != "" {
+		pluginEnvCacheSize, err = strconv.Atoi(cacheSizeStr)
+		if err != nil {
+			logrus.Fatal("An error occurred parsing the plugin environment cache size", err)
+		}
+	}
+
+	var pluginCheckoutCacheSize int
+	if cacheSizeStr := os.Getenv("PLUGIN_CHECKOUT_CACHE_SIZE"); cacheSizeStr != "" {
+		pluginCheckoutCacheSize, err = strconv.Atoi(cacheSizeStr)
+		if err != nil {
+			logrus.Fatal("An error occurred parsing the plugin checkout cache size", err)
+		}
+	}
+
+	// the private plugin repositories can't be pulled without the key encrypting their credentials, the processes
+	// started by kontrol, e.g. the plugins, don't need it
+	pluginCredentialsKey := os.Getenv("PLUGIN_CREDENTIALS_KEY")
+	if err = os.Unsetenv("PLUGIN_CREDENTIALS_KEY"); err != nil {
+		logrus.Fatal("An error occurred removing the plugin credentials key from the environment", err)
+	}
+
 	dbConnectionInfo, err := database.NewDatabaseConnectionInfo(
 		dbUsername,
 		dbPassword,
@@ -75,7 +120,28 @@ func startServer(isDevMode bool) {
 	defer analyticsWrapper.Close()
 
 	// create a type that satisfies the `api.ServerInterface`, which contains an implementation of every operation from the generated code
-	server := api.NewServer(db, analyticsWrapper)
+	// the plugin authors can run their plugins from local directories and file:// repositories in dev mode
+	var gitPluginProvider plugins.GitPluginProvider = plugins.NewGitPluginProviderImpl()
+	if isDevMode {
+		logrus.Warn("Running in dev mode. Local plugin directories and file:// repositories allowed.")
+		gitPluginProvider = plugins.NewLocalGitPluginProvider(gitPluginProvider)
+	}
+	pluginHost, err := plugins.NewPluginHost(plugins.PluginHostConfig{
+		Limits:                pluginLimits,
+		EnvCacheSize:          pluginEnvCacheSize,
+		CheckoutCacheSize:     pluginCheckoutCacheSize,
+		CredentialsKey:        pluginCredentialsKey,
+		RemoteAllowedNetworks: pluginRemoteAllowedNetworks,
+	})
+	if err != nil {
+		logrus.Fatal("An error occurred creating the plugin host", err)
+	}
+	server := api.NewServer(db, analyticsWrapper, gitPluginProvider, pluginHost, traceRouter)
+
+	// the plugins of the existing baselines are warmed in the background so the server starts right away
+	if os.Getenv("PLUGIN_PREWARM") == "true" {
+		go server.WarmAllTenantPlugins(context.Background())
+	}
 
 	e := echo.New()
 
@@ -129,8 +195,76 @@ func startServer(isDevMode bool) {
 		}
 	})
 
+	e.Use(api.FlowCreateOptionsMiddleware)
+
 	server.RegisterExternalAndInternalApi(e)
 
 	// And we serve HTTP until the world ends.
 	logrus.Fatal(e.Start("0.0.0.0:8080"))
 }
+
+// getServerTraceRouter returns the trace router used by the tenants not overriding it in their settings, the unset
+// environment variables keep the defaults
+func getServerTraceRouter() (settings.TraceRouterSettings, error) {
+	traceRouter := settings.TraceRouterSettings{
+		Namespace: os.Getenv("TRACE_ROUTER_NAMESPACE"),
+		Service:   os.Getenv("TRACE_ROUTER_SERVICE"),
+		Fallback:  settings.TraceRouterFallback(os.Getenv("TRACE_ROUTER_FALLBACK")),
+	}
+	if portStr := os.Getenv("TRACE_ROUTER_PORT"); portStr != "" {
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return settings.TraceRouterSettings{}, stacktrace.Propagate(err, "An error occurred parsing the trace router port '%s'", portStr)
+		}
+		traceRouter.Port = uint16(port)
+	}
+	if timeoutStr := os.Getenv("TRACE_ROUTER_TIMEOUT_MS"); timeoutStr != "" {
+		timeout, err := strconv.ParseUint(timeoutStr, 10, 32)
+		if err != nil {
+			return settings.TraceRouterSettings{}, stacktrace.Propagate(err, "An error occurred parsing the trace router timeout '%s'", timeoutStr)
+		}
+		traceRouter.TimeoutMs = uint32(timeout)
+	}
+	return settings.NewServerTraceRouter(traceRouter)
+}
+
+// getServerPluginLimits returns the limits of the plugin processes, the unset environment variables keep the defaults
+func getServerPluginLimits() (plugins.PluginLimits, error) {
+	limits := plugins.PluginLimits{}
+	if timeoutStr := os.Getenv("PLUGIN_TIMEOUT"); timeoutStr != "" {
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil {
+			return plugins.PluginLimits{}, stacktrace.Propagate(err, "An error occurred parsing the plugin timeout '%s'", timeoutStr)
+		}
+		limits.Timeout = timeout
+	}
+	if cpuSecondsStr := os.Getenv("PLUGIN_CPU_SECONDS"); cpuSecondsStr != "" {
+		cpuSeconds, err := strconv.ParseUint(cpuSecondsStr, 10, 64)
+		if err != nil {
+			return plugins.PluginLimits{}, stacktrace.Propagate(err, "An error occurred parsing the plugin CPU seconds '%s'", cpuSecondsStr)
+		}
+		limits.CPUSeconds = cpuSeconds
+	}
+	if memoryMBStr := os.Getenv("PLUGIN_MEMORY_MB"); memoryMBStr != "" {
+		memoryMB, err := strconv.ParseUint(memoryMBStr, 10, 64)
+		if err != nil {
+			return plugins.PluginLimits{}, stacktrace.Propagate(err, "An error occurred parsing the plugin memory '%s'", memoryMBStr)
+		}
+		limits.MemoryBytes = memoryMB * 1024 * 1024
+	}
+	if maxOutputStr := os.Getenv("PLUGIN_MAX_OUTPUT_BYTES"); maxOutputStr != "" {
+		maxOutput, err := strconv.Atoi(maxOutputStr)
+		if err != nil {
+			return plugins.PluginLimits{}, stacktrace.Propagate(err, "An error occurred parsing the plugin output size '%s'", maxOutputStr)
+		}
+		limits.MaxOutputBytes = maxOutput
+	}
+	if concurrencyStr := os.Getenv("PLUGIN_CONCURRENCY"); concurrencyStr != "" {
+		concurrency, err := strconv.Atoi(concurrencyStr)
+		if err != nil {
+			return plugins.PluginLimits{}, stacktrace.Propagate(err, "An error occurred parsing the plugin concurrency '%s'", concurrencyStr)
+		}
+		limits.Concurrency = concurrency
+	}
+	return limits, nil
+}
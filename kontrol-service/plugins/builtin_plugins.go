@@ -0,0 +1,61 @@
+package plugins
+
+import (
+	"context"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func init() {
+	RegisterNativePlugin("identity", identityNativePlugin{})
+	RegisterNativePlugin("env", envNativePlugin{})
+}
+
+// identityNativePlugin returns the pod specs unchanged, e.g. for the services whose flow versions only need a new
+// deployment
+type identityNativePlugin struct{}
+
+func (identityNativePlugin) CreateFlow(_ context.Context, _ []corev1.ServiceSpec, podSpecs []corev1.PodSpec, _ string, _ map[string]string) ([]corev1.PodSpec, map[string]interface{}, error) {
+	return podSpecs, map[string]interface{}{}, nil
+}
+
+func (identityNativePlugin) DeleteFlow(_ context.Context, _ map[string]interface{}, _ string) error {
+	return nil
+}
+
+// envNativePlugin sets the arguments as environment variables of all the containers, replacing the existing ones with
+// the same name, e.g. to point the flow version of a service to another database
+type envNativePlugin struct{}
+
+func (envNativePlugin) CreateFlow(_ context.Context, _ []corev1.ServiceSpec, podSpecs []corev1.PodSpec, _ string, arguments map[string]string) ([]corev1.PodSpec, map[string]interface{}, error) {
+	names := make([]string, 0, len(arguments))
+	for name := range arguments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for podSpecIdx := range podSpecs {
+		containers := podSpecs[podSpecIdx].Containers
+		for containerIdx := range containers {
+			for _, name := range names {
+				containers[containerIdx].Env = setEnvVar(containers[containerIdx].Env, name, arguments[name])
+			}
+		}
+	}
+	return podSpecs, map[string]interface{}{"env": names}, nil
+}
+
+func (envNativePlugin) DeleteFlow(_ context.Context, _ map[string]interface{}, _ string) error {
+	return nil
+}
+
+func setEnvVar(envVars []corev1.EnvVar, name string, value string) []corev1.EnvVar {
+	for idx := range envVars {
+		if envVars[idx].Name == name {
+			envVars[idx] = corev1.EnvVar{Name: name, Value: value}
+			return envVars
+		}
+	}
+	return append(envVars, corev1.EnvVar{Name: name, Value: value})
+}
@@ -0,0 +1,330 @@
+package plugins
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// pluginCheckoutReadyFile marks the checkouts whose files were all copied, the others are copied again
+	pluginCheckoutReadyFile = ".kardinal-checkout"
+	// pluginCloneDirName is the clone of the repository updated by the git provider, the plugins run in the checkouts
+	pluginCloneDirName = "clone"
+	// pluginDefaultCheckoutDirName is used by the providers which don't return the commit checked out
+	pluginDefaultCheckoutDirName = "default"
+	pluginURLHashLength          = 12
+	pluginCheckoutsDirName       = "go-python-plugins"
+
+	defaultPluginCheckoutCacheSize = 20
+	// pluginFilePerms are the permissions of the files created for the plugin checkouts, environments and locks
+	pluginFilePerms = 0644
+)
+
+// pluginCheckout is the checkout of a commit of a plugin, it's not modified once created so the concurrent runs of the
+// plugin can share it
+type pluginCheckout struct {
+	path   string
+	commit string
+	// key identifies the repository and the commit of the checkout
+	key string
+	// release must be called once the checkout is not used anymore, so it can be evicted
+	release func()
+}
+
+// pluginCheckoutCache keeps the checkouts of the plugin commits, the least recently used ones are removed when there
+// are more than maxEntries, like the plugin environments
+type pluginCheckoutCache struct {
+	dir        string
+	maxEntries int
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	// lru has the most recently used entries first
+	lru    *list.List
+	loaded bool
+}
+
+type pluginCheckoutEntry struct {
+	path string
+	// refs is the number of calls using the checkout, it's not removed while it's used
+	refs int
+}
+
+func newPluginCheckoutCache(dir string, maxEntries int) *pluginCheckoutCache {
+	return &pluginCheckoutCache{
+		dir:        dir,
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+// acquire marks the checkout as used until the returned function is called, the checkout is created by the caller
+// once acquired
+func (c *pluginCheckoutCache) acquire(path string) func() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.loadLocked()
+
+	element, found := c.entries[path]
+	if !found {
+		element = c.lru.PushFront(&pluginCheckoutEntry{path: path})
+		c.entries[path] = element
+	} else {
+		c.lru.MoveToFront(element)
+	}
+	entry := element.Value.(*pluginCheckoutEntry)
+	entry.refs++
+	c.evictLocked()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { c.release(entry) })
+	}
+}
+
+func (c *pluginCheckoutCache) release(entry *pluginCheckoutEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry.refs--
+	c.evictLocked()
+}
+
+// evictLocked removes the least recently used checkouts which are not used until there are at most maxEntries
+func (c *pluginCheckoutCache) evictLocked() {
+	for element := c.lru.Back(); element != nil && c.lru.Len() > c.maxEntries; {
+		previous := element.Prev()
+		entry := element.Value.(*pluginCheckoutEntry)
+		if entry.refs == 0 {
+			c.lru.Remove(element)
+			delete(c.entries, entry.path)
+			logrus.Infof("Removing the plugin checkout '%s'", entry.path)
+			if err := os.RemoveAll(entry.path); err != nil {
+				logrus.Errorf("An error occurred removing the plugin checkout '%s': %v", entry.path, err)
+			}
+		}
+		element = previous
+	}
+}
+
+// loadLocked adds the checkouts created before a restart to the cache, the oldest first, the incomplete ones are
+// copied again when they are used
+func (c *pluginCheckoutCache) loadLocked() {
+	if c.loaded {
+		return
+	}
+	c.loaded = true
+
+	repoDirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logrus.Errorf("An error occurred reading the plugin checkouts in '%s': %v", c.dir, err)
+		}
+		return
+	}
+
+	type createdCheckout struct {
+		path    string
+		modTime int64
+	}
+	var createdCheckouts []createdCheckout
+	for _, repoDirEntry := range repoDirEntries {
+		if !repoDirEntry.IsDir() {
+			continue
+		}
+		repoDir := filepath.Join(c.dir, repoDirEntry.Name())
+		checkoutDirEntries, err := os.ReadDir(repoDir)
+		if err != nil {
+			logrus.Errorf("An error occurred reading the plugin checkouts in '%s': %v", repoDir, err)
+			continue
+		}
+		for _, checkoutDirEntry := range checkoutDirEntries {
+			if !checkoutDirEntry.IsDir() || checkoutDirEntry.Name() == pluginCloneDirName {
+				continue
+			}
+			path := filepath.Join(repoDir, checkoutDirEntry.Name())
+			if info, err := os.Stat(filepath.Join(path, pluginCheckoutReadyFile)); err == nil {
+				createdCheckouts = append(createdCheckouts, createdCheckout{path: path, modTime: info.ModTime().UnixNano()})
+			}
+		}
+	}
+	sort.Slice(createdCheckouts, func(i, j int) bool {
+		return createdCheckouts[i].modTime < createdCheckouts[j].modTime
+	})
+	for _, checkout := range createdCheckouts {
+		c.entries[checkout.path] = c.lru.PushFront(&pluginCheckoutEntry{path: checkout.path})
+	}
+	c.evictLocked()
+}
+
+// getOrCloneRepo checks out the commit, or the ref in the plugin name when it's empty, the repositories are stored by
+// full URL and the clone of each repository is locked while it's updated and copied to the checkout of the commit, the
+// git commands are killed when the context of the plugin call is done, the checkout must be released once used
+func (pr *PluginRunner) getOrCloneRepo(ctx context.Context, pluginUrl string, commit string) (*pluginCheckout, error) {
+	repoURL, ref, err := ParsePluginName(pluginUrl)
+	if err != nil {
+		return nil, err
+	}
+	if commit != "" {
+		if err = validateGitRef(commit); err != nil {
+			return nil, fmt.Errorf("invalid plugin commit: %v", err)
+		}
+		ref = commit
+	}
+
+	if isLocalPluginSource(repoURL) {
+		if _, ok := pr.gitPluginProvider.(*LocalGitPluginProvider); !ok {
+			return nil, fmt.Errorf("plugin '%s' is a local directory or repository, which can only be used in dev mode", repoURL)
+		}
+	} else {
+		if !strings.HasPrefix(repoURL, "https://") {
+			repoURL = "https://" + repoURL
+		}
+		if !strings.HasSuffix(repoURL, ".git") {
+			repoURL = repoURL + ".git"
+		}
+	}
+
+	var credentials *PluginCredentials
+	if !isLocalPluginSource(repoURL) {
+		if credentials, err = pr.getPluginCredentials(repoURL); err != nil {
+			return nil, fmt.Errorf("failed to get the plugin credentials: %v", err)
+		}
+	}
+
+	// the private repositories are cloned for each tenant, so the tenants without their credentials can't run them
+	repoDirName := getPluginRepoDirName(repoURL, "")
+	if credentials != nil {
+		repoDirName = getPluginRepoDirName(repoURL, pr.tenantId)
+	}
+	repoDir := filepath.Join(pr.host.checkoutCache.dir, repoDirName)
+	if err := os.MkdirAll(repoDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create temporary plugins directory: %v", err)
+	}
+
+	clonePath := filepath.Join(repoDir, pluginCloneDirName)
+	unlock, err := lockFile(ctx, clonePath+".lock")
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock the plugin repository: %v", err)
+	}
+	defer unlock()
+
+	logrus.Infof("Cloning plugin from %s to %s", repoURL, clonePath)
+	checkedOutCommit, err := pr.gitPluginProvider.PullGitHubPlugin(ctx, clonePath, repoURL, ref, credentials)
+	if err != nil {
+		return nil, fmt.Errorf("An error occurred pulling plugin from GitHub:\n%v", err.Error())
+	}
+	if ref != "" {
+		logrus.Infof("Checked out ref '%s' of plugin %s at commit '%s'", ref, repoURL, checkedOutCommit)
+	}
+
+	checkoutDirName := checkedOutCommit
+	if checkoutDirName == "" {
+		checkoutDirName = pluginDefaultCheckoutDirName
+	}
+	checkoutPath := filepath.Join(repoDir, checkoutDirName)
+	release := pr.host.checkoutCache.acquire(checkoutPath)
+	if _, err := os.Stat(filepath.Join(checkoutPath, pluginCheckoutReadyFile)); err != nil {
+		if err = createPluginCheckout(clonePath, checkoutPath); err != nil {
+			release()
+			return nil, fmt.Errorf("failed to create the checkout of commit '%s': %v", checkedOutCommit, err)
+		}
+	}
+
+	return &pluginCheckout{
+		path:    checkoutPath,
+		commit:  checkedOutCommit,
+		key:     fmt.Sprintf("%s-%s", repoDirName, shortenCommit(checkoutDirName)),
+		release: release,
+	}, nil
+}
+
+// getPluginRepoDirName returns <repository name>-<URL and tenant hash>, so the repositories with the same name in
+// different organizations or hosts don't collide, the tenant is empty for the public repositories
+func getPluginRepoDirName(repoURL string, tenantId string) string {
+	urlHash := sha256.Sum256([]byte(repoURL + "\x00" + tenantId))
+	return fmt.Sprintf("%s-%s", strings.TrimSuffix(filepath.Base(repoURL), ".git"), hex.EncodeToString(urlHash[:])[:pluginURLHashLength])
+}
+
+func shortenCommit(commit string) string {
+	if len(commit) > pluginEnvKeyHashLength {
+		return commit[:pluginEnvKeyHashLength]
+	}
+	return commit
+}
+
+// createPluginCheckout copies the files of the clone, the checkout is marked as ready once all the files were copied
+func createPluginCheckout(clonePath, checkoutPath string) error {
+	if err := os.RemoveAll(checkoutPath); err != nil {
+		return err
+	}
+	if err := copyPluginFiles(clonePath, checkoutPath); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(checkoutPath, pluginCheckoutReadyFile), []byte{}, pluginFilePerms)
+}
+
+// copyPluginFiles copies the files of the plugin directory, without its git directory
+func copyPluginFiles(sourcePath, targetPath string) error {
+	return filepath.WalkDir(sourcePath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(sourcePath, path)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && entry.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		targetFilePath := filepath.Join(targetPath, relativePath)
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case entry.IsDir():
+			return os.MkdirAll(targetFilePath, info.Mode().Perm()|0700)
+		case info.Mode()&fs.ModeSymlink != 0:
+			linkTarget, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(linkTarget, targetFilePath)
+		default:
+			return copyFile(path, targetFilePath, info.Mode().Perm())
+		}
+	})
+}
+
+func copyFile(sourcePath, targetPath string, perm fs.FileMode) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(target, source); err != nil {
+		target.Close()
+		return err
+	}
+	return target.Close()
+}
@@ -0,0 +1,124 @@
+package plugins
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPluginCheckoutsAreKeyedByFullURLAndCommit(t *testing.T) {
+	github := map[string]map[string]string{
+		"https://github.com/first-org/plugin.git":  {"main.py": "ORG = 'first'\n"},
+		"https://github.com/second-org/plugin.git": {"main.py": "ORG = 'second'\n"},
+	}
+	runner, cleanUpDbFunc := getPluginRunnerWithProvider(t, NewMockGitPluginProvider(github))
+	defer cleanUpDbFunc()
+
+	firstCheckout, err := runner.getOrCloneRepo(context.Background(), "github.com/first-org/plugin:v1", "")
+	require.NoError(t, err)
+	secondCheckout, err := runner.getOrCloneRepo(context.Background(), "github.com/second-org/plugin:v1", "")
+	require.NoError(t, err)
+	require.NotEqual(t, firstCheckout.path, secondCheckout.path)
+	require.NotEqual(t, firstCheckout.key, secondCheckout.key)
+	requireFileContents(t, filepath.Join(firstCheckout.path, "main.py"), "ORG = 'first'\n")
+	requireFileContents(t, filepath.Join(secondCheckout.path, "main.py"), "ORG = 'second'\n")
+
+	// the mocked repositories return the ref as the commit
+	otherCommitCheckout, err := runner.getOrCloneRepo(context.Background(), "github.com/first-org/plugin:v1", "v2")
+	require.NoError(t, err)
+	require.Equal(t, "v2", otherCommitCheckout.commit)
+	require.NotEqual(t, firstCheckout.path, otherCommitCheckout.path)
+	require.Equal(t, filepath.Dir(firstCheckout.path), filepath.Dir(otherCommitCheckout.path))
+}
+
+func TestPluginCheckoutsAreSafeForConcurrentRuns(t *testing.T) {
+	runner, cleanUpDbFunc := getPluginRunnerWithProvider(t, NewMockGitPluginProvider(MockGitHub))
+	defer cleanUpDbFunc()
+
+	var wg sync.WaitGroup
+	checkouts := make([]*pluginCheckout, 8)
+	errs := make([]error, len(checkouts))
+	for idx := range checkouts {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			checkouts[idx], errs[idx] = runner.getOrCloneRepo(context.Background(), simplePlugin, "")
+		}(idx)
+	}
+	wg.Wait()
+
+	for idx, checkout := range checkouts {
+		require.NoError(t, errs[idx])
+		require.Equal(t, checkouts[0].path, checkout.path)
+	}
+	contents, err := os.ReadFile(filepath.Join(checkouts[0].path, "main.py"))
+	require.NoError(t, err)
+	require.Equal(t, MockGitHub[simplePlugin]["main.py"], string(contents))
+	require.FileExists(t, filepath.Join(checkouts[0].path, pluginCheckoutReadyFile))
+}
+
+func TestPluginCheckoutCacheEvictsUnusedCheckouts(t *testing.T) {
+	dir := t.TempDir()
+	cache := newPluginCheckoutCache(dir, 1)
+	createCheckout := func(path string) {
+		require.NoError(t, os.MkdirAll(path, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(path, pluginCheckoutReadyFile), []byte{}, pluginFilePerms))
+	}
+
+	firstPath := filepath.Join(dir, "plugin-1f2e3d", "first")
+	releaseFirst := cache.acquire(firstPath)
+	createCheckout(firstPath)
+	secondPath := filepath.Join(dir, "plugin-1f2e3d", "second")
+	releaseSecond := cache.acquire(secondPath)
+	createCheckout(secondPath)
+
+	// the checkout in use is not evicted
+	require.DirExists(t, firstPath)
+	releaseFirst()
+	require.NoDirExists(t, firstPath)
+	releaseSecond()
+	releaseSecond()
+	require.Equal(t, 0, cache.entries[secondPath].Value.(*pluginCheckoutEntry).refs)
+
+	// the checkouts created before a restart are evicted too, but not the clones
+	clonePath := filepath.Join(dir, "plugin-1f2e3d", pluginCloneDirName)
+	require.NoError(t, os.MkdirAll(clonePath, 0755))
+	restartedCache := newPluginCheckoutCache(dir, 1)
+	thirdPath := filepath.Join(dir, "other-plugin-4c5b6a", "third")
+	restartedCache.acquire(thirdPath)()
+	require.NoDirExists(t, secondPath)
+	require.DirExists(t, clonePath)
+}
+
+func TestPluginHostCachesHaveTheirOwnSizes(t *testing.T) {
+	host := newTestPluginHost(t, PluginHostConfig{EnvCacheSize: 3, CheckoutCacheSize: 5})
+	require.Equal(t, 3, host.envCache.maxEntries)
+	require.Equal(t, 5, host.checkoutCache.maxEntries)
+
+	host = newTestPluginHost(t, PluginHostConfig{})
+	require.Equal(t, defaultPluginEnvCacheSize, host.envCache.maxEntries)
+	require.Equal(t, defaultPluginCheckoutCacheSize, host.checkoutCache.maxEntries)
+}
+
+func TestPluginRepositoryLockStopsWaitingWithTheContext(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), pluginCloneDirName+".lock")
+	unlock, err := lockFile(context.Background(), lockPath)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = lockFile(ctx, lockPath)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 10*time.Second)
+
+	unlock()
+	unlock, err = lockFile(context.Background(), lockPath)
+	require.NoError(t, err)
+	unlock()
+}
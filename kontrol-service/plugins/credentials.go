@@ -0,0 +1,230 @@
+package plugins
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/kurtosis-tech/stacktrace"
+
+	"kardinal.kontrol-service/database"
+)
+
+type PluginCredentialsType string
+
+const (
+	// PluginTokenCredentials authenticates the HTTPS requests with a token, e.g. a GitHub personal access token
+	PluginTokenCredentials PluginCredentialsType = "token"
+	// PluginSSHKeyCredentials pulls the repositories with SSH and a private deploy key
+	PluginSSHKeyCredentials PluginCredentialsType = "ssh-key"
+
+	defaultTokenUsername       = "x-access-token"
+	defaultSSHKeyUsername      = "git"
+	pluginCredentialsKeyLength = 32
+	redactedSecret             = "[redacted]"
+)
+
+// PluginCredentialsCipher encrypts the secrets stored in the database, the credentials can't be used without it
+type PluginCredentialsCipher struct {
+	aead cipher.AEAD
+}
+
+// Secret is a token or a private key, it's never printed, logged or returned by the API
+type Secret string
+
+func (s Secret) String() string {
+	return redactedSecret
+}
+
+func (s Secret) Format(f fmt.State, _ rune) {
+	_, _ = f.Write([]byte(redactedSecret))
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(redactedSecret)
+}
+
+// PluginCredentials are used to pull the private plugin repositories of a tenant starting with the repository prefix
+type PluginCredentials struct {
+	// Repository is the URL prefix of the repositories, e.g. github.com/my-org or github.com/my-org/my-plugin
+	Repository string                `json:"repository"`
+	Type       PluginCredentialsType `json:"type"`
+	Username   string                `json:"username,omitempty"`
+	// Secret is the token or the private SSH key, it's only set in the requests
+	Secret Secret `json:"secret,omitempty"`
+}
+
+func (c *PluginCredentials) Validate() error {
+	if normalizePluginRepository(c.Repository) == "" {
+		return stacktrace.NewError("The repository of the plugin credentials can't be empty")
+	}
+	if c.Type != PluginTokenCredentials && c.Type != PluginSSHKeyCredentials {
+		return stacktrace.NewError("The plugin credentials type must be '%s' or '%s', got '%s'", PluginTokenCredentials, PluginSSHKeyCredentials, c.Type)
+	}
+	if c.Secret == "" {
+		return stacktrace.NewError("The secret of the plugin credentials can't be empty")
+	}
+	return nil
+}
+
+func (c *PluginCredentials) getUsername() string {
+	if c.Username != "" {
+		return c.Username
+	}
+	if c.Type == PluginSSHKeyCredentials {
+		return defaultSSHKeyUsername
+	}
+	return defaultTokenUsername
+}
+
+// NewPluginCredentialsCipher returns the cipher of the base64 encoded AES-256 key encrypting the plugin credentials in
+// the database
+func NewPluginCredentialsCipher(encodedKey string) (*PluginCredentialsCipher, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, stacktrace.NewError("The plugin credentials key must be base64 encoded")
+	}
+	if len(key) != pluginCredentialsKeyLength {
+		return nil, stacktrace.NewError("The plugin credentials key must have %d bytes, got %d", pluginCredentialsKeyLength, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "An error occurred creating the plugin credentials cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "An error occurred creating the plugin credentials cipher")
+	}
+	return &PluginCredentialsCipher{aead: aead}, nil
+}
+
+// SavePluginCredentials encrypts the secret with the cipher and stores the credentials of the repository prefix of the
+// tenant, the cipher is nil when the server has no credentials key
+func SavePluginCredentials(db *database.Db, credentialsCipher *PluginCredentialsCipher, tenantId string, credentials PluginCredentials) error {
+	if err := credentials.Validate(); err != nil {
+		return err
+	}
+	repository := normalizePluginRepository(credentials.Repository)
+	encryptedSecret, err := credentialsCipher.encrypt(tenantId, repository, credentials.Secret)
+	if err != nil {
+		return err
+	}
+	return db.SavePluginCredential(&database.PluginCredential{
+		TenantId:        tenantId,
+		Repository:      repository,
+		Type:            string(credentials.Type),
+		Username:        credentials.Username,
+		EncryptedSecret: encryptedSecret,
+	})
+}
+
+// ListPluginCredentials returns the credentials of the tenant without their secrets
+func ListPluginCredentials(db *database.Db, tenantId string) ([]PluginCredentials, error) {
+	storedCredentials, err := db.GetPluginCredentials(tenantId)
+	if err != nil {
+		return nil, err
+	}
+	credentials := []PluginCredentials{}
+	for _, storedCredential := range storedCredentials {
+		credentials = append(credentials, PluginCredentials{
+			Repository: storedCredential.Repository,
+			Type:       PluginCredentialsType(storedCredential.Type),
+			Username:   storedCredential.Username,
+		})
+	}
+	return credentials, nil
+}
+
+// DeletePluginCredentials deletes the credentials of the repository prefix, it returns false if there were none
+func DeletePluginCredentials(db *database.Db, tenantId string, repository string) (bool, error) {
+	return db.DeletePluginCredential(tenantId, normalizePluginRepository(repository))
+}
+
+// getPluginCredentials returns the credentials of the tenant with the longest repository prefix matching the
+// repository, nil if there are none, the http repositories and remote plugins matching credentials are rejected
+func (pr *PluginRunner) getPluginCredentials(repoURL string) (*PluginCredentials, error) {
+	storedCredentials, err := pr.db.GetPluginCredentials(pr.tenantId)
+	if err != nil {
+		return nil, err
+	}
+
+	repository := normalizePluginRepository(repoURL)
+	var matchingCredential *database.PluginCredential
+	for idx, storedCredential := range storedCredentials {
+		if repository != storedCredential.Repository && !strings.HasPrefix(repository, storedCredential.Repository+"/") {
+			continue
+		}
+		if matchingCredential == nil || len(storedCredential.Repository) > len(matchingCredential.Repository) {
+			matchingCredential = &storedCredentials[idx]
+		}
+	}
+	if matchingCredential == nil {
+		return nil, nil
+	}
+	// the credentials would be sent in clear text
+	if strings.HasPrefix(strings.ToLower(strings.TrimSpace(repoURL)), "http://") {
+		return nil, fmt.Errorf("the credentials of repository '%s' can't be sent over http, use an https URL", matchingCredential.Repository)
+	}
+
+	secret, err := pr.host.credentialsCipher.decrypt(pr.tenantId, matchingCredential.Repository, matchingCredential.EncryptedSecret)
+	if err != nil {
+		return nil, err
+	}
+	return &PluginCredentials{
+		Repository: matchingCredential.Repository,
+		Type:       PluginCredentialsType(matchingCredential.Type),
+		Username:   matchingCredential.Username,
+		Secret:     secret,
+	}, nil
+}
+
+// encrypt returns the nonce followed by the encrypted secret, the tenant and the repository are authenticated so the
+// encrypted secret can't be used for another tenant or repository
+func (c *PluginCredentialsCipher) encrypt(tenantId string, repository string, secret Secret) ([]byte, error) {
+	if c == nil {
+		return nil, stacktrace.NewError("The plugin credentials key is not configured")
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, stacktrace.Propagate(err, "An error occurred generating the plugin credentials nonce")
+	}
+	return c.aead.Seal(nonce, nonce, []byte(secret), getPluginSecretAdditionalData(tenantId, repository)), nil
+}
+
+func (c *PluginCredentialsCipher) decrypt(tenantId string, repository string, encryptedSecret []byte) (Secret, error) {
+	if c == nil {
+		return "", stacktrace.NewError("The plugin credentials key is not configured")
+	}
+	nonceSize := c.aead.NonceSize()
+	if len(encryptedSecret) < nonceSize {
+		return "", stacktrace.NewError("The encrypted secret of the plugin credentials for repository '%s' is invalid", repository)
+	}
+	secret, err := c.aead.Open(nil, encryptedSecret[:nonceSize], encryptedSecret[nonceSize:], getPluginSecretAdditionalData(tenantId, repository))
+	if err != nil {
+		// the cipher errors don't contain the secret
+		return "", stacktrace.Propagate(err, "An error occurred decrypting the plugin credentials for repository '%s'", repository)
+	}
+	return Secret(secret), nil
+}
+
+func getPluginSecretAdditionalData(tenantId string, repository string) []byte {
+	return []byte(tenantId + "\x00" + repository)
+}
+
+// normalizePluginRepository removes the scheme, the user, the .git suffix and the trailing slashes of the repository
+// URL, so the credentials match the plugin names with or without them
+func normalizePluginRepository(repoURL string) string {
+	repository := strings.TrimSpace(repoURL)
+	if schemeIdx := strings.Index(repository, "://"); schemeIdx >= 0 {
+		repository = repository[schemeIdx+len("://"):]
+	}
+	if userIdx := strings.Index(repository, "@"); userIdx >= 0 && userIdx < strings.Index(repository+"/", "/") {
+		repository = repository[userIdx+1:]
+	}
+	repository = strings.TrimRight(repository, "/")
+	return strings.TrimSuffix(repository, ".git")
+}
@@ -0,0 +1,215 @@
+package plugins
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPluginEnvCacheSize = 20
+	pluginEnvsDirName         = "go-python-plugin-envs"
+	// pluginEnvReadyFile marks the environments whose requirements were installed, the others are rebuilt
+	pluginEnvReadyFile     = ".kardinal-ready"
+	pluginEnvKeyHashLength = 12
+)
+
+// pluginEnvCache keeps the Python virtual environments of the plugins, they are shared by all the tenants and flows
+// and keyed by the repository and commit of the plugin and the hash of its requirements, the least recently used ones
+// are removed when there are more than maxEntries
+type pluginEnvCache struct {
+	dir        string
+	maxEntries int
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	// lru has the most recently used entries first
+	lru    *list.List
+	loaded bool
+}
+
+type pluginEnvEntry struct {
+	key  string
+	path string
+	// refs is the number of calls using the environment, it's not removed while it's used
+	refs int
+	// buildLock is held while the environment is built, so it's built once, it's a channel so the calls waiting for
+	// it stop when their context is done
+	buildLock chan struct{}
+	ready     bool
+}
+
+func newPluginEnvCache(dir string, maxEntries int) *pluginEnvCache {
+	return &pluginEnvCache{
+		dir:        dir,
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+// get returns the path of the environment of the plugin checkout, building it if needed, the release function must be
+// called once the environment is not used anymore, the call stops waiting for the build of another call when the
+// context is done
+func (c *pluginEnvCache) get(ctx context.Context, call *pluginCall, checkout *pluginCheckout) (string, func(), error) {
+	key, err := getPluginEnvKey(checkout)
+	if err != nil {
+		return "", nil, call.errorf(ctx, "failed to get the environment key: %v", err)
+	}
+
+	entry := c.acquire(key)
+	release := func() { c.release(entry) }
+
+	select {
+	case entry.buildLock <- struct{}{}:
+	case <-ctx.Done():
+		release()
+		return "", nil, call.errorf(ctx, "failed to wait for the environment '%s': %v", entry.key, ctx.Err())
+	}
+	defer func() { <-entry.buildLock }()
+	if entry.ready {
+		logrus.Debugf("Using the cached environment '%s' of plugin '%s'", entry.key, call.plugin)
+		return entry.path, release, nil
+	}
+
+	logrus.Infof("Building the environment '%s' of plugin '%s'", entry.key, call.plugin)
+	if err = buildPluginEnv(ctx, call, checkout.path, entry.path); err != nil {
+		release()
+		return "", nil, err
+	}
+	entry.ready = true
+	return entry.path, release, nil
+}
+
+func newPluginEnvEntry(key string, path string, ready bool) *pluginEnvEntry {
+	return &pluginEnvEntry{key: key, path: path, buildLock: make(chan struct{}, 1), ready: ready}
+}
+
+func (c *pluginEnvCache) acquire(key string) *pluginEnvEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.loadLocked()
+
+	element, found := c.entries[key]
+	if !found {
+		element = c.lru.PushFront(newPluginEnvEntry(key, filepath.Join(c.dir, key), false))
+		c.entries[key] = element
+	} else {
+		c.lru.MoveToFront(element)
+	}
+	entry := element.Value.(*pluginEnvEntry)
+	entry.refs++
+	c.evictLocked()
+	return entry
+}
+
+func (c *pluginEnvCache) release(entry *pluginEnvEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry.refs--
+	c.evictLocked()
+}
+
+// evictLocked removes the least recently used environments which are not used until there are at most maxEntries
+func (c *pluginEnvCache) evictLocked() {
+	for element := c.lru.Back(); element != nil && c.lru.Len() > c.maxEntries; {
+		previous := element.Prev()
+		entry := element.Value.(*pluginEnvEntry)
+		if entry.refs == 0 {
+			c.lru.Remove(element)
+			delete(c.entries, entry.key)
+			logrus.Infof("Removing the plugin environment '%s' from the cache", entry.key)
+			if err := os.RemoveAll(entry.path); err != nil {
+				logrus.Errorf("An error occurred removing the plugin environment '%s': %v", entry.path, err)
+			}
+		}
+		element = previous
+	}
+}
+
+// loadLocked adds the environments built before a restart to the cache, the oldest first, and removes the ones which
+// were not completed
+func (c *pluginEnvCache) loadLocked() {
+	if c.loaded {
+		return
+	}
+	c.loaded = true
+
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logrus.Errorf("An error occurred reading the plugin environments in '%s': %v", c.dir, err)
+		}
+		return
+	}
+
+	type builtEnv struct {
+		key     string
+		modTime int64
+	}
+	var builtEnvs []builtEnv
+	for _, dirEntry := range dirEntries {
+		path := filepath.Join(c.dir, dirEntry.Name())
+		info, err := os.Stat(filepath.Join(path, pluginEnvReadyFile))
+		if err != nil {
+			if err = os.RemoveAll(path); err != nil {
+				logrus.Errorf("An error occurred removing the incomplete plugin environment '%s': %v", path, err)
+			}
+			continue
+		}
+		builtEnvs = append(builtEnvs, builtEnv{key: dirEntry.Name(), modTime: info.ModTime().UnixNano()})
+	}
+	sort.Slice(builtEnvs, func(i, j int) bool {
+		return builtEnvs[i].modTime < builtEnvs[j].modTime
+	})
+	for _, env := range builtEnvs {
+		c.entries[env.key] = c.lru.PushFront(newPluginEnvEntry(env.key, filepath.Join(c.dir, env.key), true))
+	}
+	c.evictLocked()
+}
+
+// buildPluginEnv creates the virtual environment and installs the requirements of the plugin, the incomplete
+// environments are removed so the next call builds them again
+func buildPluginEnv(ctx context.Context, call *pluginCall, repoPath string, venvPath string) error {
+	if err := os.RemoveAll(venvPath); err != nil {
+		return call.errorf(ctx, "failed to remove the incomplete environment: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(venvPath), 0755); err != nil {
+		return call.errorf(ctx, "failed to create the plugin environments directory: %v", err)
+	}
+	if err := createVirtualEnv(ctx, call, venvPath); err != nil {
+		return err
+	}
+
+	requirementsPath := filepath.Join(repoPath, "requirements.txt")
+	if _, err := os.Stat(requirementsPath); err == nil {
+		if err := installDependencies(ctx, call, venvPath, requirementsPath); err != nil {
+			return err
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(venvPath, pluginEnvReadyFile), []byte{}, pluginFilePerms); err != nil {
+		return call.errorf(ctx, "failed to mark the environment as ready: %v", err)
+	}
+	return nil
+}
+
+// getPluginEnvKey returns <checkout key>-<requirements hash>, the checkout key identifies the repository and the commit
+func getPluginEnvKey(checkout *pluginCheckout) (string, error) {
+	requirements, err := os.ReadFile(filepath.Join(checkout.path, "requirements.txt"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to read the requirements: %v", err)
+	}
+	requirementsHash := sha256.Sum256(requirements)
+
+	return fmt.Sprintf("%s-%s", checkout.key, hex.EncodeToString(requirementsHash[:])[:pluginEnvKeyHashLength]), nil
+}
@@ -0,0 +1,92 @@
+package plugins
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPluginEnvCacheReusesAndEvictsEnvironments(t *testing.T) {
+	cache := newPluginEnvCache(filepath.Join(t.TempDir(), "envs"), 1)
+	runner, cleanUpDbFunc := getPluginRunnerWithProvider(t, NewMockGitPluginProvider(MockGitHub))
+	defer cleanUpDbFunc()
+	simpleCheckout, err := runner.getOrCloneRepo(context.Background(), simplePlugin, "")
+	require.NoError(t, err)
+	identityCheckout, err := runner.getOrCloneRepo(context.Background(), identityPlugin, "")
+	require.NoError(t, err)
+
+	call := &pluginCall{plugin: simplePlugin, operation: warmOperation, timeout: time.Minute, limits: PluginLimits{}.withDefaults()}
+	simpleEnvPath, release, err := cache.get(context.Background(), call, simpleCheckout)
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(simpleEnvPath, pluginEnvReadyFile))
+	require.Equal(t, filepath.Join(cache.dir, simpleCheckout.key+"-e3b0c44298fc"), simpleEnvPath)
+
+	// the environment in use is not evicted
+	identityEnvPath, identityRelease, err := cache.get(context.Background(), call, identityCheckout)
+	require.NoError(t, err)
+	require.DirExists(t, simpleEnvPath)
+	release()
+	require.NoDirExists(t, simpleEnvPath)
+	identityRelease()
+
+	// the cached environment is not built again
+	readyFileInfo, err := os.Stat(filepath.Join(identityEnvPath, pluginEnvReadyFile))
+	require.NoError(t, err)
+	reusedEnvPath, release, err := cache.get(context.Background(), call, identityCheckout)
+	require.NoError(t, err)
+	release()
+	require.Equal(t, identityEnvPath, reusedEnvPath)
+	reusedReadyFileInfo, err := os.Stat(filepath.Join(identityEnvPath, pluginEnvReadyFile))
+	require.NoError(t, err)
+	require.Equal(t, readyFileInfo.ModTime(), reusedReadyFileInfo.ModTime())
+
+	// the environments built before a restart are reused
+	restartedCache := newPluginEnvCache(cache.dir, 1)
+	restartedEnvPath, release, err := restartedCache.get(context.Background(), call, identityCheckout)
+	require.NoError(t, err)
+	release()
+	require.Equal(t, identityEnvPath, restartedEnvPath)
+	require.True(t, restartedCache.entries[filepath.Base(identityEnvPath)].Value.(*pluginEnvEntry).ready)
+}
+
+func TestPluginEnvCacheStopsWaitingWithTheContext(t *testing.T) {
+	cache := newPluginEnvCache(filepath.Join(t.TempDir(), "envs"), 1)
+	checkout := &pluginCheckout{path: t.TempDir(), commit: "36ed9a4", key: "plugin-36ed9a4"}
+	key, err := getPluginEnvKey(checkout)
+	require.NoError(t, err)
+
+	// another call is building the environment
+	entry := cache.acquire(key)
+	entry.buildLock <- struct{}{}
+	defer func() {
+		<-entry.buildLock
+		cache.release(entry)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	call := &pluginCall{plugin: simplePlugin, operation: warmOperation, timeout: 100 * time.Millisecond, limits: PluginLimits{}.withDefaults()}
+	start := time.Now()
+	_, _, err = cache.get(ctx, call, checkout)
+	require.Less(t, time.Since(start), 10*time.Second)
+	pluginErr, found := GetPluginError(err)
+	require.True(t, found)
+	require.Equal(t, PluginTimeoutError, pluginErr.Kind)
+	require.Equal(t, 1, entry.refs)
+}
+
+func TestPluginEnvKeyChangesWithRequirements(t *testing.T) {
+	checkout := &pluginCheckout{path: t.TempDir(), commit: "36ed9a4", key: "plugin-36ed9a4"}
+	require.NoError(t, os.WriteFile(filepath.Join(checkout.path, "requirements.txt"), []byte("requests"), mockProviderPerms))
+	key, err := getPluginEnvKey(checkout)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(checkout.path, "requirements.txt"), []byte("requests==2.32.3"), mockProviderPerms))
+	updatedKey, err := getPluginEnvKey(checkout)
+	require.NoError(t, err)
+	require.NotEqual(t, key, updatedKey)
+}
@@ -0,0 +1,243 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/kurtosis-tech/stacktrace"
+)
+
+const (
+	defaultPluginTimeout        = 5 * time.Minute
+	defaultPluginMaxOutputBytes = 64 * 1024
+	defaultPluginConcurrency    = 4
+	// pluginWaitDelay is the time given to the processes to close their output after they were killed
+	pluginWaitDelay = 5 * time.Second
+
+	createFlowOperation = "create_flow"
+	deleteFlowOperation = "delete_flow"
+	warmOperation       = "warm"
+)
+
+// PluginLimits bound the resources used by the plugin processes, they run in the kontrol pod
+type PluginLimits struct {
+	// Timeout is the default duration of a plugin call, including the setup of its environment, the plugins can
+	// set a shorter one
+	Timeout time.Duration
+	// CPUSeconds is the CPU time limit of each plugin process, 0 for no limit
+	CPUSeconds uint64
+	// MemoryBytes is the virtual memory limit of each plugin process, 0 for no limit
+	MemoryBytes uint64
+	// MaxOutputBytes is the size of the stdout and stderr kept from each plugin process, the rest is truncated
+	MaxOutputBytes int
+	// Concurrency is the number of independent plugins run at the same time while creating a flow
+	Concurrency int
+}
+
+// pluginProcessEnvVars are the variables of the kontrol environment passed to the plugin and git processes, the others,
+// e.g. DB_PASSWORD and PLUGIN_CREDENTIALS_KEY, are not
+var pluginProcessEnvVars = []string{
+	"PATH", "HOME", "USER", "LANG", "LC_ALL", "TZ", "TMPDIR",
+	"SSL_CERT_FILE", "SSL_CERT_DIR",
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
+	"PIP_INDEX_URL", "PIP_EXTRA_INDEX_URL", "PIP_TRUSTED_HOST",
+}
+
+// withDefaults replaces the zero timeout, output size and concurrency with the built-in defaults
+func (l PluginLimits) withDefaults() PluginLimits {
+	if l.Timeout == 0 {
+		l.Timeout = defaultPluginTimeout
+	}
+	if l.MaxOutputBytes == 0 {
+		l.MaxOutputBytes = defaultPluginMaxOutputBytes
+	}
+	if l.Concurrency == 0 {
+		l.Concurrency = defaultPluginConcurrency
+	}
+	return l
+}
+
+type PluginErrorKind string
+
+const (
+	// PluginTimeoutError is returned when the plugin call took longer than its timeout
+	PluginTimeoutError PluginErrorKind = "timeout"
+	// PluginCanceledError is returned when the request calling the plugin was canceled
+	PluginCanceledError PluginErrorKind = "canceled"
+	// PluginExecutionError is returned when the plugin or the setup of its environment failed
+	PluginExecutionError PluginErrorKind = "execution"
+)
+
+// PluginError is the failure of a plugin call, with the truncated output of the failed process
+type PluginError struct {
+	Plugin    string          `json:"plugin"`
+	Operation string          `json:"operation"`
+	Kind      PluginErrorKind `json:"kind"`
+	Timeout   string          `json:"timeout,omitempty"`
+	Message   string          `json:"message"`
+	Stdout    string          `json:"stdout,omitempty"`
+	Stderr    string          `json:"stderr,omitempty"`
+}
+
+func (e *PluginError) Error() string {
+	var sb bytes.Buffer
+	switch e.Kind {
+	case PluginTimeoutError:
+		sb.WriteString(fmt.Sprintf("plugin '%s' %s timed out after %s: %s", e.Plugin, e.Operation, e.Timeout, e.Message))
+	case PluginCanceledError:
+		sb.WriteString(fmt.Sprintf("plugin '%s' %s was canceled: %s", e.Plugin, e.Operation, e.Message))
+	default:
+		sb.WriteString(fmt.Sprintf("plugin '%s' %s failed: %s", e.Plugin, e.Operation, e.Message))
+	}
+	if e.Stdout != "" {
+		sb.WriteString(fmt.Sprintf("\nStdout: %s", e.Stdout))
+	}
+	if e.Stderr != "" {
+		sb.WriteString(fmt.Sprintf("\nStderr: %s", e.Stderr))
+	}
+	return sb.String()
+}
+
+// GetPluginError returns the plugin error causing the error, if any
+func GetPluginError(err error) (*PluginError, bool) {
+	var pluginErr *PluginError
+	if errors.As(err, &pluginErr) || errors.As(stacktrace.RootCause(err), &pluginErr) {
+		return pluginErr, true
+	}
+	return nil, false
+}
+
+// pluginCall is a call to create_flow or delete_flow of a plugin, it gives the errors of its commands the context of
+// the call
+type pluginCall struct {
+	plugin    string
+	operation string
+	timeout   time.Duration
+	limits    PluginLimits
+}
+
+func (c *pluginCall) newError(ctx context.Context, message string, output *commandOutput) *PluginError {
+	pluginErr := &PluginError{
+		Plugin:    c.plugin,
+		Operation: c.operation,
+		Kind:      PluginExecutionError,
+		Message:   message,
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		pluginErr.Kind = PluginTimeoutError
+		pluginErr.Timeout = c.timeout.String()
+	} else if errors.Is(ctx.Err(), context.Canceled) {
+		pluginErr.Kind = PluginCanceledError
+	}
+	if output != nil {
+		pluginErr.Stdout = output.stdout.String()
+		pluginErr.Stderr = output.stderr.String()
+	}
+	return pluginErr
+}
+
+// errorf returns a plugin error without process output
+func (c *pluginCall) errorf(ctx context.Context, format string, args ...interface{}) *PluginError {
+	return c.newError(ctx, fmt.Sprintf(format, args...), nil)
+}
+
+type commandOutput struct {
+	stdout *truncatedBuffer
+	stderr *truncatedBuffer
+}
+
+// run runs the command with the limits of the call, the command and the processes it started are killed when the
+// context is done, the failure describes the step in the returned error
+func (c *pluginCall) run(ctx context.Context, failure string, dir string, name string, args ...string) (*commandOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, c.errorf(ctx, "%s: %v", failure, err)
+	}
+
+	cmd := newLimitedCommand(ctx, c.limits, name, args...)
+	cmd.Dir = dir
+	cmd.WaitDelay = pluginWaitDelay
+	output := &commandOutput{
+		stdout: newTruncatedBuffer(c.limits.MaxOutputBytes),
+		stderr: newTruncatedBuffer(c.limits.MaxOutputBytes),
+	}
+	cmd.Stdout = output.stdout
+	cmd.Stderr = output.stderr
+
+	if err := cmd.Run(); err != nil {
+		return output, c.newError(ctx, fmt.Sprintf("%s: %v", failure, err), output)
+	}
+	return output, nil
+}
+
+// truncatedBuffer keeps the first bytes written to it, the writes never fail so the process is not blocked
+type truncatedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func newTruncatedBuffer(max int) *truncatedBuffer {
+	return &truncatedBuffer{max: max}
+}
+
+func (b *truncatedBuffer) Write(p []byte) (int, error) {
+	remaining := b.max - b.buf.Len()
+	if remaining < len(p) {
+		b.truncated = true
+		if remaining > 0 {
+			b.buf.Write(p[:remaining])
+		}
+		return len(p), nil
+	}
+	b.buf.Write(p)
+	return len(p), nil
+}
+
+func (b *truncatedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "\n[truncated]"
+	}
+	return b.buf.String()
+}
+
+// getPluginProcessEnv returns the environment of the plugin and git processes, with the allowed variables of the
+// kontrol environment only
+func getPluginProcessEnv() []string {
+	env := []string{}
+	for _, name := range pluginProcessEnvVars {
+		if value, found := os.LookupEnv(name); found {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// newLimitedCommand returns the command, which runs in its own process group with the CPU and memory limits and the
+// allowed variables of the kontrol environment
+func newLimitedCommand(ctx context.Context, limits PluginLimits, name string, args ...string) *exec.Cmd {
+	if limits.CPUSeconds == 0 && limits.MemoryBytes == 0 {
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Env = getPluginProcessEnv()
+		setProcessGroupKill(cmd)
+		return cmd
+	}
+
+	// the limits are set by the shell before replacing itself with the command, so they only apply to the plugin
+	script := ""
+	if limits.CPUSeconds > 0 {
+		script += fmt.Sprintf("ulimit -t %d && ", limits.CPUSeconds)
+	}
+	if limits.MemoryBytes > 0 {
+		script += fmt.Sprintf("ulimit -v %d && ", limits.MemoryBytes/1024)
+	}
+	script += `exec "$@"`
+	cmd := exec.CommandContext(ctx, "/bin/sh", append([]string{"-c", script, "sh", name}, args...)...)
+	cmd.Env = getPluginProcessEnv()
+	setProcessGroupKill(cmd)
+	return cmd
+}
@@ -0,0 +1,80 @@
+package plugins
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPluginCallTimeoutKillsProcessGroup(t *testing.T) {
+	call := &pluginCall{plugin: simplePlugin, operation: createFlowOperation, timeout: 200 * time.Millisecond, limits: PluginLimits{}.withDefaults()}
+	ctx, cancel := context.WithTimeout(context.Background(), call.timeout)
+	defer cancel()
+
+	start := time.Now()
+	// the background sleep keeps the output open, the call only returns when the whole group is killed
+	_, err := call.run(ctx, "failed to run Python script", "", "/bin/sh", "-c", "echo started; sleep 30 & sleep 30")
+	require.Less(t, time.Since(start), 10*time.Second)
+
+	pluginErr, found := GetPluginError(err)
+	require.True(t, found)
+	require.Equal(t, PluginTimeoutError, pluginErr.Kind)
+	require.Equal(t, "200ms", pluginErr.Timeout)
+	require.Equal(t, "started\n", pluginErr.Stdout)
+}
+
+func TestPluginCallTruncatesOutput(t *testing.T) {
+	limits := PluginLimits{}.withDefaults()
+	limits.MaxOutputBytes = 10
+	limits.CPUSeconds = 10
+	limits.MemoryBytes = 512 * 1024 * 1024
+	call := &pluginCall{plugin: simplePlugin, operation: deleteFlowOperation, timeout: time.Minute, limits: limits}
+
+	_, err := call.run(context.Background(), "failed to run Python script", "", "/bin/sh", "-c", "yes | head -c 100000 >&2; exit 3")
+	pluginErr, found := GetPluginError(err)
+	require.True(t, found)
+	require.Equal(t, PluginExecutionError, pluginErr.Kind)
+	require.Equal(t, "y\ny\ny\ny\ny\n\n[truncated]", pluginErr.Stderr)
+	require.Contains(t, pluginErr.Error(), "plugin '"+simplePlugin+"' delete_flow failed: failed to run Python script: exit status 3")
+}
+
+func TestPluginCallTimeoutIsCappedByTheServerTimeout(t *testing.T) {
+	host := newTestPluginHost(t, PluginHostConfig{Limits: PluginLimits{Timeout: 10 * time.Minute}})
+	runner := NewPluginRunner(NewMockGitPluginProvider(MockGitHub), host, "tenant", nil)
+
+	call, _, cancel := runner.newPluginCall(context.Background(), simplePlugin, createFlowOperation, time.Minute)
+	cancel()
+	require.Equal(t, time.Minute, call.timeout)
+
+	call, _, cancel = runner.newPluginCall(context.Background(), simplePlugin, createFlowOperation, 0)
+	cancel()
+	require.Equal(t, 10*time.Minute, call.timeout)
+
+	call, ctx, cancel := runner.newPluginCall(context.Background(), simplePlugin, createFlowOperation, 24*time.Hour)
+	defer cancel()
+	require.Equal(t, 10*time.Minute, call.timeout)
+	deadline, found := ctx.Deadline()
+	require.True(t, found)
+	require.LessOrEqual(t, time.Until(deadline), 10*time.Minute)
+}
+
+func TestPluginHostKeepsTheDefaultLimits(t *testing.T) {
+	host := newTestPluginHost(t, PluginHostConfig{Limits: PluginLimits{Concurrency: 2}})
+	require.Equal(t, PluginLimits{Timeout: defaultPluginTimeout, MaxOutputBytes: defaultPluginMaxOutputBytes, Concurrency: 2}, host.GetLimits())
+
+	_, err := NewPluginHost(PluginHostConfig{Limits: PluginLimits{Timeout: -time.Second}})
+	require.Error(t, err)
+}
+
+func TestPluginCallOnlyGetsTheAllowedEnvironment(t *testing.T) {
+	t.Setenv("PLUGIN_CREDENTIALS_KEY", "not-a-real-key")
+	t.Setenv("DB_PASSWORD", "not-a-real-password")
+	call := &pluginCall{plugin: simplePlugin, operation: createFlowOperation, timeout: time.Minute, limits: PluginLimits{}.withDefaults()}
+
+	output, err := call.run(context.Background(), "failed to run Python script", "", "/bin/sh", "-c", "env")
+	require.NoError(t, err)
+	require.NotContains(t, output.stdout.String(), "not-a-real")
+	require.Contains(t, output.stdout.String(), "PATH=")
+}
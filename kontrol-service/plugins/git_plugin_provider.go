@@ -1,18 +1,35 @@
 package plugins
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
 )
 
 const (
 	mockProviderPerms = 0644
+	privateDirPerms   = 0700
+	privateFilePerms  = 0600
+
+	// gitRefForbiddenChars are the characters git check-ref-format rejects in the ref names, besides the control ones
+	gitRefForbiddenChars = " ~^:?*[\\"
 )
 
+// gitCommitRegex matches the full commit IDs, which can't change once fetched
+var gitCommitRegex = regexp.MustCompile("^[0-9a-f]{40}$")
+
 type GitPluginProvider interface {
-	PullGitHubPlugin(repoPath, repoUrl string) error
+	// PullGitHubPlugin clones or updates the plugin repository and checks out the ref, the default branch when it's
+	// empty, it returns the commit checked out, the credentials are nil for the public repositories, the git commands are
+	// killed when the context is done
+	PullGitHubPlugin(ctx context.Context, repoPath, repoUrl, ref string, credentials *PluginCredentials) (string, error)
 }
 
 type GitPluginProviderImpl struct{}
@@ -21,22 +38,227 @@ func NewGitPluginProviderImpl() *GitPluginProviderImpl {
 	return &GitPluginProviderImpl{}
 }
 
-func (gpp *GitPluginProviderImpl) PullGitHubPlugin(repoPath, repoUrl string) error {
+func (gpp *GitPluginProviderImpl) PullGitHubPlugin(ctx context.Context, repoPath, repoUrl, ref string, credentials *PluginCredentials) (string, error) {
+	if ref != "" {
+		if err := validateGitRef(ref); err != nil {
+			return "", err
+		}
+	}
+	auth, err := newGitAuth(credentials)
+	if err != nil {
+		return "", err
+	}
+	defer auth.cleanup()
+	repoUrl = auth.getRepoURL(repoUrl)
+
 	if _, err := os.Stat(repoPath); os.IsNotExist(err) {
-		cmd := exec.Command("git", "clone", repoUrl, repoPath)
-		if output, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("git clone failed: %v\nOutput: %s", err, output)
+		if output, err := auth.run(ctx, "", "clone", "--end-of-options", repoUrl, repoPath); err != nil {
+			return "", fmt.Errorf("git clone failed: %v\nOutput: %s", err, output)
 		}
+	} else if isFetchedCommit(ctx, auth, repoPath, ref) {
+		// the pinned commit was already fetched and can't have changed
+		logrus.Debugf("Commit '%s' is already in the plugin repository, skipping the fetch", ref)
 	} else {
-		// If the repository already exists, pull the latest changes
-		cmd := exec.Command("git", "-C", repoPath, "pull")
-		if output, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("git pull failed: %v\nOutput: %s", err, output)
+		// the credentials may have changed since the clone, e.g. from a token to an SSH key
+		if output, err := auth.run(ctx, repoPath, "remote", "set-url", "--end-of-options", "origin", repoUrl); err != nil {
+			return "", fmt.Errorf("git remote set-url failed: %v\nOutput: %s", err, output)
+		}
+		// If the repository already exists, fetch the latest changes
+		if output, err := auth.run(ctx, repoPath, "fetch", "--tags", "--force", "--end-of-options", "origin"); err != nil {
+			return "", fmt.Errorf("git fetch failed: %v\nOutput: %s", err, output)
+		}
+	}
+
+	commit, err := resolveGitRef(ctx, auth, repoPath, ref)
+	if err != nil {
+		return "", err
+	}
+
+	// the commit is the output of rev-parse, so it can't be taken for an option
+	if output, err := auth.run(ctx, repoPath, "checkout", "--force", "--detach", commit); err != nil {
+		return "", fmt.Errorf("git checkout of '%s' failed: %v\nOutput: %s", commit, err, output)
+	}
+	return commit, nil
+}
+
+// resolveGitRef returns the commit of the branch, tag or commit, the remote branches are used so the latest changes
+// of a branch are checked out, and the commits which are not in the fetched branches are fetched
+func resolveGitRef(ctx context.Context, auth *gitAuth, repoPath, ref string) (string, error) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	for _, candidate := range []string{"origin/" + ref, ref} {
+		if commit, err := revParseCommit(ctx, auth, repoPath, candidate); err == nil {
+			return commit, nil
 		}
 	}
+
+	if output, err := auth.run(ctx, repoPath, "fetch", "--end-of-options", "origin", ref); err != nil {
+		return "", fmt.Errorf("ref '%s' not found in the repository: %v\nOutput: %s", ref, err, output)
+	}
+	return revParseCommit(ctx, auth, repoPath, "FETCH_HEAD")
+}
+
+// isFetchedCommit returns true when the ref is a full commit ID already in the repository
+func isFetchedCommit(ctx context.Context, auth *gitAuth, repoPath, ref string) bool {
+	if !gitCommitRegex.MatchString(ref) {
+		return false
+	}
+	commit, err := revParseCommit(ctx, auth, repoPath, ref)
+	return err == nil && commit == ref
+}
+
+func revParseCommit(ctx context.Context, auth *gitAuth, repoPath, rev string) (string, error) {
+	output, err := auth.run(ctx, repoPath, "rev-parse", "--verify", "--quiet", "--end-of-options", rev+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse of '%s' failed: %v", rev, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// validateGitRef checks the branch, tag or commit with the rules of git check-ref-format, and rejects the refs starting
+// with '-' which git would take for options
+func validateGitRef(ref string) error {
+	if gitCommitRegex.MatchString(ref) {
+		return nil
+	}
+	invalid := ref == "" || ref == "@" ||
+		strings.HasPrefix(ref, "-") || strings.HasPrefix(ref, "/") ||
+		strings.HasSuffix(ref, "/") || strings.HasSuffix(ref, ".") ||
+		strings.Contains(ref, "..") || strings.Contains(ref, "@{") || strings.Contains(ref, "//") ||
+		strings.ContainsAny(ref, gitRefForbiddenChars) ||
+		strings.ContainsFunc(ref, func(r rune) bool { return r < 0x20 || r == 0x7f })
+	for _, component := range strings.Split(ref, "/") {
+		invalid = invalid || strings.HasPrefix(component, ".") || strings.HasSuffix(component, ".lock")
+	}
+	if invalid {
+		return fmt.Errorf("'%s' is not a valid git branch, tag or commit", ref)
+	}
 	return nil
 }
 
+// gitAuth passes the credentials to the git commands with environment variables, so they are not in the command
+// lines or in the git config of the clones, and removes them from the output of the commands
+type gitAuth struct {
+	env     []string
+	secrets []string
+	// sshUsername is set when the repositories are pulled with SSH
+	sshUsername string
+	keyDir      string
+}
+
+func newGitAuth(credentials *PluginCredentials) (*gitAuth, error) {
+	// the commands fail instead of waiting for a password
+	auth := &gitAuth{env: []string{"GIT_TERMINAL_PROMPT=0"}}
+	if credentials == nil {
+		return auth, nil
+	}
+
+	secret := string(credentials.Secret)
+	switch credentials.Type {
+	case PluginTokenCredentials:
+		basicAuth := base64.StdEncoding.EncodeToString([]byte(credentials.getUsername() + ":" + secret))
+		auth.env = append(auth.env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+basicAuth,
+		)
+		auth.secrets = []string{secret, basicAuth}
+	case PluginSSHKeyCredentials:
+		keysDir, err := getPluginSSHKeysDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the SSH keys directory: %v", err)
+		}
+		keyDir, err := os.MkdirTemp(keysDir, "key-*")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the SSH key directory: %v", err)
+		}
+		auth.keyDir = keyDir
+		keyPath := filepath.Join(keyDir, "id")
+		if !strings.HasSuffix(secret, "\n") {
+			secret += "\n"
+		}
+		if err = writePrivateFile(keyPath, []byte(secret)); err != nil {
+			auth.cleanup()
+			return nil, fmt.Errorf("failed to write the SSH key: %v", err)
+		}
+		auth.env = append(auth.env, fmt.Sprintf("GIT_SSH_COMMAND=ssh -i %s -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new", keyPath))
+		auth.sshUsername = credentials.getUsername()
+		auth.secrets = []string{strings.TrimSpace(secret)}
+	default:
+		return nil, fmt.Errorf("unknown plugin credentials type '%s'", credentials.Type)
+	}
+	return auth, nil
+}
+
+// getPluginSSHKeysDir returns the directory of the SSH keys written while the repositories are pulled, it's in the
+// cache directory of the kontrol user instead of the shared temporary directory and only the user can access it
+func getPluginSSHKeysDir() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	keysDir := filepath.Join(cacheDir, "kardinal", "plugin-ssh-keys")
+	if err = os.MkdirAll(keysDir, privateDirPerms); err != nil {
+		return "", err
+	}
+	// the directory may have been created before with other permissions
+	if err = os.Chmod(keysDir, privateDirPerms); err != nil {
+		return "", err
+	}
+	return keysDir, nil
+}
+
+// writePrivateFile creates the file only the user can read, it fails if the file exists
+func writePrivateFile(path string, contents []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, privateFilePerms)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(contents); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// getRepoURL returns the SSH URL of the HTTPS repositories pulled with an SSH key
+func (auth *gitAuth) getRepoURL(repoUrl string) string {
+	if auth.sshUsername != "" && strings.HasPrefix(repoUrl, "https://") {
+		return fmt.Sprintf("ssh://%s@%s", auth.sshUsername, strings.TrimPrefix(repoUrl, "https://"))
+	}
+	return repoUrl
+}
+
+// run runs the git command in the repository, or the current directory when it's empty, and returns its output
+// without the secrets, the command and the processes it started are killed when the context is done
+func (auth *gitAuth) run(ctx context.Context, repoPath string, args ...string) (string, error) {
+	if repoPath != "" {
+		args = append([]string{"-C", repoPath}, args...)
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
+	setProcessGroupKill(cmd)
+	cmd.WaitDelay = pluginWaitDelay
+	cmd.Env = append(getPluginProcessEnv(), auth.env...)
+	output, err := cmd.CombinedOutput()
+	return auth.redact(string(output)), err
+}
+
+func (auth *gitAuth) redact(output string) string {
+	for _, secret := range auth.secrets {
+		if secret != "" {
+			output = strings.ReplaceAll(output, secret, redactedSecret)
+		}
+	}
+	return output
+}
+
+func (auth *gitAuth) cleanup() {
+	if auth.keyDir != "" {
+		_ = os.RemoveAll(auth.keyDir)
+	}
+}
+
 type MockGitPluginProvider struct {
 	// repoURL -> [ filename: fileContents ]
 	github map[string]map[string]string
@@ -48,15 +270,17 @@ func NewMockGitPluginProvider(github map[string]map[string]string) *MockGitPlugi
 	}
 }
 
-func (mgpp *MockGitPluginProvider) PullGitHubPlugin(repoPath, repoUrl string) error {
+// PullGitHubPlugin writes the files of the mocked repository, the mocked repositories have a single revision so the
+// ref is returned as the commit
+func (mgpp *MockGitPluginProvider) PullGitHubPlugin(_ context.Context, repoPath, repoUrl, ref string, _ *PluginCredentials) (string, error) {
 	repoContents, found := mgpp.github[repoUrl]
 	if !found {
-		return fmt.Errorf("Repo with url '%v' not found in github", repoUrl)
+		return "", fmt.Errorf("Repo with url '%v' not found in github", repoUrl)
 	}
 	// repoPath should already exist but in case, create it
 	err := os.MkdirAll(repoPath, 0744)
 	if err != nil {
-		return fmt.Errorf("An error occurred ensuring directory for '%v' exists:\n%v", repoUrl, err.Error())
+		return "", fmt.Errorf("An error occurred ensuring directory for '%v' exists:\n%v", repoUrl, err.Error())
 	}
 
 	for filename, contents := range repoContents {
@@ -64,8 +288,8 @@ func (mgpp *MockGitPluginProvider) PullGitHubPlugin(repoPath, repoUrl string) er
 
 		err := os.WriteFile(filePath, []byte(contents), mockProviderPerms)
 		if err != nil {
-			return fmt.Errorf("An error occurred writing to filepath '%v' with contents:\n%v", repoPath, contents)
+			return "", fmt.Errorf("An error occurred writing to filepath '%v' with contents:\n%v", repoPath, contents)
 		}
 	}
-	return nil
+	return ref, nil
 }
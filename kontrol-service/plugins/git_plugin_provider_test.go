@@ -0,0 +1,128 @@
+package plugins
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePluginName(t *testing.T) {
+	repoURL, ref, err := ParsePluginName("github.com/kardinaldev/redis-db-sidecar-plugin:36ed9a4")
+	require.NoError(t, err)
+	require.Equal(t, "github.com/kardinaldev/redis-db-sidecar-plugin", repoURL)
+	require.Equal(t, "36ed9a4", ref)
+
+	repoURL, ref, err = ParsePluginName(simplePlugin)
+	require.NoError(t, err)
+	require.Equal(t, simplePlugin, repoURL)
+	require.Empty(t, ref)
+
+	repoURL, ref, err = ParsePluginName("https://git.example.com:8443/org/plugin.git")
+	require.NoError(t, err)
+	require.Equal(t, "https://git.example.com:8443/org/plugin.git", repoURL)
+	require.Empty(t, ref)
+
+	repoURL, ref, err = ParsePluginName("https://git.example.com:8443/org/plugin.git:v1")
+	require.NoError(t, err)
+	require.Equal(t, "https://git.example.com:8443/org/plugin.git", repoURL)
+	require.Equal(t, "v1", ref)
+
+	repoURL, ref, err = ParsePluginName("https://git.example.com:8443/org/plugin.git:feature/v1")
+	require.NoError(t, err)
+	require.Equal(t, "https://git.example.com:8443/org/plugin.git", repoURL)
+	require.Equal(t, "feature/v1", ref)
+
+	_, _, err = ParsePluginName("github.com/org/plugin:")
+	require.Error(t, err)
+
+	for _, invalidRef := range []string{"--upload-pack=touch", "v1..v2", "feature/.hidden", "main.lock", "v1 v2", "ref@{1}", "feature//v1", "feature/"} {
+		_, _, err = ParsePluginName("github.com/org/plugin:" + invalidRef)
+		require.Error(t, err, invalidRef)
+	}
+}
+
+func TestGitPluginProviderChecksOutRefs(t *testing.T) {
+	originPath := t.TempDir()
+	runGit(t, originPath, "init", "--initial-branch", "main")
+	firstCommit := commitFile(t, originPath, "main.py", "VERSION = 1\n")
+	runGit(t, originPath, "tag", "v1")
+	secondCommit := commitFile(t, originPath, "main.py", "VERSION = 2\n")
+
+	provider := NewGitPluginProviderImpl()
+	repoPath := filepath.Join(t.TempDir(), "plugin")
+
+	commit, err := provider.PullGitHubPlugin(context.Background(), repoPath, originPath, "v1", nil)
+	require.NoError(t, err)
+	require.Equal(t, firstCommit, commit)
+	requireFileContents(t, filepath.Join(repoPath, "main.py"), "VERSION = 1\n")
+
+	commit, err = provider.PullGitHubPlugin(context.Background(), repoPath, originPath, "", nil)
+	require.NoError(t, err)
+	require.Equal(t, secondCommit, commit)
+
+	// a push to the branch doesn't change the commit checked out for a flow
+	thirdCommit := commitFile(t, originPath, "main.py", "VERSION = 3\n")
+	commit, err = provider.PullGitHubPlugin(context.Background(), repoPath, originPath, secondCommit, nil)
+	require.NoError(t, err)
+	require.Equal(t, secondCommit, commit)
+	requireFileContents(t, filepath.Join(repoPath, "main.py"), "VERSION = 2\n")
+
+	commit, err = provider.PullGitHubPlugin(context.Background(), repoPath, originPath, "main", nil)
+	require.NoError(t, err)
+	require.Equal(t, thirdCommit, commit)
+
+	_, err = provider.PullGitHubPlugin(context.Background(), repoPath, originPath, "missing-ref", nil)
+	require.Error(t, err)
+
+	runGit(t, originPath, "checkout", "-b", "feature/v4")
+	fourthCommit := commitFile(t, originPath, "main.py", "VERSION = 4\n")
+	commit, err = provider.PullGitHubPlugin(context.Background(), repoPath, originPath, "feature/v4", nil)
+	require.NoError(t, err)
+	require.Equal(t, fourthCommit, commit)
+
+	// the commits already fetched are checked out without reaching the repository
+	require.NoError(t, os.RemoveAll(originPath))
+	commit, err = provider.PullGitHubPlugin(context.Background(), repoPath, originPath, secondCommit, nil)
+	require.NoError(t, err)
+	require.Equal(t, secondCommit, commit)
+	requireFileContents(t, filepath.Join(repoPath, "main.py"), "VERSION = 2\n")
+
+	_, err = provider.PullGitHubPlugin(context.Background(), repoPath, originPath, "main", nil)
+	require.Error(t, err)
+}
+
+func runGit(t *testing.T, repoPath string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-C", repoPath, "-c", "user.name=test", "-c", "user.email=test@kardinal.dev"}, args...)...)
+	output, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(output))
+	return strings.TrimSpace(string(output))
+}
+
+func commitFile(t *testing.T, repoPath, filename, contents string) string {
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, filename), []byte(contents), mockProviderPerms))
+	runGit(t, repoPath, "add", filename)
+	runGit(t, repoPath, "commit", "--message", "update "+filename)
+	return runGit(t, repoPath, "rev-parse", "HEAD")
+}
+
+func requireFileContents(t *testing.T, path, expectedContents string) {
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, expectedContents, string(contents))
+}
+
+func TestGitPluginProviderStopsWithTheContext(t *testing.T) {
+	originPath := t.TempDir()
+	runGit(t, originPath, "init", "--initial-branch", "main")
+	commitFile(t, originPath, "main.py", "VERSION = 1\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := NewGitPluginProviderImpl().PullGitHubPlugin(ctx, filepath.Join(t.TempDir(), "plugin"), originPath, "", nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,91 @@
+package plugins
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/kurtosis-tech/stacktrace"
+)
+
+// PluginHostConfig configures the plugin host of the server, the zero values keep the built-in defaults
+type PluginHostConfig struct {
+	Limits PluginLimits
+	// WorkDir keeps the plugin checkouts and environments, the temporary directory by default
+	WorkDir string
+	// EnvCacheSize is the number of plugin environments kept on disk
+	EnvCacheSize int
+	// CheckoutCacheSize is the number of plugin checkouts kept on disk
+	CheckoutCacheSize int
+	// CredentialsKey is the base64 encoded AES-256 key encrypting the plugin credentials in the database, the private
+	// plugin repositories can't be pulled without it
+	CredentialsKey string
+	// RemoteAllowedNetworks are the CIDRs the remote plugins can be reached in even though they are loopback,
+	// link-local, private or denied addresses, e.g. '10.0.0.0/8' for the plugins running in the cluster
+	RemoteAllowedNetworks []string
+}
+
+// PluginHost is shared by the plugin runners of all the tenants, it's created once by the server, bounds the plugin
+// processes with the server limits, keeps the checkouts and environments of the plugins and decrypts their credentials
+type PluginHost struct {
+	limits            PluginLimits
+	checkoutCache     *pluginCheckoutCache
+	envCache          *pluginEnvCache
+	credentialsCipher *PluginCredentialsCipher
+
+	remoteAllowedNetworks []*net.IPNet
+	// remoteTLSConfig is the TLS configuration of the remote plugin clients, the system roots are used when nil
+	remoteTLSConfig *tls.Config
+}
+
+// NewPluginHost validates the config and returns the host of the plugins
+func NewPluginHost(config PluginHostConfig) (*PluginHost, error) {
+	limits := config.Limits
+	if limits.Timeout < 0 || limits.MaxOutputBytes < 0 || limits.Concurrency < 0 {
+		return nil, stacktrace.NewError("The plugin timeout, output size and concurrency can't be negative, got %v, %d and %d", limits.Timeout, limits.MaxOutputBytes, limits.Concurrency)
+	}
+	if config.EnvCacheSize < 0 || config.CheckoutCacheSize < 0 {
+		return nil, stacktrace.NewError("The plugin environment and checkout cache sizes can't be negative, got %d and %d", config.EnvCacheSize, config.CheckoutCacheSize)
+	}
+	workDir := config.WorkDir
+	if workDir == "" {
+		workDir = os.TempDir()
+	}
+	envCacheSize := config.EnvCacheSize
+	if envCacheSize == 0 {
+		envCacheSize = defaultPluginEnvCacheSize
+	}
+	checkoutCacheSize := config.CheckoutCacheSize
+	if checkoutCacheSize == 0 {
+		checkoutCacheSize = defaultPluginCheckoutCacheSize
+	}
+	var credentialsCipher *PluginCredentialsCipher
+	if config.CredentialsKey != "" {
+		var err error
+		if credentialsCipher, err = NewPluginCredentialsCipher(config.CredentialsKey); err != nil {
+			return nil, err
+		}
+	}
+	remoteAllowedNetworks, err := parseRemotePluginNetworks(config.RemoteAllowedNetworks)
+	if err != nil {
+		return nil, err
+	}
+	return &PluginHost{
+		limits:                limits.withDefaults(),
+		checkoutCache:         newPluginCheckoutCache(filepath.Join(workDir, pluginCheckoutsDirName), checkoutCacheSize),
+		envCache:              newPluginEnvCache(filepath.Join(workDir, pluginEnvsDirName), envCacheSize),
+		credentialsCipher:     credentialsCipher,
+		remoteAllowedNetworks: remoteAllowedNetworks,
+	}, nil
+}
+
+// GetLimits returns the limits of the plugins
+func (h *PluginHost) GetLimits() PluginLimits {
+	return h.limits
+}
+
+// GetCredentialsCipher returns the cipher of the plugin credentials, nil when the server has no credentials key
+func (h *PluginHost) GetCredentialsCipher() *PluginCredentialsCipher {
+	return h.credentialsCipher
+}
@@ -0,0 +1,115 @@
+package plugins
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	fileRepoURLPrefix = "file://"
+	// localDirCommitPrefix prefixes the content hash used as the commit of the local directories
+	localDirCommitPrefix = "local-"
+)
+
+// LocalGitPluginProvider pulls the plugins from the local directories and file:// repositories, so the plugin authors
+// can run their plugins with a local kontrol without pushing them, the other plugins are pulled by the remote provider,
+// it's only used in dev mode
+type LocalGitPluginProvider struct {
+	remote GitPluginProvider
+	git    *GitPluginProviderImpl
+}
+
+func NewLocalGitPluginProvider(remote GitPluginProvider) *LocalGitPluginProvider {
+	return &LocalGitPluginProvider{
+		remote: remote,
+		git:    NewGitPluginProviderImpl(),
+	}
+}
+
+// PullGitHubPlugin clones the file:// repositories like the remote ones and copies the local directories as they are,
+// including the changes which are not committed, the ref of a local directory is ignored and its commit is the hash of
+// its contents so each change gets a new checkout
+func (lgpp *LocalGitPluginProvider) PullGitHubPlugin(ctx context.Context, repoPath, repoUrl, ref string, credentials *PluginCredentials) (string, error) {
+	if strings.HasPrefix(repoUrl, fileRepoURLPrefix) {
+		return lgpp.git.PullGitHubPlugin(ctx, repoPath, repoUrl, ref, nil)
+	}
+	if !isLocalPluginSource(repoUrl) {
+		return lgpp.remote.PullGitHubPlugin(ctx, repoPath, repoUrl, ref, credentials)
+	}
+
+	dirPath, err := filepath.Abs(repoUrl)
+	if err != nil {
+		return "", fmt.Errorf("An error occurred getting the absolute path of plugin directory '%v':\n%v", repoUrl, err.Error())
+	}
+	if info, err := os.Stat(dirPath); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("Plugin directory '%v' not found", dirPath)
+	}
+
+	contentHash, err := hashPluginFiles(dirPath)
+	if err != nil {
+		return "", fmt.Errorf("An error occurred hashing the files of plugin directory '%v':\n%v", dirPath, err.Error())
+	}
+	if err = os.RemoveAll(repoPath); err != nil {
+		return "", fmt.Errorf("An error occurred removing the previous copy of plugin directory '%v':\n%v", dirPath, err.Error())
+	}
+	if err = copyPluginFiles(dirPath, repoPath); err != nil {
+		return "", fmt.Errorf("An error occurred copying plugin directory '%v':\n%v", dirPath, err.Error())
+	}
+	return localDirCommitPrefix + contentHash, nil
+}
+
+// isLocalPluginSource returns true for the file:// repositories and the absolute and relative directory paths
+func isLocalPluginSource(repoURL string) bool {
+	return strings.HasPrefix(repoURL, fileRepoURLPrefix) ||
+		strings.HasPrefix(repoURL, "/") ||
+		strings.HasPrefix(repoURL, "./") ||
+		strings.HasPrefix(repoURL, "../")
+}
+
+// hashPluginFiles returns the hash of the paths, modes and contents of the files of the plugin directory, without its
+// git directory
+func hashPluginFiles(dirPath string) (string, error) {
+	hash := sha256.New()
+	err := filepath.WalkDir(dirPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if entry.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relativePath, err := filepath.Rel(dirPath, path)
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s\x00%v\x00", relativePath, info.Mode())
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(hash, file)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
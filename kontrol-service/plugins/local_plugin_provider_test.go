@@ -0,0 +1,78 @@
+package plugins
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const identityPluginMain = `def create_flow(service_specs, pod_specs, flow_uuid):
+    return {
+        "pod_specs": pod_specs,
+        "config_map": {"flow": flow_uuid}
+    }
+
+def delete_flow(config_map, flow_uuid):
+    return None
+`
+
+func TestLocalGitPluginProviderRunsFileRepositories(t *testing.T) {
+	originPath := t.TempDir()
+	runGit(t, originPath, "init", "--initial-branch", "main")
+	commit := commitFile(t, originPath, "main.py", identityPluginMain)
+
+	runner, cleanUpDbFunc := getPluginRunnerWithProvider(t, NewLocalGitPluginProvider(NewMockGitPluginProvider(MockGitHub)))
+	defer cleanUpDbFunc()
+
+	pluginName := "file://" + originPath
+	updatedWorkloadSpecs, configMap, err := runner.CreateFlow(context.Background(), pluginName, serviceSpecs, workloadSpecs, flowUuid, map[string]string{}, 0)
+	require.NoError(t, err)
+	require.Equal(t, workloadSpecs, updatedWorkloadSpecs)
+	require.JSONEq(t, `{"flow": "`+flowUuid+`"}`, configMap)
+
+	pluginConfig, err := runner.getConfigForFlow(flowUuid)
+	require.NoError(t, err)
+	require.Equal(t, commit, pluginConfig.Commit)
+
+	err = runner.DeleteFlow(context.Background(), pluginName, flowUuid, 0)
+	require.NoError(t, err)
+}
+
+func TestLocalGitPluginProviderCopiesLocalDirectories(t *testing.T) {
+	pluginPath := filepath.Join(t.TempDir(), "local-plugin")
+	require.NoError(t, os.MkdirAll(pluginPath, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(pluginPath, "main.py"), []byte(identityPluginMain), mockProviderPerms))
+
+	runner, cleanUpDbFunc := getPluginRunnerWithProvider(t, NewLocalGitPluginProvider(NewMockGitPluginProvider(MockGitHub)))
+	defer cleanUpDbFunc()
+	checkout, err := runner.getOrCloneRepo(context.Background(), pluginPath, "")
+	require.NoError(t, err)
+	requireFileContents(t, filepath.Join(checkout.path, "main.py"), identityPluginMain)
+
+	// each change of the plugin gets a new checkout, without committing it
+	require.NoError(t, os.WriteFile(filepath.Join(pluginPath, "main.py"), []byte(identityPluginMain+"\n# changed\n"), mockProviderPerms))
+	changedCheckout, err := runner.getOrCloneRepo(context.Background(), pluginPath, "")
+	require.NoError(t, err)
+	require.NotEqual(t, checkout.commit, changedCheckout.commit)
+	require.NotEqual(t, checkout.path, changedCheckout.path)
+	requireFileContents(t, filepath.Join(checkout.path, "main.py"), identityPluginMain)
+	requireFileContents(t, filepath.Join(changedCheckout.path, "main.py"), identityPluginMain+"\n# changed\n")
+
+	// the remote plugins are pulled by the remote provider
+	remoteCheckout, err := runner.getOrCloneRepo(context.Background(), identityPlugin, "")
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(remoteCheckout.path, "main.py"))
+}
+
+func TestLocalPluginSourcesRequireDevMode(t *testing.T) {
+	runner, cleanUpDbFunc := getPluginRunnerWithProvider(t, NewGitPluginProviderImpl())
+	defer cleanUpDbFunc()
+
+	_, err := runner.getOrCloneRepo(context.Background(), "file://"+t.TempDir(), "")
+	require.ErrorContains(t, err, "can only be used in dev mode")
+	_, err = runner.getOrCloneRepo(context.Background(), "./local-plugin", "")
+	require.ErrorContains(t, err, "can only be used in dev mode")
+}
@@ -0,0 +1,23 @@
+//go:build !unix
+
+package plugins
+
+import (
+	"context"
+	"sync"
+)
+
+var fileLocks sync.Map
+
+// lockFile takes an exclusive lock on the path for this process, the file locks are not available on this platform,
+// it stops waiting for the lock when the context is done
+func lockFile(ctx context.Context, path string) (func(), error) {
+	lock, _ := fileLocks.LoadOrStore(path, make(chan struct{}, 1))
+	lockCh := lock.(chan struct{})
+	select {
+	case lockCh <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return func() { <-lockCh }, nil
+}
@@ -0,0 +1,44 @@
+//go:build unix
+
+package plugins
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// lockFileRetryDelay is the delay between the attempts to take a lock held by another process or call
+const lockFileRetryDelay = 50 * time.Millisecond
+
+// lockFile takes an exclusive lock on the file, creating it if needed, the lock is shared with the other processes
+// and the other open files of this process, it stops waiting for the lock when the context is done and returns the
+// function releasing the lock
+func lockFile(ctx context.Context, path string) (func(), error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, pluginFilePerms)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) && !errors.Is(err, syscall.EINTR) {
+			file.Close()
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return nil, ctx.Err()
+		case <-time.After(lockFileRetryDelay):
+		}
+	}
+	return func() {
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
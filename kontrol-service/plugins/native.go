@@ -0,0 +1,166 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// nativePluginScheme prefixes the names of the Go plugins run in the kontrol process, e.g. 'builtin://env'
+const nativePluginScheme = "builtin://"
+
+// Plugin is a stateful plugin written in Go, it's the native counterpart of the create_flow and delete_flow functions of
+// the Python plugins and runs in the kontrol process
+type Plugin interface {
+	// CreateFlow returns the pod specs of the flow, one per pod spec received which the plugin can modify, and the
+	// config passed to DeleteFlow, the config must be encodable to JSON
+	CreateFlow(ctx context.Context, serviceSpecs []corev1.ServiceSpec, podSpecs []corev1.PodSpec, flowUuid string, arguments map[string]string) ([]corev1.PodSpec, map[string]interface{}, error)
+	// DeleteFlow cleans up the resources created by CreateFlow with the config it returned
+	DeleteFlow(ctx context.Context, config map[string]interface{}, flowUuid string) error
+}
+
+var (
+	nativePluginsMutex sync.RWMutex
+	nativePlugins      = map[string]Plugin{}
+)
+
+// RegisterNativePlugin makes the plugin available as 'builtin://<name>', it's meant to be called from init functions
+// and panics if the name is already registered
+func RegisterNativePlugin(name string, plugin Plugin) {
+	nativePluginsMutex.Lock()
+	defer nativePluginsMutex.Unlock()
+	if plugin == nil {
+		panic(fmt.Sprintf("the native plugin '%s' is nil", name))
+	}
+	if _, found := nativePlugins[name]; found {
+		panic(fmt.Sprintf("the native plugin '%s' is already registered", name))
+	}
+	nativePlugins[name] = plugin
+}
+
+// GetNativePluginNames returns the sorted names of the registered native plugins
+func GetNativePluginNames() []string {
+	nativePluginsMutex.RLock()
+	defer nativePluginsMutex.RUnlock()
+	names := make([]string, 0, len(nativePlugins))
+	for name := range nativePlugins {
+		names = append(names, nativePluginScheme+name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isNativePluginName returns true for the plugin names with the native plugin scheme
+func isNativePluginName(pluginName string) bool {
+	return strings.HasPrefix(pluginName, nativePluginScheme)
+}
+
+func getNativePlugin(pluginName string) (Plugin, error) {
+	name := strings.TrimPrefix(pluginName, nativePluginScheme)
+	nativePluginsMutex.RLock()
+	plugin, found := nativePlugins[name]
+	nativePluginsMutex.RUnlock()
+	if !found {
+		// the names are listed once the lock is released, a pending registration would block a second read lock
+		return nil, fmt.Errorf("the native plugin '%s' doesn't exist, the available ones are %v", name, GetNativePluginNames())
+	}
+	return plugin, nil
+}
+
+// ValidatePluginName checks that the native plugins are registered, that the remote plugins have an HTTP URL and that
+// the other plugin names can be parsed
+func ValidatePluginName(pluginName string) error {
+	if isNativePluginName(pluginName) {
+		_, err := getNativePlugin(pluginName)
+		return err
+	}
+	if isRemotePluginName(pluginName) {
+		_, err := parseRemotePluginURL(pluginName)
+		return err
+	}
+	_, _, err := ParsePluginName(pluginName)
+	return err
+}
+
+// runNativePlugin runs the operation of a native plugin within the timeout of the call, the panics of the plugin are
+// returned as errors, and a plugin ignoring its context is abandoned when the call times out
+func runNativePlugin(ctx context.Context, call *pluginCall, operation func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				done <- fmt.Errorf("the plugin panicked: %v", recovered)
+			}
+		}()
+		done <- operation()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return call.errorf(ctx, "%v", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return call.errorf(ctx, "%v", ctx.Err())
+	}
+}
+
+// runNativeCreateFlow runs CreateFlow of the native plugin with copies of the pod specs
+func runNativeCreateFlow(
+	ctx context.Context,
+	call *pluginCall,
+	pluginName string,
+	serviceSpecs []corev1.ServiceSpec,
+	podSpecs []*corev1.PodSpec,
+	flowUuid string,
+	arguments map[string]string,
+) ([]corev1.PodSpec, map[string]interface{}, error) {
+	plugin, err := getNativePlugin(pluginName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pluginServiceSpecs := make([]corev1.ServiceSpec, 0, len(serviceSpecs))
+	for _, serviceSpec := range serviceSpecs {
+		pluginServiceSpecs = append(pluginServiceSpecs, *serviceSpec.DeepCopy())
+	}
+	pluginPodSpecs := make([]corev1.PodSpec, 0, len(podSpecs))
+	for _, podSpec := range podSpecs {
+		pluginPodSpecs = append(pluginPodSpecs, *podSpec.DeepCopy())
+	}
+
+	var newPodSpecs []corev1.PodSpec
+	var config map[string]interface{}
+	err = runNativePlugin(ctx, call, func() error {
+		var createErr error
+		newPodSpecs, config, createErr = plugin.CreateFlow(ctx, pluginServiceSpecs, pluginPodSpecs, flowUuid, arguments)
+		return createErr
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return newPodSpecs, config, nil
+}
+
+// runNativeDeleteFlow runs DeleteFlow of the native plugin with the config stored by CreateFlow
+func runNativeDeleteFlow(ctx context.Context, call *pluginCall, pluginName string, configMap string, flowUuid string) error {
+	plugin, err := getNativePlugin(pluginName)
+	if err != nil {
+		return err
+	}
+
+	var config map[string]interface{}
+	if err = json.Unmarshal([]byte(configMap), &config); err != nil {
+		return fmt.Errorf("invalid config map: %v", err)
+	}
+
+	return runNativePlugin(ctx, call, func() error {
+		return plugin.DeleteFlow(ctx, config, flowUuid)
+	})
+}
@@ -0,0 +1,160 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// recordingNativePlugin removes the containers' env vars and records the flows deleted
+type recordingNativePlugin struct {
+	mutex        sync.Mutex
+	deletedFlows map[string]map[string]interface{}
+}
+
+func (p *recordingNativePlugin) CreateFlow(_ context.Context, _ []corev1.ServiceSpec, podSpecs []corev1.PodSpec, flowUuid string, _ map[string]string) ([]corev1.PodSpec, map[string]interface{}, error) {
+	for idx := range podSpecs {
+		podSpecs[idx].Containers[0].Env = nil
+	}
+	return podSpecs, map[string]interface{}{"flow": flowUuid}, nil
+}
+
+func (p *recordingNativePlugin) DeleteFlow(_ context.Context, config map[string]interface{}, flowUuid string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.deletedFlows[flowUuid] = config
+	return nil
+}
+
+type misbehavingNativePlugin struct{}
+
+func (misbehavingNativePlugin) CreateFlow(_ context.Context, _ []corev1.ServiceSpec, _ []corev1.PodSpec, _ string, arguments map[string]string) ([]corev1.PodSpec, map[string]interface{}, error) {
+	if arguments["panic"] == "true" {
+		panic("something went wrong")
+	}
+	// ignores its context
+	time.Sleep(time.Minute)
+	return nil, nil, nil
+}
+
+func (misbehavingNativePlugin) DeleteFlow(_ context.Context, _ map[string]interface{}, _ string) error {
+	return nil
+}
+
+var testRecordingNativePlugin = &recordingNativePlugin{deletedFlows: map[string]map[string]interface{}{}}
+
+func init() {
+	RegisterNativePlugin("test-recording", testRecordingNativePlugin)
+	RegisterNativePlugin("test-misbehaving", misbehavingNativePlugin{})
+}
+
+func TestNativePluginCreatesAndDeletesFlows(t *testing.T) {
+	runner, cleanUpDbFunc := getPluginRunner(t)
+	defer cleanUpDbFunc()
+
+	updatedWorkloadSpecs, configMap, err := runner.CreateFlow(context.Background(), "builtin://test-recording", serviceSpecs, workloadSpecs, flowUuid, map[string]string{}, 0)
+	require.NoError(t, err)
+	require.Len(t, updatedWorkloadSpecs, len(workloadSpecs))
+	for idx, updatedWorkloadSpec := range updatedWorkloadSpecs {
+		require.Empty(t, updatedWorkloadSpec.GetTemplateSpec().Containers[0].Env)
+		// the specs of the caller are not modified
+		require.NotEmpty(t, workloadSpecs[idx].GetTemplateSpec().Containers[0].Env)
+	}
+	require.JSONEq(t, `{"flow": "test-flow-uuid"}`, configMap)
+
+	err = runner.DeleteFlow(context.Background(), "builtin://test-recording", flowUuid, 0)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"flow": flowUuid}, testRecordingNativePlugin.deletedFlows[flowUuid])
+	_, err = runner.getConfigForFlow(flowUuid)
+	require.ErrorContains(t, err, "no config map found")
+}
+
+func TestBuiltinEnvPlugin(t *testing.T) {
+	runner, cleanUpDbFunc := getPluginRunner(t)
+	defer cleanUpDbFunc()
+
+	arguments := map[string]string{"REDIS": "redis-flow:6379", "DEBUG": "true"}
+	updatedWorkloadSpecs, configMap, err := runner.CreateFlow(context.Background(), "builtin://env", serviceSpecs, workloadSpecs, flowUuid, arguments, 0)
+	require.NoError(t, err)
+	require.Equal(t, []corev1.EnvVar{
+		{Name: "REDIS", Value: "redis-flow:6379"},
+		{Name: "DEBUG", Value: "true"},
+	}, updatedWorkloadSpecs[0].GetTemplateSpec().Containers[0].Env)
+	require.Equal(t, []corev1.EnvVar{
+		{Name: "REDIS", Value: "redis-flow:6379"},
+		{Name: "FOO", Value: "bar"},
+		{Name: "DEBUG", Value: "true"},
+	}, updatedWorkloadSpecs[1].GetTemplateSpec().Containers[0].Env)
+
+	var configMapData map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(configMap), &configMapData))
+	require.Equal(t, map[string]interface{}{"env": []interface{}{"DEBUG", "REDIS"}}, configMapData)
+
+	require.NoError(t, runner.DeleteFlow(context.Background(), "builtin://env", flowUuid, 0))
+}
+
+func TestBuiltinIdentityPlugin(t *testing.T) {
+	runner, cleanUpDbFunc := getPluginRunner(t)
+	defer cleanUpDbFunc()
+
+	updatedWorkloadSpecs, configMap, err := runner.CreateFlow(context.Background(), "builtin://identity", serviceSpecs, workloadSpecs, flowUuid, map[string]string{}, 0)
+	require.NoError(t, err)
+	require.Equal(t, workloadSpecs, updatedWorkloadSpecs)
+	require.Equal(t, "{}", configMap)
+	require.NoError(t, runner.WarmPlugin(context.Background(), "builtin://identity", 0))
+	require.NoError(t, runner.DeleteFlow(context.Background(), "builtin://identity", flowUuid, 0))
+}
+
+func TestNativePluginFailures(t *testing.T) {
+	runner, cleanUpDbFunc := getPluginRunner(t)
+	defer cleanUpDbFunc()
+
+	_, _, err := runner.CreateFlow(context.Background(), "builtin://test-misbehaving", serviceSpecs, workloadSpecs, flowUuid, map[string]string{"panic": "true"}, 0)
+	pluginErr, found := GetPluginError(err)
+	require.True(t, found)
+	require.Equal(t, PluginExecutionError, pluginErr.Kind)
+	require.Contains(t, pluginErr.Message, "something went wrong")
+
+	_, _, err = runner.CreateFlow(context.Background(), "builtin://test-misbehaving", serviceSpecs, workloadSpecs, flowUuid, map[string]string{}, 100*time.Millisecond)
+	pluginErr, found = GetPluginError(err)
+	require.True(t, found)
+	require.Equal(t, PluginTimeoutError, pluginErr.Kind)
+
+	_, _, err = runner.CreateFlow(context.Background(), "builtin://missing", serviceSpecs, workloadSpecs, flowUuid, map[string]string{}, 0)
+	require.ErrorContains(t, err, "the native plugin 'missing' doesn't exist")
+	require.Error(t, ValidatePluginName("builtin://missing"))
+	require.NoError(t, ValidatePluginName("builtin://env"))
+	require.NoError(t, ValidatePluginName(simplePlugin+":v1"))
+}
+
+func TestMissingNativePluginsDontBlockTheRegistrations(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for idx := 0; idx < 50; idx++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				_, _ = getNativePlugin("builtin://missing")
+			}()
+			go func(idx int) {
+				defer wg.Done()
+				RegisterNativePlugin(fmt.Sprintf("test-concurrent-registration-%d", idx), misbehavingNativePlugin{})
+			}(idx)
+		}
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the native plugin lookups and registrations are deadlocked")
+	}
+}
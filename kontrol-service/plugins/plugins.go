@@ -1,13 +1,15 @@
 package plugins
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
@@ -19,25 +21,62 @@ import (
 const (
 	// <plugin.service_name>-<flow id>
 	pluginIdFmtStr = "%s-%s"
+	// <repository URL>:<branch, tag or commit>
+	pluginRefSeparator = ":"
 )
 
 type PluginRunner struct {
 	gitPluginProvider GitPluginProvider
 
+	host *PluginHost
+
 	tenantId string
 
 	db *database.Db
+
+	// createdFlows are the plugin flows created by the runner, they are deleted if the creation of the flow fails
+	createdFlowsMutex sync.Mutex
+	createdFlows      []createdPluginFlow
 }
 
-func NewPluginRunner(gitPluginProvider GitPluginProvider, tenantId string, db *database.Db) *PluginRunner {
+func NewPluginRunner(gitPluginProvider GitPluginProvider, host *PluginHost, tenantId string, db *database.Db) *PluginRunner {
 	return &PluginRunner{
 		gitPluginProvider: gitPluginProvider,
+		host:              host,
 		tenantId:          tenantId,
 		db:                db,
 	}
 }
 
-func (pr *PluginRunner) CreateFlow(pluginUrl string, serviceSpecs []corev1.ServiceSpec, originalWorkloadSpecs []*kardinal.WorkloadSpec, flowUuid string, arguments map[string]string) ([]*kardinal.WorkloadSpec, string, error) {
+// newPluginCall returns the call of an operation of the plugin, the zero timeout uses the server one and the plugins
+// can't run longer than the server timeout
+func (pr *PluginRunner) newPluginCall(ctx context.Context, pluginUrl string, operation string, timeout time.Duration) (*pluginCall, context.Context, context.CancelFunc) {
+	limits := pr.host.GetLimits()
+	if timeout <= 0 {
+		timeout = limits.Timeout
+	}
+	if timeout > limits.Timeout {
+		logrus.Warnf("The timeout %v of plugin '%s' is longer than the server plugin timeout, using %v", timeout, pluginUrl, limits.Timeout)
+		timeout = limits.Timeout
+	}
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	return &pluginCall{plugin: pluginUrl, operation: operation, timeout: timeout, limits: limits}, callCtx, cancel
+}
+
+// CreateFlow runs create_flow of the plugin, the plugin processes are killed when the context is done or after the
+// timeout, the zero timeout uses the server one
+func (pr *PluginRunner) CreateFlow(
+	ctx context.Context,
+	pluginUrl string,
+	serviceSpecs []corev1.ServiceSpec,
+	originalWorkloadSpecs []*kardinal.WorkloadSpec,
+	flowUuid string,
+	arguments map[string]string,
+	timeout time.Duration,
+) ([]*kardinal.WorkloadSpec, string, error) {
+	call, ctx, cancel := pr.newPluginCall(ctx, pluginUrl, createFlowOperation, timeout)
+	defer cancel()
+
 	var workloadSpecs []*kardinal.WorkloadSpec
 	var podSpecs []*v1.PodSpec
 	for _, originalWorkloadSpec := range originalWorkloadSpecs {
@@ -46,131 +85,237 @@ func (pr *PluginRunner) CreateFlow(pluginUrl string, serviceSpecs []corev1.Servi
 		podSpecs = append(podSpecs, workloadSpec.GetTemplateSpec())
 	}
 
-	repoPath, err := pr.getOrCloneRepo(pluginUrl)
+	var newPodSpecs []v1.PodSpec
+	var configMap map[string]interface{}
+	var commit string
+	var err error
+	switch {
+	case isNativePluginName(pluginUrl):
+		newPodSpecs, configMap, err = runNativeCreateFlow(ctx, call, pluginUrl, serviceSpecs, podSpecs, flowUuid, arguments)
+	case isRemotePluginName(pluginUrl):
+		newPodSpecs, configMap, err = pr.runRemoteCreateFlow(ctx, call, pluginUrl, serviceSpecs, podSpecs, flowUuid, arguments)
+	default:
+		newPodSpecs, configMap, commit, err = pr.runPythonPluginCreateFlow(ctx, call, pluginUrl, serviceSpecs, podSpecs, flowUuid, arguments)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	// the flow is tracked as soon as the plugin created it, so it's rolled back with its config even if it's not stored
+	if configMap == nil {
+		configMap = map[string]interface{}{}
+	}
+	configMapBytes, err := json.Marshal(configMap)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to get or clone repository: %v", err)
+		pr.trackCreatedFlow(pluginUrl, flowUuid, timeout, &database.PluginConfig{FlowId: flowUuid, Config: "{}", Commit: commit, TenantId: pr.tenantId})
+		return nil, "", fmt.Errorf("failed to re-marshal config map: %v", err)
 	}
+	pr.trackCreatedFlow(pluginUrl, flowUuid, timeout, &database.PluginConfig{FlowId: flowUuid, Config: string(configMapBytes), Commit: commit, TenantId: pr.tenantId})
+
+	numWorkloadSpecs := len(workloadSpecs)
+	numNewPodSpecs := len(newPodSpecs)
+	if numWorkloadSpecs != numNewPodSpecs {
+		return nil, "", fmt.Errorf("expected to receive '%d' modified pod specs from plugin '%s' execution result but '%d' were received instead, this is a bug in Kardinal", numWorkloadSpecs, flowUuid, numNewPodSpecs)
+	}
+	for newPodSpecIdx, newPodSpec := range newPodSpecs {
+		workloadSpecs[newPodSpecIdx].UpdateTemplateSpec(newPodSpec)
+	}
+
+	logrus.Infof("Storing config map for plugin called with uuid '%v':\n %s\n...", flowUuid, string(configMapBytes))
+	_, err = pr.db.CreatePluginConfig(flowUuid, string(configMapBytes), commit, pr.tenantId)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to store the config map: %v", err)
+	}
+
+	return workloadSpecs, string(configMapBytes), nil
+}
+
+// runPythonPluginCreateFlow runs create_flow of the Python plugin, it returns the pod specs, the config map and the
+// commit of the plugin
+func (pr *PluginRunner) runPythonPluginCreateFlow(
+	ctx context.Context,
+	call *pluginCall,
+	pluginUrl string,
+	serviceSpecs []corev1.ServiceSpec,
+	podSpecs []*v1.PodSpec,
+	flowUuid string,
+	arguments map[string]string,
+) ([]v1.PodSpec, map[string]interface{}, string, error) {
+	checkout, err := pr.getOrCloneRepo(ctx, pluginUrl, "")
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to get or clone repository: %v", err)
+	}
+	defer checkout.release()
 
 	serviceSpecsJSON, err := json.Marshal(serviceSpecs)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to marshal service specs: %v", err)
+		return nil, nil, "", fmt.Errorf("failed to marshal service specs: %v", err)
 	}
 	serviceSpecsJSONStr := base64.StdEncoding.EncodeToString(serviceSpecsJSON)
 
 	podSpecsJSON, err := json.Marshal(podSpecs)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to marshal pod specs: %v", err)
+		return nil, nil, "", fmt.Errorf("failed to marshal pod specs: %v", err)
 	}
 	podSpecsJSONStr := base64.StdEncoding.EncodeToString(podSpecsJSON)
 
-	result, err := runPythonCreateFlow(repoPath, serviceSpecsJSONStr, podSpecsJSONStr, flowUuid, arguments)
+	result, err := pr.runPythonCreateFlow(ctx, call, checkout, serviceSpecsJSONStr, podSpecsJSONStr, flowUuid, arguments)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, "", err
 	}
 
 	var resultMap map[string]json.RawMessage
 	err = json.Unmarshal([]byte(result), &resultMap)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to parse result: %v", err)
+		return nil, nil, "", fmt.Errorf("failed to parse result: %v", err)
 	}
 
 	if resultMap["pod_specs"] == nil {
-		return nil, "", fmt.Errorf("no pod_specs found in plugin result")
-	} else {
-		var newPodSpecs []v1.PodSpec
-		err = json.Unmarshal(resultMap["pod_specs"], &newPodSpecs)
-		if err != nil {
-			logrus.Errorf("Failed to unmarshal pod specs: %v", string(resultMap["pod_specs"]))
-			return nil, "", fmt.Errorf("failed to unmarshal pod specs: %v", err)
-		}
-		numWorkloadSpecs := len(workloadSpecs)
-		numNewPodSpecs := len(newPodSpecs)
-		if numWorkloadSpecs != numNewPodSpecs {
-			return nil, "", fmt.Errorf("expected to receive '%d' modified pod specs from plugin '%s' execution result but '%d' were received instead, this is a bug in Kardinal", numWorkloadSpecs, flowUuid, numNewPodSpecs)
-		}
-		for newPodSpecIdx, newPodSpec := range newPodSpecs {
-			workloadSpecs[newPodSpecIdx].UpdateTemplateSpec(newPodSpec)
-		}
+		return nil, nil, "", fmt.Errorf("no pod_specs found in plugin result")
+	}
+	var newPodSpecs []v1.PodSpec
+	err = json.Unmarshal(resultMap["pod_specs"], &newPodSpecs)
+	if err != nil {
+		logrus.Errorf("Failed to unmarshal pod specs: %v", string(resultMap["pod_specs"]))
+		return nil, nil, "", fmt.Errorf("failed to unmarshal pod specs: %v", err)
 	}
 
 	configMapJSON := resultMap["config_map"]
 	var configMap map[string]interface{}
 	err = json.Unmarshal(configMapJSON, &configMap)
 	if err != nil {
-		return nil, "", fmt.Errorf("invalid config map: %v", err)
+		return nil, nil, "", fmt.Errorf("invalid config map: %v", err)
 	}
 
-	configMapBytes, err := json.Marshal(configMap)
+	return newPodSpecs, configMap, checkout.commit, nil
+}
+
+// DeleteFlow runs delete_flow of the plugin with the config stored by create_flow, with the same limits and the same
+// revision of the plugin
+func (pr *PluginRunner) DeleteFlow(ctx context.Context, pluginUrl, flowUuid string, timeout time.Duration) error {
+	pluginConfig, err := pr.getConfigForFlow(flowUuid)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to re-marshal config map: %v", err)
+		return err
 	}
+	return pr.deleteFlowWithConfig(ctx, pluginUrl, flowUuid, timeout, pluginConfig)
+}
 
-	logrus.Infof("Storing config map for plugin called with uuid '%v':\n %s\n...", flowUuid, string(configMapBytes))
-	_, err = pr.db.CreatePluginConfig(flowUuid, string(configMapBytes), pr.tenantId)
+// deleteFlowWithConfig runs delete_flow of the plugin with the config and removes the stored config, if any
+func (pr *PluginRunner) deleteFlowWithConfig(ctx context.Context, pluginUrl, flowUuid string, timeout time.Duration, pluginConfig *database.PluginConfig) error {
+	call, ctx, cancel := pr.newPluginCall(ctx, pluginUrl, deleteFlowOperation, timeout)
+	defer cancel()
+
+	var err error
+	switch {
+	case isNativePluginName(pluginUrl):
+		err = runNativeDeleteFlow(ctx, call, pluginUrl, pluginConfig.Config, flowUuid)
+	case isRemotePluginName(pluginUrl):
+		err = pr.runRemoteDeleteFlow(ctx, call, pluginUrl, pluginConfig.Config, flowUuid)
+	default:
+		err = pr.runPythonPluginDeleteFlow(ctx, call, pluginUrl, pluginConfig, flowUuid)
+	}
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to store the config map: %v", err)
+		return err
 	}
 
-	return workloadSpecs, string(configMapBytes), nil
+	err = pr.db.DeletePluginConfig(pr.tenantId, flowUuid)
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
 
-func (pr *PluginRunner) DeleteFlow(pluginUrl, flowUuid string) error {
-	repoPath, err := pr.getOrCloneRepo(pluginUrl)
+// runPythonPluginDeleteFlow runs delete_flow of the Python plugin
+func (pr *PluginRunner) runPythonPluginDeleteFlow(ctx context.Context, call *pluginCall, pluginUrl string, pluginConfig *database.PluginConfig, flowUuid string) error {
+	// the configs stored before the plugins were pinned have no commit, the ref of the plugin is used instead
+	checkout, err := pr.getOrCloneRepo(ctx, pluginUrl, pluginConfig.Commit)
 	if err != nil {
 		return fmt.Errorf("failed to get or clone repository: %v", err)
 	}
+	defer checkout.release()
 
-	configMap, err := pr.getConfigForFlow(flowUuid)
-	if err != nil {
-		return err
+	_, err = pr.runPythonDeleteFlow(ctx, call, checkout, pluginConfig.Config, flowUuid)
+	return err
+}
+
+// WarmPlugin clones the plugin and builds its environment, so the next calls of the plugin don't wait for them, the
+// native and remote plugins are only validated
+func (pr *PluginRunner) WarmPlugin(ctx context.Context, pluginUrl string, timeout time.Duration) error {
+	if isNativePluginName(pluginUrl) || isRemotePluginName(pluginUrl) {
+		return ValidatePluginName(pluginUrl)
 	}
 
-	_, err = runPythonDeleteFlow(repoPath, configMap, flowUuid)
+	call, ctx, cancel := pr.newPluginCall(ctx, pluginUrl, warmOperation, timeout)
+	defer cancel()
+
+	checkout, err := pr.getOrCloneRepo(ctx, pluginUrl, "")
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to get or clone repository: %v", err)
 	}
+	defer checkout.release()
 
-	err = pr.db.DeletePluginConfig(pr.tenantId, flowUuid)
+	_, release, err := pr.preparePythonPlugin(ctx, call, checkout)
 	if err != nil {
 		return err
 	}
-
+	release()
 	return nil
 }
 
+// GetLimits returns the limits of the plugins run by the runner
+func (pr *PluginRunner) GetLimits() PluginLimits {
+	return pr.host.GetLimits()
+}
+
 func GetPluginId(pluginServiceName string, flowId string) string {
 	return fmt.Sprintf(pluginIdFmtStr, pluginServiceName, flowId)
 }
 
-func (pr *PluginRunner) getConfigForFlow(flowUuid string) (string, error) {
+func (pr *PluginRunner) getConfigForFlow(flowUuid string) (*database.PluginConfig, error) {
 	pluginConfig, err := pr.db.GetPluginConfigByFlowID(pr.tenantId, flowUuid)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if pluginConfig == nil {
-		return "", fmt.Errorf("no config map found for flow UUID: %s", flowUuid)
+		return nil, fmt.Errorf("no config map found for flow UUID: %s", flowUuid)
 	}
-	return pluginConfig.Config, nil
+	return pluginConfig, nil
 }
 
-func runPythonCreateFlow(repoPath, serviceSpecsJSONStr, podSpecsJSONStr, flowUuid string, arguments map[string]string) (string, error) {
-	scriptPath := filepath.Join(repoPath, "main.py")
-
-	if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
-		return "", fmt.Errorf("main.py not found in the repository")
+// ParsePluginName splits the plugin name into the repository URL and the branch, tag or commit to use, e.g.
+// 'github.com/org/plugin:feature/v1.2.0', the ref is empty when the default branch is used
+func ParsePluginName(pluginName string) (string, string, error) {
+	// the separators of the URL scheme and port are before the path of the repository, the ref is after it
+	pathIdx := 0
+	if schemeIdx := strings.Index(pluginName, "://"); schemeIdx >= 0 {
+		pathIdx = schemeIdx + len("://")
 	}
-
-	venvPath := filepath.Join(repoPath, "venv")
-	if err := createVirtualEnv(venvPath); err != nil {
-		return "", fmt.Errorf("failed to create virtual environment: %v", err)
+	if slashIdx := strings.Index(pluginName[pathIdx:], "/"); slashIdx >= 0 {
+		pathIdx += slashIdx
+	}
+	refSeparatorIdx := strings.Index(pluginName[pathIdx:], pluginRefSeparator)
+	if refSeparatorIdx < 0 {
+		return pluginName, "", nil
+	}
+	refSeparatorIdx += pathIdx
+	repoURL, ref := pluginName[:refSeparatorIdx], pluginName[refSeparatorIdx+1:]
+	if ref == "" {
+		return "", "", fmt.Errorf("the plugin name '%s' ends with '%s' but has no ref", pluginName, pluginRefSeparator)
 	}
+	if err := validateGitRef(ref); err != nil {
+		return "", "", fmt.Errorf("invalid ref in plugin name '%s': %v", pluginName, err)
+	}
+	return repoURL, ref, nil
+}
 
-	requirementsPath := filepath.Join(repoPath, "requirements.txt")
-	if _, err := os.Stat(requirementsPath); err == nil {
-		if err := installDependencies(venvPath, requirementsPath); err != nil {
-			return "", fmt.Errorf("failed to install dependencies: %v", err)
-		}
+func (pr *PluginRunner) runPythonCreateFlow(ctx context.Context, call *pluginCall, checkout *pluginCheckout, serviceSpecsJSONStr, podSpecsJSONStr, flowUuid string, arguments map[string]string) (string, error) {
+	venvPath, release, err := pr.preparePythonPlugin(ctx, call, checkout)
+	if err != nil {
+		return "", err
 	}
+	defer release()
+	repoPath := checkout.path
 
 	// Convert arguments to JSON, then encode it for Python
 	argsJSON, err := json.Marshal(arguments)
@@ -228,7 +373,7 @@ with open('%s', 'w') as f:
     json.dump(result, f)
 `, repoPath, serviceSpecsJSONStr, podSpecsJSONStr, flowUuid, argJsonStr, tempResultFile.Name())
 
-	if err := executePythonScript(venvPath, repoPath, tempScript); err != nil {
+	if err := executePythonScript(ctx, call, venvPath, repoPath, tempScript); err != nil {
 		return "", err
 	}
 
@@ -241,24 +386,13 @@ with open('%s', 'w') as f:
 	return string(resultBytes), nil
 }
 
-func runPythonDeleteFlow(repoPath, configMap, flowUuid string) (string, error) {
-	scriptPath := filepath.Join(repoPath, "main.py")
-
-	if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
-		return "", fmt.Errorf("main.py not found in the repository")
-	}
-
-	venvPath := filepath.Join(repoPath, "venv")
-	if err := createVirtualEnv(venvPath); err != nil {
-		return "", fmt.Errorf("failed to create virtual environment: %v", err)
-	}
-
-	requirementsPath := filepath.Join(repoPath, "requirements.txt")
-	if _, err := os.Stat(requirementsPath); err == nil {
-		if err := installDependencies(venvPath, requirementsPath); err != nil {
-			return "", fmt.Errorf("failed to install dependencies: %v", err)
-		}
+func (pr *PluginRunner) runPythonDeleteFlow(ctx context.Context, call *pluginCall, checkout *pluginCheckout, configMap, flowUuid string) (string, error) {
+	venvPath, release, err := pr.preparePythonPlugin(ctx, call, checkout)
+	if err != nil {
+		return "", err
 	}
+	defer release()
+	repoPath := checkout.path
 
 	tempResultFile, err := os.CreateTemp("", "result_*.json")
 	if err != nil {
@@ -296,7 +430,7 @@ with open('%s', 'w') as f:
     json.dump(result, f)
 `, repoPath, configMap, flowUuid, tempResultFile.Name())
 
-	if err := executePythonScript(venvPath, repoPath, tempScript); err != nil {
+	if err := executePythonScript(ctx, call, venvPath, repoPath, tempScript); err != nil {
 		return "", err
 	}
 
@@ -309,7 +443,19 @@ with open('%s', 'w') as f:
 	return string(resultBytes), nil
 }
 
-func executePythonScript(venvPath, repoPath, scriptContent string) error {
+// preparePythonPlugin returns the path of the cached virtual environment of the plugin with its requirements
+// installed, the release function must be called once the plugin ran
+func (pr *PluginRunner) preparePythonPlugin(ctx context.Context, call *pluginCall, checkout *pluginCheckout) (string, func(), error) {
+	scriptPath := filepath.Join(checkout.path, "main.py")
+
+	if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
+		return "", nil, call.errorf(ctx, "main.py not found in the repository")
+	}
+
+	return pr.host.envCache.get(ctx, call, checkout)
+}
+
+func executePythonScript(ctx context.Context, call *pluginCall, venvPath, repoPath, scriptContent string) error {
 	tempFile, err := os.CreateTemp("", "temp_script_*.py")
 	if err != nil {
 		return fmt.Errorf("failed to create temporary script: %v", err)
@@ -321,54 +467,21 @@ func executePythonScript(venvPath, repoPath, scriptContent string) error {
 	}
 	tempFile.Close()
 
-	cmd := exec.Command(filepath.Join(venvPath, "bin", "python"), tempFile.Name())
-	cmd.Dir = repoPath
-	output, err := cmd.CombinedOutput()
+	output, err := call.run(ctx, "failed to run Python script", repoPath, filepath.Join(venvPath, "bin", "python"), tempFile.Name())
 	if err != nil {
-		return fmt.Errorf("failed to run Python script: %v\nOutput: %s", err, output)
+		return err
 	}
+	logrus.Debugf("Output of plugin '%s' %s:\n%s", call.plugin, call.operation, output.stdout.String())
 
 	return nil
 }
 
-func (pr *PluginRunner) getOrCloneRepo(repoURL string) (string, error) {
-	if !strings.HasPrefix(repoURL, "https://") {
-		repoURL = "https://" + repoURL
-	}
-	if !strings.HasSuffix(repoURL, ".git") {
-		repoURL = repoURL + ".git"
-	}
-
-	parts := strings.Split(repoURL, "/")
-	repoName := parts[len(parts)-1]
-
-	tempDir := filepath.Join(os.TempDir(), "go-python-plugins")
-	if err := os.MkdirAll(tempDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create temporary plugins directory: %v", err)
-	}
-
-	repoPath := filepath.Join(tempDir, repoName)
-	logrus.Infof("Cloning plugin from %s to %s", repoURL, repoPath)
-	err := pr.gitPluginProvider.PullGitHubPlugin(repoPath, repoURL)
-	if err != nil {
-		return "", fmt.Errorf("An error occurred pulling plugin from GitHub:\n%v", err.Error())
-	}
-
-	return repoPath, nil
+func createVirtualEnv(ctx context.Context, call *pluginCall, venvPath string) error {
+	_, err := call.run(ctx, "failed to create virtual environment", "", "python3", "-m", "venv", venvPath)
+	return err
 }
 
-func createVirtualEnv(venvPath string) error {
-	cmd := exec.Command("python3", "-m", "venv", venvPath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to create virtual environment: %v\nOutput: %s", err, output)
-	}
-	return nil
-}
-
-func installDependencies(venvPath, requirementsPath string) error {
-	cmd := exec.Command(filepath.Join(venvPath, "bin", "pip"), "install", "-r", requirementsPath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to install dependencies: %v\nOutput: %s", err, output)
-	}
-	return nil
+func installDependencies(ctx context.Context, call *pluginCall, venvPath, requirementsPath string) error {
+	_, err := call.run(ctx, "failed to install dependencies", "", filepath.Join(venvPath, "bin", "pip"), "install", "-r", requirementsPath)
+	return err
 }
@@ -1,6 +1,7 @@
 package plugins
 
 import (
+	"context"
 	"encoding/json"
 	"testing"
 
@@ -105,17 +106,34 @@ var workloadSpecs = []*kardinal.WorkloadSpec{
 	&workloadSpec2,
 }
 
+func newTestPluginHost(t *testing.T, config PluginHostConfig) *PluginHost {
+	if config.WorkDir == "" {
+		config.WorkDir = t.TempDir()
+	}
+	if config.CredentialsKey == "" {
+		config.CredentialsKey = testPluginCredentialsKey
+	}
+	host, err := NewPluginHost(config)
+	require.NoError(t, err)
+	return host
+}
+
 func getPluginRunner(t *testing.T) (*PluginRunner, func() error) {
+	return getPluginRunnerWithProvider(t, NewMockGitPluginProvider(MockGitHub))
+}
+
+func getPluginRunnerWithProvider(t *testing.T, gitPluginProvider GitPluginProvider) (*PluginRunner, func() error) {
 	db, cleanUpDbFunc, err := database.NewSQLiteDB()
 	require.NoError(t, err)
 	err = db.Clear()
 	require.NoError(t, err)
-	err = db.AutoMigrate(&database.Tenant{}, &database.Flow{}, &database.PluginConfig{})
+	err = db.AutoMigrate(&database.Tenant{}, &database.Flow{}, &database.PluginConfig{}, &database.PluginCredential{})
 	require.NoError(t, err)
 	_, err = db.GetOrCreateTenant("tenant-test")
 	require.NoError(t, err)
 	pluginRunner := NewPluginRunner(
-		NewMockGitPluginProvider(MockGitHub),
+		gitPluginProvider,
+		newTestPluginHost(t, PluginHostConfig{}),
 		"tenant-test",
 		db,
 	)
@@ -130,7 +148,7 @@ func TestSimplePlugin(t *testing.T) {
 		"text_to_replace": "helloworld",
 	}
 
-	updatedDeploymentSpecs, configMap, err := runner.CreateFlow(simplePlugin, serviceSpecs, workloadSpecs, flowUuid, arguments)
+	updatedDeploymentSpecs, configMap, err := runner.CreateFlow(context.Background(), simplePlugin, serviceSpecs, workloadSpecs, flowUuid, arguments, 0)
 	require.NoError(t, err)
 
 	for idx, updatedDeploymentSpec := range updatedDeploymentSpecs {
@@ -145,7 +163,7 @@ func TestSimplePlugin(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, "helloworld", configMapData["original_text"])
 
-	err = runner.DeleteFlow(simplePlugin, flowUuid)
+	err = runner.DeleteFlow(context.Background(), simplePlugin, flowUuid, 0)
 	require.NoError(t, err)
 
 	// Verify that the flow UUID was removed from memory
@@ -158,7 +176,7 @@ func TestIdentityPlugin(t *testing.T) {
 	runner, cleanUpDbFunc := getPluginRunner(t)
 	defer cleanUpDbFunc()
 
-	updatedServiceSpec, configMap, err := runner.CreateFlow(identityPlugin, serviceSpecs, workloadSpecs, flowUuid, map[string]string{})
+	updatedServiceSpec, configMap, err := runner.CreateFlow(context.Background(), identityPlugin, serviceSpecs, workloadSpecs, flowUuid, map[string]string{}, 0)
 	require.NoError(t, err)
 
 	// Check if the deployment spec was updated correctly
@@ -170,7 +188,7 @@ func TestIdentityPlugin(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, map[string]interface{}{}, configMapData)
 
-	err = runner.DeleteFlow(identityPlugin, flowUuid)
+	err = runner.DeleteFlow(context.Background(), identityPlugin, flowUuid, 0)
 	require.NoError(t, err)
 
 	// Verify that the flow UUID was removed from memory
@@ -179,11 +197,27 @@ func TestIdentityPlugin(t *testing.T) {
 	require.Contains(t, err.Error(), "no config map found")
 }
 
+func TestPinnedPluginRecordsCommit(t *testing.T) {
+	runner, cleanUpDbFunc := getPluginRunner(t)
+	defer cleanUpDbFunc()
+
+	_, _, err := runner.CreateFlow(context.Background(), identityPlugin+":v1", serviceSpecs, workloadSpecs, flowUuid, map[string]string{}, 0)
+	require.NoError(t, err)
+
+	// the mocked repositories return the ref as the commit
+	pluginConfig, err := runner.getConfigForFlow(flowUuid)
+	require.NoError(t, err)
+	require.Equal(t, "v1", pluginConfig.Commit)
+
+	err = runner.DeleteFlow(context.Background(), identityPlugin+":v1", flowUuid, 0)
+	require.NoError(t, err)
+}
+
 func TestComplexPlugin(t *testing.T) {
 	runner, cleanUpDbFunc := getPluginRunner(t)
 	defer cleanUpDbFunc()
 
-	updatedDeploymentSpecs, configMap, err := runner.CreateFlow(complexPlugin, serviceSpecs, workloadSpecs, flowUuid, map[string]string{})
+	updatedDeploymentSpecs, configMap, err := runner.CreateFlow(context.Background(), complexPlugin, serviceSpecs, workloadSpecs, flowUuid, map[string]string{}, 0)
 	require.NoError(t, err)
 
 	for _, updatedDeploymentSpec := range updatedDeploymentSpecs {
@@ -198,7 +232,7 @@ func TestComplexPlugin(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, "ip_addr", configMapData["original_value"])
 
-	err = runner.DeleteFlow(complexPlugin, flowUuid)
+	err = runner.DeleteFlow(context.Background(), complexPlugin, flowUuid, 0)
 	require.NoError(t, err)
 
 	// Verify that the flow UUID was removed from memory
@@ -211,7 +245,7 @@ func TestRedisPluginTest(t *testing.T) {
 	runner, cleanUpDbFunc := getPluginRunner(t)
 	defer cleanUpDbFunc()
 
-	updatedDeploymentSpecs, configMap, err := runner.CreateFlow(redisPlugin, serviceSpecs, workloadSpecs, flowUuid, map[string]string{})
+	updatedDeploymentSpecs, configMap, err := runner.CreateFlow(context.Background(), redisPlugin, serviceSpecs, workloadSpecs, flowUuid, map[string]string{}, 0)
 	require.NoError(t, err)
 
 	for _, updatedDeploymentSpec := range updatedDeploymentSpecs {
@@ -225,7 +259,7 @@ func TestRedisPluginTest(t *testing.T) {
 	require.NoError(t, err)
 	require.Empty(t, configMapData)
 
-	err = runner.DeleteFlow(complexPlugin, flowUuid)
+	err = runner.DeleteFlow(context.Background(), complexPlugin, flowUuid, 0)
 	require.NoError(t, err)
 
 	// Verify that the flow UUID was removed from memory
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package plugins
+
+import (
+	"os/exec"
+)
+
+// setProcessGroupKill keeps the default cancellation, which only kills the command process
+func setProcessGroupKill(_ *exec.Cmd) {}
@@ -0,0 +1,349 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kurtosis-tech/stacktrace"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// remotePluginSchemePrefix prefixes the URLs of the plugins served over HTTP, e.g.
+	// 'remote+https://redis-plugin.example.com', so they are not mistaken for git repositories
+	remotePluginSchemePrefix = "remote+"
+
+	remoteValidateOperation = "validate"
+
+	remotePluginMaxAttempts = 3
+	// remotePluginMaxResponseBytes bounds the responses of the remote plugins, they contain the pod specs of the flow
+	remotePluginMaxResponseBytes = 16 * 1024 * 1024
+
+	remotePluginDialTimeout         = 30 * time.Second
+	remotePluginTLSHandshakeTimeout = 10 * time.Second
+)
+
+var (
+	// remotePluginRetryDelay is the delay before the first retry of a failed request, it doubles for each attempt
+	remotePluginRetryDelay = 500 * time.Millisecond
+
+	// remotePluginDenyNetworks are rejected unless they are in the allowed networks, like the private ones, the
+	// carrier-grade NAT range has the metadata endpoints of some clouds, e.g. 100.100.100.200, and the NAT64 prefixes
+	// can wrap any IPv4 address, e.g. 64:ff9b::a01:203 for 10.1.2.3
+	remotePluginDenyNetworks = mustParseRemotePluginNetworks("100.64.0.0/10", "64:ff9b::/96", "64:ff9b:1::/48")
+)
+
+// RemoteCreateFlowRequest is the body of the POST <plugin URL>/create_flow requests, it has the same inputs as the
+// create_flow function of the Python plugins
+type RemoteCreateFlowRequest struct {
+	ServiceSpecs []corev1.ServiceSpec `json:"service_specs"`
+	PodSpecs     []corev1.PodSpec     `json:"pod_specs"`
+	FlowUuid     string               `json:"flow_uuid"`
+	Arguments    map[string]string    `json:"arguments"`
+}
+
+// RemoteCreateFlowResponse is the body of the create_flow responses, with one pod spec per pod spec of the request
+type RemoteCreateFlowResponse struct {
+	PodSpecs  []corev1.PodSpec       `json:"pod_specs"`
+	ConfigMap map[string]interface{} `json:"config_map"`
+}
+
+// RemoteDeleteFlowRequest is the body of the POST <plugin URL>/delete_flow requests, with the config map returned by
+// create_flow
+type RemoteDeleteFlowRequest struct {
+	ConfigMap map[string]interface{} `json:"config_map"`
+	FlowUuid  string                 `json:"flow_uuid"`
+}
+
+// RemoteValidateResponse is the body of the POST <plugin URL>/validate responses, the requests have the body of the
+// create_flow ones and are sent before them
+type RemoteValidateResponse struct {
+	Valid   bool   `json:"valid"`
+	Message string `json:"message,omitempty"`
+}
+
+// RemoteErrorResponse is the body of the failed responses
+type RemoteErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// isRemotePluginName returns true for the plugin names with the remote plugin scheme
+func isRemotePluginName(pluginName string) bool {
+	return strings.HasPrefix(pluginName, remotePluginSchemePrefix)
+}
+
+// parseRemotePluginURL returns the HTTP URL of the remote plugin
+func parseRemotePluginURL(pluginName string) (string, error) {
+	pluginURL := strings.TrimSuffix(strings.TrimPrefix(pluginName, remotePluginSchemePrefix), "/")
+	parsedURL, err := url.Parse(pluginURL)
+	if err != nil {
+		return "", fmt.Errorf("the remote plugin URL '%s' is invalid: %v", pluginURL, err)
+	}
+	if (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+		return "", fmt.Errorf("the remote plugin URL '%s' must be an http or https URL", pluginURL)
+	}
+	if parsedURL.User != nil {
+		return "", fmt.Errorf("the remote plugin URL '%s' can't contain credentials, set them with the plugin credentials", parsedURL.Redacted())
+	}
+	return pluginURL, nil
+}
+
+// parseRemotePluginNetworks parses the CIDRs of the networks, e.g. '10.0.0.0/8' for the plugins running in the cluster
+func parseRemotePluginNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "Invalid remote plugin network '%s'", cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func mustParseRemotePluginNetworks(cidrs ...string) []*net.IPNet {
+	networks, err := parseRemotePluginNetworks(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
+
+// checkRemotePluginAddress rejects the connections to the loopback, link-local, private, unspecified and denied
+// addresses which are not in the allowed networks, it's called with the resolved address of each connection so the DNS
+// names and the redirects can't get around it
+func (h *PluginHost) checkRemotePluginAddress(_ string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("the remote plugin address '%s' is not an IP address", address)
+	}
+
+	for _, network := range h.remoteAllowedNetworks {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	for _, network := range remotePluginDenyNetworks {
+		if network.Contains(ip) {
+			return fmt.Errorf("the remote plugin address '%s' is in the denied network '%s' and not in the allowed networks", ip, network)
+		}
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified() {
+		return fmt.Errorf("the remote plugin address '%s' is a loopback, link-local, private or unspecified address which is not in the allowed networks", ip)
+	}
+	return nil
+}
+
+// newRemotePluginHTTPClient returns the client of the remote plugins, it doesn't use the proxy of the environment so
+// the addresses of the plugins are the ones checked
+func (h *PluginHost) newRemotePluginHTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: remotePluginDialTimeout,
+		Control: h.checkRemotePluginAddress,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSClientConfig:     h.remoteTLSConfig,
+			TLSHandshakeTimeout: remotePluginTLSHandshakeTimeout,
+			ForceAttemptHTTP2:   true,
+		},
+	}
+}
+
+// remotePluginClient calls the operations of a remote plugin, the failed requests are retried so the operations must
+// be idempotent for a flow
+type remotePluginClient struct {
+	pluginURL     string
+	httpClient    *http.Client
+	authorization Secret
+}
+
+// newRemotePluginClient returns the client of the remote plugin, the token credentials of the tenant matching the
+// plugin URL are sent as bearer tokens
+func (pr *PluginRunner) newRemotePluginClient(pluginName string) (*remotePluginClient, error) {
+	pluginURL, err := parseRemotePluginURL(pluginName)
+	if err != nil {
+		return nil, err
+	}
+	client := &remotePluginClient{
+		pluginURL:  pluginURL,
+		httpClient: pr.host.newRemotePluginHTTPClient(),
+	}
+
+	credentials, err := pr.getPluginCredentials(pluginURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the plugin credentials: %v", err)
+	}
+	if credentials != nil {
+		if credentials.Type != PluginTokenCredentials {
+			return nil, fmt.Errorf("the '%s' credentials of repository '%s' can't be used by remote plugins, only '%s' ones can", credentials.Type, credentials.Repository, PluginTokenCredentials)
+		}
+		client.authorization = "Bearer " + credentials.Secret
+	}
+	return client, nil
+}
+
+// post sends the request to the operation of the plugin and decodes its response, the network errors and the 429 and
+// 5xx responses are retried until the context is done
+func (c *remotePluginClient) post(ctx context.Context, call *pluginCall, operation string, request interface{}, response interface{}) error {
+	requestBody, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal the %s request: %v", operation, err)
+	}
+	operationURL := c.pluginURL + "/" + operation
+
+	retryDelay := remotePluginRetryDelay
+	var failure string
+	for attempt := 1; attempt <= remotePluginMaxAttempts; attempt++ {
+		if attempt > 1 {
+			logrus.Warnf("Retrying %s of plugin '%s' in %v after attempt %d failed: %s", operation, call.plugin, retryDelay, attempt-1, failure)
+			select {
+			case <-time.After(retryDelay):
+			case <-ctx.Done():
+				return call.errorf(ctx, "%s: %v", failure, ctx.Err())
+			}
+			retryDelay *= 2
+		}
+
+		var retryable bool
+		retryable, failure, err = c.send(ctx, operationURL, requestBody, response, call.limits.MaxOutputBytes)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return call.errorf(ctx, "%s", failure)
+		}
+		if !retryable {
+			break
+		}
+	}
+	return call.errorf(ctx, "%s", failure)
+}
+
+// send sends one request, it returns whether the failure can be retried and its description
+func (c *remotePluginClient) send(ctx context.Context, operationURL string, requestBody []byte, response interface{}, maxErrorBytes int) (bool, string, error) {
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, operationURL, bytes.NewReader(requestBody))
+	if err != nil {
+		return false, fmt.Sprintf("failed to create the request to '%s': %v", operationURL, err), err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set("Accept", "application/json")
+	if c.authorization != "" {
+		httpRequest.Header.Set("Authorization", string(c.authorization))
+	}
+
+	httpResponse, err := c.httpClient.Do(httpRequest)
+	if err != nil {
+		return true, fmt.Sprintf("the request to '%s' failed: %v", operationURL, err), err
+	}
+	defer httpResponse.Body.Close()
+
+	responseBody, err := io.ReadAll(io.LimitReader(httpResponse.Body, remotePluginMaxResponseBytes+1))
+	if err != nil {
+		return true, fmt.Sprintf("failed to read the response of '%s': %v", operationURL, err), err
+	}
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode > 299 {
+		// only the error of the protocol is returned, the other bodies may be pages of any server the URL points to
+		errorMessage := newTruncatedBuffer(maxErrorBytes)
+		var errorResponse RemoteErrorResponse
+		if json.Unmarshal(responseBody, &errorResponse) == nil && errorResponse.Error != "" {
+			errorMessage.Write([]byte(errorResponse.Error))
+		} else {
+			errorMessage.Write([]byte("the response is not a remote plugin error"))
+		}
+		err = fmt.Errorf("'%s' returned status %d: %s", operationURL, httpResponse.StatusCode, errorMessage.String())
+		retryable := httpResponse.StatusCode == http.StatusTooManyRequests || httpResponse.StatusCode >= 500
+		return retryable, err.Error(), err
+	}
+	if len(responseBody) > remotePluginMaxResponseBytes {
+		err = fmt.Errorf("the response of '%s' is larger than %d bytes", operationURL, remotePluginMaxResponseBytes)
+		return false, err.Error(), err
+	}
+	if len(bytes.TrimSpace(responseBody)) == 0 {
+		return false, "", nil
+	}
+	if err = json.Unmarshal(responseBody, response); err != nil {
+		err = fmt.Errorf("failed to parse the response of '%s': %v", operationURL, err)
+		return false, err.Error(), err
+	}
+	return false, "", nil
+}
+
+// runRemoteCreateFlow validates the inputs with the remote plugin and runs its create_flow
+func (pr *PluginRunner) runRemoteCreateFlow(
+	ctx context.Context,
+	call *pluginCall,
+	pluginName string,
+	serviceSpecs []corev1.ServiceSpec,
+	podSpecs []*corev1.PodSpec,
+	flowUuid string,
+	arguments map[string]string,
+) ([]corev1.PodSpec, map[string]interface{}, error) {
+	client, err := pr.newRemotePluginClient(pluginName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	request := RemoteCreateFlowRequest{
+		ServiceSpecs: serviceSpecs,
+		PodSpecs:     make([]corev1.PodSpec, 0, len(podSpecs)),
+		FlowUuid:     flowUuid,
+		Arguments:    arguments,
+	}
+	for _, podSpec := range podSpecs {
+		request.PodSpecs = append(request.PodSpecs, *podSpec)
+	}
+
+	var validateResponse RemoteValidateResponse
+	if err = client.post(ctx, call, remoteValidateOperation, request, &validateResponse); err != nil {
+		return nil, nil, err
+	}
+	if !validateResponse.Valid {
+		return nil, nil, call.errorf(ctx, "the plugin rejected flow '%s': %s", flowUuid, validateResponse.Message)
+	}
+
+	var response RemoteCreateFlowResponse
+	if err = client.post(ctx, call, createFlowOperation, request, &response); err != nil {
+		return nil, nil, err
+	}
+	if response.PodSpecs == nil {
+		return nil, nil, fmt.Errorf("no pod_specs found in plugin result")
+	}
+	return response.PodSpecs, response.ConfigMap, nil
+}
+
+// runRemoteDeleteFlow runs delete_flow of the remote plugin with the config stored by create_flow
+func (pr *PluginRunner) runRemoteDeleteFlow(ctx context.Context, call *pluginCall, pluginName string, configMap string, flowUuid string) error {
+	client, err := pr.newRemotePluginClient(pluginName)
+	if err != nil {
+		return err
+	}
+
+	request := RemoteDeleteFlowRequest{FlowUuid: flowUuid}
+	if err = json.Unmarshal([]byte(configMap), &request.ConfigMap); err != nil {
+		return fmt.Errorf("invalid config map: %v", err)
+	}
+
+	var response struct{}
+	return client.post(ctx, call, deleteFlowOperation, request, &response)
+}
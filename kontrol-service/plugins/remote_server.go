@@ -0,0 +1,78 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ValidatingPlugin is implemented by the plugins checking the inputs of create_flow before it's called
+type ValidatingPlugin interface {
+	Plugin
+	Validate(ctx context.Context, serviceSpecs []corev1.ServiceSpec, podSpecs []corev1.PodSpec, arguments map[string]string) error
+}
+
+// NewRemotePluginHandler serves the plugin with the remote plugin protocol, e.g. to run a Go plugin as a separate
+// service or as a local stand-in of a remote plugin, the plugins without Validate accept all the inputs
+func NewRemotePluginHandler(plugin Plugin) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+remoteValidateOperation, func(w http.ResponseWriter, r *http.Request) {
+		var request RemoteCreateFlowRequest
+		if !decodeRemotePluginRequest(w, r, &request) {
+			return
+		}
+		response := RemoteValidateResponse{Valid: true}
+		if validatingPlugin, ok := plugin.(ValidatingPlugin); ok {
+			if err := validatingPlugin.Validate(r.Context(), request.ServiceSpecs, request.PodSpecs, request.Arguments); err != nil {
+				response = RemoteValidateResponse{Valid: false, Message: err.Error()}
+			}
+		}
+		writeRemotePluginResponse(w, http.StatusOK, response)
+	})
+	mux.HandleFunc("/"+createFlowOperation, func(w http.ResponseWriter, r *http.Request) {
+		var request RemoteCreateFlowRequest
+		if !decodeRemotePluginRequest(w, r, &request) {
+			return
+		}
+		podSpecs, configMap, err := plugin.CreateFlow(r.Context(), request.ServiceSpecs, request.PodSpecs, request.FlowUuid, request.Arguments)
+		if err != nil {
+			writeRemotePluginResponse(w, http.StatusInternalServerError, RemoteErrorResponse{Error: err.Error()})
+			return
+		}
+		writeRemotePluginResponse(w, http.StatusOK, RemoteCreateFlowResponse{PodSpecs: podSpecs, ConfigMap: configMap})
+	})
+	mux.HandleFunc("/"+deleteFlowOperation, func(w http.ResponseWriter, r *http.Request) {
+		var request RemoteDeleteFlowRequest
+		if !decodeRemotePluginRequest(w, r, &request) {
+			return
+		}
+		if err := plugin.DeleteFlow(r.Context(), request.ConfigMap, request.FlowUuid); err != nil {
+			writeRemotePluginResponse(w, http.StatusInternalServerError, RemoteErrorResponse{Error: err.Error()})
+			return
+		}
+		writeRemotePluginResponse(w, http.StatusOK, struct{}{})
+	})
+	return mux
+}
+
+// decodeRemotePluginRequest writes the error response and returns false if the request is not a valid POST request
+func decodeRemotePluginRequest(w http.ResponseWriter, r *http.Request, request interface{}) bool {
+	if r.Method != http.MethodPost {
+		writeRemotePluginResponse(w, http.StatusMethodNotAllowed, RemoteErrorResponse{Error: fmt.Sprintf("method %s not allowed", r.Method)})
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		writeRemotePluginResponse(w, http.StatusBadRequest, RemoteErrorResponse{Error: fmt.Sprintf("invalid request: %v", err)})
+		return false
+	}
+	return true
+}
+
+func writeRemotePluginResponse(w http.ResponseWriter, statusCode int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(response)
+}
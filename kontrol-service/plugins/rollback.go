@@ -0,0 +1,55 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"kardinal.kontrol-service/database"
+)
+
+// createdPluginFlow is a create_flow call of the runner which succeeded
+type createdPluginFlow struct {
+	pluginUrl string
+	flowUuid  string
+	timeout   time.Duration
+	// config is the config returned by the plugin, kept in memory since it may not have been stored
+	config *database.PluginConfig
+}
+
+func (pr *PluginRunner) trackCreatedFlow(pluginUrl string, flowUuid string, timeout time.Duration, config *database.PluginConfig) {
+	pr.createdFlowsMutex.Lock()
+	defer pr.createdFlowsMutex.Unlock()
+	pr.createdFlows = append(pr.createdFlows, createdPluginFlow{pluginUrl: pluginUrl, flowUuid: flowUuid, timeout: timeout, config: config})
+}
+
+// CommitFlows keeps the plugin flows created by the runner once the flow using them was stored, so they are not
+// deleted by RollbackFlows
+func (pr *PluginRunner) CommitFlows() {
+	pr.createdFlowsMutex.Lock()
+	defer pr.createdFlowsMutex.Unlock()
+	pr.createdFlows = nil
+}
+
+// RollbackFlows runs delete_flow of the plugin flows created by the runner in the reverse order of their creation with
+// the configs returned by the plugins, all of them are deleted even if some fail, and the failures are returned together
+func (pr *PluginRunner) RollbackFlows(ctx context.Context) error {
+	pr.createdFlowsMutex.Lock()
+	createdFlows := pr.createdFlows
+	pr.createdFlows = nil
+	pr.createdFlowsMutex.Unlock()
+
+	var rollbackErrs []error
+	for idx := len(createdFlows) - 1; idx >= 0; idx-- {
+		createdFlow := createdFlows[idx]
+		logrus.Infof("Rolling back flow '%s' of plugin '%s'...", createdFlow.flowUuid, createdFlow.pluginUrl)
+		if err := pr.deleteFlowWithConfig(ctx, createdFlow.pluginUrl, createdFlow.flowUuid, createdFlow.timeout, createdFlow.config); err != nil {
+			logrus.Errorf("An error occurred rolling back flow '%s' of plugin '%s': %v", createdFlow.flowUuid, createdFlow.pluginUrl, err)
+			rollbackErrs = append(rollbackErrs, fmt.Errorf("failed to roll back flow '%s' of plugin '%s': %w", createdFlow.flowUuid, createdFlow.pluginUrl, err))
+		}
+	}
+	return errors.Join(rollbackErrs...)
+}
@@ -0,0 +1,99 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// orderRecordingNativePlugin records the order of the deleted flows and fails to delete the flows in failingFlows
+type orderRecordingNativePlugin struct {
+	identityNativePlugin
+	mutex        sync.Mutex
+	deletedFlows []string
+	failingFlows map[string]bool
+}
+
+func (p *orderRecordingNativePlugin) CreateFlow(ctx context.Context, serviceSpecs []corev1.ServiceSpec, podSpecs []corev1.PodSpec, flowUuid string, arguments map[string]string) ([]corev1.PodSpec, map[string]interface{}, error) {
+	return p.identityNativePlugin.CreateFlow(ctx, serviceSpecs, podSpecs, flowUuid, arguments)
+}
+
+func (p *orderRecordingNativePlugin) DeleteFlow(_ context.Context, _ map[string]interface{}, flowUuid string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.deletedFlows = append(p.deletedFlows, flowUuid)
+	if p.failingFlows[flowUuid] {
+		return errors.New("the resources of the flow can't be deleted")
+	}
+	return nil
+}
+
+var testOrderRecordingNativePlugin = &orderRecordingNativePlugin{failingFlows: map[string]bool{"plugin-b-flow": true}}
+
+func init() {
+	RegisterNativePlugin("test-order-recording", testOrderRecordingNativePlugin)
+}
+
+func TestRollbackFlowsDeletesTheCreatedFlowsInReverseOrder(t *testing.T) {
+	runner, cleanUpDbFunc := getPluginRunner(t)
+	defer cleanUpDbFunc()
+
+	pluginName := "builtin://test-order-recording"
+	for _, pluginFlowUuid := range []string{"plugin-a-flow", "plugin-b-flow", "plugin-c-flow"} {
+		_, _, err := runner.CreateFlow(context.Background(), pluginName, serviceSpecs, workloadSpecs, pluginFlowUuid, map[string]string{}, 0)
+		require.NoError(t, err)
+	}
+	// the failed calls have nothing to roll back
+	_, _, err := runner.CreateFlow(context.Background(), "builtin://missing", serviceSpecs, workloadSpecs, "plugin-d-flow", map[string]string{}, 0)
+	require.Error(t, err)
+
+	err = runner.RollbackFlows(context.Background())
+	require.ErrorContains(t, err, "failed to roll back flow 'plugin-b-flow' of plugin 'builtin://test-order-recording'")
+	require.Equal(t, []string{"plugin-c-flow", "plugin-b-flow", "plugin-a-flow"}, testOrderRecordingNativePlugin.deletedFlows)
+
+	// the configs of the deleted flows are removed, the one of the flow which couldn't be deleted is kept
+	_, err = runner.getConfigForFlow("plugin-a-flow")
+	require.ErrorContains(t, err, "no config map found")
+	_, err = runner.getConfigForFlow("plugin-b-flow")
+	require.NoError(t, err)
+	_, err = runner.getConfigForFlow("plugin-c-flow")
+	require.ErrorContains(t, err, "no config map found")
+
+	// the flows are only rolled back once
+	require.NoError(t, runner.RollbackFlows(context.Background()))
+	require.Len(t, testOrderRecordingNativePlugin.deletedFlows, 3)
+}
+
+func TestCommitFlowsKeepsTheCreatedFlows(t *testing.T) {
+	runner, cleanUpDbFunc := getPluginRunner(t)
+	defer cleanUpDbFunc()
+
+	_, _, err := runner.CreateFlow(context.Background(), "builtin://identity", serviceSpecs, workloadSpecs, flowUuid, map[string]string{}, 0)
+	require.NoError(t, err)
+	runner.CommitFlows()
+
+	require.NoError(t, runner.RollbackFlows(context.Background()))
+	_, err = runner.getConfigForFlow(flowUuid)
+	require.NoError(t, err)
+}
+
+func TestRollbackFlowsDeletesTheFlowsWhoseConfigWasNotStored(t *testing.T) {
+	runner, cleanUpDbFunc := getPluginRunner(t)
+	defer cleanUpDbFunc()
+
+	// the config of the flow can't be stored twice
+	unstoredFlowUuid := "unstored-config-flow"
+	_, err := runner.db.CreatePluginConfig(unstoredFlowUuid, "{}", "", runner.tenantId)
+	require.NoError(t, err)
+	_, _, err = runner.CreateFlow(context.Background(), "builtin://test-recording", serviceSpecs, workloadSpecs, unstoredFlowUuid, map[string]string{}, 0)
+	require.ErrorContains(t, err, "failed to store the config map")
+
+	require.NoError(t, runner.RollbackFlows(context.Background()))
+	testRecordingNativePlugin.mutex.Lock()
+	defer testRecordingNativePlugin.mutex.Unlock()
+	require.Equal(t, map[string]interface{}{"flow": unstoredFlowUuid}, testRecordingNativePlugin.deletedFlows[unstoredFlowUuid])
+}
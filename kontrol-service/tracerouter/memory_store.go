@@ -0,0 +1,90 @@
+package tracerouter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type traceRoutes struct {
+	destinations map[string]string
+	expiresAt    time.Time
+}
+
+// MemoryStore keeps the routing tables in the process memory, it's meant for a single trace router replica
+type MemoryStore struct {
+	mutex  sync.RWMutex
+	traces map[string]*traceRoutes
+	now    func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		traces: map[string]*traceRoutes{},
+		now:    time.Now,
+	}
+}
+
+func (s *MemoryStore) SetRoute(_ context.Context, traceID string, hostname string, destination string, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	routes, found := s.traces[traceID]
+	if !found || !now.Before(routes.expiresAt) {
+		routes = &traceRoutes{destinations: map[string]string{}}
+		s.traces[traceID] = routes
+	}
+	routes.destinations[hostname] = destination
+	routes.expiresAt = now.Add(ttl)
+	return nil
+}
+
+func (s *MemoryStore) GetRoute(_ context.Context, traceID string, hostname string) (string, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	routes, found := s.traces[traceID]
+	if !found || !s.now().Before(routes.expiresAt) {
+		return "", false, nil
+	}
+	destination, found := routes.destinations[hostname]
+	return destination, found, nil
+}
+
+// Len returns the number of traces stored, including the expired ones not deleted yet
+func (s *MemoryStore) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.traces)
+}
+
+// DeleteExpired removes the expired traces and returns how many were removed
+func (s *MemoryStore) DeleteExpired() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	deleted := 0
+	for traceID, routes := range s.traces {
+		if !now.Before(routes.expiresAt) {
+			delete(s.traces, traceID)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// RunCleanup deletes the expired traces every interval until the context is done
+func (s *MemoryStore) RunCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.DeleteExpired()
+		}
+	}
+}
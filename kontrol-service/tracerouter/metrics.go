@@ -0,0 +1,55 @@
+package tracerouter
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// metrics are the counters exposed in the Prometheus text format on /metrics
+type metrics struct {
+	setRoutes         atomic.Uint64
+	routeHits         atomic.Uint64
+	routeBaselines    atomic.Uint64
+	routeMisses       atomic.Uint64
+	storeErrors       atomic.Uint64
+	badRequests       atomic.Uint64
+	generatedTraceIDs atomic.Uint64
+	storedTraces      func() int
+}
+
+func (m *metrics) write(writer io.Writer) error {
+	counters := []struct {
+		name   string
+		help   string
+		labels string
+		value  uint64
+	}{
+		{"kardinal_trace_router_set_routes_total", "Routes set in the routing tables of the traces.", "", m.setRoutes.Load()},
+		{"kardinal_trace_router_routes_total", "Destinations returned, by where they were found.", `{result="hit"}`, m.routeHits.Load()},
+		{"kardinal_trace_router_routes_total", "", `{result="baseline"}`, m.routeBaselines.Load()},
+		{"kardinal_trace_router_routes_total", "", `{result="miss"}`, m.routeMisses.Load()},
+		{"kardinal_trace_router_store_errors_total", "Requests failed because of a store error.", "", m.storeErrors.Load()},
+		{"kardinal_trace_router_bad_requests_total", "Requests rejected because of missing or invalid parameters.", "", m.badRequests.Load()},
+		{"kardinal_trace_router_generated_trace_ids_total", "Trace IDs generated.", "", m.generatedTraceIDs.Load()},
+	}
+
+	for _, counter := range counters {
+		if counter.help != "" {
+			if _, err := fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(writer, "%s%s %d\n", counter.name, counter.labels, counter.value); err != nil {
+			return err
+		}
+	}
+
+	if m.storedTraces != nil {
+		if _, err := fmt.Fprintf(writer, "# HELP kardinal_trace_router_traces Traces stored in memory.\n# TYPE kardinal_trace_router_traces gauge\nkardinal_trace_router_traces %d\n", m.storedTraces()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package tracerouter
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/kurtosis-tech/stacktrace"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultRedisKeyPrefix      = "kardinal:trace:"
+	defaultRedisPoolSize       = 16
+	defaultRedisDialTimeout    = 2 * time.Second
+	defaultRedisCommandTimeout = 2 * time.Second
+
+	// redisSetRouteScript sets the route and the expiration of the trace atomically, so a trace is never stored
+	// without a TTL when the connection fails between the two commands
+	redisSetRouteScript = `redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+return redis.call("PEXPIRE", KEYS[1], ARGV[3])`
+)
+
+var setRouteScript = redis.NewScript(redisSetRouteScript)
+
+type RedisOptions struct {
+	Address  string
+	Password string
+	DB       int
+	// KeyPrefix is prepended to the trace IDs to build the keys of the routing table hashes
+	KeyPrefix   string
+	PoolSize    int
+	DialTimeout time.Duration
+	// CommandTimeout bounds the commands sent with a context without deadline
+	CommandTimeout time.Duration
+}
+
+// RedisStore keeps the routing table of each trace in a Redis hash, with the TTL set as the key expiration, so the
+// routes are shared by all the trace router replicas. It works with the Redis compatible servers, e.g. Valkey or KeyDB.
+type RedisStore struct {
+	options RedisOptions
+	client  *redis.Client
+}
+
+func NewRedisStore(options RedisOptions) (*RedisStore, error) {
+	if options.Address == "" {
+		return nil, stacktrace.NewError("The Redis address is required")
+	}
+	store := newRedisStore(options)
+
+	// fail early on a wrong address or password
+	ctx, cancel := store.withDefaultTimeout(context.Background())
+	defer cancel()
+	if err := store.client.Ping(ctx).Err(); err != nil {
+		_ = store.client.Close()
+		return nil, stacktrace.Propagate(err, "An error occurred connecting to Redis at '%s'", options.Address)
+	}
+
+	return store, nil
+}
+
+// newRedisStore fills in the default options and creates the client, which connects on the first command
+func newRedisStore(options RedisOptions) *RedisStore {
+	if options.KeyPrefix == "" {
+		options.KeyPrefix = defaultRedisKeyPrefix
+	}
+	if options.PoolSize <= 0 {
+		options.PoolSize = defaultRedisPoolSize
+	}
+	if options.DialTimeout <= 0 {
+		options.DialTimeout = defaultRedisDialTimeout
+	}
+	if options.CommandTimeout <= 0 {
+		options.CommandTimeout = defaultRedisCommandTimeout
+	}
+
+	return &RedisStore{
+		options: options,
+		client: redis.NewClient(&redis.Options{
+			Addr:                  options.Address,
+			Password:              options.Password,
+			DB:                    options.DB,
+			PoolSize:              options.PoolSize,
+			DialTimeout:           options.DialTimeout,
+			ContextTimeoutEnabled: true,
+			// RESP2 and no CLIENT SETINFO on connect, which the older Redis compatible servers don't support
+			Protocol:        2,
+			DisableIdentity: true,
+		}),
+	}
+}
+
+func (s *RedisStore) SetRoute(ctx context.Context, traceID string, hostname string, destination string, ttl time.Duration) error {
+	ctx, cancel := s.withDefaultTimeout(ctx)
+	defer cancel()
+
+	key := s.options.KeyPrefix + traceID
+	if err := setRouteScript.Run(ctx, s.client, []string{key}, hostname, destination, redisTTLMilliseconds(ttl)).Err(); err != nil {
+		return stacktrace.Propagate(err, "An error occurred setting the route of '%s' for trace '%s'", hostname, traceID)
+	}
+	return nil
+}
+
+func (s *RedisStore) GetRoute(ctx context.Context, traceID string, hostname string) (string, bool, error) {
+	ctx, cancel := s.withDefaultTimeout(ctx)
+	defer cancel()
+
+	destination, err := s.client.HGet(ctx, s.options.KeyPrefix+traceID, hostname).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, stacktrace.Propagate(err, "An error occurred getting the route of '%s' for trace '%s'", hostname, traceID)
+	}
+	return destination, true, nil
+}
+
+// Close closes the connections
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
+
+// redisTTLMilliseconds rounds the TTL up to the next millisecond, PEXPIRE 0 would delete the trace right away
+func redisTTLMilliseconds(ttl time.Duration) int64 {
+	milliseconds := int64((ttl + time.Millisecond - 1) / time.Millisecond)
+	if milliseconds < 1 {
+		return 1
+	}
+	return milliseconds
+}
+
+// withDefaultTimeout bounds the context with the command timeout when it doesn't have a deadline, so a stalled
+// server doesn't block the requests of the filters forever, including the retries of the client
+func (s *RedisStore) withDefaultTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, hasDeadline := ctx.Deadline(); hasDeadline {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, s.options.CommandTimeout)
+}
@@ -0,0 +1,260 @@
+package tracerouter
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis implements the few commands used by the Redis store, with the expiration checked on read, it answers
+// HELLO with an error like the servers speaking only RESP2
+type fakeRedis struct {
+	mutex    sync.Mutex
+	password string
+	hashes   map[string]map[string]string
+	expiries map[string]time.Time
+	scripts  map[string]string
+	commands []string
+}
+
+func startFakeRedis(t *testing.T, password string) (*fakeRedis, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	server := &fakeRedis{
+		password: password,
+		hashes:   map[string]map[string]string{},
+		expiries: map[string]time.Time{},
+		scripts:  map[string]string{},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server, listener.Addr().String()
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := s.password == ""
+	for {
+		command, err := readFakeRedisCommand(reader)
+		if err != nil {
+			return
+		}
+		command[0] = strings.ToUpper(command[0])
+		var reply string
+		if command[0] == "HELLO" {
+			reply = "-ERR unknown command 'HELLO'\r\n"
+		} else if command[0] == "AUTH" {
+			if command[1] == s.password {
+				authenticated = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		} else if !authenticated {
+			reply = "-NOAUTH Authentication required.\r\n"
+		} else {
+			reply = s.execute(command)
+		}
+		if _, err = io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeRedis) execute(command []string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.commands = append(s.commands, command[0])
+
+	switch command[0] {
+	case "PING":
+		return "+PONG\r\n"
+	case "EVAL":
+		sha := sha1.Sum([]byte(command[1]))
+		s.scripts[hex.EncodeToString(sha[:])] = command[1]
+		return s.eval(command[1], command[2:])
+	case "EVALSHA":
+		script, found := s.scripts[command[1]]
+		if !found {
+			return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+		}
+		return s.eval(script, command[2:])
+	default:
+		return s.run(command)
+	}
+}
+
+// eval runs the set route script, the only one run by the store
+func (s *fakeRedis) eval(script string, args []string) string {
+	if script != redisSetRouteScript || args[0] != "1" {
+		return "-ERR unknown script\r\n"
+	}
+	key := args[1]
+	s.run([]string{"HSET", key, args[2], args[3]})
+	return s.run([]string{"PEXPIRE", key, args[4]})
+}
+
+func (s *fakeRedis) run(command []string) string {
+	key := command[1]
+	if expiry, found := s.expiries[key]; found && !time.Now().Before(expiry) {
+		delete(s.hashes, key)
+		delete(s.expiries, key)
+	}
+
+	switch command[0] {
+	case "HSET":
+		if s.hashes[key] == nil {
+			s.hashes[key] = map[string]string{}
+		}
+		s.hashes[key][command[2]] = command[3]
+		return ":1\r\n"
+	case "PEXPIRE":
+		ms, _ := strconv.Atoi(command[2])
+		s.expiries[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case "HGET":
+		value, found := s.hashes[key][command[2]]
+		if !found {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func (s *fakeRedis) executedCommands() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.commands
+}
+
+func (s *fakeRedis) hasKey(key string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, found := s.hashes[key]
+	return found
+}
+
+// readFakeRedisCommand reads a command sent as an array of bulk strings
+func readFakeRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := readFakeRedisLine(reader, '*')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(line)
+	if err != nil {
+		return nil, err
+	}
+	command := make([]string, count)
+	for i := range command {
+		if line, err = readFakeRedisLine(reader, '$'); err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		if _, err = io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		command[i] = string(data[:length])
+	}
+	return command, nil
+}
+
+func readFakeRedisLine(reader *bufio.Reader, prefix byte) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[0] != prefix || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("invalid command line '%s'", line)
+	}
+	return line[1 : len(line)-2], nil
+}
+
+func TestRedisStore(t *testing.T) {
+	ctx := context.Background()
+	server, address := startFakeRedis(t, "secret")
+
+	_, err := NewRedisStore(RedisOptions{Address: address, Password: "wrong"})
+	require.Error(t, err)
+
+	store, err := NewRedisStore(RedisOptions{Address: address, Password: "secret", PoolSize: 2})
+	require.NoError(t, err)
+	defer store.Close()
+
+	// the script is loaded by the first route and then run by its hash
+	require.NoError(t, store.SetRoute(ctx, "abc", "backend", "backend-dev-flow-1", time.Minute))
+	require.NoError(t, store.SetRoute(ctx, "abc", "frontend", "frontend-dev-flow-1", time.Minute))
+	require.Equal(t, []string{"PING", "EVALSHA", "EVAL", "EVALSHA"}, server.executedCommands())
+	require.True(t, server.hasKey(defaultRedisKeyPrefix+"abc"))
+
+	destination, found, err := store.GetRoute(ctx, "abc", "backend")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "backend-dev-flow-1", destination)
+
+	_, found, err = store.GetRoute(ctx, "abc", "api")
+	require.NoError(t, err)
+	require.False(t, found)
+
+	require.NoError(t, store.SetRoute(ctx, "short", "backend", "backend-dev-flow-1", 10*time.Millisecond))
+	time.Sleep(20 * time.Millisecond)
+	_, found, err = store.GetRoute(ctx, "short", "backend")
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestRedisTTLMilliseconds(t *testing.T) {
+	require.Equal(t, int64(60000), redisTTLMilliseconds(time.Minute))
+	// the sub-millisecond TTLs are rounded up instead of deleting the trace
+	require.Equal(t, int64(1), redisTTLMilliseconds(500*time.Microsecond))
+	require.Equal(t, int64(2), redisTTLMilliseconds(1500*time.Microsecond))
+}
+
+func TestRedisStoreDefaultDeadline(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	// the server accepts the connections but never replies
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	store := newRedisStore(RedisOptions{Address: listener.Addr().String(), DialTimeout: time.Second, CommandTimeout: 50 * time.Millisecond})
+	defer store.Close()
+	start := time.Now()
+	_, _, err = store.GetRoute(context.Background(), "abc", "backend")
+	require.Error(t, err)
+	require.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,191 @@
+package tracerouter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultTraceTTL = time.Hour
+
+	traceIDParam             = "trace_id"
+	hostnameParam            = "hostname"
+	namespaceParam           = "namespace"
+	destinationParam         = "destination"
+	baselinePrefixParam      = "baseline_prefix"
+	baselineDestinationParam = "baseline_destination"
+)
+
+// Router serves the endpoints called by the Lua filters rendered by the kontrol service:
+//   - POST /set-route stores the destination of a hostname for a trace, it's called by the filters of the flow entry
+//     points for every service of the flow
+//   - GET /route returns the destination of a hostname for a trace, it's called by the outbound filters of every
+//     service, the baseline destination is returned when the trace has no route for the hostname
+//   - GET /generate-trace-id returns a new W3C compatible trace ID
+type Router struct {
+	store   Store
+	ttl     time.Duration
+	metrics *metrics
+}
+
+func NewRouter(store Store, ttl time.Duration) *Router {
+	if ttl <= 0 {
+		ttl = DefaultTraceTTL
+	}
+	router := &Router{
+		store:   store,
+		ttl:     ttl,
+		metrics: &metrics{},
+	}
+	if memoryStore, ok := store.(*MemoryStore); ok {
+		router.metrics.storedTraces = memoryStore.Len
+	}
+	return router
+}
+
+func (r *Router) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /set-route", r.setRouteHandler)
+	mux.HandleFunc("GET /route", r.routeHandler)
+	mux.HandleFunc("GET /generate-trace-id", r.generateTraceIDHandler)
+	mux.HandleFunc("GET /metrics", r.metricsHandler)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		writeText(w, http.StatusOK, "OK")
+	})
+	return mux
+}
+
+func (r *Router) setRouteHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	traceID := query.Get(traceIDParam)
+	hostname := routeHostname(query.Get(hostnameParam), "")
+	destination := query.Get(destinationParam)
+	if traceID == "" || hostname == "" || destination == "" {
+		r.metrics.badRequests.Add(1)
+		writeText(w, http.StatusBadRequest, "The trace_id, hostname and destination parameters are required")
+		return
+	}
+
+	err := r.store.SetRoute(req.Context(), traceID, hostname, destination, r.ttl)
+	if err != nil {
+		r.metrics.storeErrors.Add(1)
+		logrus.Errorf("An error occurred setting the route of '%s' to '%s' for trace '%s': %v", hostname, destination, traceID, err)
+		writeText(w, http.StatusServiceUnavailable, "An error occurred storing the route")
+		return
+	}
+
+	r.metrics.setRoutes.Add(1)
+	logrus.Debugf("Set route of '%s' to '%s' for trace '%s'", hostname, destination, traceID)
+	writeText(w, http.StatusOK, "OK")
+}
+
+// routeHandler returns the destination set for the hostname in the trace, the hostname can be the service name or
+// one of its cluster local names in the namespace of the filter. Without a route the baseline destination sent by
+// the filter is used, the baseline_prefix parameter is only a fallback for the filters rendered by older versions,
+// which also didn't send the namespace.
+func (r *Router) routeHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	traceID := query.Get(traceIDParam)
+	namespace := query.Get(namespaceParam)
+	if namespace == "" {
+		namespace = query.Get(baselinePrefixParam)
+	}
+	hostname := routeHostname(query.Get(hostnameParam), namespace)
+	if traceID == "" || hostname == "" {
+		r.metrics.badRequests.Add(1)
+		writeText(w, http.StatusBadRequest, "The trace_id and hostname parameters are required")
+		return
+	}
+
+	destination, found, err := r.store.GetRoute(req.Context(), traceID, hostname)
+	if err != nil {
+		r.metrics.storeErrors.Add(1)
+		logrus.Errorf("An error occurred getting the route of '%s' for trace '%s': %v", hostname, traceID, err)
+		writeText(w, http.StatusServiceUnavailable, "An error occurred reading the route")
+		return
+	}
+	if found {
+		r.metrics.routeHits.Add(1)
+		writeText(w, http.StatusOK, destination)
+		return
+	}
+
+	if baselineDestination := query.Get(baselineDestinationParam); baselineDestination != "" {
+		r.metrics.routeBaselines.Add(1)
+		writeText(w, http.StatusOK, baselineDestination)
+		return
+	}
+	if baselinePrefix := query.Get(baselinePrefixParam); baselinePrefix != "" {
+		r.metrics.routeBaselines.Add(1)
+		writeText(w, http.StatusOK, hostname+"-"+baselinePrefix)
+		return
+	}
+
+	r.metrics.routeMisses.Add(1)
+	writeText(w, http.StatusNotFound, "No route found for the hostname")
+}
+
+func (r *Router) generateTraceIDHandler(w http.ResponseWriter, _ *http.Request) {
+	traceID, err := generateTraceID()
+	if err != nil {
+		logrus.Errorf("An error occurred generating a trace ID: %v", err)
+		writeText(w, http.StatusInternalServerError, "An error occurred generating a trace ID")
+		return
+	}
+	r.metrics.generatedTraceIDs.Add(1)
+	writeText(w, http.StatusOK, traceID)
+}
+
+func (r *Router) metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := r.metrics.write(w); err != nil {
+		logrus.Errorf("An error occurred writing the metrics: %v", err)
+	}
+}
+
+// routeHostname returns the key of the hostname in the routing table of a trace. The filters of the flow entry points
+// set the routes with the service names but the outbound filters send the hostnames used by the services, so the
+// cluster local names of the services of the namespace, e.g. backend.prod.svc.cluster.local, are keyed by the
+// service name. The other hostnames are kept whole, without the port, so api.example.com doesn't get the route of
+// the api service.
+func routeHostname(hostname string, namespace string) string {
+	hostname = strings.ToLower(hostname)
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = host
+	}
+	if namespace == "" {
+		return hostname
+	}
+
+	namespaceSuffixes := []string{"." + namespace, "." + namespace + ".svc", "." + namespace + ".svc.cluster.local"}
+	for _, suffix := range namespaceSuffixes {
+		service, found := strings.CutSuffix(hostname, suffix)
+		if found && service != "" && !strings.Contains(service, ".") {
+			return service
+		}
+	}
+	return hostname
+}
+
+// generateTraceID returns 32 random hex digits, a valid W3C trace ID
+func generateTraceID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func writeText(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := w.Write([]byte(body)); err != nil {
+		logrus.Debugf("An error occurred writing the response: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package tracerouter
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func doRequest(t *testing.T, handler http.Handler, method string, path string) (int, string) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+	body, err := io.ReadAll(recorder.Result().Body)
+	require.NoError(t, err)
+	return recorder.Code, string(body)
+}
+
+func TestRouterRoutes(t *testing.T) {
+	handler := NewRouter(NewMemoryStore(), time.Minute).Handler()
+
+	status, _ := doRequest(t, handler, http.MethodPost, "/set-route?trace_id=abc&hostname=backend&destination=backend-dev-flow-1")
+	require.Equal(t, http.StatusOK, status)
+
+	status, body := doRequest(t, handler, http.MethodGet, "/route?trace_id=abc&hostname=backend&baseline_prefix=prod")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "backend-dev-flow-1", body)
+
+	status, body = doRequest(t, handler, http.MethodGet, "/route?trace_id=abc&hostname=backend.prod.svc.cluster.local&baseline_prefix=prod")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "backend-dev-flow-1", body)
+
+	status, body = doRequest(t, handler, http.MethodGet, "/route?trace_id=abc&hostname=frontend&baseline_prefix=prod&baseline_destination=frontend-prod-1f2e3d")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "frontend-prod-1f2e3d", body)
+
+	status, body = doRequest(t, handler, http.MethodGet, "/route?trace_id=other&hostname=backend&baseline_prefix=prod")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "backend-prod", body)
+
+	status, _ = doRequest(t, handler, http.MethodGet, "/route?trace_id=other&hostname=backend")
+	require.Equal(t, http.StatusNotFound, status)
+
+	status, _ = doRequest(t, handler, http.MethodPost, "/set-route?trace_id=abc&hostname=backend")
+	require.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = doRequest(t, handler, http.MethodGet, "/set-route?trace_id=abc&hostname=backend&destination=backend-dev-flow-1")
+	require.Equal(t, http.StatusMethodNotAllowed, status)
+
+	status, body = doRequest(t, handler, http.MethodGet, "/metrics")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, "kardinal_trace_router_set_routes_total 1\n")
+	require.Contains(t, body, "kardinal_trace_router_routes_total{result=\"hit\"} 2\n")
+	require.Contains(t, body, "kardinal_trace_router_routes_total{result=\"baseline\"} 2\n")
+	require.Contains(t, body, "kardinal_trace_router_routes_total{result=\"miss\"} 1\n")
+	require.Contains(t, body, "kardinal_trace_router_bad_requests_total 1\n")
+	require.Contains(t, body, "kardinal_trace_router_traces 1\n")
+}
+
+func TestRouterKeepsTheExternalHostnames(t *testing.T) {
+	handler := NewRouter(NewMemoryStore(), time.Minute).Handler()
+
+	status, _ := doRequest(t, handler, http.MethodPost, "/set-route?trace_id=abc&hostname=api&destination=api-dev-flow-1")
+	require.Equal(t, http.StatusOK, status)
+
+	for _, hostname := range []string{"api", "api:8080", "api.prod", "api.prod.svc", "API.prod.svc.cluster.local:8080"} {
+		_, body := doRequest(t, handler, http.MethodGet, "/route?trace_id=abc&namespace=prod&baseline_destination=api-prod&hostname="+hostname)
+		require.Equal(t, "api-dev-flow-1", body, hostname)
+	}
+
+	// the external hostnames and the services of the other namespaces don't get the route of the service
+	for _, hostname := range []string{"api.example.com", "api.staging.svc.cluster.local", "api.prod.example.com"} {
+		_, body := doRequest(t, handler, http.MethodGet, "/route?trace_id=abc&namespace=prod&baseline_destination=api-prod&hostname="+hostname)
+		require.Equal(t, "api-prod", body, hostname)
+	}
+}
+
+func TestRouteHostname(t *testing.T) {
+	require.Equal(t, "backend", routeHostname("backend.prod.svc.cluster.local", "prod"))
+	require.Equal(t, "backend", routeHostname("Backend:8080", ""))
+	require.Equal(t, "backend.prod.svc.cluster.local", routeHostname("backend.prod.svc.cluster.local:8080", ""))
+	require.Equal(t, "api.example.com", routeHostname("api.example.com:443", "prod"))
+	require.Equal(t, "prod.svc", routeHostname("prod.svc", "prod"))
+}
+
+func TestRouterGenerateTraceID(t *testing.T) {
+	handler := NewRouter(NewMemoryStore(), time.Minute).Handler()
+
+	status, first := doRequest(t, handler, http.MethodGet, "/generate-trace-id")
+	require.Equal(t, http.StatusOK, status)
+	require.Regexp(t, regexp.MustCompile("^[0-9a-f]{32}$"), first)
+
+	_, second := doRequest(t, handler, http.MethodGet, "/generate-trace-id")
+	require.NotEqual(t, first, second)
+}
+
+func TestMemoryStoreTTL(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+
+	require.NoError(t, store.SetRoute(ctx, "abc", "frontend", "frontend-dev", time.Minute))
+	now = now.Add(50 * time.Second)
+	// setting a route extends the TTL of the whole trace
+	require.NoError(t, store.SetRoute(ctx, "abc", "backend", "backend-dev", time.Minute))
+	now = now.Add(50 * time.Second)
+
+	destination, found, err := store.GetRoute(ctx, "abc", "frontend")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "frontend-dev", destination)
+	require.Equal(t, 0, store.DeleteExpired())
+
+	now = now.Add(time.Minute)
+	_, found, err = store.GetRoute(ctx, "abc", "backend")
+	require.NoError(t, err)
+	require.False(t, found)
+
+	// an expired trace starts with an empty routing table
+	require.NoError(t, store.SetRoute(ctx, "abc", "backend", "backend-dev", time.Minute))
+	_, found, err = store.GetRoute(ctx, "abc", "frontend")
+	require.NoError(t, err)
+	require.False(t, found)
+
+	now = now.Add(2 * time.Minute)
+	require.Equal(t, 1, store.DeleteExpired())
+	require.Equal(t, 0, store.Len())
+}
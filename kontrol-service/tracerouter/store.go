@@ -0,0 +1,14 @@
+package tracerouter
+
+import (
+	"context"
+	"time"
+)
+
+// Store keeps the routing table of each trace, the destination of every hostname called in the trace, for the TTL
+// of the trace. Setting a route extends the TTL of the whole trace.
+type Store interface {
+	SetRoute(ctx context.Context, traceID string, hostname string, destination string, ttl time.Duration) error
+	// GetRoute returns false when the trace has no route for the hostname or has expired
+	GetRoute(ctx context.Context, traceID string, hostname string) (string, bool, error)
+}
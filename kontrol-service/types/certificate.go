@@ -0,0 +1,75 @@
+package types
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	certificateApiVersion = "cert-manager.io/v1"
+	certificateKind       = "Certificate"
+	certManagerGroup      = "cert-manager.io"
+)
+
+// Certificate is the subset of the cert-manager Certificate resource rendered for the flow hostnames, the
+// cert-manager module is not imported only for this type
+type Certificate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec CertificateSpec `json:"spec"`
+}
+
+type CertificateSpec struct {
+	SecretName string               `json:"secretName"`
+	DNSNames   []string             `json:"dnsNames"`
+	IssuerRef  CertificateIssuerRef `json:"issuerRef"`
+}
+
+type CertificateIssuerRef struct {
+	Name  string `json:"name"`
+	Kind  string `json:"kind"`
+	Group string `json:"group"`
+}
+
+func NewCertificate(name string, namespace string, secretName string, dnsNames []string, issuerName string, issuerKind string) *Certificate {
+	return &Certificate{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: certificateApiVersion,
+			Kind:       certificateKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Spec: CertificateSpec{
+			SecretName: secretName,
+			DNSNames:   dnsNames,
+			IssuerRef: CertificateIssuerRef{
+				Name:  issuerName,
+				Kind:  issuerKind,
+				Group: certManagerGroup,
+			},
+		},
+	}
+}
+
+func (in *Certificate) DeepCopy() *Certificate {
+	if in == nil {
+		return nil
+	}
+	out := new(Certificate)
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+	if in.Spec.DNSNames != nil {
+		out.Spec.DNSNames = make([]string, len(in.Spec.DNSNames))
+		copy(out.Spec.DNSNames, in.Spec.DNSNames)
+	}
+	return out
+}
+
+// DeepCopyObject implements runtime.Object so the certificates can be printed with the other resources
+func (in *Certificate) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
@@ -0,0 +1,102 @@
+package resolved
+
+import (
+	"regexp"
+	"sort"
+
+	"github.com/kurtosis-tech/stacktrace"
+	"github.com/samber/lo"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// maxFlowCanaryWeight is the percentage of the baseline traffic that can be sent to the flows, in total
+const maxFlowCanaryWeight = 100
+
+// FlowCanary sends part of the baseline traffic to a flow, the requests are entered in the flow at the entry points
+// so the rest of the trace stays in the flow, including its isolated stateful dependencies
+type FlowCanary struct {
+	// Weight is the percentage of the baseline requests sent to the flow
+	Weight int32 `json:"weight,omitempty"`
+	// Matches send the baseline requests matching any of them to the flow, whatever the weight
+	Matches []FlowCanaryMatch `json:"matches,omitempty"`
+}
+
+// FlowCanaryMatch matches the requests with all its headers, e.g. the header identifying the user
+type FlowCanaryMatch struct {
+	Headers []FlowCanaryHeaderMatch `json:"headers"`
+}
+
+type FlowCanaryHeaderMatch struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Regex matches the header value with this RE2 regular expression instead of exactly
+	Regex bool `json:"regex,omitempty"`
+}
+
+// FlowCanaryEntry is the canary of a flow, in the order the canaries are rendered
+type FlowCanaryEntry struct {
+	FlowID string
+	Canary FlowCanary
+}
+
+func (c FlowCanary) Validate() error {
+	if c.Weight < 0 || c.Weight > maxFlowCanaryWeight {
+		return stacktrace.NewError("The canary weight must be between 0 and %d, got %d", maxFlowCanaryWeight, c.Weight)
+	}
+	if c.Weight == 0 && len(c.Matches) == 0 {
+		return stacktrace.NewError("The canary must have a weight or matches")
+	}
+	for matchIx, match := range c.Matches {
+		if len(match.Headers) == 0 {
+			return stacktrace.NewError("The canary match %d has no headers", matchIx)
+		}
+		for _, header := range match.Headers {
+			if errs := validation.IsHTTPHeaderName(header.Name); len(errs) > 0 {
+				return stacktrace.NewError("Invalid canary match header name '%s': %v", header.Name, errs)
+			}
+			if header.Regex {
+				if _, err := regexp.Compile(header.Value); err != nil {
+					return stacktrace.Propagate(err, "Invalid canary match regular expression '%s' for header '%s'", header.Value, header.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateFlowCanaries checks the canaries of all the flows, their weights can't send more than all the baseline
+// traffic to the flows
+func ValidateFlowCanaries(flowCanaries map[string]FlowCanary) error {
+	totalWeight := int32(0)
+	for flowID, canary := range flowCanaries {
+		if err := canary.Validate(); err != nil {
+			return stacktrace.Propagate(err, "Invalid canary for flow '%s'", flowID)
+		}
+		totalWeight += canary.Weight
+	}
+	if totalWeight > maxFlowCanaryWeight {
+		return stacktrace.NewError("The canaries of the flows send %d%% of the baseline traffic, more than %d%%", totalWeight, maxFlowCanaryWeight)
+	}
+	return nil
+}
+
+// GetFlowCanaries returns the canaries of the active flows sorted by flow ID, the weights above the total allowed are
+// ignored so the baseline is never left with a negative weight
+func (clusterTopology *ClusterTopology) GetFlowCanaries(activeFlowIDs []string) []FlowCanaryEntry {
+	flowIDs := lo.Filter(lo.Keys(clusterTopology.FlowCanaries), func(flowID string, _ int) bool {
+		return flowID != clusterTopology.Namespace && lo.Contains(activeFlowIDs, flowID)
+	})
+	sort.Strings(flowIDs)
+
+	entries := []FlowCanaryEntry{}
+	totalWeight := int32(0)
+	for _, flowID := range flowIDs {
+		canary := clusterTopology.FlowCanaries[flowID]
+		if totalWeight+canary.Weight > maxFlowCanaryWeight {
+			canary.Weight = 0
+		}
+		totalWeight += canary.Weight
+		entries = append(entries, FlowCanaryEntry{FlowID: flowID, Canary: canary})
+	}
+	return entries
+}
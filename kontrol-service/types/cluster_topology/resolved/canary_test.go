@@ -0,0 +1,43 @@
+package resolved
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateFlowCanaries(t *testing.T) {
+	userMatch := FlowCanaryMatch{Headers: []FlowCanaryHeaderMatch{{Name: "x-user", Value: "alice|bob", Regex: true}}}
+
+	require.NoError(t, ValidateFlowCanaries(map[string]FlowCanary{
+		"dev-flow-1": {Weight: 60},
+		"dev-flow-2": {Weight: 40, Matches: []FlowCanaryMatch{userMatch}},
+	}))
+	require.Error(t, ValidateFlowCanaries(map[string]FlowCanary{
+		"dev-flow-1": {Weight: 60},
+		"dev-flow-2": {Weight: 41},
+	}))
+
+	require.Error(t, FlowCanary{}.Validate())
+	require.Error(t, FlowCanary{Weight: 101}.Validate())
+	require.Error(t, FlowCanary{Matches: []FlowCanaryMatch{{}}}.Validate())
+	require.Error(t, FlowCanary{Matches: []FlowCanaryMatch{{Headers: []FlowCanaryHeaderMatch{{Name: "x user", Value: "alice"}}}}}.Validate())
+	require.Error(t, FlowCanary{Matches: []FlowCanaryMatch{{Headers: []FlowCanaryHeaderMatch{{Name: "x-user", Value: "(", Regex: true}}}}}.Validate())
+}
+
+func TestGetFlowCanaries(t *testing.T) {
+	topology := ClusterTopology{
+		Namespace: "prod",
+		FlowCanaries: map[string]FlowCanary{
+			"dev-flow-2": {Weight: 80},
+			"dev-flow-1": {Weight: 50},
+			"inactive":   {Weight: 10},
+		},
+	}
+
+	// the weights above 100% in total are ignored, in flow ID order
+	require.Equal(t, []FlowCanaryEntry{
+		{FlowID: "dev-flow-1", Canary: FlowCanary{Weight: 50}},
+		{FlowID: "dev-flow-2", Canary: FlowCanary{Weight: 0}},
+	}, topology.GetFlowCanaries([]string{"prod", "dev-flow-1", "dev-flow-2"}))
+}
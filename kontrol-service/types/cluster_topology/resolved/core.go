@@ -22,6 +22,12 @@ type ClusterTopology struct {
 	Services            []*Service          `json:"services"`
 	ServiceDependencies []ServiceDependency `json:"serviceDependencies"`
 	Namespace           string              `json:"namespace"`
+	// FlowCanaries are the canaries by flow ID, a flow topology only has its own
+	FlowCanaries map[string]FlowCanary `json:"flowCanaries,omitempty"`
+	// FlowMirrors are the mirrors by flow ID, a flow topology only has its own
+	FlowMirrors map[string]FlowMirror `json:"flowMirrors,omitempty"`
+	// FlowResilience are the resilience test settings by flow ID, a flow topology only has its own
+	FlowResilience map[string]FlowResilience `json:"flowResilience,omitempty"`
 }
 
 type Service struct {
@@ -62,6 +68,10 @@ type IngressAccessEntry struct {
 	Service       string `json:"service"`
 	Namespace     string `json:"namespace"`
 	Type          string `json:"type"`
+	// PathPrefix is set when the flow is entered with a path prefix on the hostname
+	PathPrefix string `json:"pathPrefix,omitempty"`
+	// FlowHeader is set when the flow is entered with the flow ID in this header on the hostname
+	FlowHeader string `json:"flowHeader,omitempty"`
 }
 
 func (clusterTopology *ClusterTopology) GetServiceAndPort(serviceName string, servicePortName string) (*Service, *corev1.ServicePort, error) {
@@ -131,7 +141,7 @@ func (clusterTopology *ClusterTopology) MoveServiceToVersion(service *Service, v
 
 func ReplaceOrAddSubdomain(url string, newSubdomain string) string {
 	re := regexp.MustCompile(`^(https?://)?(([^./]+\.)?([^./]+\.[^./]+))(.*)$`)
-	return re.ReplaceAllString(url, fmt.Sprintf("${1}%s.${4}${5}", newSubdomain))
+	return re.ReplaceAllString(url, fmt.Sprintf("${1}%s.${4}${5}", DNSLabel(newSubdomain)))
 }
 
 func (service *Service) IsHTTP() bool {
@@ -142,7 +152,7 @@ func (service *Service) IsHTTP() bool {
 	return servicePort.AppProtocol != nil && *servicePort.AppProtocol == "HTTP"
 }
 
-func getIngressFlowHostMap(ingress *Ingress, namespace string) map[string][]IngressAccessEntry {
+func getIngressFlowHostMap(ingress *Ingress, namespace string, strategy FlowEntryStrategy) map[string][]IngressAccessEntry {
 	flowHostMapping := map[string][]IngressAccessEntry{}
 
 	if ingress == nil {
@@ -156,22 +166,18 @@ func getIngressFlowHostMap(ingress *Ingress, namespace string) map[string][]Ingr
 		}
 		for _, ing := range ingress.Ingresses {
 			for _, rule := range ing.Spec.Rules {
-				host := ReplaceOrAddSubdomain(rule.Host, flowID)
-
 				// Ingress is placed in the same namespace by the render
 				ns := namespace
 				if ing.Namespace != "" {
 					ns = ing.Namespace
 				}
 
-				entry := IngressAccessEntry{
-					FlowID:        flowID,
-					FlowNamespace: namespace,
-					Hostname:      host,
-					Service:       ing.Name,
-					Namespace:     ns,
-					Type:          "ingress",
-				}
+				// the baseline topology (or prod topology) flow ID and namespace are equal
+				entry := flowAccessEntry(rule.Host, flowID, namespace, IngressEntryStrategy(strategy))
+				entry.FlowNamespace = namespace
+				entry.Service = ing.Name
+				entry.Namespace = ns
+				entry.Type = "ingress"
 				flowHostMapping[flowID] = append(flowHostMapping[flowID], entry)
 			}
 		}
@@ -180,7 +186,7 @@ func getIngressFlowHostMap(ingress *Ingress, namespace string) map[string][]Ingr
 	return flowHostMapping
 }
 
-func getGatewayFlowHostMap(gw *GatewayAndRoutes, namespace string) map[string][]IngressAccessEntry {
+func getGatewayFlowHostMap(gw *GatewayAndRoutes, namespace string, strategy FlowEntryStrategy) map[string][]IngressAccessEntry {
 	flowHostMapping := map[string][]IngressAccessEntry{}
 
 	if gw == nil {
@@ -195,19 +201,16 @@ func getGatewayFlowHostMap(gw *GatewayAndRoutes, namespace string) map[string][]
 		for _, route := range gw.GatewayRoutes {
 			for _, ref := range route.ParentRefs {
 				for _, originalHost := range route.Hostnames {
-					host := ReplaceOrAddSubdomain(string(originalHost), flowID)
 					ns := "default"
 					if ref.Namespace != nil {
 						ns = string(*ref.Namespace)
 					}
-					entry := IngressAccessEntry{
-						FlowID:        flowID,
-						FlowNamespace: namespace,
-						Hostname:      host,
-						Service:       string(ref.Name),
-						Namespace:     ns,
-						Type:          "gateway",
-					}
+					// the baseline topology (or prod topology) flow ID and namespace are equal
+					entry := flowAccessEntry(string(originalHost), flowID, namespace, strategy)
+					entry.FlowNamespace = namespace
+					entry.Service = string(ref.Name)
+					entry.Namespace = ns
+					entry.Type = "gateway"
 					flowHostMapping[flowID] = append(flowHostMapping[flowID], entry)
 				}
 			}
@@ -254,10 +257,11 @@ func (service *Service) Hash() ServiceHash {
 	return ServiceHash(hashString)
 }
 
-func (clusterTopology *ClusterTopology) GetFlowHostMapping() map[string][]IngressAccessEntry {
+// GetFlowHostMapping returns the entries used to reach each flow of the topology with the given entry strategy
+func (clusterTopology *ClusterTopology) GetFlowHostMapping(strategy FlowEntryStrategy) map[string][]IngressAccessEntry {
 	flowHostMapping := map[string][]IngressAccessEntry{}
-	gatewayFlowHostMap := getGatewayFlowHostMap(clusterTopology.GatewayAndRoutes, clusterTopology.Namespace)
-	ingressFlowHostMap := getIngressFlowHostMap(clusterTopology.Ingress, clusterTopology.Namespace)
+	gatewayFlowHostMap := getGatewayFlowHostMap(clusterTopology.GatewayAndRoutes, clusterTopology.Namespace, strategy)
+	ingressFlowHostMap := getIngressFlowHostMap(clusterTopology.Ingress, clusterTopology.Namespace, strategy)
 
 	for flowID, entries := range gatewayFlowHostMap {
 		imap, found := ingressFlowHostMap[flowID]
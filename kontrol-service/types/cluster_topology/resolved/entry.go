@@ -0,0 +1,81 @@
+package resolved
+
+import (
+	"net/url"
+	"strings"
+)
+
+// FlowEntryStrategy is how the requests entering the cluster select a flow
+type FlowEntryStrategy string
+
+const (
+	// SubdomainEntryStrategy enters a flow with the flow ID as subdomain of the entry point hostnames
+	SubdomainEntryStrategy FlowEntryStrategy = "subdomain"
+	// PathPrefixEntryStrategy enters a flow with the /flows/<flow ID> path prefix, the prefix is removed before the
+	// requests reach the services
+	PathPrefixEntryStrategy FlowEntryStrategy = "path-prefix"
+	// HeaderEntryStrategy enters a flow with the flow ID in the x-kardinal-flow header or the kardinal-flow cookie, it's
+	// only supported by the gateways, the ingresses use the path prefix instead because they can't match headers
+	HeaderEntryStrategy FlowEntryStrategy = "header"
+
+	FlowHeaderName = "x-kardinal-flow"
+	FlowCookieName = "kardinal-flow"
+	// FlowQueryParamName joins a flow from a link, it's used when the flow can't be entered with a URL only
+	FlowQueryParamName = "kardinal-flow"
+	// FlowBaggageKey is the W3C baggage member carrying the flow ID when the flows are routed with the baggage header
+	FlowBaggageKey = "kardinal-flow"
+
+	flowPathPrefixBase = "/flows/"
+)
+
+// FlowPathPrefix returns the path prefix used to enter a flow with the path prefix strategy
+func FlowPathPrefix(flowID string) string {
+	return flowPathPrefixBase + flowID
+}
+
+// AddFlowPathPrefix returns the path with the flow path prefix
+func AddFlowPathPrefix(path string, flowID string) string {
+	return FlowPathPrefix(flowID) + "/" + strings.TrimPrefix(path, "/")
+}
+
+// IngressEntryStrategy returns the strategy used by the ingresses, which can't match headers
+func IngressEntryStrategy(strategy FlowEntryStrategy) FlowEntryStrategy {
+	if strategy == HeaderEntryStrategy {
+		return PathPrefixEntryStrategy
+	}
+	return strategy
+}
+
+// flowAccessEntry returns the entry used to reach the flow through an entry point serving the hostname, the baseline
+// flow is reached with the unchanged hostname with the path prefix and header strategies
+func flowAccessEntry(hostname string, flowID string, baselineFlowID string, strategy FlowEntryStrategy) IngressAccessEntry {
+	entry := IngressAccessEntry{
+		FlowID:   flowID,
+		Hostname: hostname,
+	}
+
+	switch strategy {
+	case PathPrefixEntryStrategy:
+		if flowID != baselineFlowID {
+			entry.PathPrefix = FlowPathPrefix(flowID)
+		}
+	case HeaderEntryStrategy:
+		if flowID != baselineFlowID {
+			entry.FlowHeader = FlowHeaderName
+		}
+	default:
+		entry.Hostname = ReplaceOrAddSubdomain(hostname, flowID)
+	}
+
+	return entry
+}
+
+// Address returns the hostname and path used to enter the flow, a flow entered with the flow header gets the flow query
+// parameter which is matched like the header by the gateway routes, so the address can be opened as is
+func (entry IngressAccessEntry) Address() string {
+	address := entry.Hostname + entry.PathPrefix
+	if entry.FlowHeader != "" {
+		address += "/?" + url.Values{FlowQueryParamName: []string{entry.FlowID}}.Encode()
+	}
+	return address
+}
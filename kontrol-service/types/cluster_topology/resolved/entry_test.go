@@ -0,0 +1,47 @@
+package resolved
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlowAccessEntry(t *testing.T) {
+	entry := flowAccessEntry("app.kardinal.dev", "dev-flow", "prod", SubdomainEntryStrategy)
+	require.Equal(t, "dev-flow.kardinal.dev", entry.Hostname)
+	require.Empty(t, entry.PathPrefix)
+	require.Empty(t, entry.FlowHeader)
+
+	entry = flowAccessEntry("app.kardinal.dev", "dev-flow", "prod", PathPrefixEntryStrategy)
+	require.Equal(t, "app.kardinal.dev", entry.Hostname)
+	require.Equal(t, "/flows/dev-flow", entry.PathPrefix)
+
+	entry = flowAccessEntry("app.kardinal.dev", "dev-flow", "prod", HeaderEntryStrategy)
+	require.Equal(t, "app.kardinal.dev", entry.Hostname)
+	require.Equal(t, FlowHeaderName, entry.FlowHeader)
+
+	// the baseline is reached with the unchanged hostname
+	entry = flowAccessEntry("app.kardinal.dev", "prod", "prod", PathPrefixEntryStrategy)
+	require.Equal(t, "app.kardinal.dev", entry.Hostname)
+	require.Empty(t, entry.PathPrefix)
+}
+
+func TestIngressAccessEntryAddress(t *testing.T) {
+	entry := flowAccessEntry("app.kardinal.dev", "dev-flow", "prod", SubdomainEntryStrategy)
+	require.Equal(t, "dev-flow.kardinal.dev", entry.Address())
+
+	entry = flowAccessEntry("app.kardinal.dev", "dev-flow", "prod", PathPrefixEntryStrategy)
+	require.Equal(t, "app.kardinal.dev/flows/dev-flow", entry.Address())
+
+	entry = flowAccessEntry("app.kardinal.dev", "dev-flow", "prod", HeaderEntryStrategy)
+	require.Equal(t, "app.kardinal.dev/?kardinal-flow=dev-flow", entry.Address())
+
+	entry = flowAccessEntry("app.kardinal.dev", "prod", "prod", HeaderEntryStrategy)
+	require.Equal(t, "app.kardinal.dev", entry.Address())
+}
+
+func TestAddFlowPathPrefix(t *testing.T) {
+	require.Equal(t, "/flows/dev-flow/", AddFlowPathPrefix("/", "dev-flow"))
+	require.Equal(t, "/flows/dev-flow/api/users", AddFlowPathPrefix("/api/users", "dev-flow"))
+	require.Equal(t, "/flows/dev-flow/api", AddFlowPathPrefix("api", "dev-flow"))
+}
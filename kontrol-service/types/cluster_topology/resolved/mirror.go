@@ -0,0 +1,91 @@
+package resolved
+
+import (
+	"slices"
+	"sort"
+
+	"github.com/kurtosis-tech/stacktrace"
+	"github.com/samber/lo"
+)
+
+// FlowMirror mirrors part of the baseline requests of some services to their flow versions, the responses of the
+// mirrored requests are discarded and the writes go to the isolated stateful dependencies of the flow
+type FlowMirror struct {
+	// Percentage is the percentage of the baseline requests mirrored, from 0 (excluded) to 100
+	Percentage float64 `json:"percentage"`
+	// Services are the IDs of the mirrored services, they must have their own version in the flow
+	Services []string `json:"services"`
+}
+
+// FlowMirrorEntry is the mirror of a flow, in the order the mirrors are rendered
+type FlowMirrorEntry struct {
+	FlowID string
+	Mirror FlowMirror
+}
+
+func (m FlowMirror) Validate() error {
+	if m.Percentage <= 0 || m.Percentage > 100 {
+		return stacktrace.NewError("The mirror percentage must be greater than 0 and at most 100, got %v", m.Percentage)
+	}
+	if len(m.Services) == 0 {
+		return stacktrace.NewError("The mirror has no services")
+	}
+	return nil
+}
+
+// GetFlowVersion returns the version of the service deployed for the flow, the shared versions are used by several
+// flows so they are not returned
+func (clusterTopology *ClusterTopology) GetFlowVersion(serviceID string, flowID string) (*Service, bool) {
+	return lo.Find(clusterTopology.Services, func(service *Service) bool {
+		return service.ServiceID == serviceID && service.Version == flowID
+	})
+}
+
+// GetStatefulDependenciesWithoutFlowVersion returns the IDs of the stateful services reached by the services, directly
+// or through other services, which have no version for the flow. The requests mirrored to the flow would write to
+// their baseline version a second time. The shared versions created for the flow are isolated from the baseline too.
+func (clusterTopology *ClusterTopology) GetStatefulDependenciesWithoutFlowVersion(serviceIDs []string, flowID string) []string {
+	dependencies := map[string][]string{}
+	for _, dependency := range clusterTopology.ServiceDependencies {
+		serviceID := dependency.Service.ServiceID
+		dependencies[serviceID] = append(dependencies[serviceID], dependency.DependsOnService.ServiceID)
+	}
+
+	reached := map[string]bool{}
+	toVisit := slices.Clone(serviceIDs)
+	for len(toVisit) > 0 {
+		serviceID := toVisit[0]
+		toVisit = toVisit[1:]
+		if reached[serviceID] {
+			continue
+		}
+		reached[serviceID] = true
+		toVisit = append(toVisit, dependencies[serviceID]...)
+	}
+
+	var missing []string
+	for serviceID := range reached {
+		versions := lo.Filter(clusterTopology.Services, func(service *Service, _ int) bool { return service.ServiceID == serviceID })
+		isStateful := lo.SomeBy(versions, func(service *Service) bool { return service.IsStateful })
+		hasFlowVersion := lo.SomeBy(versions, func(service *Service) bool {
+			return service.Version == flowID || (service.IsShared && service.OriginalVersionIfShared == flowID)
+		})
+		if isStateful && !hasFlowVersion {
+			missing = append(missing, serviceID)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// GetFlowMirrors returns the mirrors of the flows sorted by flow ID
+func (clusterTopology *ClusterTopology) GetFlowMirrors() []FlowMirrorEntry {
+	flowIDs := lo.Filter(lo.Keys(clusterTopology.FlowMirrors), func(flowID string, _ int) bool {
+		return flowID != clusterTopology.Namespace
+	})
+	sort.Strings(flowIDs)
+
+	return lo.Map(flowIDs, func(flowID string, _ int) FlowMirrorEntry {
+		return FlowMirrorEntry{FlowID: flowID, Mirror: clusterTopology.FlowMirrors[flowID]}
+	})
+}
@@ -0,0 +1,74 @@
+package resolved
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateFlowMirror(t *testing.T) {
+	require.NoError(t, FlowMirror{Percentage: 0.5, Services: []string{"frontend"}}.Validate())
+	require.NoError(t, FlowMirror{Percentage: 100, Services: []string{"frontend"}}.Validate())
+
+	require.Error(t, FlowMirror{Percentage: 0, Services: []string{"frontend"}}.Validate())
+	require.Error(t, FlowMirror{Percentage: 100.5, Services: []string{"frontend"}}.Validate())
+	require.Error(t, FlowMirror{Percentage: 10}.Validate())
+}
+
+func TestGetFlowMirrors(t *testing.T) {
+	topology := ClusterTopology{
+		Namespace: "prod",
+		Services: []*Service{
+			{ServiceID: "frontend", Version: "prod"},
+			{ServiceID: "frontend", Version: "dev-flow-1"},
+			{ServiceID: "cartservice", Version: "shared", IsShared: true, OriginalVersionIfShared: "dev-flow-1"},
+		},
+		FlowMirrors: map[string]FlowMirror{
+			"dev-flow-2": {Percentage: 20, Services: []string{"frontend"}},
+			"dev-flow-1": {Percentage: 10, Services: []string{"frontend"}},
+			"prod":       {Percentage: 10, Services: []string{"frontend"}},
+		},
+	}
+
+	require.Equal(t, []FlowMirrorEntry{
+		{FlowID: "dev-flow-1", Mirror: FlowMirror{Percentage: 10, Services: []string{"frontend"}}},
+		{FlowID: "dev-flow-2", Mirror: FlowMirror{Percentage: 20, Services: []string{"frontend"}}},
+	}, topology.GetFlowMirrors())
+
+	_, found := topology.GetFlowVersion("frontend", "dev-flow-1")
+	require.True(t, found)
+	// the shared versions are used by several flows
+	_, found = topology.GetFlowVersion("cartservice", "dev-flow-1")
+	require.False(t, found)
+}
+
+func TestGetStatefulDependenciesWithoutFlowVersion(t *testing.T) {
+	frontend := &Service{ServiceID: "frontend", Version: "prod"}
+	cart := &Service{ServiceID: "cartservice", Version: "prod"}
+	postgres := &Service{ServiceID: "postgres", Version: "prod", IsStateful: true}
+	redis := &Service{ServiceID: "redis", Version: "prod", IsStateful: true}
+	topology := ClusterTopology{
+		Namespace: "prod",
+		Services: []*Service{
+			frontend,
+			{ServiceID: "frontend", Version: "dev-flow-1"},
+			cart,
+			postgres,
+			{ServiceID: "postgres", Version: "dev-flow-1", IsStateful: true},
+			redis,
+		},
+		ServiceDependencies: []ServiceDependency{
+			{Service: frontend, DependsOnService: cart},
+			{Service: cart, DependsOnService: postgres},
+			{Service: cart, DependsOnService: redis},
+		},
+	}
+
+	// redis is reached through the baseline version of the cart service
+	require.Equal(t, []string{"redis"}, topology.GetStatefulDependenciesWithoutFlowVersion([]string{"frontend"}, "dev-flow-1"))
+	require.Equal(t, []string{"postgres", "redis"}, topology.GetStatefulDependenciesWithoutFlowVersion([]string{"frontend"}, "dev-flow-2"))
+
+	// a shared version created for the flow is isolated from the baseline
+	topology.Services = append(topology.Services, &Service{ServiceID: "redis", Version: "shared", IsStateful: true, IsShared: true, OriginalVersionIfShared: "dev-flow-1"})
+	require.Empty(t, topology.GetStatefulDependenciesWithoutFlowVersion([]string{"frontend"}, "dev-flow-1"))
+}
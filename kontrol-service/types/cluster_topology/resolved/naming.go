@@ -0,0 +1,53 @@
+package resolved
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// MaxDNSLabelLength is the maximum length of a DNS-1123 label, which is also the limit for k8s Service names,
+	// label values and hostname subdomains
+	MaxDNSLabelLength = 63
+
+	nameHashLength = 8
+
+	// hashedLabelPrefix starts the hashed labels which would otherwise start with a digit, DNS-1035 labels (k8s
+	// Service names) must start with a letter
+	hashedLabelPrefix = "k"
+)
+
+var invalidDNSLabelCharsRegex = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// DNSLabel joins the name parts with '-' and returns a valid DNS-1123 label
+// Names that are already valid labels are returned unchanged, otherwise the name is sanitized, truncated and suffixed
+// with a hash of the original name so different inputs can't collide after truncation, and it starts with a letter
+// The result is deterministic so every place deriving a name from the same parts (k8s resources, routing headers,
+// Lua scripts) gets the same value
+func DNSLabel(parts ...string) string {
+	name := strings.Join(parts, "-")
+
+	sanitized := invalidDNSLabelCharsRegex.ReplaceAllString(strings.ToLower(name), "-")
+	sanitized = strings.Trim(sanitized, "-")
+	if sanitized == name && len(name) <= MaxDNSLabelLength {
+		return name
+	}
+
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))[:nameHashLength]
+	if sanitized == "" || sanitized[0] < 'a' || sanitized[0] > 'z' {
+		sanitized = hashedLabelPrefix + sanitized
+	}
+	maxPrefixLength := MaxDNSLabelLength - nameHashLength - 1
+	if len(sanitized) > maxPrefixLength {
+		sanitized = strings.TrimRight(sanitized[:maxPrefixLength], "-")
+	}
+	return sanitized + "-" + hash
+}
+
+// VersionedName returns the name used for a version of a service, e.g. the workload and versioned service names and
+// the x-kardinal-destination header values
+func VersionedName(serviceID string, version string) string {
+	return DNSLabel(serviceID, version)
+}
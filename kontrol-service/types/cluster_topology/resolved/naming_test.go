@@ -0,0 +1,54 @@
+package resolved
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestDNSLabelKeepsValidNames(t *testing.T) {
+	require.Equal(t, "frontend-dev-flow-1", DNSLabel("frontend", "dev-flow-1"))
+	require.Equal(t, "cartservice-baseline", VersionedName("cartservice", "baseline"))
+}
+
+func TestDNSLabelTruncatesLongNames(t *testing.T) {
+	longFlowID := strings.Repeat("a", 60)
+
+	name := VersionedName("productcatalogservice", longFlowID)
+	require.Len(t, name, MaxDNSLabelLength)
+	require.Empty(t, validation.IsDNS1123Label(name))
+	require.True(t, strings.HasPrefix(name, "productcatalogservice-aaa"))
+
+	// deterministic
+	require.Equal(t, name, VersionedName("productcatalogservice", longFlowID))
+
+	// names sharing the same truncated prefix don't collide
+	otherName := VersionedName("productcatalogservice", longFlowID+"b")
+	require.NotEqual(t, name, otherName)
+}
+
+func TestDNSLabelSanitizesInvalidCharacters(t *testing.T) {
+	name := DNSLabel("Frontend", "my_flow.1")
+	require.Empty(t, validation.IsDNS1123Label(name))
+	require.True(t, strings.HasPrefix(name, "frontend-my-flow-1-"))
+	require.NotEqual(t, name, DNSLabel("frontend", "my-flow-1"))
+}
+
+func TestReplaceOrAddSubdomainUsesDNSLabel(t *testing.T) {
+	require.Equal(t, "dev-flow.kardinal.dev", ReplaceOrAddSubdomain("app.kardinal.dev", "dev-flow"))
+
+	host := ReplaceOrAddSubdomain("app.kardinal.dev", strings.Repeat("x", 70))
+	subdomain := strings.Split(host, ".")[0]
+	require.Len(t, subdomain, MaxDNSLabelLength)
+	require.True(t, strings.HasSuffix(host, ".kardinal.dev"))
+}
+
+func TestDNSLabelHashedNamesStartWithALetter(t *testing.T) {
+	for _, name := range []string{"___", "1-flow_", "-_-"} {
+		label := DNSLabel(name)
+		require.Empty(t, validation.IsDNS1035Label(label), label)
+	}
+	require.NotEqual(t, DNSLabel("___"), DNSLabel("-_-"))
+}
@@ -1,8 +1,55 @@
 package resolved
 
+import (
+	"sort"
+	"time"
+
+	"github.com/kurtosis-tech/stacktrace"
+)
+
 type StatefulPlugin struct {
 	Name        string            `json:"name"`
 	Type        string            `json:"type"`
 	ServiceName string            `json:"servicename"`
 	Args        map[string]string `json:"args"`
+	// Timeout is the maximum duration of the create_flow and delete_flow calls of the plugin, e.g. "1m", the server
+	// timeout is used when it's empty or longer
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// GetTimeout returns the timeout of the plugin calls, 0 when the server timeout is used, the plugin runner caps it with
+// the server timeout
+func (plugin *StatefulPlugin) GetTimeout() (time.Duration, error) {
+	if plugin.Timeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(plugin.Timeout)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "Invalid timeout '%s' for plugin '%s'", plugin.Timeout, plugin.ServiceName)
+	}
+	if timeout <= 0 {
+		return 0, stacktrace.NewError("The timeout of plugin '%s' must be positive, got '%s'", plugin.ServiceName, plugin.Timeout)
+	}
+	return timeout, nil
+}
+
+// GetPlugins returns the plugins used by the services of the topology, each plugin once, sorted by name
+func (clusterTopology *ClusterTopology) GetPlugins() []*StatefulPlugin {
+	pluginsByName := map[string]*StatefulPlugin{}
+	for _, service := range clusterTopology.Services {
+		for _, plugin := range service.StatefulPlugins {
+			if _, found := pluginsByName[plugin.Name]; !found {
+				pluginsByName[plugin.Name] = plugin
+			}
+		}
+	}
+
+	plugins := make([]*StatefulPlugin, 0, len(pluginsByName))
+	for _, plugin := range pluginsByName {
+		plugins = append(plugins, plugin)
+	}
+	sort.Slice(plugins, func(i, j int) bool {
+		return plugins[i].Name < plugins[j].Name
+	})
+	return plugins
 }
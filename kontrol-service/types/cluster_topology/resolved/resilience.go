@@ -0,0 +1,122 @@
+package resolved
+
+import (
+	"time"
+
+	"github.com/kurtosis-tech/stacktrace"
+)
+
+// FlowResilience are the resilience test settings of the services of a flow by service ID, they only apply to the
+// versions of the services deployed for the flow
+type FlowResilience map[string]ServiceResilience
+
+// ServiceResilience injects faults in the requests sent to a service and sets their timeout and retry policy, the
+// durations use the Go format, e.g. "1.5s"
+type ServiceResilience struct {
+	// Delay delays a percentage of the requests before sending them to the service
+	Delay *FaultDelay `json:"delay,omitempty"`
+	// Abort answers a percentage of the requests with an HTTP error instead of sending them to the service
+	Abort *FaultAbort `json:"abort,omitempty"`
+	// Timeout is the timeout of the requests, including the retries
+	Timeout string `json:"timeout,omitempty"`
+	// Retries is the retry policy of the failed requests
+	Retries *RetryPolicy `json:"retries,omitempty"`
+}
+
+type FaultDelay struct {
+	FixedDelay string  `json:"fixedDelay"`
+	Percentage float64 `json:"percentage"`
+}
+
+type FaultAbort struct {
+	HTTPStatus int32   `json:"httpStatus"`
+	Percentage float64 `json:"percentage"`
+}
+
+type RetryPolicy struct {
+	Attempts int32 `json:"attempts"`
+	// PerTryTimeout is the timeout of each attempt, the request timeout is used by default
+	PerTryTimeout string `json:"perTryTimeout,omitempty"`
+	// RetryOn are the Envoy retry conditions separated by commas, e.g. "5xx,connect-failure"
+	RetryOn string `json:"retryOn,omitempty"`
+}
+
+func (r FlowResilience) Validate() error {
+	for serviceID, resilience := range r {
+		if err := resilience.Validate(); err != nil {
+			return stacktrace.Propagate(err, "Invalid resilience settings for service '%s'", serviceID)
+		}
+	}
+	return nil
+}
+
+func (r ServiceResilience) Validate() error {
+	if r.Delay == nil && r.Abort == nil && r.Timeout == "" && r.Retries == nil {
+		return stacktrace.NewError("The resilience settings have no delay, abort, timeout or retries")
+	}
+	if r.Delay != nil {
+		if _, err := ParseResilienceDuration(r.Delay.FixedDelay); err != nil {
+			return stacktrace.Propagate(err, "Invalid fixed delay")
+		}
+		if err := validateFaultPercentage(r.Delay.Percentage); err != nil {
+			return stacktrace.Propagate(err, "Invalid delay percentage")
+		}
+	}
+	if r.Abort != nil {
+		if r.Abort.HTTPStatus < 200 || r.Abort.HTTPStatus > 599 {
+			return stacktrace.NewError("The abort HTTP status must be between 200 and 599, got %d", r.Abort.HTTPStatus)
+		}
+		if err := validateFaultPercentage(r.Abort.Percentage); err != nil {
+			return stacktrace.Propagate(err, "Invalid abort percentage")
+		}
+	}
+	if r.Timeout != "" {
+		if _, err := ParseResilienceDuration(r.Timeout); err != nil {
+			return stacktrace.Propagate(err, "Invalid timeout")
+		}
+	}
+	if r.Retries != nil {
+		if r.Retries.Attempts < 0 {
+			return stacktrace.NewError("The retry attempts can't be negative, got %d", r.Retries.Attempts)
+		}
+		if r.Retries.PerTryTimeout != "" {
+			if _, err := ParseResilienceDuration(r.Retries.PerTryTimeout); err != nil {
+				return stacktrace.Propagate(err, "Invalid per try timeout")
+			}
+		}
+	}
+	return nil
+}
+
+// ParseResilienceDuration parses a duration of the resilience settings, which must be positive
+func ParseResilienceDuration(duration string) (time.Duration, error) {
+	parsed, err := time.ParseDuration(duration)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "Invalid duration '%s'", duration)
+	}
+	if parsed <= 0 {
+		return 0, stacktrace.NewError("The duration must be positive, got '%s'", duration)
+	}
+	return parsed, nil
+}
+
+func validateFaultPercentage(percentage float64) error {
+	if percentage <= 0 || percentage > 100 {
+		return stacktrace.NewError("The percentage must be greater than 0 and at most 100, got %v", percentage)
+	}
+	return nil
+}
+
+// GetServiceResilience returns the resilience settings of the flow versions of the service by flow ID
+func (clusterTopology *ClusterTopology) GetServiceResilience(serviceID string) map[string]ServiceResilience {
+	serviceResilience := map[string]ServiceResilience{}
+	for flowID, flowResilience := range clusterTopology.FlowResilience {
+		if flowID == clusterTopology.Namespace {
+			continue
+		}
+		if resilience, found := flowResilience[serviceID]; found {
+			serviceResilience[flowID] = resilience
+		}
+	}
+	return serviceResilience
+}
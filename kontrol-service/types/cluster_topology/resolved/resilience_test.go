@@ -0,0 +1,39 @@
+package resolved
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateFlowResilience(t *testing.T) {
+	require.NoError(t, FlowResilience{
+		"payments": {
+			Delay:   &FaultDelay{FixedDelay: "2s", Percentage: 50},
+			Abort:   &FaultAbort{HTTPStatus: 503, Percentage: 10},
+			Timeout: "5s",
+			Retries: &RetryPolicy{Attempts: 3, PerTryTimeout: "1500ms", RetryOn: "5xx"},
+		},
+	}.Validate())
+
+	require.Error(t, ServiceResilience{}.Validate())
+	require.Error(t, ServiceResilience{Delay: &FaultDelay{FixedDelay: "2 seconds", Percentage: 50}}.Validate())
+	require.Error(t, ServiceResilience{Delay: &FaultDelay{FixedDelay: "2s", Percentage: 0}}.Validate())
+	require.Error(t, ServiceResilience{Abort: &FaultAbort{HTTPStatus: 99, Percentage: 10}}.Validate())
+	require.Error(t, ServiceResilience{Timeout: "-1s"}.Validate())
+	require.Error(t, ServiceResilience{Retries: &RetryPolicy{Attempts: -1}}.Validate())
+}
+
+func TestGetServiceResilience(t *testing.T) {
+	topology := ClusterTopology{
+		Namespace: "prod",
+		FlowResilience: map[string]FlowResilience{
+			"dev-flow-1": {"payments": {Timeout: "1s"}},
+			"dev-flow-2": {"frontend": {Timeout: "2s"}},
+			"prod":       {"payments": {Timeout: "3s"}},
+		},
+	}
+
+	require.Equal(t, map[string]ServiceResilience{"dev-flow-1": {Timeout: "1s"}}, topology.GetServiceResilience("payments"))
+	require.Empty(t, topology.GetServiceResilience("cartservice"))
+}
@@ -15,6 +15,9 @@ const (
 	namespaceKind       = "Namespace"
 	istioLabel          = "istio-injection"
 	enabledIstioValue   = "enabled"
+	dataplaneModeLabel  = "istio.io/dataplane-mode"
+	ambientModeValue    = "ambient"
+	useWaypointLabel    = "istio.io/use-waypoint"
 )
 
 type ClusterResources struct {
@@ -28,19 +31,34 @@ type ClusterResources struct {
 	Gateways              []gateway.Gateway                     `json:"gateways"`
 	HTTPRoutes            []gateway.HTTPRoute                   `json:"http_routes"`
 	Ingresses             []net.Ingress                         `json:"ingresses"`
+	NetworkPolicies       []net.NetworkPolicy                   `json:"network_policies"`
+	Certificates          []Certificate                         `json:"certificates"`
 }
 
-func NewNamespaceWithIstioEnabled(namespaceName string) *corev1.Namespace {
+func NewNamespace(namespaceName string) *corev1.Namespace {
 	return &corev1.Namespace{
 		TypeMeta: metav1.TypeMeta{
 			APIVersion: namespaceApiVersion,
 			Kind:       namespaceKind,
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name: namespaceName,
-			Labels: map[string]string{
-				istioLabel: enabledIstioValue,
-			},
+			Name:   namespaceName,
+			Labels: map[string]string{},
 		},
 	}
 }
+
+func NewNamespaceWithIstioEnabled(namespaceName string) *corev1.Namespace {
+	namespace := NewNamespace(namespaceName)
+	namespace.Labels[istioLabel] = enabledIstioValue
+	return namespace
+}
+
+// NewNamespaceWithIstioAmbientEnabled returns a namespace enrolled in the Istio ambient mesh, the traffic to its
+// services goes through the given waypoint proxy
+func NewNamespaceWithIstioAmbientEnabled(namespaceName string, waypointName string) *corev1.Namespace {
+	namespace := NewNamespace(namespaceName)
+	namespace.Labels[dataplaneModeLabel] = ambientModeValue
+	namespace.Labels[useWaypointLabel] = waypointName
+	return namespace
+}
@@ -0,0 +1,380 @@
+package settings
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/kurtosis-tech/stacktrace"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+)
+
+type RendererType string
+
+const (
+	// IstioRenderer renders VirtualServices, DestinationRules and Lua EnvoyFilters, it requires the Istio sidecars
+	IstioRenderer RendererType = "istio"
+	// GatewayAPIRenderer renders Gateway API HTTPRoutes with header matches and per version Services only
+	GatewayAPIRenderer RendererType = "gateway-api"
+)
+
+type IstioDataplaneMode string
+
+const (
+	// SidecarDataplaneMode runs the routing filters in the sidecar injected in every pod
+	SidecarDataplaneMode IstioDataplaneMode = "sidecar"
+	// AmbientDataplaneMode runs the routing filters in the waypoint proxy of the namespace
+	AmbientDataplaneMode IstioDataplaneMode = "ambient"
+
+	defaultWaypointName = "waypoint"
+
+	// DefaultTraceIDHeader is the canonical header carrying the trace ID of a request between the services
+	DefaultTraceIDHeader = "x-kardinal-trace-id"
+
+	IssuerKind        = "Issuer"
+	ClusterIssuerKind = "ClusterIssuer"
+)
+
+// DefaultTraceHeaderPriorities are the headers a trace ID is read from, in order, when a request doesn't carry the
+// canonical trace ID header
+var DefaultTraceHeaderPriorities = []string{
+	"x-b3-traceid",          // Zipkin B3
+	"x-request-id",          // General request ID, often used for tracing
+	"x-cloud-trace-context", // Google Cloud Trace
+	"x-amzn-trace-id",       // AWS X-Ray
+	"traceparent",           // W3C Trace Context
+	"uber-trace-id",         // Jaeger
+	"x-datadog-trace-id",    // Datadog
+}
+
+type FlowRoutingMode string
+
+const (
+	// TraceRouterRoutingMode stores the flow of each trace in the trace router when the request enters the flow, the
+	// outbound filters ask it for the destination of every request
+	TraceRouterRoutingMode FlowRoutingMode = "trace-router"
+	// FlowHeaderRoutingMode writes the flow ID in the x-kardinal-flow header when the request enters the flow, the
+	// outbound filters find the destination from that header without calling the trace router, it requires the
+	// services to propagate the header
+	FlowHeaderRoutingMode FlowRoutingMode = "flow-header"
+	// BaggageRoutingMode is the flow header mode with the flow ID in the W3C baggage header, which is already
+	// propagated by the services instrumented with OpenTelemetry
+	BaggageRoutingMode FlowRoutingMode = "baggage"
+)
+
+type TraceRouterFallback string
+
+const (
+	// BaselineTraceRouterFallback sends the requests to the baseline when the trace router can't be reached
+	BaselineTraceRouterFallback TraceRouterFallback = "baseline"
+	// RejectTraceRouterFallback fails the requests with a 503 when the trace router can't be reached, so they never
+	// end up in the baseline by mistake
+	RejectTraceRouterFallback TraceRouterFallback = "reject"
+)
+
+// defaultTraceRouter is the trace router location used when neither the server nor the tenant set one
+var defaultTraceRouter = TraceRouterSettings{
+	Namespace: "default",
+	Service:   "trace-router",
+	Port:      8080,
+	TimeoutMs: 5000,
+	Fallback:  BaselineTraceRouterFallback,
+}
+
+type TraceIDMode string
+
+const (
+	// EntryTraceIDMode generates a trace ID for the requests entering the cluster through a gateway or an ingress,
+	// the requests sent by the services without a trace ID are rejected
+	EntryTraceIDMode TraceIDMode = "entry"
+	// EdgeTraceIDMode also generates a trace ID for the requests sent by the services targeted by a gateway or an
+	// ingress, e.g. when they call other services on webhooks or scheduled jobs, the inner services stay strict
+	EdgeTraceIDMode TraceIDMode = "edge"
+	// StrictTraceIDMode rejects every request without a trace ID, including the ones entering the cluster
+	StrictTraceIDMode TraceIDMode = "strict"
+)
+
+// TenantSettings are the per tenant options used when rendering the cluster resources of the tenant
+// Zero values are replaced by the defaults so new settings can be added without migrating the stored ones
+type TenantSettings struct {
+	Renderer RendererType `json:"renderer"`
+
+	FlowEntryStrategy resolved.FlowEntryStrategy `json:"flowEntryStrategy"`
+	StickyFlowCookie  StickyFlowCookieSettings   `json:"stickyFlowCookie"`
+
+	// FlowRoutingMode is only used by the Istio renderer, the Gateway API renderer always routes on the flow header
+	FlowRoutingMode FlowRoutingMode `json:"flowRoutingMode"`
+
+	// IstioDataplaneMode and WaypointName are only used by the Istio renderer
+	IstioDataplaneMode IstioDataplaneMode `json:"istioDataplaneMode"`
+	WaypointName       string             `json:"waypointName"`
+
+	// AuthorizationPolicies renders the Istio policies denying the requests without a trace ID
+	AuthorizationPolicies bool `json:"authorizationPolicies"`
+	// StatefulFlowIsolation renders NetworkPolicies so the flow versions of stateful services only accept traffic
+	// from the pods of the same flow, the manager API has no field for them yet so they are only in the manifest
+	StatefulFlowIsolation bool `json:"statefulFlowIsolation"`
+
+	FlowTLS FlowTLSSettings `json:"flowTLS"`
+
+	TraceID TraceIDSettings `json:"traceID"`
+
+	// TraceRouter overrides the server trace router settings, the zero values are replaced by the server ones when
+	// rendering, see GetTraceRouter
+	TraceRouter TraceRouterSettings `json:"traceRouter"`
+
+	// serverTraceRouter is the trace router configured on the server, it's not stored with the tenant settings and is
+	// set with WithServerTraceRouter after loading them
+	serverTraceRouter TraceRouterSettings
+}
+
+// TraceRouterSettings locate the trace router called by the Lua filters to store and read the routing table of the
+// traces, and configure what the filters do when it can't be reached
+type TraceRouterSettings struct {
+	Namespace string              `json:"namespace,omitempty"`
+	Service   string              `json:"service,omitempty"`
+	Port      uint16              `json:"port,omitempty"`
+	TimeoutMs uint32              `json:"timeoutMs,omitempty"`
+	Fallback  TraceRouterFallback `json:"fallback,omitempty"`
+}
+
+// Host returns the cluster local hostname of the trace router service
+func (s TraceRouterSettings) Host() string {
+	return fmt.Sprintf("%s.%s.svc.cluster.local", s.Service, s.Namespace)
+}
+
+func (s TraceRouterSettings) withDefaults(defaults TraceRouterSettings) TraceRouterSettings {
+	if s.Namespace == "" {
+		s.Namespace = defaults.Namespace
+	}
+	if s.Service == "" {
+		s.Service = defaults.Service
+	}
+	if s.Port == 0 {
+		s.Port = defaults.Port
+	}
+	if s.TimeoutMs == 0 {
+		s.TimeoutMs = defaults.TimeoutMs
+	}
+	if s.Fallback == "" {
+		s.Fallback = defaults.Fallback
+	}
+	return s
+}
+
+func (s TraceRouterSettings) validate() error {
+	if len(validation.IsDNS1123Label(s.Namespace)) > 0 {
+		return stacktrace.NewError("trace router namespace '%s' is not a valid namespace name", s.Namespace)
+	}
+	if len(validation.IsDNS1035Label(s.Service)) > 0 {
+		return stacktrace.NewError("trace router service '%s' is not a valid service name", s.Service)
+	}
+	switch s.Fallback {
+	case BaselineTraceRouterFallback, RejectTraceRouterFallback:
+	default:
+		return stacktrace.NewError("unknown trace router fallback '%s', the supported fallbacks are '%s' and '%s'", s.Fallback, BaselineTraceRouterFallback, RejectTraceRouterFallback)
+	}
+	return nil
+}
+
+// NewServerTraceRouter returns the trace router settings used by the tenants not overriding them, the zero values
+// keep the built-in defaults
+func NewServerTraceRouter(traceRouter TraceRouterSettings) (TraceRouterSettings, error) {
+	traceRouter = traceRouter.withDefaults(defaultTraceRouter)
+	if err := traceRouter.validate(); err != nil {
+		return TraceRouterSettings{}, stacktrace.Propagate(err, "Invalid server trace router settings")
+	}
+	return traceRouter, nil
+}
+
+// WithServerTraceRouter returns the settings completed with the trace router configured on the server
+func (s TenantSettings) WithServerTraceRouter(serverTraceRouter TraceRouterSettings) TenantSettings {
+	s.serverTraceRouter = serverTraceRouter
+	return s
+}
+
+// GetTraceRouter returns the trace router settings of the tenant, completed with the server ones
+func (s TenantSettings) GetTraceRouter() TraceRouterSettings {
+	return s.TraceRouter.withDefaults(s.serverTraceRouter.withDefaults(defaultTraceRouter))
+}
+
+// TraceIDSettings configure where a trace ID is generated for the requests that don't carry one
+type TraceIDSettings struct {
+	Mode TraceIDMode `json:"mode"`
+	// Traceparent adds a W3C traceparent header with the generated trace ID when the request has none
+	Traceparent bool `json:"traceparent"`
+	// Header is the canonical header set by the filters with the trace ID found or generated for a request
+	Header string `json:"header"`
+	// HeaderPriorities replace the default list of headers a trace ID is read from, e.g. to use a x-correlation-id
+	// header set by the tenant applications, the canonical header is always read first
+	HeaderPriorities []string `json:"headerPriorities"`
+}
+
+// TraceHeaders returns the headers a trace ID is read from in priority order, starting with the canonical header
+func (s TraceIDSettings) TraceHeaders() []string {
+	headers := []string{s.Header}
+	for _, header := range s.HeaderPriorities {
+		if !slices.Contains(headers, header) {
+			headers = append(headers, header)
+		}
+	}
+	return headers
+}
+
+// StickyFlowCookieSettings configure the kardinal-flow cookie pinning a browser session to the flow it entered, the
+// requests carrying the cookie are sent to the flow whatever their hostname is, it's a Secure cookie so the browsers
+// only keep it for the hostnames served with HTTPS (and localhost)
+type StickyFlowCookieSettings struct {
+	Enabled bool `json:"enabled"`
+	// Domain of the cookie, it has to be a parent domain of the entry point hostnames for the cookie to be sent to all of them
+	Domain string `json:"domain"`
+}
+
+// FlowTLSSettings configure how the hostnames created for the flows are covered by TLS, they are needed when the
+// gateway and ingress certificates don't have a wildcard for the flow subdomains
+type FlowTLSSettings struct {
+	// CertManagerIssuer renders a cert-manager Certificate for the hostnames of each flow entry point when set, like
+	// the network policies they are only in the manifest
+	CertManagerIssuer     string `json:"certManagerIssuer"`
+	CertManagerIssuerKind string `json:"certManagerIssuerKind"`
+	// GatewayListeners adds an HTTPS listener for each flow hostname to the Kardinal gateways, the listeners use the
+	// secrets of the cert-manager Certificates or secrets with the same names created by other means
+	GatewayListeners bool `json:"gatewayListeners"`
+}
+
+func NewDefaultTenantSettings() TenantSettings {
+	return TenantSettings{
+		Renderer:           IstioRenderer,
+		FlowEntryStrategy:  resolved.SubdomainEntryStrategy,
+		FlowRoutingMode:    TraceRouterRoutingMode,
+		IstioDataplaneMode: SidecarDataplaneMode,
+		WaypointName:       defaultWaypointName,
+		FlowTLS: FlowTLSSettings{
+			CertManagerIssuerKind: ClusterIssuerKind,
+		},
+		TraceID: TraceIDSettings{
+			Mode:             EntryTraceIDMode,
+			Header:           DefaultTraceIDHeader,
+			HeaderPriorities: slices.Clone(DefaultTraceHeaderPriorities),
+		},
+	}
+}
+
+// ParseTenantSettings decodes the settings stored for a tenant, empty values are filled with the defaults
+func ParseTenantSettings(settingsJson []byte) (TenantSettings, error) {
+	tenantSettings := NewDefaultTenantSettings()
+	if len(settingsJson) == 0 {
+		return tenantSettings, nil
+	}
+
+	err := json.Unmarshal(settingsJson, &tenantSettings)
+	if err != nil {
+		return tenantSettings, stacktrace.Propagate(err, "An error occurred decoding the tenant settings")
+	}
+	tenantSettings.applyDefaults()
+
+	if err = tenantSettings.Validate(); err != nil {
+		return tenantSettings, err
+	}
+
+	return tenantSettings, nil
+}
+
+func (s *TenantSettings) Validate() error {
+	switch s.Renderer {
+	case IstioRenderer, GatewayAPIRenderer:
+	default:
+		return stacktrace.NewError("unknown renderer '%s', the supported renderers are '%s' and '%s'", s.Renderer, IstioRenderer, GatewayAPIRenderer)
+	}
+
+	switch s.FlowEntryStrategy {
+	case resolved.SubdomainEntryStrategy, resolved.PathPrefixEntryStrategy, resolved.HeaderEntryStrategy:
+	default:
+		return stacktrace.NewError("unknown flow entry strategy '%s', the supported strategies are '%s', '%s' and '%s'", s.FlowEntryStrategy, resolved.SubdomainEntryStrategy, resolved.PathPrefixEntryStrategy, resolved.HeaderEntryStrategy)
+	}
+
+	switch s.FlowRoutingMode {
+	case TraceRouterRoutingMode, FlowHeaderRoutingMode, BaggageRoutingMode:
+	default:
+		return stacktrace.NewError("unknown flow routing mode '%s', the supported modes are '%s', '%s' and '%s'", s.FlowRoutingMode, TraceRouterRoutingMode, FlowHeaderRoutingMode, BaggageRoutingMode)
+	}
+
+	cookieDomain := strings.TrimPrefix(s.StickyFlowCookie.Domain, ".")
+	if cookieDomain != "" && len(validation.IsDNS1123Subdomain(cookieDomain)) > 0 {
+		return stacktrace.NewError("sticky flow cookie domain '%s' is not a valid domain", s.StickyFlowCookie.Domain)
+	}
+
+	switch s.IstioDataplaneMode {
+	case SidecarDataplaneMode, AmbientDataplaneMode:
+	default:
+		return stacktrace.NewError("unknown Istio dataplane mode '%s', the supported modes are '%s' and '%s'", s.IstioDataplaneMode, SidecarDataplaneMode, AmbientDataplaneMode)
+	}
+
+	if len(validation.IsDNS1123Label(s.WaypointName)) > 0 {
+		return stacktrace.NewError("waypoint name '%s' is not a valid DNS label", s.WaypointName)
+	}
+
+	switch s.FlowTLS.CertManagerIssuerKind {
+	case IssuerKind, ClusterIssuerKind:
+	default:
+		return stacktrace.NewError("unknown cert-manager issuer kind '%s', the supported kinds are '%s' and '%s'", s.FlowTLS.CertManagerIssuerKind, IssuerKind, ClusterIssuerKind)
+	}
+
+	switch s.TraceID.Mode {
+	case EntryTraceIDMode, EdgeTraceIDMode, StrictTraceIDMode:
+	default:
+		return stacktrace.NewError("unknown trace ID mode '%s', the supported modes are '%s', '%s' and '%s'", s.TraceID.Mode, EntryTraceIDMode, EdgeTraceIDMode, StrictTraceIDMode)
+	}
+
+	traceRouter := s.GetTraceRouter()
+	if err := traceRouter.validate(); err != nil {
+		return err
+	}
+
+	for _, header := range s.TraceID.TraceHeaders() {
+		if len(validation.IsHTTPHeaderName(header)) > 0 {
+			return stacktrace.NewError("trace header '%s' is not a valid HTTP header name", header)
+		}
+	}
+
+	return nil
+}
+
+func (s *TenantSettings) applyDefaults() {
+	defaults := NewDefaultTenantSettings()
+	if s.Renderer == "" {
+		s.Renderer = defaults.Renderer
+	}
+	if s.FlowEntryStrategy == "" {
+		s.FlowEntryStrategy = defaults.FlowEntryStrategy
+	}
+	if s.FlowRoutingMode == "" {
+		s.FlowRoutingMode = defaults.FlowRoutingMode
+	}
+	if s.IstioDataplaneMode == "" {
+		s.IstioDataplaneMode = defaults.IstioDataplaneMode
+	}
+	if s.WaypointName == "" {
+		s.WaypointName = defaults.WaypointName
+	}
+	if s.FlowTLS.CertManagerIssuerKind == "" {
+		s.FlowTLS.CertManagerIssuerKind = defaults.FlowTLS.CertManagerIssuerKind
+	}
+	if s.TraceID.Mode == "" {
+		s.TraceID.Mode = defaults.TraceID.Mode
+	}
+	if s.TraceID.Header == "" {
+		s.TraceID.Header = defaults.TraceID.Header
+	}
+	if s.TraceID.HeaderPriorities == nil {
+		s.TraceID.HeaderPriorities = defaults.TraceID.HeaderPriorities
+	}
+	// Envoy lowercases the header names, the Lua filters wouldn't find the headers configured with upper case letters
+	s.TraceID.Header = strings.ToLower(s.TraceID.Header)
+	for i, header := range s.TraceID.HeaderPriorities {
+		s.TraceID.HeaderPriorities[i] = strings.ToLower(header)
+	}
+}
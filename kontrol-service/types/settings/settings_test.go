@@ -0,0 +1,152 @@
+package settings
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"kardinal.kontrol-service/types/cluster_topology/resolved"
+)
+
+func TestParseTenantSettingsDefaults(t *testing.T) {
+	tenantSettings, err := ParseTenantSettings(nil)
+	require.NoError(t, err)
+	require.Equal(t, NewDefaultTenantSettings(), tenantSettings)
+
+	tenantSettings, err = ParseTenantSettings([]byte(`{"renderer": ""}`))
+	require.NoError(t, err)
+	require.Equal(t, IstioRenderer, tenantSettings.Renderer)
+}
+
+func TestParseTenantSettings(t *testing.T) {
+	tenantSettings, err := ParseTenantSettings([]byte(`{"renderer": "gateway-api"}`))
+	require.NoError(t, err)
+	require.Equal(t, GatewayAPIRenderer, tenantSettings.Renderer)
+	require.False(t, tenantSettings.AuthorizationPolicies)
+	require.False(t, tenantSettings.StatefulFlowIsolation)
+
+	tenantSettings, err = ParseTenantSettings([]byte(`{"authorizationPolicies": true, "statefulFlowIsolation": true}`))
+	require.NoError(t, err)
+	require.True(t, tenantSettings.AuthorizationPolicies)
+	require.True(t, tenantSettings.StatefulFlowIsolation)
+
+	tenantSettings, err = ParseTenantSettings([]byte(`{"flowTLS": {"certManagerIssuer": "letsencrypt"}}`))
+	require.NoError(t, err)
+	require.Equal(t, "letsencrypt", tenantSettings.FlowTLS.CertManagerIssuer)
+	require.Equal(t, ClusterIssuerKind, tenantSettings.FlowTLS.CertManagerIssuerKind)
+
+	_, err = ParseTenantSettings([]byte(`{"flowTLS": {"certManagerIssuerKind": "Vault"}}`))
+	require.Error(t, err)
+
+	_, err = ParseTenantSettings([]byte(`{"renderer": "linkerd"}`))
+	require.Error(t, err)
+
+	tenantSettings, err = ParseTenantSettings([]byte(`{"flowEntryStrategy": "path-prefix"}`))
+	require.NoError(t, err)
+	require.Equal(t, resolved.PathPrefixEntryStrategy, tenantSettings.FlowEntryStrategy)
+
+	_, err = ParseTenantSettings([]byte(`{"flowEntryStrategy": "query"}`))
+	require.Error(t, err)
+
+	tenantSettings, err = ParseTenantSettings([]byte(`{"flowRoutingMode": "baggage"}`))
+	require.NoError(t, err)
+	require.Equal(t, BaggageRoutingMode, tenantSettings.FlowRoutingMode)
+
+	_, err = ParseTenantSettings([]byte(`{"flowRoutingMode": "cookie"}`))
+	require.Error(t, err)
+
+	tenantSettings, err = ParseTenantSettings([]byte(`{"stickyFlowCookie": {"enabled": true, "domain": "kardinal.dev"}}`))
+	require.NoError(t, err)
+	require.True(t, tenantSettings.StickyFlowCookie.Enabled)
+	require.Equal(t, "kardinal.dev", tenantSettings.StickyFlowCookie.Domain)
+
+	tenantSettings, err = ParseTenantSettings([]byte(`{"traceID": {"traceparent": true}}`))
+	require.NoError(t, err)
+	require.Equal(t, EntryTraceIDMode, tenantSettings.TraceID.Mode)
+	require.True(t, tenantSettings.TraceID.Traceparent)
+
+	tenantSettings, err = ParseTenantSettings([]byte(`{"traceID": {"mode": "edge"}}`))
+	require.NoError(t, err)
+	require.Equal(t, EdgeTraceIDMode, tenantSettings.TraceID.Mode)
+
+	_, err = ParseTenantSettings([]byte(`{"traceID": {"mode": "everywhere"}}`))
+	require.Error(t, err)
+}
+
+func TestParseTenantSettingsTraceHeaders(t *testing.T) {
+	tenantSettings, err := ParseTenantSettings(nil)
+	require.NoError(t, err)
+	require.Equal(t, append([]string{DefaultTraceIDHeader}, DefaultTraceHeaderPriorities...), tenantSettings.TraceID.TraceHeaders())
+
+	tenantSettings, err = ParseTenantSettings([]byte(`{"traceID": {"header": "X-Trace-Id", "headerPriorities": ["x-correlation-id", "x-trace-id", "traceparent"]}}`))
+	require.NoError(t, err)
+	require.Equal(t, "x-trace-id", tenantSettings.TraceID.Header)
+	require.Equal(t, []string{"x-trace-id", "x-correlation-id", "traceparent"}, tenantSettings.TraceID.TraceHeaders())
+
+	tenantSettings, err = ParseTenantSettings([]byte(`{"traceID": {"headerPriorities": []}}`))
+	require.NoError(t, err)
+	require.Equal(t, []string{DefaultTraceIDHeader}, tenantSettings.TraceID.TraceHeaders())
+
+	_, err = ParseTenantSettings([]byte(`{"traceID": {"header": "trace id"}}`))
+	require.Error(t, err)
+
+	_, err = ParseTenantSettings([]byte(`{"traceID": {"headerPriorities": [":authority"]}}`))
+	require.Error(t, err)
+}
+
+func TestParseTenantSettingsAmbient(t *testing.T) {
+	tenantSettings, err := ParseTenantSettings([]byte(`{"istioDataplaneMode": "ambient"}`))
+	require.NoError(t, err)
+	require.Equal(t, AmbientDataplaneMode, tenantSettings.IstioDataplaneMode)
+	require.Equal(t, defaultWaypointName, tenantSettings.WaypointName)
+
+	_, err = ParseTenantSettings([]byte(`{"istioDataplaneMode": "proxyless"}`))
+	require.Error(t, err)
+
+	_, err = ParseTenantSettings([]byte(`{"waypointName": "Not_A_Label"}`))
+	require.Error(t, err)
+}
+
+func TestParseTenantSettingsTraceRouter(t *testing.T) {
+	tenantSettings, err := ParseTenantSettings(nil)
+	require.NoError(t, err)
+	require.Equal(t, defaultTraceRouter, tenantSettings.GetTraceRouter())
+	require.Equal(t, "trace-router.default.svc.cluster.local", tenantSettings.GetTraceRouter().Host())
+
+	tenantSettings, err = ParseTenantSettings([]byte(`{"traceRouter": {"namespace": "kardinal", "fallback": "reject"}}`))
+	require.NoError(t, err)
+	traceRouter := tenantSettings.GetTraceRouter()
+	require.Equal(t, "trace-router.kardinal.svc.cluster.local", traceRouter.Host())
+	require.Equal(t, uint16(8080), traceRouter.Port)
+	require.Equal(t, RejectTraceRouterFallback, traceRouter.Fallback)
+
+	_, err = ParseTenantSettings([]byte(`{"traceRouter": {"namespace": "Kardinal"}}`))
+	require.Error(t, err)
+
+	_, err = ParseTenantSettings([]byte(`{"traceRouter": {"fallback": "retry"}}`))
+	require.Error(t, err)
+}
+
+func TestServerTraceRouter(t *testing.T) {
+	serverTraceRouter, err := NewServerTraceRouter(TraceRouterSettings{Namespace: "kardinal-system", TimeoutMs: 1000})
+	require.NoError(t, err)
+	require.Equal(t, uint16(8080), serverTraceRouter.Port)
+
+	tenantSettings, err := ParseTenantSettings([]byte(`{"traceRouter": {"timeoutMs": 2000}}`))
+	require.NoError(t, err)
+	traceRouter := tenantSettings.WithServerTraceRouter(serverTraceRouter).GetTraceRouter()
+	require.Equal(t, "trace-router.kardinal-system.svc.cluster.local", traceRouter.Host())
+	require.Equal(t, uint32(2000), traceRouter.TimeoutMs)
+
+	// the other tenant settings keep the defaults
+	require.Equal(t, "trace-router.default.svc.cluster.local", tenantSettings.GetTraceRouter().Host())
+
+	// the server trace router is not stored with the tenant settings
+	settingsJson, err := json.Marshal(tenantSettings.WithServerTraceRouter(serverTraceRouter))
+	require.NoError(t, err)
+	require.NotContains(t, string(settingsJson), "kardinal-system")
+
+	_, err = NewServerTraceRouter(TraceRouterSettings{Fallback: "retry"})
+	require.Error(t, err)
+}